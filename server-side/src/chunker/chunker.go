@@ -0,0 +1,309 @@
+/*
+Content-defined chunking.  A stream is split into chunks at positions chosen
+by the content itself (FastCDC: a gear rolling hash, with normalized chunking)
+so inserting or deleting bytes only changes the chunks near the edit.  The
+chunks after it realign with the original boundaries and dedup as before.
+
+Block devices and VM images dedup better, and far more cheaply, in fixed-size
+blocks aligned with the filesystem inside them.  Mode selects between the two;
+both produce the same Chunks so the rest of the pipeline does not care.
+
+Each chunk carries its SHA256 digest, which is the key for the digest indexes
+(see digestmap, map326 and robin32).
+
+	ch, err := chunker.New(file, chunker.DefaultOptions)
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		...
+		idx.Put(chunk.Digest[:], location)
+	}
+*/
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/bits"
+	"util"
+)
+
+type Digest [sha256.Size]byte
+
+type Chunk struct {
+	//position of the first byte in the stream
+	Offset uint64
+	//the chunk's bytes.  Only valid until the next call to Next.
+	Data []byte
+	Digest Digest
+	/*
+	All bytes are 0 (Fixed mode only).  Zero blocks are common in disk images;
+	their digest comes from a table instead of hashing and callers may skip
+	storing them entirely.
+	*/
+	Zero bool
+}
+
+type Mode int
+
+const (
+	//content-defined chunking (FastCDC)
+	CDC Mode = iota
+	//fixed-size blocks
+	Fixed
+)
+
+var modeNames = []string{"cdc", "fixed"}
+
+func (m Mode) String() string {
+	if m >= 0 && int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+//Parse a mode name ("cdc" or "fixed") from configuration, eg per backup source
+func ParseMode(name string) (Mode, error) {
+	for i, n := range modeNames {
+		if n == name {
+			return Mode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("chunker: unknown mode %q", name)
+}
+
+/*
+Chunking parameters.  In CDC mode chunks are never smaller than MinSize (except
+the last) or larger than MaxSize and average roughly AvgSize.
+
+In Fixed mode every chunk is BlockSize bytes except possibly the last and, if
+AlignOffset is set, the first.  AlignOffset is the stream offset of a block
+boundary, eg the byte offset of a partition within a disk image, so that blocks
+line up with the filesystem's blocks.  The first chunk is then the
+AlignOffset % BlockSize bytes before the first boundary.
+*/
+type Options struct {
+	Mode Mode
+
+	MinSize int
+	//must be a power of 2
+	AvgSize int
+	MaxSize int
+
+	BlockSize int
+	AlignOffset uint64
+}
+
+var DefaultOptions = Options{
+	Mode: CDC,
+	MinSize: 2 * 1024,
+	AvgSize: 8 * 1024,
+	MaxSize: 64 * 1024,
+}
+
+var DefaultFixedOptions = Options{
+	Mode: Fixed,
+	BlockSize: 4 * 1024,
+}
+
+const minAvgBits = 8
+const maxMaxSize = 64 * 1024 * 1024
+
+func (o Options) validate() error {
+	switch o.Mode {
+	case CDC:
+	case Fixed:
+		if o.BlockSize <= 0 || o.BlockSize > maxMaxSize {
+			return fmt.Errorf("chunker: BlockSize %d must be between 1 and %d", o.BlockSize, maxMaxSize)
+		}
+		return nil
+	default:
+		return fmt.Errorf("chunker: unknown mode %d", int(o.Mode))
+	}
+
+	if o.AvgSize < 1 << minAvgBits || o.AvgSize & (o.AvgSize - 1) != 0 {
+		return fmt.Errorf("chunker: AvgSize %d must be a power of 2 and at least %d", o.AvgSize, 1 << minAvgBits)
+	}
+	if o.MinSize <= 0 || o.MinSize >= o.AvgSize || o.AvgSize >= o.MaxSize || o.MaxSize > maxMaxSize {
+		return fmt.Errorf("chunker: need 0 < MinSize < AvgSize < MaxSize <= %d, got %d, %d, %d",
+			maxMaxSize, o.MinSize, o.AvgSize, o.MaxSize)
+	}
+	return nil
+}
+
+/*
+Gear table: one random 64bit value per byte value.  It is generated from a
+fixed seed and is effectively part of the on-disk format: changing it moves
+every chunk boundary, so nothing already stored would dedup.
+*/
+var gear [256]uint64
+
+func init() {
+	rs := util.NewRandStreamBytes([]byte("chunker gear table"))
+	for i := range gear {
+		gear[i] = rs.Rand64bit()
+	}
+}
+
+/*
+A mask of n one bits at the top of the word.  The gear hash shifts left, so
+the high bits depend on the most recent 64 bytes.
+*/
+func topMask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+//Finds chunk boundaries
+type cutter struct {
+	Options
+	//stricter mask used before AvgSize, looser after.  Narrows the size distribution.
+	maskS, maskL uint64
+}
+
+func newCutter(opts Options) cutter {
+	if opts.Mode == Fixed {
+		return cutter{Options: opts}
+	}
+	avgBits := bits.TrailingZeros(uint(opts.AvgSize))
+	return cutter{
+		Options: opts,
+		maskS: topMask(avgBits + 2),
+		maskL: topMask(avgBits - 2),
+	}
+}
+
+//Largest chunk cut can return
+func (c *cutter) maxChunk() int {
+	if c.Mode == Fixed {
+		return c.BlockSize
+	}
+	return c.MaxSize
+}
+
+/*
+Length of the chunk at stream offset off, which starts data.  data must hold
+at least maxChunk bytes unless it is the end of the stream.
+*/
+func (c *cutter) cut(off uint64, data []byte) int {
+	if c.Mode == Fixed {
+		//distance to the next block boundary
+		bs := uint64(c.BlockSize)
+		n := bs - (off + bs - c.AlignOffset % bs) % bs
+		return int(min(n, uint64(len(data))))
+	}
+
+	n := len(data)
+	if n <= c.MinSize {
+		return n
+	}
+	if n > c.MaxSize {
+		n = c.MaxSize
+	}
+	normal := min(c.AvgSize, n)
+
+	var fp uint64
+	i := c.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp & c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp & c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+/*
+Splits an io.Reader into chunks.  Not safe for concurrent use.
+*/
+type Chunker struct {
+	r io.Reader
+	cutter cutter
+	buf []byte
+	//unconsumed data is buf[start:end]
+	start, end int
+	//stream offset of buf[start]
+	offset uint64
+	//sticky read error; io.EOF once the reader is exhausted
+	err error
+	//Fixed mode: a zero block and its digest
+	zeroBlock []byte
+	zeroDigest Digest
+}
+
+func New(r io.Reader, opts Options) (*Chunker, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	ch := &Chunker{
+		r: r,
+		cutter: newCutter(opts),
+	}
+	//room for two chunks, and read at least 1MB at a time in Fixed mode
+	bufSize := 2 * ch.cutter.maxChunk()
+	if opts.Mode == Fixed {
+		ch.zeroBlock = make([]byte, opts.BlockSize)
+		ch.zeroDigest = sha256.Sum256(ch.zeroBlock)
+		bufSize = max(bufSize, 1024 * 1024)
+	}
+	ch.buf = make([]byte, bufSize)
+	return ch, nil
+}
+
+//Move the unconsumed data to the front of buf and read until buf is full or the reader fails
+func (ch *Chunker) fill() {
+	ch.end = copy(ch.buf, ch.buf[ch.start:ch.end])
+	ch.start = 0
+	for ch.end < len(ch.buf) && ch.err == nil {
+		var n int
+		n, ch.err = ch.r.Read(ch.buf[ch.end:])
+		ch.end += n
+	}
+}
+
+/*
+Return the next chunk.  Returns io.EOF after the last chunk.  Any other read
+error is returned as soon as it happens (without the buffered data, whose last
+boundary could not be trusted) and again on every later call.
+*/
+func (ch *Chunker) Next() (Chunk, error) {
+	if ch.end - ch.start < ch.cutter.maxChunk() && ch.err == nil {
+		ch.fill()
+	}
+	if ch.err != nil && ch.err != io.EOF {
+		return Chunk{}, ch.err
+	}
+	if ch.start == ch.end {
+		return Chunk{}, io.EOF
+	}
+
+	n := ch.cutter.cut(ch.offset, ch.buf[ch.start:ch.end])
+	data := ch.buf[ch.start:ch.start+n]
+	chunk := Chunk{
+		Offset: ch.offset,
+		Data: data,
+	}
+	if ch.zeroBlock != nil && bytes.Equal(data, ch.zeroBlock[:n]) {
+		chunk.Zero = true
+		if n == len(ch.zeroBlock) {
+			chunk.Digest = ch.zeroDigest
+		} else {
+			//a short first or last block
+			chunk.Digest = sha256.Sum256(data)
+		}
+	} else {
+		chunk.Digest = sha256.Sum256(data)
+	}
+	ch.start += n
+	ch.offset += uint64(n)
+	return chunk, nil
+}
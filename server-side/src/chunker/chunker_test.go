@@ -0,0 +1,289 @@
+package chunker
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing/iotest"
+	"util"
+)
+
+func randData(seed uint64, size int) []byte {
+	dat := make([]byte, size)
+	util.NewRandStream64(seed).Read(dat)
+	return dat
+}
+
+func chunkAll(t *testing.T, r io.Reader, opts Options) []Chunk {
+	ch, err := New(r, opts)
+	require.NoError(t, err)
+	var chunks []Chunk
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunk.Data = append([]byte(nil), chunk.Data...)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	req := require.New(t)
+
+	dat := randData(1, 4 << 20)
+	chunks := chunkAll(t, bytes.NewReader(dat), DefaultOptions)
+
+	var joined []byte
+	for i, c := range chunks {
+		req.Equal(uint64(len(joined)), c.Offset)
+		req.Equal(Digest(sha256.Sum256(c.Data)), c.Digest)
+		req.LessOrEqual(len(c.Data), DefaultOptions.MaxSize)
+		if i < len(chunks) - 1 {
+			req.GreaterOrEqual(len(c.Data), DefaultOptions.MinSize)
+		}
+		joined = append(joined, c.Data...)
+	}
+	req.Equal(dat, joined)
+
+	//the average is near AvgSize (normalized chunking adds about MinSize)
+	avg := len(dat) / len(chunks)
+	req.InDelta(DefaultOptions.AvgSize + DefaultOptions.MinSize, avg, 2500)
+
+	//same boundaries no matter how the reader delivers the data
+	req.Equal(chunks, chunkAll(t, iotest.OneByteReader(bytes.NewReader(dat)), DefaultOptions))
+	req.Equal(chunks, chunkAll(t, iotest.DataErrReader(bytes.NewReader(dat)), DefaultOptions))
+}
+
+func TestSmallInputs(t *testing.T) {
+	req := require.New(t)
+
+	req.Empty(chunkAll(t, bytes.NewReader(nil), DefaultOptions))
+
+	chunks := chunkAll(t, bytes.NewReader([]byte("hello")), DefaultOptions)
+	req.Len(chunks, 1)
+	req.Equal([]byte("hello"), chunks[0].Data)
+
+	//constant data has no boundaries so every chunk is MaxSize
+	zeros := make([]byte, 3 * DefaultOptions.MaxSize + 10)
+	chunks = chunkAll(t, bytes.NewReader(zeros), DefaultOptions)
+	req.Len(chunks, 4)
+	req.Equal(chunks[0].Digest, chunks[2].Digest)
+	req.Len(chunks[3].Data, 10)
+}
+
+func digestSet(chunks []Chunk) map[Digest]bool {
+	set := make(map[Digest]bool)
+	for _, c := range chunks {
+		set[c.Digest] = true
+	}
+	return set
+}
+
+//Chunks of edited not found among the original chunks
+func countNew(orig, edited []Chunk) int {
+	set := digestSet(orig)
+	n := 0
+	for _, c := range edited {
+		if !set[c.Digest] {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+An insertion or deletion only disturbs the chunks around it; boundaries after
+it realign.  With fixed-size blocks every later block would change.
+*/
+func TestBoundaryStability(t *testing.T) {
+	req := require.New(t)
+
+	dat := randData(2, 2 << 20)
+	orig := chunkAll(t, bytes.NewReader(dat), DefaultOptions)
+
+	//usually just the chunk holding the edit changes; occasionally a cut
+	//point falls within MinSize of the edit and a few more follow
+	total := 0
+	for seed := uint64(0); seed < 10; seed++ {
+		for _, kind := range []util.EditKind{util.EditInsert, util.EditDelete, util.EditOverwrite} {
+			edited := util.Edit(dat, util.EditOptions{Seed: seed, Kind: kind, Count: 1, MaxLen: 100})
+			chunks := chunkAll(t, bytes.NewReader(edited), DefaultOptions)
+			n := countNew(orig, chunks)
+			req.LessOrEqual(n, 8, "seed %d kind %d", seed, kind)
+			total += n
+		}
+	}
+	req.LessOrEqual(total, 2 * 30)
+
+	//prepending shifts everything
+	shifted := append(randData(3, 777), dat...)
+	chunks := chunkAll(t, bytes.NewReader(shifted), DefaultOptions)
+	req.LessOrEqual(countNew(orig, chunks), 2)
+}
+
+//Repeated content in a generated corpus is found as duplicate chunks
+func TestCorpusDedup(t *testing.T) {
+	req := require.New(t)
+
+	dat, _ := util.GenStream(util.StreamOptions{Seed: 4, Size: 8 << 20, DupRatio: 0.5, PieceSize: 64 * 1024})
+	chunks := chunkAll(t, bytes.NewReader(dat), DefaultOptions)
+	dupBytes := 0
+	seen := make(map[Digest]bool)
+	for _, c := range chunks {
+		if seen[c.Digest] {
+			dupBytes += len(c.Data)
+		}
+		seen[c.Digest] = true
+	}
+	//pieces are copied from unaligned offsets; most of each copy still dedups
+	//(but not the chunks straddling either end of it)
+	req.Greater(float64(dupBytes) / float64(len(dat)), 0.3)
+}
+
+func TestOptions(t *testing.T) {
+	req := require.New(t)
+
+	bad := []Options{
+		{MinSize: 1024, AvgSize: 3000, MaxSize: 8192},
+		{MinSize: 1024, AvgSize: 128, MaxSize: 8192},
+		{MinSize: 0, AvgSize: 4096, MaxSize: 8192},
+		{MinSize: 4096, AvgSize: 4096, MaxSize: 8192},
+		{MinSize: 1024, AvgSize: 4096, MaxSize: 4096},
+		{MinSize: 1024, AvgSize: 4096, MaxSize: 1 << 30},
+	}
+	for _, opts := range bad {
+		_, err := New(bytes.NewReader(nil), opts)
+		req.Error(err, "%+v", opts)
+	}
+
+	small := Options{MinSize: 256, AvgSize: 1024, MaxSize: 4096}
+	dat := randData(5, 1 << 20)
+	chunks := chunkAll(t, bytes.NewReader(dat), small)
+	avg := len(dat) / len(chunks)
+	req.InDelta(small.AvgSize + small.MinSize, avg, 400)
+}
+
+func TestReadError(t *testing.T) {
+	req := require.New(t)
+
+	boom := errors.New("boom")
+	r := io.MultiReader(bytes.NewReader(randData(6, 100000)), iotest.ErrReader(boom))
+	ch, err := New(r, DefaultOptions)
+	req.NoError(err)
+	_, err = ch.Next()
+	req.Equal(boom, err)
+	_, err = ch.Next()
+	req.Equal(boom, err)
+}
+
+func BenchmarkChunker(b *testing.B) {
+	dat := randData(7, 16 << 20)
+	b.SetBytes(int64(len(dat)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch, _ := New(bytes.NewReader(dat), DefaultOptions)
+		for {
+			if _, err := ch.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func TestFixed(t *testing.T) {
+	req := require.New(t)
+
+	const bs = 4096
+	//random blocks with some zero blocks and a zero tail
+	dat := randData(8, 100 * bs + 100)
+	for _, i := range []int{3, 4, 50} {
+		clear(dat[i*bs:(i+1)*bs])
+	}
+	clear(dat[100*bs:])
+
+	chunks := chunkAll(t, bytes.NewReader(dat), DefaultFixedOptions)
+	req.Len(chunks, 101)
+	zeroDigest := Digest(sha256.Sum256(make([]byte, bs)))
+	var joined []byte
+	for i, c := range chunks {
+		req.Equal(uint64(i * bs), c.Offset)
+		req.Equal(Digest(sha256.Sum256(c.Data)), c.Digest)
+		zero := i == 3 || i == 4 || i == 50 || i == 100
+		req.Equal(zero, c.Zero, "block %d", i)
+		if zero && i < 100 {
+			req.Equal(zeroDigest, c.Digest)
+		}
+		joined = append(joined, c.Data...)
+	}
+	req.Len(chunks[100].Data, 100)
+	req.Equal(dat, joined)
+
+	req.Equal(chunks, chunkAll(t, iotest.HalfReader(bytes.NewReader(dat)), DefaultFixedOptions))
+}
+
+/*
+A partition which starts 63 sectors into the image: with AlignOffset its
+blocks are the same chunks as when the partition is read on its own.
+*/
+func TestFixedAlignment(t *testing.T) {
+	req := require.New(t)
+
+	const partOffset = 63 * 512
+	partition := randData(9, 50 * 4096)
+	image := append(randData(10, partOffset), partition...)
+
+	alone := chunkAll(t, bytes.NewReader(partition), DefaultFixedOptions)
+
+	misaligned := chunkAll(t, bytes.NewReader(image), DefaultFixedOptions)
+	//nothing dedups
+	req.Equal(len(misaligned), countNew(alone, misaligned))
+
+	opts := DefaultFixedOptions
+	opts.AlignOffset = partOffset
+	aligned := chunkAll(t, bytes.NewReader(image), opts)
+	req.Len(aligned[0].Data, partOffset % 4096)
+	req.Equal(uint64(partOffset), aligned[8].Offset)
+	//only the chunks before the partition are new
+	req.Equal(8, countNew(alone, aligned))
+}
+
+func TestModes(t *testing.T) {
+	req := require.New(t)
+
+	for _, m := range []Mode{CDC, Fixed} {
+		parsed, err := ParseMode(m.String())
+		req.NoError(err)
+		req.Equal(m, parsed)
+	}
+	_, err := ParseMode("rabin")
+	req.Error(err)
+	req.Equal("Mode(7)", Mode(7).String())
+
+	_, err = New(bytes.NewReader(nil), Options{Mode: Fixed})
+	req.Error(err)
+	_, err = New(bytes.NewReader(nil), Options{Mode: 7, BlockSize: 4096})
+	req.Error(err)
+}
+
+func BenchmarkFixed(b *testing.B) {
+	dat := randData(7, 16 << 20)
+	//a quarter of the blocks are zero, as in a sparse image
+	for i := 0; i < len(dat); i += 4 * 4096 {
+		clear(dat[i:i+4096])
+	}
+	b.SetBytes(int64(len(dat)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch, _ := New(bytes.NewReader(dat), DefaultFixedOptions)
+		for {
+			if _, err := ch.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,314 @@
+/*
+dedupbench compares the digest index implementations.
+
+For every combination of implementation, key count and load factor it fills a
+fresh index, then measures random lookups of present keys (hits) and absent
+keys (misses).  Results are written as CSV and/or JSON so that runs can be
+compared across commits and hardware.
+
+Example:
+
+	dedupbench -impls map326,robin32,gomap -keys 1000000,16000000 \
+		-loads 0.5,0.85,0.95 -csv results.csv -json results.json
+
+Load factor is keys / capacity, ie each index is created with room for
+keys/load entries.  map326 is statistical and may report Full before all keys
+are added; the number actually added is reported as "added".
+*/
+package main
+
+import (
+	"digestmap"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+One benchmark run.  Latencies are in nanoseconds per lookup.
+*/
+type Result struct {
+	Impl string `json:"impl"`
+	Keys int `json:"keys"`
+	Load float64 `json:"load"`
+	Capacity int `json:"capacity"`
+	//number of keys added before the index reported Full
+	Added int `json:"added"`
+	FillNs int64 `json:"fill_ns"`
+	FillNsPerKey float64 `json:"fill_ns_per_key"`
+	HitP50Ns float64 `json:"hit_p50_ns"`
+	HitP99Ns float64 `json:"hit_p99_ns"`
+	MissP50Ns float64 `json:"miss_p50_ns"`
+	MissP99Ns float64 `json:"miss_p99_ns"`
+	//growth of the process resident set while creating and filling the index
+	RSSBytes int64 `json:"rss_bytes"`
+	RSSBytesPerEntry float64 `json:"rss_bytes_per_entry"`
+	//as reported by the implementation (DigestIndex.Stats)
+	MemBytes int64 `json:"mem_bytes"`
+	//garbage collection during fill and lookups
+	NumGC uint32 `json:"num_gc"`
+	GCPauseTotalNs uint64 `json:"gc_pause_total_ns"`
+}
+
+//Describes the machine and build so results from different runs can be told apart
+type Environment struct {
+	Label string `json:"label"`
+	Time string `json:"time"`
+	GoVersion string `json:"go_version"`
+	GOOS string `json:"goos"`
+	GOARCH string `json:"goarch"`
+	NumCPU int `json:"num_cpu"`
+	Seed int64 `json:"seed"`
+	Lookups int `json:"lookups"`
+}
+
+type KV struct {
+	K [digestmap.KeySize]byte
+	V digestmap.Value
+}
+
+func main() {
+	implsFlag := flag.String("impls", strings.Join(digestmap.Impls(), ","), "comma separated implementations")
+	keysFlag := flag.String("keys", "1000000", "comma separated key counts")
+	loadsFlag := flag.String("loads", "0.5,0.85,0.95", "comma separated load factors (keys/capacity)")
+	lookups := flag.Int("lookups", 1000000, "number of hit and of miss lookups per run")
+	seed := flag.Int64("seed", 1234, "random seed for keys")
+	csvPath := flag.String("csv", "", "write CSV results to this file (- for stdout)")
+	jsonPath := flag.String("json", "", "write JSON results to this file (- for stdout)")
+	label := flag.String("label", "", "free form label stored with the results (eg a commit hash)")
+	flag.Parse()
+
+	impls := strings.Split(*implsFlag, ",")
+	keyCounts, err := parseInts(*keysFlag)
+	if err != nil {
+		log.Fatal("-keys: ", err)
+	}
+	loads, err := parseLoads(*loadsFlag)
+	if err != nil {
+		log.Fatal("-loads: ", err)
+	}
+	if *lookups <= 0 {
+		log.Fatal("-lookups must be positive")
+	}
+
+	//default to CSV on stdout
+	if *csvPath == "" && *jsonPath == "" {
+		*csvPath = "-"
+	}
+
+	env := Environment{
+		Label: *label,
+		Time: time.Now().UTC().Format(time.RFC3339),
+		GoVersion: runtime.Version(),
+		GOOS: runtime.GOOS,
+		GOARCH: runtime.GOARCH,
+		NumCPU: runtime.NumCPU(),
+		Seed: *seed,
+		Lookups: *lookups,
+	}
+
+	var results []Result
+	for _, nKeys := range keyCounts {
+		//The same keys are used for every implementation and load
+		hits, misses := makeKeys(nKeys, *lookups, *seed)
+
+		for _, load := range loads {
+			for _, impl := range impls {
+				res, err := run(impl, hits, misses, load)
+				if err != nil {
+					log.Fatal(err)
+				}
+				fmt.Fprintf(os.Stderr, "%s keys=%d load=%g added=%d fill=%s hit p50/p99=%.0f/%.0fns miss p50/p99=%.0f/%.0fns %.1f bytes/entry\n",
+					res.Impl, res.Keys, res.Load, res.Added, time.Duration(res.FillNs),
+					res.HitP50Ns, res.HitP99Ns, res.MissP50Ns, res.MissP99Ns, res.RSSBytesPerEntry)
+				results = append(results, res)
+			}
+		}
+	}
+
+	if *csvPath != "" {
+		if err := writeFile(*csvPath, func(f *os.File) error { return writeCSV(f, env, results) }); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *jsonPath != "" {
+		if err := writeFile(*jsonPath, func(f *os.File) error { return writeJSON(f, env, results) }); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func parseInts(s string) ([]int, error) {
+	var ints []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("%d is not positive", n)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+func parseLoads(s string) ([]float64, error) {
+	var loads []float64
+	for _, field := range strings.Split(s, ",") {
+		load, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		if load <= 0 || load > 1 {
+			return nil, fmt.Errorf("load %g must be in (0, 1]", load)
+		}
+		loads = append(loads, load)
+	}
+	return loads, nil
+}
+
+/*
+Generate nKeys random key/values to insert plus nMisses keys which are
+(almost certainly) never inserted.
+*/
+func makeKeys(nKeys, nMisses int, seed int64) (hits []KV, misses []KV) {
+	rng := rand.New(rand.NewSource(seed))
+
+	hits = make([]KV, nKeys)
+	for i := range hits {
+		rng.Read(hits[i].K[:])
+		rng.Read(hits[i].V[:])
+	}
+
+	misses = make([]KV, nMisses)
+	for i := range misses {
+		rng.Read(misses[i].K[:])
+	}
+	return
+}
+
+//Run the GC and return memory to the OS so that RSS measurements start clean
+func settle() {
+	runtime.GC()
+	debug.FreeOSMemory()
+}
+
+func run(impl string, hits, misses []KV, load float64) (res Result, err error) {
+	res.Impl = impl
+	res.Keys = len(hits)
+	res.Load = load
+	res.Capacity = int(float64(len(hits)) / load)
+
+	settle()
+	rssBefore := readRSS()
+	var msBefore runtime.MemStats
+	runtime.ReadMemStats(&msBefore)
+
+	idx, err := digestmap.New(impl, res.Capacity)
+	if err != nil {
+		return
+	}
+
+	//
+	// Fill
+
+	t := time.Now()
+	for _, kv := range hits {
+		if idx.Put(kv.K[:], kv.V) == digestmap.Full {
+			break
+		}
+		res.Added++
+	}
+	res.FillNs = int64(time.Since(t))
+	if res.Added > 0 {
+		res.FillNsPerKey = float64(res.FillNs) / float64(res.Added)
+	}
+
+	res.RSSBytes = readRSS() - rssBefore
+	if res.Added > 0 {
+		res.RSSBytesPerEntry = float64(res.RSSBytes) / float64(res.Added)
+	}
+	res.MemBytes = idx.Stats().MemBytes
+
+	if res.Added == 0 {
+		err = fmt.Errorf("%s: no keys could be added", impl)
+		return
+	}
+
+	//
+	// Lookups.  Only keys which were actually added can be hits.
+
+	lookups := len(misses)
+	rng := rand.New(rand.NewSource(int64(len(hits))))
+	order := make([]int, lookups)
+	for i := range order {
+		order[i] = rng.Intn(res.Added)
+	}
+
+	var found bool
+	res.HitP50Ns, res.HitP99Ns = measureLookups(lookups, func(i int) {
+		kv := &hits[order[i]]
+		var v digestmap.Value
+		v, found = idx.Get(kv.K[:])
+		if !found || v != kv.V {
+			log.Fatalf("%s: key %d not found or has the wrong value", impl, order[i])
+		}
+	})
+
+	res.MissP50Ns, res.MissP99Ns = measureLookups(lookups, func(i int) {
+		_, found = idx.Get(misses[i].K[:])
+		if found {
+			log.Fatalf("%s: missing key %d was found", impl, i)
+		}
+	})
+
+	var msAfter runtime.MemStats
+	runtime.ReadMemStats(&msAfter)
+	res.NumGC = msAfter.NumGC - msBefore.NumGC
+	res.GCPauseTotalNs = msAfter.PauseTotalNs - msBefore.PauseTotalNs
+
+	//keep idx alive until the measurements are done
+	runtime.KeepAlive(idx)
+	return
+}
+
+/*
+Call lookup(i) for i in [0, n) and return the 50th and 99th percentile of
+the latency of a single lookup in nanoseconds.  Each lookup is timed on its
+own so that slow ones (cache and TLB misses, long probe sequences) show in the
+tail; every sample includes the cost of reading the clock, a few tens of ns.
+*/
+func measureLookups(n int, lookup func(i int)) (p50, p99 float64) {
+	samples := make([]float64, n)
+	for i := range samples {
+		t := time.Now()
+		lookup(i)
+		samples[i] = float64(time.Since(t))
+	}
+
+	sort.Float64s(samples)
+	return percentile(samples, 50), percentile(samples, 99)
+}
+
+//p-th percentile (nearest rank) of sorted samples
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p / 100 * float64(len(sorted)) + 0.5)
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank - 1]
+}
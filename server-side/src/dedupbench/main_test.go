@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentile(t *testing.T) {
+	req := require.New(t)
+
+	req.Equal(0.0, percentile(nil, 50))
+
+	var samples []float64
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, float64(i))
+	}
+	req.Equal(50.0, percentile(samples, 50))
+	req.Equal(99.0, percentile(samples, 99))
+	req.Equal(100.0, percentile(samples, 100))
+	req.Equal(1.0, percentile(samples, 0))
+	req.Equal(7.0, percentile([]float64{7}, 99))
+}
+
+func TestParse(t *testing.T) {
+	req := require.New(t)
+
+	ints, err := parseInts("10, 20,30")
+	req.Nil(err)
+	req.Equal([]int{10, 20, 30}, ints)
+	_, err = parseInts("10,x")
+	req.NotNil(err)
+	_, err = parseInts("0")
+	req.NotNil(err)
+
+	loads, err := parseLoads("0.5,1")
+	req.Nil(err)
+	req.Equal([]float64{0.5, 1}, loads)
+	_, err = parseLoads("1.5")
+	req.NotNil(err)
+}
+
+func TestRunAndOutput(t *testing.T) {
+	req := require.New(t)
+
+	hits, misses := makeKeys(2000, 500, 1)
+	var results []Result
+	for _, impl := range []string{"gomap", "robin32"} {
+		res, err := run(impl, hits, misses, 0.5)
+		req.Nil(err)
+		req.Equal(2000, res.Added)
+		req.Equal(4000, res.Capacity)
+		req.True(res.HitP50Ns > 0 && res.HitP50Ns <= res.HitP99Ns)
+		req.True(res.MissP50Ns > 0 && res.MissP50Ns <= res.MissP99Ns)
+		req.True(res.MemBytes > 0)
+		results = append(results, res)
+	}
+
+	_, err := run("nope", hits, misses, 0.5)
+	req.NotNil(err)
+
+	env := Environment{Label: "abc123", NumCPU: 4}
+
+	var buf bytes.Buffer
+	req.Nil(writeCSV(&buf, env, results))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	req.Nil(err)
+	req.Equal(3, len(rows))
+	req.Equal(csvHeader, rows[0])
+	for _, row := range rows {
+		req.Equal(len(csvHeader), len(row))
+	}
+	req.Equal("abc123", rows[1][0])
+	req.Equal("robin32", rows[2][4])
+
+	buf.Reset()
+	req.Nil(writeJSON(&buf, env, results))
+	var report jsonReport
+	req.Nil(json.Unmarshal(buf.Bytes(), &report))
+	req.Equal(env, report.Environment)
+	req.Equal(results, report.Results)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+/*
+Open path for writing ("-" is stdout) and call write.
+*/
+func writeFile(path string, write func(f *os.File) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var csvHeader = []string{
+	"label", "goos", "goarch", "num_cpu",
+	"impl", "keys", "load", "capacity", "added",
+	"fill_ns", "fill_ns_per_key",
+	"hit_p50_ns", "hit_p99_ns", "miss_p50_ns", "miss_p99_ns",
+	"rss_bytes", "rss_bytes_per_entry", "mem_bytes",
+	"num_gc", "gc_pause_total_ns",
+}
+
+/*
+One row per result.  The environment is repeated on each row so that CSV
+files from several machines can simply be concatenated (minus headers).
+*/
+func writeCSV(w io.Writer, env Environment, results []Result) error {
+	bw := bufio.NewWriter(w)
+	cw := csv.NewWriter(bw)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	i := func(v int64) string {
+		return strconv.FormatInt(v, 10)
+	}
+
+	for _, r := range results {
+		row := []string{
+			env.Label, env.GOOS, env.GOARCH, strconv.Itoa(env.NumCPU),
+			r.Impl, strconv.Itoa(r.Keys), f(r.Load), strconv.Itoa(r.Capacity), strconv.Itoa(r.Added),
+			i(r.FillNs), f(r.FillNsPerKey),
+			f(r.HitP50Ns), f(r.HitP99Ns), f(r.MissP50Ns), f(r.MissP99Ns),
+			i(r.RSSBytes), f(r.RSSBytesPerEntry), i(r.MemBytes),
+			strconv.FormatUint(uint64(r.NumGC), 10), strconv.FormatUint(r.GCPauseTotalNs, 10),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type jsonReport struct {
+	Environment Environment `json:"environment"`
+	Results []Result `json:"results"`
+}
+
+func writeJSON(w io.Writer, env Environment, results []Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jsonReport{env, results})
+}
+
+/*
+Resident set size of this process in bytes.  Read from /proc on Linux.
+Elsewhere falls back to the memory the Go runtime has obtained from the OS
+(and not yet released), which includes the large slices used by the indexes.
+*/
+func readRSS() int64 {
+	if statm, err := os.ReadFile("/proc/self/statm"); err == nil {
+		//size resident shared text lib data dt (in pages)
+		fields := strings.Fields(string(statm))
+		if len(fields) >= 2 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.Sys - ms.HeapReleased)
+}
@@ -0,0 +1,154 @@
+package digestmap
+
+import (
+	"map326"
+	"robin32"
+)
+
+//
+// map326
+
+type map326Index struct {
+	m *map326.Map
+}
+
+func newMap326(capacity int) (DigestIndex, error) {
+	m, err := map326.New(capacity)
+	if err != nil {
+		return nil, err
+	}
+	return map326Index{m}, nil
+}
+
+func (idx map326Index) Put(key []byte, value Value) PutResult {
+	checkKey(key)
+	//map326 uses the same numbering as PutResult
+	return PutResult(idx.m.Put(key, value))
+}
+
+func (idx map326Index) Get(key []byte) (Value, bool) {
+	checkKey(key)
+	return idx.m.Get(key)
+}
+
+func (idx map326Index) Len() int {
+	return idx.m.Len()
+}
+
+func (idx map326Index) Cap() int {
+	return idx.m.Capacity()
+}
+
+func (idx map326Index) Stats() Stats {
+	return makeStats("map326", idx, idx.m.MemSize())
+}
+
+//
+// robin32
+
+type robin32Index struct {
+	m *robin32.Map
+}
+
+func newRobin32(capacity int) (DigestIndex, error) {
+	return robin32Index{robin32.NewMap(capacity, ValueSize)}, nil
+}
+
+func (idx robin32Index) Put(key []byte, value Value) PutResult {
+	checkKey(key)
+	switch res := idx.m.Put(key, value[:]); res {
+	case robin32.PRKeyWasNew:
+		return Added
+	case robin32.PRValueUpdated:
+		return Updated
+	case robin32.PRFull:
+		return Full
+	default:
+		//key and value sizes were checked so this is an internal failure
+		panic("digestmap: robin32 Put failed")
+	}
+}
+
+func (idx robin32Index) Get(key []byte) (value Value, found bool) {
+	checkKey(key)
+	found = idx.m.Get(key, value[:])
+	return
+}
+
+func (idx robin32Index) Len() int {
+	return idx.m.Len()
+}
+
+func (idx robin32Index) Cap() int {
+	return idx.m.Capacity()
+}
+
+func (idx robin32Index) Stats() Stats {
+	return makeStats("robin32", idx, idx.m.MemSize())
+}
+
+//
+// Go map.  The baseline which the others are compared against.
+
+type goMapIndex struct {
+	m map[[KeySize]byte]Value
+	capacity int
+}
+
+func newGoMap(capacity int) (DigestIndex, error) {
+	return &goMapIndex{
+		m: make(map[[KeySize]byte]Value, capacity),
+		capacity: capacity,
+	}, nil
+}
+
+func (idx *goMapIndex) Put(key []byte, value Value) PutResult {
+	checkKey(key)
+	k := [KeySize]byte(key)
+	if _, exists := idx.m[k]; exists {
+		idx.m[k] = value
+		return Updated
+	}
+
+	//Enforce the capacity so all implementations behave alike
+	if len(idx.m) >= idx.capacity {
+		return Full
+	}
+	idx.m[k] = value
+	return Added
+}
+
+func (idx *goMapIndex) Get(key []byte) (Value, bool) {
+	checkKey(key)
+	v, found := idx.m[[KeySize]byte(key)]
+	return v, found
+}
+
+func (idx *goMapIndex) Delete(key []byte) bool {
+	checkKey(key)
+	k := [KeySize]byte(key)
+	if _, exists := idx.m[k]; exists {
+		delete(idx.m, k)
+		return true
+	}
+	return false
+}
+
+func (idx *goMapIndex) Len() int {
+	return len(idx.m)
+}
+
+func (idx *goMapIndex) Cap() int {
+	return idx.capacity
+}
+
+/*
+The Go runtime does not report map size so this is an estimate: each slot
+holds the key, the value and a control byte, and tables are kept at most
+7/8 full.
+*/
+func (idx *goMapIndex) Stats() Stats {
+	slotSize := int64(KeySize + ValueSize + 1)
+	mem := int64(idx.capacity) * slotSize * 8 / 7
+	return makeStats("gomap", idx, mem)
+}
@@ -0,0 +1,137 @@
+/*
+A common interface for the in-memory digest indexes.  A digest index maps a
+32 byte key (a SHA256 digest) to a 6 byte value (eg the location of a chunk).
+
+Several implementations exist with different speed and memory trade-offs
+(see map326 and robin32).  They are wrapped here behind DigestIndex so that
+callers, benchmarks and tests do not depend on any one of them and the server
+can select an implementation by name from its configuration.
+*/
+package digestmap
+
+import (
+	"fmt"
+	"map326"
+	"sort"
+)
+
+const KeySize = 32
+
+//A six byte value.  Same as map326.Value.
+type Value = map326.Value
+
+const ValueSize = len(Value{})
+
+type PutResult int
+
+const (
+	//Map has reached maximum capacity.  Nothing was changed.
+	Full PutResult = 0
+	//New entry was added.
+	Added PutResult = 1
+	//Updated the value of an existing entry.
+	Updated PutResult = 2
+)
+
+type Stats struct {
+	//Implementation name (as given to New)
+	Impl string
+	//Number of entries
+	Len int
+	//Maximum number of entries (see DigestIndex.Cap)
+	Cap int
+	//Approximate RAM used, in bytes
+	MemBytes int64
+	//MemBytes / Len
+	BytesPerEntry float64
+	//Len / Cap
+	LoadFactor float64
+}
+
+/*
+An index from 32 byte digest to Value.  Implementations are not safe for
+concurrent use.
+
+Put and Get panic if len(key) != KeySize.
+*/
+type DigestIndex interface {
+	//Add or update an entry.  Existing keys can be updated even when full.
+	Put(key []byte, value Value) PutResult
+	//Lookup a value.  Returns false if not found.
+	Get(key []byte) (Value, bool)
+	//Number of entries
+	Len() int
+	/*
+	Maximum number of entries.  Some implementations are statistical (map326)
+	so Put may return Full somewhat before Len reaches Cap.
+	*/
+	Cap() int
+	Stats() Stats
+}
+
+/*
+Implemented by indexes which support removing entries.  Use a type
+assertion to check:
+
+	if d, ok := idx.(digestmap.Deleter); ok { ... }
+*/
+type Deleter interface {
+	//Remove an entry.  Returns false if the key was not present.
+	Delete(key []byte) bool
+}
+
+//Creates an index with room for about capacity entries
+type factory func(capacity int) (DigestIndex, error)
+
+var factories = map[string]factory{
+	"map326": newMap326,
+	"robin32": newRobin32,
+	"gomap": newGoMap,
+}
+
+/*
+Create an index using the named implementation (see Impls) with room for
+about capacity entries.
+*/
+func New(impl string, capacity int) (DigestIndex, error) {
+	f, ok := factories[impl]
+	if !ok {
+		return nil, fmt.Errorf("digestmap: unknown implementation %q", impl)
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("digestmap: capacity must be positive")
+	}
+	return f(capacity)
+}
+
+//Names of all implementations accepted by New, sorted.
+func Impls() []string {
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkKey(key []byte) {
+	if len(key) != KeySize {
+		panic("digestmap: wrong key size")
+	}
+}
+
+func makeStats(impl string, idx DigestIndex, memBytes int64) Stats {
+	stats := Stats{
+		Impl: impl,
+		Len: idx.Len(),
+		Cap: idx.Cap(),
+		MemBytes: memBytes,
+	}
+	if stats.Len > 0 {
+		stats.BytesPerEntry = float64(memBytes) / float64(stats.Len)
+	}
+	if stats.Cap > 0 {
+		stats.LoadFactor = float64(stats.Len) / float64(stats.Cap)
+	}
+	return stats
+}
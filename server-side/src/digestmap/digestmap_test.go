@@ -0,0 +1,307 @@
+package digestmap
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"map326"
+)
+
+func randKey(rng *rand.Rand) []byte {
+	k := make([]byte, KeySize)
+	rng.Read(k)
+	return k
+}
+
+func randValue(rng *rand.Rand) (v Value) {
+	rng.Read(v[:])
+	return
+}
+
+/*
+Run fn as a subtest against a fresh index of every implementation.
+*/
+func forEachImpl(t *testing.T, capacity int, fn func(t *testing.T, idx DigestIndex)) {
+	for _, impl := range Impls() {
+		t.Run(impl, func(t *testing.T) {
+			idx, err := New(impl, capacity)
+			require.Nil(t, err)
+			require.Equal(t, impl, idx.Stats().Impl)
+			fn(t, idx)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	req := require.New(t)
+
+	req.Equal([]string{"gomap", "map326", "robin32"}, Impls())
+
+	_, err := New("nope", 100)
+	req.NotNil(err)
+	_, err = New("gomap", 0)
+	req.NotNil(err)
+}
+
+//map326 needs a large capacity before its pool has room for collisions
+const testCapacity = 0x10000 * 4
+
+func TestConformanceBasic(t *testing.T) {
+	forEachImpl(t, testCapacity, func(t *testing.T, idx DigestIndex) {
+		req := require.New(t)
+
+		rng := rand.New(rand.NewSource(1))
+		k := randKey(rng)
+
+		//empty
+		req.Equal(0, idx.Len())
+		_, found := idx.Get(k)
+		req.False(found)
+
+		//add
+		v1 := randValue(rng)
+		req.Equal(Added, idx.Put(k, v1))
+		v, found := idx.Get(k)
+		req.True(found)
+		req.Equal(v1, v)
+		req.Equal(1, idx.Len())
+
+		//update
+		v2 := randValue(rng)
+		req.Equal(Updated, idx.Put(k, v2))
+		v, found = idx.Get(k)
+		req.True(found)
+		req.Equal(v2, v)
+		req.Equal(1, idx.Len())
+
+		//Keys which share a long prefix (region, bucket and KeyPrefix) must stay distinct
+		for i := 0; i < KeySize; i++ {
+			k2 := append([]byte{}, k...)
+			k2[i]++
+			_, found = idx.Get(k2)
+			req.False(found, i)
+
+			req.Equal(Added, idx.Put(k2, testValue(i)))
+			v, found = idx.Get(k2)
+			req.True(found)
+			req.Equal(testValue(i), v)
+		}
+		req.Equal(KeySize + 1, idx.Len())
+
+		v, found = idx.Get(k)
+		req.True(found)
+		req.Equal(v2, v)
+
+		//wrong key size
+		req.Panics(func() { idx.Put(k[1:], v1) })
+		req.Panics(func() { idx.Get(k[1:]) })
+
+		stats := idx.Stats()
+		req.Equal(idx.Len(), stats.Len)
+		req.Equal(idx.Cap(), stats.Cap)
+		req.True(stats.Cap >= testCapacity)
+		req.True(stats.MemBytes > 0)
+		req.True(stats.BytesPerEntry > 0)
+		req.True(stats.LoadFactor > 0 && stats.LoadFactor <= 1)
+	})
+}
+
+func testValue(i int) Value {
+	return map326.ValueFromInt(i * 7919)
+}
+
+/*
+Fill with random keys until Full, then verify every key, misses, updates
+and that updates still succeed when full.
+*/
+func TestConformanceFill(t *testing.T) {
+	const capacity = testCapacity
+
+	forEachImpl(t, capacity, func(t *testing.T, idx DigestIndex) {
+		req := require.New(t)
+
+		rng := rand.New(rand.NewSource(2))
+		var keys [][]byte
+		var vals []Value
+
+		for {
+			k := randKey(rng)
+			v := randValue(rng)
+			res := idx.Put(k, v)
+			if res == Full {
+				break
+			}
+			req.Equal(Added, res)
+			keys = append(keys, k)
+			vals = append(vals, v)
+			req.True(len(keys) <= idx.Cap(), "never exceeds Cap")
+		}
+
+		//Every implementation holds at least the requested capacity (statistically)
+		n := len(keys)
+		req.Equal(n, idx.Len())
+		req.True(n >= capacity * 99 / 100, n)
+
+		for i, k := range keys {
+			v, found := idx.Get(k)
+			req.True(found)
+			req.Equal(vals[i], v)
+		}
+
+		for i := 0; i < 1000; i++ {
+			_, found := idx.Get(randKey(rng))
+			req.False(found)
+		}
+
+		//still full for new keys, but updates are allowed
+		req.Equal(Full, idx.Put(randKey(rng), Value{}))
+		for i, k := range keys {
+			vals[i] = randValue(rng)
+			req.Equal(Updated, idx.Put(k, vals[i]))
+		}
+		for i, k := range keys {
+			v, found := idx.Get(k)
+			req.True(found)
+			req.Equal(vals[i], v)
+		}
+		req.Equal(n, idx.Len())
+	})
+}
+
+/*
+Random mix of Put, Get and (when supported) Delete checked against a Go
+map as the reference model.
+*/
+func TestConformanceRandomized(t *testing.T) {
+	forEachImpl(t, testCapacity, func(t *testing.T, idx DigestIndex) {
+		req := require.New(t)
+
+		rng := rand.New(rand.NewSource(3))
+		model := make(map[[KeySize]byte]Value)
+		var known [][KeySize]byte
+
+		deleter, canDelete := idx.(Deleter)
+
+		pickKey := func() []byte {
+			//mostly reuse keys so that updates, hits and deletes are common
+			if len(known) > 0 && rng.Intn(3) > 0 {
+				k := known[rng.Intn(len(known))]
+				return k[:]
+			}
+			k := [KeySize]byte(randKey(rng))
+			known = append(known, k)
+			return k[:]
+		}
+
+		for op := 0; op < 20000; op++ {
+			k := pickKey()
+			mk := [KeySize]byte(k)
+
+			switch r := rng.Intn(10); {
+			case r < 5:
+				v := randValue(rng)
+				_, exists := model[mk]
+				res := idx.Put(k, v)
+				if exists {
+					req.Equal(Updated, res)
+					model[mk] = v
+				} else {
+					//far below capacity so never full
+					req.Equal(Added, res)
+					model[mk] = v
+				}
+			case r < 8 || !canDelete:
+				v, found := idx.Get(k)
+				mv, exists := model[mk]
+				req.Equal(exists, found)
+				req.Equal(mv, v)
+			default:
+				_, exists := model[mk]
+				req.Equal(exists, deleter.Delete(k))
+				delete(model, mk)
+			}
+
+			req.Equal(len(model), idx.Len())
+		}
+
+		for mk, mv := range model {
+			v, found := idx.Get(mk[:])
+			req.True(found)
+			req.Equal(mv, v)
+		}
+	})
+}
+
+func TestGoMapDelete(t *testing.T) {
+	req := require.New(t)
+
+	idx, _ := New("gomap", 2)
+	d := idx.(Deleter)
+
+	rng := rand.New(rand.NewSource(4))
+	k1, k2, k3 := randKey(rng), randKey(rng), randKey(rng)
+	req.Equal(Added, idx.Put(k1, Value{1}))
+	req.Equal(Added, idx.Put(k2, Value{2}))
+	req.Equal(Full, idx.Put(k3, Value{3}))
+
+	req.True(d.Delete(k1))
+	req.False(d.Delete(k1))
+	req.Equal(Added, idx.Put(k3, Value{3}))
+	req.Equal(2, idx.Len())
+}
+
+type KV struct {
+	K [KeySize]byte
+	V Value
+}
+
+func makeKeys(n int) []KV {
+	rng := rand.New(rand.NewSource(99))
+	keys := make([]KV, n)
+	for i := range keys {
+		rng.Read(keys[i].K[:])
+		rng.Read(keys[i].V[:])
+	}
+	return keys
+}
+
+func benchRandFill(impl string, approxNumKeys int, keys []KV) int {
+	idx, _ := New(impl, approxNumKeys)
+
+	//Add random keys until full
+	nAdded := 0
+	for _, kv := range keys {
+		if idx.Put(kv.K[:], kv.V) == Full {
+			break
+		}
+		nAdded++
+	}
+
+	return nAdded
+}
+
+var noCompilerOptimize int
+
+//Fill each implementation (see profile.sh)
+func Benchmark_randFill(b *testing.B) {
+	const approxNumKeys = 0x10000 * 20
+	keys := makeKeys(approxNumKeys)
+
+	for _, impl := range Impls() {
+		b.Run(impl, func(b *testing.B) {
+			for j := 0; j < b.N; j++ {
+				noCompilerOptimize += benchRandFill(impl, approxNumKeys, keys)
+			}
+		})
+	}
+}
+
+//The Go map baseline on its own so it can be profiled separately (see profile.sh)
+func Benchmark_randFillGoMap(b *testing.B) {
+	const approxNumKeys = 0x10000 * 20
+	keys := makeKeys(approxNumKeys)
+
+	for j := 0; j < b.N; j++ {
+		noCompilerOptimize += benchRandFill("gomap", approxNumKeys, keys)
+	}
+}
@@ -0,0 +1,153 @@
+package bitarray
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+/*
+A BitArray which is safe to modify from many goroutines at once, for
+concurrent marking and allocation.  Every word is read with an atomic load
+and changed with a compare-and-swap, so each operation is linearizable:
+it behaves as if it happened at one instant in some order consistent with
+the sequential BitArray.
+
+Operations which would not change a word (setting a bit which is already set)
+return without writing so that contended words are not bounced between CPUs
+needlessly.
+*/
+type AtomicBitArray []atomic.Uint64
+
+/*
+Allocate a new AtomicBitArray.  nBits will be rounded up to a multiple of 64.
+All bits start at 0 (false).
+*/
+func NewAtomicBitArray(nBits uint64) AtomicBitArray {
+	return make(AtomicBitArray, numWords(nBits))
+}
+
+//Total number of bits
+func (aba AtomicBitArray) NumBits() uint64 {
+	return uint64(len(aba)) * bpw
+}
+
+//Atomically read the word holding bits [wordIndex*64, wordIndex*64+64)
+func (aba AtomicBitArray) Word(wordIndex int) uint64 {
+	return aba[wordIndex].Load()
+}
+
+func (aba AtomicBitArray) IsSet(bitIndex uint64) bool {
+	wordIndex, bitMask := index2pos(bitIndex)
+	return aba[wordIndex].Load() & bitMask != 0
+}
+
+/*
+Set a bit to 1 and return its previous value.
+*/
+func (aba AtomicBitArray) TestAndSet(bitIndex uint64) bool {
+	wordIndex, bitMask := index2pos(bitIndex)
+	addr := &aba[wordIndex]
+	for {
+		word := addr.Load()
+		if word & bitMask != 0 {
+			return true
+		}
+		if addr.CompareAndSwap(word, word | bitMask) {
+			return false
+		}
+		//another goroutine changed the word.  Retry.
+	}
+}
+
+/*Set a bit to 1 (true)*/
+func (aba AtomicBitArray) Set(bitIndex uint64) {
+	aba.TestAndSet(bitIndex)
+}
+
+/*Set a bit to 0 but return false if the bit was already zero*/
+func (aba AtomicBitArray) ClearIfSet(bitIndex uint64) bool {
+	wordIndex, bitMask := index2pos(bitIndex)
+	addr := &aba[wordIndex]
+	for {
+		word := addr.Load()
+		if word & bitMask == 0 {
+			return false
+		}
+		if addr.CompareAndSwap(word, word &^ bitMask) {
+			return true
+		}
+	}
+}
+
+/*Set a bit to 0 (false)*/
+func (aba AtomicBitArray) Clear(bitIndex uint64) {
+	aba.ClearIfSet(bitIndex)
+}
+
+//Set the last N bits to 1.  N cannot exceed NumBits.
+func (aba AtomicBitArray) SetLastN(n uint64) {
+	if n > aba.NumBits() {
+		panic("SetLastN: n exceeds NumBits")
+	}
+	for bit := aba.NumBits() - n; bit < aba.NumBits(); bit++ {
+		aba.Set(bit)
+	}
+}
+
+/*
+Number of bits set to 1.  Exact only if no other goroutine is modifying the array.
+*/
+func (aba AtomicBitArray) Count() uint64 {
+	var n uint64
+	for i := range aba {
+		n += uint64(bits.OnesCount64(aba[i].Load()))
+	}
+	return n
+}
+
+/*
+Atomically claim any zero bit in words [fromWord, toWord) by setting it to 1.
+Returns the bit index, or NotFound if every word was (or became) full.
+*/
+func (aba AtomicBitArray) FindZeroAndSetIn(fromWord, toWord int) uint64 {
+	for wordIndex := fromWord; wordIndex < toWord; wordIndex++ {
+		addr := &aba[wordIndex]
+		for {
+			word := addr.Load()
+			if word == allFF {
+				break
+			}
+			bit := uint64(bits.TrailingZeros64(^word))
+			if addr.CompareAndSwap(word, word | (uint64(1) << bit)) {
+				return uint64(wordIndex) << bpwShift + bit
+			}
+		}
+	}
+	return NotFound
+}
+
+/*
+Atomically claim a zero bit by setting it to 1.  Like BitArray.FindZero the
+hinted bit is tried first and the search wraps around.  Returns NotFound if
+all bits are 1.
+*/
+func (aba AtomicBitArray) FindZeroAndSet(fromHint uint64) uint64 {
+	startIndex, _ := index2pos(fromHint)
+	if startIndex < uint64(len(aba)) {
+		if !aba.TestAndSet(fromHint) {
+			return fromHint
+		}
+	} else {
+		startIndex = uint64(len(aba))
+	}
+
+	if found := aba.FindZeroAndSetIn(int(startIndex), len(aba)); found != NotFound {
+		return found
+	}
+	//wrap around (including the start word, in case a bit was freed before the hint)
+	end := int(startIndex) + 1
+	if end > len(aba) {
+		end = len(aba)
+	}
+	return aba.FindZeroAndSetIn(0, end)
+}
@@ -0,0 +1,192 @@
+package bitarray
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+func TestAtomicBasic(t *testing.T) {
+	req := require.New(t)
+
+	aba := NewAtomicBitArray(190)
+	req.Equal(uint64(192), aba.NumBits())
+
+	req.False(aba.TestAndSet(5))
+	req.True(aba.TestAndSet(5))
+	req.True(aba.IsSet(5))
+	req.True(aba.ClearIfSet(5))
+	req.False(aba.ClearIfSet(5))
+	aba.Set(70)
+	aba.Clear(70)
+	req.Equal(uint64(0), aba.Count())
+
+	aba.SetLastN(2)
+	req.True(aba.IsSet(191))
+	req.True(aba.IsSet(190))
+	req.False(aba.IsSet(189))
+	aba.SetLastN(0)
+	req.Equal(uint64(2), aba.Count())
+
+	//hint first, then the rest of its word, then wrap around
+	req.Equal(uint64(100), aba.FindZeroAndSet(100))
+	req.Equal(uint64(64), aba.FindZeroAndSet(100))
+	req.Equal(uint64(0), aba.FindZeroAndSet(9999))
+	req.Equal(uint64(NotFound), aba.FindZeroAndSetIn(1, 1))
+
+	for aba.FindZeroAndSet(0) != NotFound {
+	}
+	req.Equal(aba.NumBits(), aba.Count())
+	req.Equal(uint64(allFF), aba.Word(2))
+}
+
+//Single goroutine: same results as BitArray for a random sequence of operations
+func TestAtomicMatchesSequential(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(8))
+
+	const nBits = 64 * 5
+	aba := NewAtomicBitArray(nBits)
+	ba := NewBitArray(nBits)
+	for i := 0; i < 20000; i++ {
+		bit := uint64(rng.Intn(nBits))
+		switch rng.Intn(4) {
+		case 0:
+			want := ba.IsSet(bit)
+			ba.Set(bit)
+			req.Equal(want, aba.TestAndSet(bit))
+		case 1:
+			req.Equal(ba.ClearIfSet(bit), aba.ClearIfSet(bit))
+		case 2:
+			want := ba.FindZero(bit)
+			if want != NotFound {
+				ba.Set(want)
+			}
+			req.Equal(want, aba.FindZeroAndSet(bit))
+		case 3:
+			req.Equal(ba.IsSet(bit), aba.IsSet(bit))
+		}
+	}
+	for i := range ba {
+		req.Equal(ba[i], aba.Word(i))
+	}
+}
+
+/*
+Many goroutines claim bits with FindZeroAndSet.  Linearizable means every bit
+is handed out exactly once, as it would be sequentially.
+*/
+func TestAtomicFindZeroAndSetConcurrent(t *testing.T) {
+	const nBits = 64 * 100
+	const nGoroutines = 8
+	aba := NewAtomicBitArray(nBits)
+	owner := make([]atomic.Int32, nBits)
+
+	var wg sync.WaitGroup
+	var claimed atomic.Int64
+	for g := 0; g < nGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			hint := uint64(g * nBits / nGoroutines)
+			for {
+				bit := aba.FindZeroAndSet(hint)
+				if bit == NotFound {
+					return
+				}
+				if !owner[bit].CompareAndSwap(0, int32(g + 1)) {
+					t.Errorf("bit %d claimed twice", bit)
+					return
+				}
+				claimed.Add(1)
+				hint = bit + 1
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(nBits), claimed.Load())
+	require.Equal(t, uint64(nBits), aba.Count())
+}
+
+/*
+Goroutines race TestAndSet and ClearIfSet on the same bits.  For each bit the
+number of successful sets (TestAndSet returned false) minus successful clears
+must equal its final value, as in any sequential ordering.
+*/
+func TestAtomicSetClearConcurrent(t *testing.T) {
+	const nBits = 128
+	const nGoroutines = 8
+	aba := NewAtomicBitArray(nBits)
+	sets := make([]atomic.Int64, nBits)
+	clears := make([]atomic.Int64, nBits)
+
+	var wg sync.WaitGroup
+	for g := 0; g < nGoroutines; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < 20000; i++ {
+				bit := uint64(rng.Intn(nBits))
+				if rng.Intn(2) == 0 {
+					if !aba.TestAndSet(bit) {
+						sets[bit].Add(1)
+					}
+				} else if aba.ClearIfSet(bit) {
+					clears[bit].Add(1)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	for bit := uint64(0); bit < nBits; bit++ {
+		diff := sets[bit].Load() - clears[bit].Load()
+		if aba.IsSet(bit) {
+			require.Equal(t, int64(1), diff, "bit %d", bit)
+		} else {
+			require.Equal(t, int64(0), diff, "bit %d", bit)
+		}
+	}
+}
+
+/*
+Each goroutine owns every nGoroutines'th bit, so all share words, and checks
+its own bits against a private sequential BitArray.  Concurrent updates to
+other bits of a word must never disturb them.
+*/
+func TestAtomicDisjointBits(t *testing.T) {
+	const nBits = 64 * 4
+	const nGoroutines = 8
+	aba := NewAtomicBitArray(nBits)
+
+	var wg sync.WaitGroup
+	for g := 0; g < nGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			model := NewBitArray(nBits)
+			for i := 0; i < 20000; i++ {
+				bit := uint64(rng.Intn(nBits / nGoroutines) * nGoroutines + g)
+				var got, want bool
+				if rng.Intn(2) == 0 {
+					want = model.IsSet(bit)
+					model.Set(bit)
+					got = aba.TestAndSet(bit)
+				} else {
+					want = model.ClearIfSet(bit)
+					got = aba.ClearIfSet(bit)
+				}
+				if got != want {
+					t.Errorf("goroutine %d bit %d: got %v want %v", g, bit, got, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -4,6 +4,10 @@ Supports fast searching for zero bits.
 */
 package bitarray
 
+import (
+	"math/bits"
+)
+
 type BitArray []uint64
 
 //bits per word
@@ -23,6 +27,11 @@ Allocate a new BitArray.  If nBits will be rounded up to a multiple of 64.
 All bits start at 0 (false).
 */
 func NewBitArray(nBits uint64) BitArray {
+	return BitArray(make([]uint64, numWords(nBits)))
+}
+
+//Number of words holding nBits: rounded up, and at least one
+func numWords(nBits uint64) int {
 	nWords := nBits >> bpwShift //divide by 64
 
 	//round up
@@ -35,8 +44,7 @@ func NewBitArray(nBits uint64) BitArray {
 	if int64(nWordsInt) != int64(nWords) {
 		panic("nBits too large")
 	}
-
-	return BitArray(make([]uint64, nWords))
+	return nWordsInt
 }
 
 //Total number of bits
@@ -99,53 +107,26 @@ func (ba BitArray) SetAll() {
 	}
 }
 
-//Set the last N bits to 1.  N cannot exceed 64.
+//Set the last N bits to 1.  N cannot exceed NumBits.
 func (ba BitArray) SetLastN(n uint64) {
-	if n > bpw {
-		panic("SetLastN: n exceeds 64")
-	}
-
-	wordIndex := len(ba) - 1
-	word := ba[wordIndex]
-
-	bit := uint64(1 << 63)
-	for n > 0 {
-		word |= bit
-		bit >>= 1
-		n--
+	if n > ba.NumBits() {
+		panic("SetLastN: n exceeds NumBits")
 	}
-
-	ba[wordIndex] = word
+	ba.SetRange(ba.NumBits() - n, ba.NumBits())
 }
 
 
 /*
 Find the bit index of the first zero bit in the given word.
-Returns > bpw if none are zero.
+Returns bpw if none are zero.
 */
 func findZeroBit(word uint64) (bitIndex uint64) {
-	/*
-	TODO: binary search or something from math/bits (TrailingZeros64?)
-	which 32bit half
-	which 16bit half
-	which 8bit half
-	which 4bit half
-	which 2bit half
-	which bit
-
-	The challenge is keeping track of the bitIndex
-	*/
-
-	for bitIndex < bpw && ((word & 1) == 1) {
-		word >>= 1
-		bitIndex++
-	}
-	return
+	return uint64(bits.TrailingZeros64(^word))
 }
 
 /*
 Linear search for a bit which is 0 (false).  The search is accelerated because it
-compares 64bits at a time.
+compares 64bits at a time.  See IndexedBitArray for large arrays.
 
 'fromHint' is a bitIndex which can be used to suggest where to start the search.
 Searching will wrap arround as need.
@@ -0,0 +1,113 @@
+package bitarray
+
+func checkSameLen(op string, a, b BitArray) {
+	if len(a) != len(b) {
+		panic("bitarray." + op + ": length mismatch")
+	}
+}
+
+/*
+ba = ba AND other, word by word.  Both must have the same NumBits.
+For example live := allocated.Clone(); live.And(marked).
+*/
+func (ba BitArray) And(other BitArray) {
+	checkSameLen("And", ba, other)
+	for i, word := range other {
+		ba[i] &= word
+	}
+}
+
+//ba = ba OR other.  Both must have the same NumBits.
+func (ba BitArray) Or(other BitArray) {
+	checkSameLen("Or", ba, other)
+	for i, word := range other {
+		ba[i] |= word
+	}
+}
+
+/*
+ba = ba AND NOT other.  Both must have the same NumBits.
+For example garbage := allocated.Clone(); garbage.AndNot(marked).
+*/
+func (ba BitArray) AndNot(other BitArray) {
+	checkSameLen("AndNot", ba, other)
+	for i, word := range other {
+		ba[i] &^= word
+	}
+}
+
+//ba = ba XOR other.  Both must have the same NumBits.
+func (ba BitArray) Xor(other BitArray) {
+	checkSameLen("Xor", ba, other)
+	for i, word := range other {
+		ba[i] ^= word
+	}
+}
+
+//True if both have the same NumBits and the same bits set
+func (ba BitArray) Equal(other BitArray) bool {
+	if len(ba) != len(other) {
+		return false
+	}
+	for i, word := range other {
+		if ba[i] != word {
+			return false
+		}
+	}
+	return true
+}
+
+//A copy which shares no memory with ba
+func (ba BitArray) Clone() BitArray {
+	return append(BitArray(make([]uint64, 0, len(ba))), ba...)
+}
+
+/*
+Apply fn to the masked bits of each word in the range [a, b).  b is clamped to NumBits.
+*/
+func (ba BitArray) rangeWords(a, b uint64, fn func(word *uint64, mask uint64)) {
+	if b > ba.NumBits() {
+		b = ba.NumBits()
+	}
+	if a >= b {
+		return
+	}
+
+	aWord, bWord := a >> bpwShift, (b - 1) >> bpwShift
+	firstMask := uint64(allFF) << (a & (bpw - 1))
+	lastMask := uint64(allFF) >> (bpw - 1 - ((b - 1) & (bpw - 1)))
+	if aWord == bWord {
+		fn(&ba[aWord], firstMask & lastMask)
+		return
+	}
+	fn(&ba[aWord], firstMask)
+	for i := aWord + 1; i < bWord; i++ {
+		fn(&ba[i], allFF)
+	}
+	fn(&ba[bWord], lastMask)
+}
+
+//Set bits [a, b) to 1.  b is clamped to NumBits.
+func (ba BitArray) SetRange(a, b uint64) {
+	ba.rangeWords(a, b, func(word *uint64, mask uint64) {
+		*word |= mask
+	})
+}
+
+//Set bits [a, b) to 0.  b is clamped to NumBits.
+func (ba BitArray) ClearRange(a, b uint64) {
+	ba.rangeWords(a, b, func(word *uint64, mask uint64) {
+		*word &^= mask
+	})
+}
+
+/*
+Return a BitArray of nBits (rounded up to a multiple of 64) holding the bits
+of ba.  Bits beyond the old end are 0; bits beyond the new end are dropped.
+ba is unchanged.
+*/
+func (ba BitArray) Resize(nBits uint64) BitArray {
+	resized := NewBitArray(nBits)
+	copy(resized, ba)
+	return resized
+}
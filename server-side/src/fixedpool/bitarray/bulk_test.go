@@ -0,0 +1,128 @@
+package bitarray
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+)
+
+func TestBulkOps(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(9))
+
+	a := randBitArray(rng, 640)
+	b := randBitArray(rng, 640)
+
+	check := func(op func(dst, src BitArray), bitOp func(x, y bool) bool) {
+		dst := a.Clone()
+		op(dst, b)
+		for i := uint64(0); i < a.NumBits(); i++ {
+			req.Equal(bitOp(a.IsSet(i), b.IsSet(i)), dst.IsSet(i), "bit %d", i)
+		}
+	}
+	check(BitArray.And, func(x, y bool) bool { return x && y })
+	check(BitArray.Or, func(x, y bool) bool { return x || y })
+	check(BitArray.AndNot, func(x, y bool) bool { return x && !y })
+	check(BitArray.Xor, func(x, y bool) bool { return x != y })
+
+	//live + garbage = allocated
+	live := a.Clone()
+	live.And(b)
+	garbage := a.Clone()
+	garbage.AndNot(b)
+	req.Equal(a.Count(), live.Count() + garbage.Count())
+
+	req.Panics(func() {
+		a.And(NewBitArray(64))
+	})
+}
+
+func TestEqualClone(t *testing.T) {
+	req := require.New(t)
+
+	a := NewBitArray(128)
+	a.Set(7)
+	c := a.Clone()
+	req.True(a.Equal(c))
+	c.Set(100)
+	req.False(a.Equal(c))
+	req.False(a.IsSet(100))
+	req.False(a.Equal(NewBitArray(64)))
+}
+
+func TestRanges(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(10))
+
+	const nBits = 64 * 5
+	for i := 0; i < 500; i++ {
+		ba := randBitArray(rng, nBits)
+		orig := ba.Clone()
+		a := uint64(rng.Intn(nBits + 1))
+		b := uint64(rng.Intn(nBits + 10))
+		set := rng.Intn(2) == 0
+		if set {
+			ba.SetRange(a, b)
+		} else {
+			ba.ClearRange(a, b)
+		}
+		for j := uint64(0); j < nBits; j++ {
+			if j >= a && j < b {
+				req.Equal(set, ba.IsSet(j), "bit %d of [%d, %d)", j, a, b)
+			} else {
+				req.Equal(orig.IsSet(j), ba.IsSet(j))
+			}
+		}
+	}
+}
+
+//SetLastN is no longer limited to 64
+func TestSetLastNLarge(t *testing.T) {
+	req := require.New(t)
+
+	ba := NewBitArray(192)
+	ba.SetLastN(100)
+	req.Equal(uint64(100), ba.Count())
+	req.False(ba.IsSet(91))
+	req.True(ba.IsSet(92))
+	req.Panics(func() {
+		ba.SetLastN(193)
+	})
+
+	iba := NewIndexedBitArray(64 * 600)
+	iba.SetLastN(64 * 599 + 1)
+	//only bits 0 to 62 are free
+	req.Equal(uint64(62), iba.FindZero(62))
+	req.Equal(uint64(0), iba.FindZero(64 * 599))
+	checkIndex(req, &iba)
+	iba.ClearRange(64 * 300, 64 * 301)
+	req.Equal(uint64(64 * 300), iba.FindZero(64 * 290))
+	checkIndex(req, &iba)
+
+	aba := NewAtomicBitArray(192)
+	aba.SetLastN(100)
+	req.Equal(uint64(100), aba.Count())
+}
+
+func TestResize(t *testing.T) {
+	req := require.New(t)
+
+	ba := NewBitArray(128)
+	ba.Set(3)
+	ba.Set(127)
+
+	bigger := ba.Resize(300)
+	req.Equal(uint64(320), bigger.NumBits())
+	req.True(bigger.IsSet(3))
+	req.True(bigger.IsSet(127))
+	req.Equal(uint64(2), bigger.Count())
+
+	smaller := ba.Resize(64)
+	req.Equal(uint64(64), smaller.NumBits())
+	req.True(smaller.IsSet(3))
+	req.Equal(uint64(1), smaller.Count())
+
+	//the original is unchanged
+	smaller.Set(5)
+	req.False(ba.IsSet(5))
+}
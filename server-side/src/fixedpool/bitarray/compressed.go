@@ -0,0 +1,543 @@
+package bitarray
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+/*
+A compressed, read-only form of a BitArray for storage and the network, in
+the style of Roaring bitmaps.  The bits are divided into chunks of 65,536
+bits.  Empty chunks are omitted and each other chunk is stored in whichever
+container is smallest for its density:
+
+	array: the sorted 16bit positions of the set bits (2 bytes per set bit)
+	runs: start and end positions of each run of set bits (4 bytes per run)
+	bitmap: the words themselves (8,192 bytes)
+
+So an array with one bit per chunk, very sparse or very dense, stays small.
+And, Or and AndNot work directly on this form without decompressing whole
+chunks where they are absent or arrays.
+*/
+type Compressed struct {
+	nBits uint64
+	//sorted by key
+	chunks []container
+}
+
+const chunkBits = 1 << 16
+const chunkWords = chunkBits / bpw
+
+const (
+	kindArray = 1
+	kindRuns = 2
+	kindBitmap = 3
+)
+
+type container struct {
+	//chunk index
+	key uint32
+	kind uint8
+	/*
+	array: sorted positions
+	runs: pairs of first and last position of each run
+	*/
+	vals []uint16
+	//bitmap
+	words []uint64
+}
+
+//Words of the chunk at key (the last chunk may be short)
+func chunkSpan(nWords int, key uint32) (start, end int) {
+	start = int(key) * chunkWords
+	end = start + chunkWords
+	if end > nWords {
+		end = nWords
+	}
+	return
+}
+
+//Number of set bits and of runs of set bits in words
+func countRuns(words []uint64) (nSet, nRuns int) {
+	var carry uint64
+	for _, w := range words {
+		nSet += bits.OnesCount64(w)
+		//a run starts at each set bit whose lower neighbour is clear
+		nRuns += bits.OnesCount64(w &^ (w << 1 | carry))
+		carry = w >> 63
+	}
+	return
+}
+
+//Payload bytes of the smallest container for words, and its kind.  0 kind if empty.
+func chooseKind(words []uint64) (kind uint8, size int) {
+	nSet, nRuns := countRuns(words)
+	if nSet == 0 {
+		return 0, 0
+	}
+	kind, size = kindArray, 2 * nSet
+	if 4 * nRuns < size {
+		kind, size = kindRuns, 4 * nRuns
+	}
+	if 8 * len(words) < size {
+		kind, size = kindBitmap, 8 * len(words)
+	}
+	return
+}
+
+//Build the best container for one chunk's words.  ok is false if the chunk is empty.
+func makeContainer(key uint32, words []uint64) (ct container, ok bool) {
+	kind, _ := chooseKind(words)
+	ct = container{key: key, kind: kind}
+	switch kind {
+	case 0:
+		return ct, false
+	case kindArray:
+		BitArray(words).ForEachSet(func(i uint64) bool {
+			ct.vals = append(ct.vals, uint16(i))
+			return true
+		})
+	case kindRuns:
+		ba := BitArray(words)
+		for start := ba.NextSet(0); start != NotFound; {
+			end := ba.NextZero(start)
+			if end == NotFound {
+				end = ba.NumBits()
+			}
+			ct.vals = append(ct.vals, uint16(start), uint16(end - 1))
+			start = ba.NextSet(end)
+		}
+	case kindBitmap:
+		ct.words = append([]uint64(nil), words...)
+	}
+	return ct, true
+}
+
+//Write the container's bits into dst (the chunk's words, zeroed)
+func (ct *container) toWords(dst []uint64) {
+	ba := BitArray(dst)
+	switch ct.kind {
+	case kindArray:
+		for _, v := range ct.vals {
+			ba.Set(uint64(v))
+		}
+	case kindRuns:
+		for i := 0; i < len(ct.vals); i += 2 {
+			ba.SetRange(uint64(ct.vals[i]), uint64(ct.vals[i+1]) + 1)
+		}
+	case kindBitmap:
+		copy(dst, ct.words)
+	}
+}
+
+func (ct *container) count() uint64 {
+	switch ct.kind {
+	case kindArray:
+		return uint64(len(ct.vals))
+	case kindRuns:
+		var n uint64
+		for i := 0; i < len(ct.vals); i += 2 {
+			n += uint64(ct.vals[i+1]) - uint64(ct.vals[i]) + 1
+		}
+		return n
+	default:
+		return BitArray(ct.words).Count()
+	}
+}
+
+func (ct *container) contains(pos uint16) bool {
+	switch ct.kind {
+	case kindArray:
+		i := sort.Search(len(ct.vals), func(i int) bool { return ct.vals[i] >= pos })
+		return i < len(ct.vals) && ct.vals[i] == pos
+	case kindRuns:
+		//first run whose last position is >= pos
+		nRuns := len(ct.vals) / 2
+		i := sort.Search(nRuns, func(i int) bool { return ct.vals[2*i+1] >= pos })
+		return i < nRuns && ct.vals[2*i] <= pos
+	default:
+		return int(pos) < len(ct.words) * bpw && BitArray(ct.words).IsSet(uint64(pos))
+	}
+}
+
+/*
+Compress a BitArray.
+*/
+func Compress(ba BitArray) *Compressed {
+	c := &Compressed{nBits: ba.NumBits()}
+	for key := uint32(0); int(key) * chunkWords < len(ba); key++ {
+		start, end := chunkSpan(len(ba), key)
+		if ct, ok := makeContainer(key, ba[start:end]); ok {
+			c.chunks = append(c.chunks, ct)
+		}
+	}
+	return c
+}
+
+//Expand back into a BitArray
+func (c *Compressed) Decompress() BitArray {
+	ba := NewBitArray(c.nBits)
+	for i := range c.chunks {
+		ct := &c.chunks[i]
+		start, end := chunkSpan(len(ba), ct.key)
+		ct.toWords(ba[start:end])
+	}
+	return ba
+}
+
+func (c *Compressed) NumBits() uint64 {
+	return c.nBits
+}
+
+//Number of bits set to 1
+func (c *Compressed) Count() uint64 {
+	var n uint64
+	for i := range c.chunks {
+		n += c.chunks[i].count()
+	}
+	return n
+}
+
+func (c *Compressed) find(key uint32) *container {
+	i := sort.Search(len(c.chunks), func(i int) bool { return c.chunks[i].key >= key })
+	if i < len(c.chunks) && c.chunks[i].key == key {
+		return &c.chunks[i]
+	}
+	return nil
+}
+
+func (c *Compressed) IsSet(bitIndex uint64) bool {
+	if bitIndex >= c.nBits {
+		return false
+	}
+	ct := c.find(uint32(bitIndex / chunkBits))
+	return ct != nil && ct.contains(uint16(bitIndex % chunkBits))
+}
+
+/*
+Combine two containers for the same chunk through their words.
+*/
+func combineWords(nWords int, a, b *container, op func(x, y uint64) uint64) (container, bool) {
+	start, end := chunkSpan(nWords, a.key)
+	var wa, wb [chunkWords]uint64
+	a.toWords(wa[:end-start])
+	b.toWords(wb[:end-start])
+	for i := range wa[:end-start] {
+		wa[i] = op(wa[i], wb[i])
+	}
+	return makeContainer(a.key, wa[:end-start])
+}
+
+//Keep the values of an array container for which keep is true
+func filterArray(a *container, keep func(pos uint16) bool) (container, bool) {
+	ct := container{key: a.key, kind: kindArray}
+	for _, v := range a.vals {
+		if keep(v) {
+			ct.vals = append(ct.vals, v)
+		}
+	}
+	return ct, len(ct.vals) > 0
+}
+
+func (c *Compressed) checkSame(op string, other *Compressed) {
+	if c.nBits != other.nBits {
+		panic("bitarray.Compressed." + op + ": length mismatch")
+	}
+}
+
+/*
+Merge two compressed arrays chunk by chunk.  onlyA and onlyB say whether a
+chunk present on one side only is kept.  both combines chunks present on both.
+*/
+func (c *Compressed) merge(other *Compressed, onlyA, onlyB bool,
+	both func(a, b *container) (container, bool)) *Compressed {
+
+	result := &Compressed{nBits: c.nBits}
+	i, j := 0, 0
+	for i < len(c.chunks) || j < len(other.chunks) {
+		switch {
+		case j == len(other.chunks) || (i < len(c.chunks) && c.chunks[i].key < other.chunks[j].key):
+			if onlyA {
+				result.chunks = append(result.chunks, c.chunks[i])
+			}
+			i++
+		case i == len(c.chunks) || other.chunks[j].key < c.chunks[i].key:
+			if onlyB {
+				result.chunks = append(result.chunks, other.chunks[j])
+			}
+			j++
+		default:
+			if ct, ok := both(&c.chunks[i], &other.chunks[j]); ok {
+				result.chunks = append(result.chunks, ct)
+			}
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+/*
+Bits set in both.  Chunks absent from either side are skipped and array
+chunks are intersected without expanding them.  Both must have the same NumBits.
+The result may share containers with the inputs; neither is modified.
+*/
+func (c *Compressed) And(other *Compressed) *Compressed {
+	c.checkSame("And", other)
+	nWords := int(c.nBits / bpw)
+	return c.merge(other, false, false, func(a, b *container) (container, bool) {
+		if a.kind == kindArray {
+			return filterArray(a, b.contains)
+		}
+		if b.kind == kindArray {
+			return filterArray(b, a.contains)
+		}
+		return combineWords(nWords, a, b, func(x, y uint64) uint64 { return x & y })
+	})
+}
+
+//Bits set in either.  Both must have the same NumBits.
+func (c *Compressed) Or(other *Compressed) *Compressed {
+	c.checkSame("Or", other)
+	nWords := int(c.nBits / bpw)
+	return c.merge(other, true, true, func(a, b *container) (container, bool) {
+		return combineWords(nWords, a, b, func(x, y uint64) uint64 { return x | y })
+	})
+}
+
+//Bits set in c but not in other.  Both must have the same NumBits.
+func (c *Compressed) AndNot(other *Compressed) *Compressed {
+	c.checkSame("AndNot", other)
+	nWords := int(c.nBits / bpw)
+	return c.merge(other, true, false, func(a, b *container) (container, bool) {
+		if a.kind == kindArray {
+			return filterArray(a, func(pos uint16) bool { return !b.contains(pos) })
+		}
+		return combineWords(nWords, a, b, func(x, y uint64) uint64 { return x &^ y })
+	})
+}
+
+/*
+Encoding (all integers little endian):
+
+	magic "BAZ1" (4 bytes)
+	NumBits (8 bytes)
+	number of chunks (4 bytes)
+	Each chunk, in key order:
+		key (4 bytes)
+		kind (1 byte)
+		array: count (2 bytes) then positions (2 bytes each)
+		runs: count (2 bytes) then first and last position of each run (4 bytes each)
+		bitmap: the chunk's words (8 bytes each)
+*/
+const compressedMagic = "BAZ1"
+const compressedHeaderSize = 16
+const chunkHeaderSize = 5
+
+//Bytes of the container's payload (after the chunk header)
+func (ct *container) encodedSize() int {
+	if ct.kind == kindBitmap {
+		return 8 * len(ct.words)
+	}
+	return 2 + 2 * len(ct.vals)
+}
+
+//Size of MarshalBinary's output
+func (c *Compressed) EncodedSize() int {
+	n := compressedHeaderSize
+	for i := range c.chunks {
+		n += chunkHeaderSize + c.chunks[i].encodedSize()
+	}
+	return n
+}
+
+/*
+Size in bytes of the compressed encoding of ba, computed without building it.
+Compare with 8 * len(ba) to decide whether compression is worthwhile.
+*/
+func EncodedSize(ba BitArray) int {
+	n := compressedHeaderSize
+	for key := uint32(0); int(key) * chunkWords < len(ba); key++ {
+		start, end := chunkSpan(len(ba), key)
+		kind, size := chooseKind(ba[start:end])
+		if kind == 0 {
+			continue
+		}
+		n += chunkHeaderSize + size
+		if kind != kindBitmap {
+			//count
+			n += 2
+		}
+	}
+	return n
+}
+
+//Implements encoding.BinaryMarshaler
+func (c *Compressed) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, compressedHeaderSize, c.EncodedSize())
+	copy(buf[0:4], compressedMagic)
+	binary.LittleEndian.PutUint64(buf[4:], c.nBits)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(c.chunks)))
+
+	for i := range c.chunks {
+		ct := &c.chunks[i]
+		buf = binary.LittleEndian.AppendUint32(buf, ct.key)
+		buf = append(buf, ct.kind)
+		if ct.kind == kindBitmap {
+			for _, w := range ct.words {
+				buf = binary.LittleEndian.AppendUint64(buf, w)
+			}
+			continue
+		}
+		n := len(ct.vals)
+		if ct.kind == kindRuns {
+			n /= 2
+		}
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(n))
+		for _, v := range ct.vals {
+			buf = binary.LittleEndian.AppendUint16(buf, v)
+		}
+	}
+	return buf, nil
+}
+
+var errCompressedTruncated = errors.New("bitarray: compressed data truncated")
+
+/*
+Implements encoding.BinaryUnmarshaler.  The data is fully validated.  On error
+c is unchanged.
+*/
+func (c *Compressed) UnmarshalBinary(data []byte) error {
+	if len(data) < compressedHeaderSize {
+		return errCompressedTruncated
+	}
+	if string(data[0:4]) != compressedMagic {
+		return errors.New("bitarray: not compressed bitarray data")
+	}
+
+	loaded := Compressed{nBits: binary.LittleEndian.Uint64(data[4:])}
+	nChunks := binary.LittleEndian.Uint32(data[12:])
+	if loaded.nBits % bpw != 0 || loaded.nBits / bpw > uint64(maxInt) {
+		return errors.New("bitarray: corrupt compressed header")
+	}
+	nWords := int(loaded.nBits / bpw)
+	maxKey := uint64((nWords + chunkWords - 1) / chunkWords)
+	if uint64(nChunks) > maxKey {
+		return errors.New("bitarray: corrupt compressed header")
+	}
+	data = data[compressedHeaderSize:]
+
+	for i := uint32(0); i < nChunks; i++ {
+		if len(data) < chunkHeaderSize {
+			return errCompressedTruncated
+		}
+		ct := container{key: binary.LittleEndian.Uint32(data), kind: data[4]}
+		data = data[chunkHeaderSize:]
+		if uint64(ct.key) >= maxKey || (i > 0 && ct.key <= loaded.chunks[i-1].key) {
+			return fmt.Errorf("bitarray: corrupt compressed chunk %d", i)
+		}
+		start, end := chunkSpan(nWords, ct.key)
+		chunkLen := uint64(end - start) * bpw
+
+		if ct.kind == kindBitmap {
+			if len(data) < 8 * (end - start) {
+				return errCompressedTruncated
+			}
+			ct.words = make([]uint64, end - start)
+			for j := range ct.words {
+				ct.words[j] = binary.LittleEndian.Uint64(data[j*8:])
+			}
+			data = data[8 * (end - start):]
+			loaded.chunks = append(loaded.chunks, ct)
+			continue
+		}
+
+		if len(data) < 2 {
+			return errCompressedTruncated
+		}
+		n := int(binary.LittleEndian.Uint16(data))
+		if ct.kind == kindRuns {
+			n *= 2
+		} else if ct.kind != kindArray {
+			return fmt.Errorf("bitarray: corrupt compressed chunk %d", i)
+		}
+		data = data[2:]
+		if n == 0 || len(data) < 2 * n {
+			return fmt.Errorf("bitarray: corrupt compressed chunk %d", i)
+		}
+		ct.vals = make([]uint16, n)
+		for j := range ct.vals {
+			ct.vals[j] = binary.LittleEndian.Uint16(data[j*2:])
+		}
+		data = data[2 * n:]
+
+		//strictly increasing within the chunk (runs may not overlap or touch out of order)
+		for j, v := range ct.vals {
+			ok := uint64(v) < chunkLen
+			if j > 0 {
+				if ct.kind == kindRuns && j % 2 == 1 {
+					ok = ok && v >= ct.vals[j-1]
+				} else {
+					ok = ok && v > ct.vals[j-1]
+				}
+			}
+			if !ok {
+				return fmt.Errorf("bitarray: corrupt compressed chunk %d", i)
+			}
+		}
+		loaded.chunks = append(loaded.chunks, ct)
+	}
+
+	if len(data) != 0 {
+		return errors.New("bitarray: trailing bytes after compressed data")
+	}
+	*c = loaded
+	return nil
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+/*
+Encode in the compressed form.  Implements encoding.BinaryMarshaler.
+*/
+func (ba BitArray) MarshalBinary() ([]byte, error) {
+	return Compress(ba).MarshalBinary()
+}
+
+/*
+The largest BitArray which BitArray.UnmarshalBinary will create (512MB).  A
+few bytes can describe a huge all-zero array, so the size is checked before
+anything is allocated.  Use UnmarshalBitArray for a different limit.
+*/
+const MaxUnmarshalBits = 1 << 32
+
+/*
+Decode the compressed form.  Implements encoding.BinaryUnmarshaler.  Fails
+if the array has more than MaxUnmarshalBits.  On error ba is unchanged.
+*/
+func (ba *BitArray) UnmarshalBinary(data []byte) error {
+	loaded, err := UnmarshalBitArray(data, MaxUnmarshalBits)
+	if err != nil {
+		return err
+	}
+	*ba = loaded
+	return nil
+}
+
+/*
+Decode the compressed form into a BitArray of at most maxBits bits.  The
+size is checked before the array is allocated.
+*/
+func UnmarshalBitArray(data []byte, maxBits uint64) (BitArray, error) {
+	var c Compressed
+	if err := c.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if c.nBits > maxBits {
+		return nil, fmt.Errorf("bitarray: compressed array has %d bits, more than the limit of %d", c.nBits, maxBits)
+	}
+	return c.Decompress(), nil
+}
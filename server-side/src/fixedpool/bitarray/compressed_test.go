@@ -0,0 +1,201 @@
+package bitarray
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"encoding/binary"
+	"math/rand"
+)
+
+//Arrays spanning several chunks, the last one short, with one density per chunk
+func compressedSamples(rng *rand.Rand) map[string]BitArray {
+	const nBits = chunkBits * 3 + 64 * 100
+	sparse := NewBitArray(nBits)
+	for i := 0; i < 300; i++ {
+		sparse.Set(uint64(rng.Intn(nBits)))
+	}
+	runs := NewBitArray(nBits)
+	for i := 0; i < 20; i++ {
+		a := uint64(rng.Intn(nBits))
+		runs.SetRange(a, a + uint64(rng.Intn(5000)))
+	}
+	full := NewBitArray(nBits)
+	full.SetRange(0, nBits)
+	mixed := randBitArray(rng, nBits)
+	//leave chunk 1 empty
+	mixed.ClearRange(chunkBits, 2 * chunkBits)
+
+	return map[string]BitArray{
+		"empty": NewBitArray(nBits),
+		"sparse": sparse,
+		"runs": runs,
+		"full": full,
+		"random": randBitArray(rng, nBits),
+		"mixed": mixed,
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(11))
+
+	for name, ba := range compressedSamples(rng) {
+		c := Compress(ba)
+		req.True(ba.Equal(c.Decompress()), name)
+		req.Equal(ba.Count(), c.Count(), name)
+		req.Equal(ba.NumBits(), c.NumBits(), name)
+		for i := 0; i < 2000; i++ {
+			bit := uint64(rng.Intn(int(ba.NumBits())))
+			req.Equal(ba.IsSet(bit), c.IsSet(bit), "%s bit %d", name, bit)
+		}
+
+		data, err := c.MarshalBinary()
+		req.NoError(err)
+		req.Equal(len(data), c.EncodedSize(), name)
+		req.Equal(len(data), EncodedSize(ba), name)
+
+		var loaded Compressed
+		req.NoError(loaded.UnmarshalBinary(data))
+		req.True(ba.Equal(loaded.Decompress()), name)
+
+		//via BitArray's own methods
+		data2, err := ba.MarshalBinary()
+		req.NoError(err)
+		req.Equal(data, data2)
+		var ba2 BitArray
+		req.NoError(ba2.UnmarshalBinary(data))
+		req.True(ba.Equal(ba2), name)
+	}
+}
+
+func TestCompressedContainerChoice(t *testing.T) {
+	req := require.New(t)
+
+	ba := NewBitArray(chunkBits * 3)
+	//chunk 0: a few scattered bits
+	ba.Set(5)
+	ba.Set(1000)
+	//chunk 1: one long run
+	ba.SetRange(chunkBits + 10, chunkBits + 50000)
+	//chunk 2: every other bit
+	for i := uint64(2 * chunkBits); i < 3 * chunkBits; i += 2 {
+		ba.Set(i)
+	}
+
+	c := Compress(ba)
+	req.Len(c.chunks, 3)
+	req.Equal(uint8(kindArray), c.chunks[0].kind)
+	req.Equal(uint8(kindRuns), c.chunks[1].kind)
+	req.Equal(uint8(kindBitmap), c.chunks[2].kind)
+
+	//far smaller than the 24KB raw array
+	req.Less(EncodedSize(ba), 8200 + 100)
+	req.Equal(16, EncodedSize(NewBitArray(chunkBits * 3)))
+}
+
+func TestCompressedOps(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(12))
+
+	samples := compressedSamples(rng)
+	check := func(op func(a, b *Compressed) *Compressed, rawOp func(dst, src BitArray)) {
+		for nameA, a := range samples {
+			for nameB, b := range samples {
+				want := a.Clone()
+				rawOp(want, b)
+				got := op(Compress(a), Compress(b))
+				req.True(want.Equal(got.Decompress()), "%s %s", nameA, nameB)
+				//results are canonical: the same as compressing the raw result
+				req.Equal(EncodedSize(want), got.EncodedSize(), "%s %s", nameA, nameB)
+			}
+		}
+	}
+	check((*Compressed).And, BitArray.And)
+	check((*Compressed).Or, BitArray.Or)
+	check((*Compressed).AndNot, BitArray.AndNot)
+
+	req.Panics(func() {
+		Compress(NewBitArray(64)).And(Compress(NewBitArray(128)))
+	})
+}
+
+func TestCompressedCorrupt(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(13))
+
+	samples := compressedSamples(rng)
+	ba := samples["mixed"]
+	ba.Or(samples["sparse"])
+	ba.Or(samples["runs"])
+	data, err := ba.MarshalBinary()
+	req.NoError(err)
+
+	//every truncation is rejected and leaves the target unchanged
+	orig := Compress(NewBitArray(64))
+	for n := 0; n < len(data); n += 1 + n / 50 {
+		c := *orig
+		req.Error(c.UnmarshalBinary(data[:n]), "length %d", n)
+		req.Equal(*orig, c)
+	}
+	req.Error(new(Compressed).UnmarshalBinary(append(data, 0)))
+
+	corrupt := func(offset int, b byte) error {
+		bad := append([]byte(nil), data...)
+		bad[offset] = b
+		return new(Compressed).UnmarshalBinary(bad)
+	}
+	//magic
+	req.Error(corrupt(0, 'X'))
+	//NumBits not a multiple of 64
+	req.Error(corrupt(4, data[4] + 1))
+	//kind of the first chunk
+	req.Error(corrupt(compressedHeaderSize + 4, 9))
+
+	//unsorted array positions
+	sparse := NewBitArray(chunkBits)
+	sparse.Set(3)
+	sparse.Set(9)
+	data, err = sparse.MarshalBinary()
+	req.NoError(err)
+	data[len(data) - 2] = 1
+	req.Error(new(Compressed).UnmarshalBinary(data))
+}
+
+//A tiny input describing a huge empty array is refused before it is allocated
+func TestUnmarshalLimit(t *testing.T) {
+	req := require.New(t)
+
+	data, err := Compress(NewBitArray(1000)).MarshalBinary()
+	req.NoError(err)
+	binary.LittleEndian.PutUint64(data[4:], 1 << 40)
+	req.Len(data, compressedHeaderSize)
+	var c Compressed
+	req.NoError(c.UnmarshalBinary(data))
+	req.Equal(uint64(1 << 40), c.NumBits())
+
+	ba := NewBitArray(64)
+	ba.Set(5)
+	req.ErrorContains(ba.UnmarshalBinary(data), "more than the limit")
+	req.Equal(uint64(64), ba.NumBits())
+	req.True(ba.IsSet(5))
+
+	binary.LittleEndian.PutUint64(data[4:], 128)
+	_, err = UnmarshalBitArray(data, 64)
+	req.Error(err)
+	loaded, err := UnmarshalBitArray(data, 128)
+	req.NoError(err)
+	req.Equal(uint64(128), loaded.NumBits())
+}
+
+//Bitmap containers are capped at the raw size, so compression never costs much
+func TestCompressedWorstCase(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(14))
+
+	ba := NewBitArray(chunkBits * 4)
+	for i := range ba {
+		ba[i] = rng.Uint64()
+	}
+	raw := 8 * len(ba)
+	req.LessOrEqual(EncodedSize(ba), raw + compressedHeaderSize + 4 * chunkHeaderSize)
+}
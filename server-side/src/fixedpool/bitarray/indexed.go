@@ -0,0 +1,241 @@
+package bitarray
+
+import (
+	"math/bits"
+)
+
+/*
+A BitArray with a summary index so that FindZero stays fast when the array is
+huge and nearly full.
+
+Level 1 has one bit per word of the array, set when that word has a zero.
+Arrays of more than l2MinWords words get a level 2 with one bit per word
+of level 1, set when that level 1 word has any bit set.  FindZero skips 64
+words per level 1 bit test and 4096 per level 2 bit test, so on 100M bits it
+reads a few hundred words at most instead of 1.5M.
+
+The index is kept up to date by every method.  Code which modifies the
+words returned by Bits directly must call Rebuild afterwards.
+*/
+type IndexedBitArray struct {
+	bits BitArray
+	l1 BitArray
+	//nil for small arrays
+	l2 BitArray
+}
+
+//Arrays with more words than this get a level 2 summary
+const l2MinWords = 8 * bpw
+
+/*
+Allocate a new IndexedBitArray.  nBits will be rounded up to a multiple of 64.
+All bits start at 0 (false).
+*/
+func NewIndexedBitArray(nBits uint64) IndexedBitArray {
+	return NewIndexedFrom(NewBitArray(nBits))
+}
+
+/*
+Build an index over existing words.  The IndexedBitArray takes ownership of ba.
+*/
+func NewIndexedFrom(ba BitArray) IndexedBitArray {
+	iba := IndexedBitArray{
+		bits: ba,
+		l1: NewBitArray(uint64(len(ba))),
+	}
+	if len(ba) > l2MinWords {
+		iba.l2 = NewBitArray(uint64(len(iba.l1)))
+	}
+	iba.Rebuild()
+	return iba
+}
+
+/*
+The underlying words.  Read only, unless followed by Rebuild.
+*/
+func (iba *IndexedBitArray) Bits() BitArray {
+	return iba.bits
+}
+
+//Recompute the summary levels from the words
+func (iba *IndexedBitArray) Rebuild() {
+	iba.l1.ClearAll()
+	for i, word := range iba.bits {
+		if word != allFF {
+			iba.l1.Set(uint64(i))
+		}
+	}
+	if iba.l2 != nil {
+		iba.l2.ClearAll()
+		for i, word := range iba.l1 {
+			if word != 0 {
+				iba.l2.Set(uint64(i))
+			}
+		}
+	}
+}
+
+//Total number of bits
+func (iba *IndexedBitArray) NumBits() uint64 {
+	return iba.bits.NumBits()
+}
+
+func (iba *IndexedBitArray) IsSet(bitIndex uint64) bool {
+	return iba.bits.IsSet(bitIndex)
+}
+
+//The word at wordIndex became full
+func (iba *IndexedBitArray) wordFull(wordIndex uint64) {
+	l1Index, l1Mask := index2pos(wordIndex)
+	iba.l1[l1Index] &^= l1Mask
+	if iba.l2 != nil && iba.l1[l1Index] == 0 {
+		iba.l2.Clear(l1Index)
+	}
+}
+
+//The word at wordIndex has a zero
+func (iba *IndexedBitArray) wordHasZero(wordIndex uint64) {
+	l1Index, l1Mask := index2pos(wordIndex)
+	iba.l1[l1Index] |= l1Mask
+	if iba.l2 != nil {
+		iba.l2.Set(l1Index)
+	}
+}
+
+/*Set a bit to 1 (true)*/
+func (iba *IndexedBitArray) Set(bitIndex uint64) {
+	wordIndex, bitMask := index2pos(bitIndex)
+	word := iba.bits[wordIndex] | bitMask
+	iba.bits[wordIndex] = word
+	if word == allFF {
+		iba.wordFull(wordIndex)
+	}
+}
+
+/*Set a bit to 0 (false)*/
+func (iba *IndexedBitArray) Clear(bitIndex uint64) {
+	wordIndex, bitMask := index2pos(bitIndex)
+	iba.bits[wordIndex] &^= bitMask
+	iba.wordHasZero(wordIndex)
+}
+
+/*Set a bit to 0 but return false if the bit was already zero*/
+func (iba *IndexedBitArray) ClearIfSet(bitIndex uint64) bool {
+	wordIndex, bitMask := index2pos(bitIndex)
+	if (iba.bits[wordIndex] & bitMask) == 0 {
+		return false
+	}
+	iba.bits[wordIndex] &^= bitMask
+	iba.wordHasZero(wordIndex)
+	return true
+}
+
+//Set all bits to 0
+func (iba *IndexedBitArray) ClearAll() {
+	iba.bits.ClearAll()
+	iba.Rebuild()
+}
+
+//Set all bits to 1 (true)
+func (iba *IndexedBitArray) SetAll() {
+	iba.bits.SetAll()
+	iba.Rebuild()
+}
+
+//Set the last N bits to 1.  N cannot exceed NumBits.
+func (iba *IndexedBitArray) SetLastN(n uint64) {
+	iba.SetRange(iba.NumBits() - n, iba.NumBits())
+}
+
+//Set bits [a, b) to 1.  b is clamped to NumBits.
+func (iba *IndexedBitArray) SetRange(a, b uint64) {
+	iba.bits.SetRange(a, b)
+	iba.reindexRange(a, b)
+}
+
+//Set bits [a, b) to 0.  b is clamped to NumBits.
+func (iba *IndexedBitArray) ClearRange(a, b uint64) {
+	iba.bits.ClearRange(a, b)
+	iba.reindexRange(a, b)
+}
+
+//Update the summary for the words holding bits [a, b)
+func (iba *IndexedBitArray) reindexRange(a, b uint64) {
+	if b > iba.NumBits() {
+		b = iba.NumBits()
+	}
+	if a >= b {
+		return
+	}
+	for wordIndex := a >> bpwShift; wordIndex <= (b - 1) >> bpwShift; wordIndex++ {
+		if iba.bits[wordIndex] == allFF {
+			iba.wordFull(wordIndex)
+		} else {
+			iba.wordHasZero(wordIndex)
+		}
+	}
+}
+
+/*
+Index of the first set bit in level 1 in [from, end), or NotFound.  Uses
+level 2 (when present) to skip empty level 1 words.
+*/
+func (iba *IndexedBitArray) nextL1(from, end uint64) uint64 {
+	if from >= end {
+		return NotFound
+	}
+
+	l1Index, _ := index2pos(from)
+	//bits at or after from in its word
+	word := iba.l1[l1Index] & (allFF << (from & (bpw - 1)))
+
+	for word == 0 {
+		l1Index++
+		if l1Index >= uint64(len(iba.l1)) {
+			return NotFound
+		}
+		if iba.l2 != nil {
+			//jump straight to the next non-empty level 1 word
+			l1Index = iba.l2.NextSet(l1Index)
+			if l1Index == NotFound {
+				return NotFound
+			}
+		}
+		word = iba.l1[l1Index]
+	}
+
+	found := l1Index << bpwShift + uint64(bits.TrailingZeros64(word))
+	if found >= end {
+		return NotFound
+	}
+	return found
+}
+
+/*
+Same as BitArray.FindZero (including the wrap around and the preference for
+the hinted bit) but the search uses the summary index.
+*/
+func (iba *IndexedBitArray) FindZero(fromHint uint64) uint64 {
+	startIndex, startMask := index2pos(fromHint)
+	nWords := uint64(len(iba.bits))
+
+	//check the hinted bit (big speedup for sequential allocation)
+	if startIndex < nWords && (iba.bits[startIndex] & startMask) == 0 {
+		return fromHint
+	}
+
+	if startIndex > nWords {
+		startIndex = nWords
+	}
+
+	wordIndex := iba.nextL1(startIndex, nWords)
+	if wordIndex == NotFound {
+		//wrap around
+		wordIndex = iba.nextL1(0, startIndex)
+		if wordIndex == NotFound {
+			return NotFound
+		}
+	}
+
+	return wordIndex * bpw + findZeroBit(iba.bits[wordIndex])
+}
@@ -0,0 +1,147 @@
+package bitarray
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+)
+
+func TestFindZeroBit(t *testing.T) {
+	req := require.New(t)
+
+	req.Equal(uint64(0), findZeroBit(0))
+	req.Equal(uint64(3), findZeroBit(7))
+	req.Equal(uint64(63), findZeroBit(allFF >> 1))
+	req.Equal(uint64(bpw), findZeroBit(allFF))
+}
+
+//Check the summary levels against the words
+func checkIndex(req *require.Assertions, iba *IndexedBitArray) {
+	for i, word := range iba.bits {
+		req.Equal(word != allFF, iba.l1.IsSet(uint64(i)), "word %d", i)
+	}
+	if iba.l2 != nil {
+		for i, word := range iba.l1 {
+			req.Equal(word != 0, iba.l2.IsSet(uint64(i)), "l1 word %d", i)
+		}
+	}
+}
+
+func TestIndexedFind(t *testing.T) {
+	req := require.New(t)
+
+	iba := NewIndexedBitArray(192)
+	req.Nil(iba.l2)
+	n := iba.NumBits()
+
+	req.Equal(uint64(0), iba.FindZero(0))
+	req.Equal(uint64(191), iba.FindZero(191))
+	req.Equal(uint64(0), iba.FindZero(999))  //wrapped
+
+	iba.SetAll()
+	req.Equal(uint64(NotFound), iba.FindZero(0))
+	iba.Clear(99)
+	req.Equal(uint64(99), iba.FindZero(0))
+	req.Equal(uint64(99), iba.FindZero(180))
+	iba.Set(99)
+	checkIndex(req, &iba)
+
+	//Try finding every bit
+	var i uint64
+	for i = 0; i < n; i++ {
+		iba.Clear(i)
+		req.Equal(i, iba.FindZero(0))
+		if i > 3 {
+			req.Equal(i, iba.FindZero(i-3))
+		}
+		req.Equal(i, iba.FindZero(i+3))
+		req.True(iba.ClearIfSet(i) == false)
+		iba.Set(i)
+	}
+
+	iba.ClearAll()
+	iba.SetLastN(64)
+	checkIndex(req, &iba)
+	req.Equal(uint64(0), iba.FindZero(150))
+}
+
+//Compare against BitArray.FindZero on arrays with a level 2 summary
+func TestIndexedRandom(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(7))
+
+	for _, nBits := range []uint64{64, 640, (l2MinWords + 1) * 64, 300000} {
+		iba := NewIndexedBitArray(nBits)
+		plain := NewBitArray(nBits)
+		req.Equal(nBits > l2MinWords * 64, iba.l2 != nil)
+
+		iba.SetAll()
+		plain.SetAll()
+
+		for i := 0; i < 20000; i++ {
+			bit := uint64(rng.Int63n(int64(nBits)))
+			switch rng.Intn(4) {
+			case 0:
+				iba.Set(bit)
+				plain.Set(bit)
+			case 1:
+				req.Equal(plain.ClearIfSet(bit), iba.ClearIfSet(bit))
+			default:
+				//mostly full: clear rarely, find often
+				if rng.Intn(8) == 0 {
+					iba.Clear(bit)
+					plain.Clear(bit)
+				}
+				req.Equal(plain.FindZero(bit), iba.FindZero(bit))
+			}
+		}
+		checkIndex(req, &iba)
+
+		rebuilt := NewIndexedFrom(append(BitArray{}, iba.Bits()...))
+		req.Equal(iba.l1, rebuilt.l1)
+		req.Equal(iba.l2, rebuilt.l2)
+	}
+}
+
+const benchBits = 100 * 1000 * 1000
+
+/*
+A 99% full array whose free bits are clustered in one region, as in a pool
+where a range of blocks was freed together.  A linear scan from a random
+hint walks half the array on average.
+*/
+func nearlyFull() BitArray {
+	ba := NewBitArray(benchBits)
+	ba.SetAll()
+	start := uint64(benchBits / 2)
+	for i := start; i < start + benchBits / 100; i++ {
+		ba.Clear(i)
+	}
+	return ba
+}
+
+func benchFind(b *testing.B, find func(uint64) uint64) {
+	rng := rand.New(rand.NewSource(1))
+	hints := make([]uint64, 1024)
+	for i := range hints {
+		//hints in the full region after the free cluster, so the search must wrap around
+		hints[i] = benchBits * 52 / 100 + uint64(rng.Int63n(benchBits * 47 / 100))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if find(hints[i & 1023]) == NotFound {
+			b.Fatal("not found")
+		}
+	}
+}
+
+func Benchmark_findZeroLinear(b *testing.B) {
+	ba := nearlyFull()
+	benchFind(b, ba.FindZero)
+}
+
+func Benchmark_findZeroIndexed(b *testing.B) {
+	iba := NewIndexedFrom(nearlyFull())
+	benchFind(b, iba.FindZero)
+}
@@ -0,0 +1,225 @@
+package bitarray
+
+import (
+	"math/bits"
+	"sort"
+)
+
+//Number of bits set to 1
+func (ba BitArray) Count() uint64 {
+	var n uint64
+	for _, word := range ba {
+		n += uint64(bits.OnesCount64(word))
+	}
+	return n
+}
+
+/*
+Number of bits set to 1 in [a, b).  b is clamped to NumBits.
+*/
+func (ba BitArray) CountRange(a, b uint64) uint64 {
+	if b > ba.NumBits() {
+		b = ba.NumBits()
+	}
+	if a >= b {
+		return 0
+	}
+
+	aWord, bWord := a >> bpwShift, b >> bpwShift
+	//bits of the first word at or after a
+	first := ba[aWord] & (allFF << (a & (bpw - 1)))
+	if aWord == bWord {
+		//a and b in the same word
+		return uint64(bits.OnesCount64(first &^ (allFF << (b & (bpw - 1)))))
+	}
+
+	n := uint64(bits.OnesCount64(first))
+	for _, word := range ba[aWord+1:bWord] {
+		n += uint64(bits.OnesCount64(word))
+	}
+	if b & (bpw - 1) != 0 {
+		n += uint64(bits.OnesCount64(ba[bWord] &^ (allFF << (b & (bpw - 1)))))
+	}
+	return n
+}
+
+/*
+Number of bits set to 1 before bit i, ie in [0, i).  Linear; see RankDirectory.
+*/
+func (ba BitArray) Rank(i uint64) uint64 {
+	return ba.CountRange(0, i)
+}
+
+/*
+Index of the k'th set bit (counting from 0), or NotFound if fewer than k+1
+bits are set.  Linear; see RankDirectory.
+*/
+func (ba BitArray) Select(k uint64) uint64 {
+	return selectFrom(ba, 0, k)
+}
+
+//Select starting at word wordIndex
+func selectFrom(ba BitArray, wordIndex int, k uint64) uint64 {
+	for ; wordIndex < len(ba); wordIndex++ {
+		n := uint64(bits.OnesCount64(ba[wordIndex]))
+		if k < n {
+			return uint64(wordIndex) << bpwShift + selectInWord(ba[wordIndex], k)
+		}
+		k -= n
+	}
+	return NotFound
+}
+
+//Position of the k'th set bit in word.  k must be less than the word's popcount.
+func selectInWord(word uint64, k uint64) uint64 {
+	//narrow down by halves then drop the lowest set bits
+	var base uint64
+	for _, width := range []uint{32, 16, 8} {
+		low := word & (uint64(1) << width - 1)
+		if n := uint64(bits.OnesCount64(low)); k >= n {
+			k -= n
+			word >>= width
+			base += uint64(width)
+		} else {
+			word = low
+		}
+	}
+	for ; k > 0; k-- {
+		word &= word - 1
+	}
+	return base + uint64(bits.TrailingZeros64(word))
+}
+
+/*
+Index of the first bit set to 1 at or after from, or NotFound.
+*/
+func (ba BitArray) NextSet(from uint64) uint64 {
+	wordIndex := from >> bpwShift
+	if wordIndex >= uint64(len(ba)) {
+		return NotFound
+	}
+	word := ba[wordIndex] & (allFF << (from & (bpw - 1)))
+	for word == 0 {
+		wordIndex++
+		if wordIndex >= uint64(len(ba)) {
+			return NotFound
+		}
+		word = ba[wordIndex]
+	}
+	return wordIndex << bpwShift + uint64(bits.TrailingZeros64(word))
+}
+
+/*
+Index of the first bit set to 0 at or after from, or NotFound.  Unlike
+FindZero this never wraps around.
+*/
+func (ba BitArray) NextZero(from uint64) uint64 {
+	wordIndex := from >> bpwShift
+	if wordIndex >= uint64(len(ba)) {
+		return NotFound
+	}
+	word := ^ba[wordIndex] & (allFF << (from & (bpw - 1)))
+	for word == 0 {
+		wordIndex++
+		if wordIndex >= uint64(len(ba)) {
+			return NotFound
+		}
+		word = ^ba[wordIndex]
+	}
+	return wordIndex << bpwShift + uint64(bits.TrailingZeros64(word))
+}
+
+/*
+Call fn with the index of each bit set to 1, in order, until it returns false.
+Zero words are skipped 64 bits at a time.
+*/
+func (ba BitArray) ForEachSet(fn func(i uint64) bool) {
+	for wordIndex, word := range ba {
+		for word != 0 {
+			bit := uint64(bits.TrailingZeros64(word))
+			word &= word - 1
+			if !fn(uint64(wordIndex) << bpwShift + bit) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Sampled counts which make Rank and Select fast on large arrays.  Every
+sampleWords words the directory stores the number of set bits before that
+point, so Rank reads at most sampleWords words and Select does a binary search
+over the samples first.  With the default of 8 words the directory adds 1/8 to
+the size of the array.
+
+The directory describes the array at the time it was built.  Rebuild it after
+the array changes.
+*/
+type RankDirectory struct {
+	ba BitArray
+	sampleWords int
+	//samples[i] = number of set bits in words [0, i*sampleWords)
+	samples []uint64
+}
+
+const DefaultRankSampleWords = 8
+
+/*
+Build a directory over ba.  sampleWords <= 0 uses DefaultRankSampleWords.
+*/
+func NewRankDirectory(ba BitArray, sampleWords int) *RankDirectory {
+	if sampleWords <= 0 {
+		sampleWords = DefaultRankSampleWords
+	}
+	rd := &RankDirectory{
+		ba: ba,
+		sampleWords: sampleWords,
+		samples: make([]uint64, (len(ba) + sampleWords - 1) / sampleWords + 1),
+	}
+	rd.Rebuild()
+	return rd
+}
+
+//Recount after the array has changed
+func (rd *RankDirectory) Rebuild() {
+	var n uint64
+	for i := range rd.samples {
+		rd.samples[i] = n
+		start := i * rd.sampleWords
+		end := start + rd.sampleWords
+		if end > len(rd.ba) {
+			end = len(rd.ba)
+		}
+		for _, word := range rd.ba[min(start, end):end] {
+			n += uint64(bits.OnesCount64(word))
+		}
+	}
+}
+
+//Total number of set bits
+func (rd *RankDirectory) Count() uint64 {
+	return rd.samples[len(rd.samples) - 1]
+}
+
+//Same as BitArray.Rank
+func (rd *RankDirectory) Rank(i uint64) uint64 {
+	if i >= rd.ba.NumBits() {
+		return rd.Count()
+	}
+	wordIndex := i >> bpwShift
+	sample := int(wordIndex) / rd.sampleWords
+	start := uint64(sample * rd.sampleWords) << bpwShift
+	return rd.samples[sample] + rd.ba.CountRange(start, i)
+}
+
+//Same as BitArray.Select
+func (rd *RankDirectory) Select(k uint64) uint64 {
+	if k >= rd.Count() {
+		return NotFound
+	}
+	//last sample with fewer than k+1 bits before it
+	sample := sort.Search(len(rd.samples), func(i int) bool {
+		return rd.samples[i] > k
+	}) - 1
+	return selectFrom(rd.ba, sample * rd.sampleWords, k - rd.samples[sample])
+}
@@ -0,0 +1,214 @@
+package bitarray
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+)
+
+func randBitArray(rng *rand.Rand, nBits uint64) BitArray {
+	ba := NewBitArray(nBits)
+	for i := range ba {
+		//mix dense, sparse and empty words
+		switch rng.Intn(4) {
+		case 0:
+		case 1:
+			ba[i] = rng.Uint64()
+		case 2:
+			ba[i] = rng.Uint64() & rng.Uint64() & rng.Uint64()
+		case 3:
+			ba[i] = allFF
+		}
+	}
+	return ba
+}
+
+func TestCountAndIterate(t *testing.T) {
+	req := require.New(t)
+
+	ba := NewBitArray(192)
+	req.Equal(uint64(0), ba.Count())
+	req.Equal(uint64(NotFound), ba.NextSet(0))
+	req.Equal(uint64(5), ba.NextZero(5))
+	req.Equal(uint64(NotFound), ba.Select(0))
+
+	for _, i := range []uint64{0, 5, 63, 64, 130, 191} {
+		ba.Set(i)
+	}
+	req.Equal(uint64(6), ba.Count())
+	req.Equal(uint64(4), ba.CountRange(5, 131))
+	req.Equal(uint64(3), ba.CountRange(5, 130))
+	req.Equal(uint64(1), ba.CountRange(63, 64))
+	req.Equal(uint64(0), ba.CountRange(6, 63))
+	req.Equal(uint64(6), ba.CountRange(0, 9999))
+	req.Equal(uint64(0), ba.CountRange(100, 50))
+
+	req.Equal(uint64(0), ba.Rank(0))
+	req.Equal(uint64(1), ba.Rank(1))
+	req.Equal(uint64(3), ba.Rank(64))
+	req.Equal(uint64(64), ba.Select(3))
+	req.Equal(uint64(191), ba.Select(5))
+	req.Equal(uint64(NotFound), ba.Select(6))
+
+	req.Equal(uint64(5), ba.NextSet(1))
+	req.Equal(uint64(130), ba.NextSet(65))
+	req.Equal(uint64(NotFound), ba.NextSet(192))
+	req.Equal(uint64(65), ba.NextZero(63))
+
+	var got []uint64
+	ba.ForEachSet(func(i uint64) bool {
+		got = append(got, i)
+		return true
+	})
+	req.Equal([]uint64{0, 5, 63, 64, 130, 191}, got)
+
+	got = nil
+	ba.ForEachSet(func(i uint64) bool {
+		got = append(got, i)
+		return len(got) < 2
+	})
+	req.Equal([]uint64{0, 5}, got)
+
+	ba.SetAll()
+	req.Equal(uint64(NotFound), ba.NextZero(0))
+}
+
+func TestSelectInWord(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 1000; i++ {
+		word := rng.Uint64()
+		k := uint64(0)
+		for bit := uint64(0); bit < 64; bit++ {
+			if word & (uint64(1) << bit) != 0 {
+				req.Equal(bit, selectInWord(word, k))
+				k++
+			}
+		}
+	}
+}
+
+//Compare everything against bit by bit answers
+func TestRankSelectRandom(t *testing.T) {
+	req := require.New(t)
+	rng := rand.New(rand.NewSource(4))
+
+	for _, nBits := range []uint64{64, 1000, 64 * 8, 64 * 8 + 1, 50000} {
+		ba := randBitArray(rng, nBits)
+		for _, sampleWords := range []int{0, 1, 3} {
+			rd := NewRankDirectory(ba, sampleWords)
+			req.Equal(ba.Count(), rd.Count())
+
+			var rank uint64
+			for i := uint64(0); i < ba.NumBits(); i++ {
+				req.Equal(rank, rd.Rank(i))
+				if ba.IsSet(i) {
+					req.Equal(i, rd.Select(rank))
+					rank++
+				}
+			}
+			req.Equal(rank, rd.Rank(ba.NumBits()))
+			req.Equal(uint64(NotFound), rd.Select(rank))
+		}
+
+		for i := 0; i < 200; i++ {
+			a := uint64(rng.Int63n(int64(ba.NumBits())))
+			b := uint64(rng.Int63n(int64(ba.NumBits())))
+			var want uint64
+			for j := a; j < b; j++ {
+				if ba.IsSet(j) {
+					want++
+				}
+			}
+			req.Equal(want, ba.CountRange(a, b))
+
+			next := a
+			for next < ba.NumBits() && !ba.IsSet(next) {
+				next++
+			}
+			if next == ba.NumBits() {
+				next = NotFound
+			}
+			req.Equal(next, ba.NextSet(a))
+
+			next = a
+			for next < ba.NumBits() && ba.IsSet(next) {
+				next++
+			}
+			if next == ba.NumBits() {
+				next = NotFound
+			}
+			req.Equal(next, ba.NextZero(a))
+		}
+	}
+}
+
+const bigBits = 1000 * 1000 * 1000
+
+var bigArray BitArray
+var bigDirectory *RankDirectory
+
+//1e9 random bits (125MB) shared by the benchmarks
+func big() (BitArray, *RankDirectory) {
+	if bigArray == nil {
+		rng := rand.New(rand.NewSource(1))
+		bigArray = NewBitArray(bigBits)
+		for i := range bigArray {
+			bigArray[i] = rng.Uint64()
+		}
+		bigDirectory = NewRankDirectory(bigArray, 0)
+	}
+	return bigArray, bigDirectory
+}
+
+func Benchmark_rank(b *testing.B) {
+	_, rd := big()
+	rng := rand.New(rand.NewSource(2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rd.Rank(uint64(rng.Int63n(bigBits)))
+	}
+}
+
+func Benchmark_select(b *testing.B) {
+	_, rd := big()
+	rng := rand.New(rand.NewSource(2))
+	n := int64(rd.Count())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rd.Select(uint64(rng.Int63n(n)))
+	}
+}
+
+//Without the directory, for comparison
+func Benchmark_rankLinear(b *testing.B) {
+	ba, _ := big()
+	rng := rand.New(rand.NewSource(2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ba.Rank(uint64(rng.Int63n(bigBits)))
+	}
+}
+
+func Benchmark_count(b *testing.B) {
+	ba, _ := big()
+	b.SetBytes(bigBits / 8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ba.Count()
+	}
+}
+
+func Benchmark_forEachSet(b *testing.B) {
+	ba, _ := big()
+	b.SetBytes(bigBits / 8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n uint64
+		ba.ForEachSet(func(uint64) bool {
+			n++
+			return true
+		})
+	}
+}
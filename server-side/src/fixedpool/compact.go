@@ -0,0 +1,200 @@
+package fixedpool
+
+import (
+	"fixedpool/bitarray"
+	"sort"
+)
+
+/*
+What Compact did, or (from CompactDryRun) would do.
+*/
+type CompactReport struct {
+	//blocks in use (unchanged by compaction)
+	LiveBlocks int
+	//blocks which must be relocated
+	Moves int
+	//blocks released from the backing memory
+	BlocksReclaimed int
+	BytesReclaimed int64
+}
+
+/*
+Report what Compact(numBlocks, ...) would do without changing anything.
+*/
+func (pool *Pool) CompactDryRun(numBlocks int) CompactReport {
+	keep := pool.compactSize(numBlocks)
+	moves := 0
+	for index := uint64(keep); index < uint64(pool.NumBlocks()); index++ {
+		if pool.allocMask.IsSet(index) {
+			moves++
+		}
+	}
+
+	reclaimed := pool.NumBlocks() - keep
+	return CompactReport{
+		LiveBlocks: pool.nUsed,
+		Moves: moves,
+		BlocksReclaimed: reclaimed,
+		BytesReclaimed: int64(reclaimed) * int64(pool.blockSize),
+	}
+}
+
+/*
+The size Compact shrinks to: numBlocks, but no fewer than the blocks in use,
+never more than the pool has now, and at least one (see NewPool).
+*/
+func (pool *Pool) compactSize(numBlocks int) int {
+	return max(min(numBlocks, pool.NumBlocks()), pool.nUsed, 1)
+}
+
+/*
+Move every live block into the lowest indices then shrink the pool to
+numBlocks blocks, releasing the rest of its memory.  numBlocks is raised to
+NumUsed if it is smaller, so Compact(0, ...) gives the tightest fit; the
+pool is then full and Alloc returns Zero until something is freed.  Leave
+headroom (eg NumUsed plus the expected growth) for a pool which will keep
+being used.
+
+relocate is called once for each block that moved, after its contents have
+been copied, so the owner can rewrite its pointer.  Calls are in increasing
+order of oldPtr.  The old Ptr must not be used again.  Pointers to blocks
+which did not move remain valid.
+*/
+func (pool *Pool) Compact(numBlocks int, relocate func(oldPtr, newPtr Ptr)) CompactReport {
+	report := pool.CompactDryRun(numBlocks)
+	keep := uint64(pool.compactSize(numBlocks))
+	numBlocksNow := uint64(pool.NumBlocks())
+
+	//Every live block at or beyond keep moves into a hole below keep.
+	// There are at least as many holes as such blocks.
+	var hole uint64
+	for index := keep; index < numBlocksNow; index++ {
+		if !pool.allocMask.IsSet(index) {
+			continue
+		}
+
+		hole = pool.allocMask.FindZero(hole)
+		oldPtr := pool.encodePtr(index)
+		copy(pool.block(hole), pool.block(index))
+		pool.allocMask.Set(hole)
+		pool.allocMask.Clear(index)
+		relocate(oldPtr, pool.encodePtr(hole))
+	}
+
+	//Shrink.  Copy so the old backing array can be collected.
+	data := make([]byte, keep * uint64(pool.blockSize))
+	copy(data, pool.data)
+	pool.data = data
+
+	allocMask := bitarray.NewIndexedBitArray(keep)
+	for index := uint64(0); index < keep; index++ {
+		if pool.allocMask.IsSet(index) {
+			allocMask.Set(index)
+		}
+	}
+	allocMask.SetLastN(allocMask.NumBits() - keep)
+	pool.allocMask = allocMask
+	pool.nextAllocIndex = 0
+
+	if pool.debug != nil && pool.debug.gens != nil {
+		gens := make([]uint8, keep)
+		copy(gens, pool.debug.gens)
+		pool.debug.gens = gens
+	}
+
+	return report
+}
+
+/*
+Report what Compact would do without changing anything.
+*/
+func (sp *SlabPool) CompactDryRun() CompactReport {
+	keepSlabs := sp.compactSlabs()
+	report := CompactReport{LiveBlocks: sp.nUsed}
+	for _, slab := range sp.slabs[keepSlabs:] {
+		report.Moves += slab.NumUsed()
+		report.BlocksReclaimed += slab.NumBlocks()
+	}
+	report.BytesReclaimed = int64(report.BlocksReclaimed) * int64(sp.blockSize)
+	return report
+}
+
+//Number of slabs needed to hold the blocks in use
+func (sp *SlabPool) compactSlabs() int {
+	bps := sp.BlocksPerSlab()
+	return (sp.nUsed + bps - 1) / bps
+}
+
+/*
+Move live blocks out of the highest slabs into free blocks of the lower
+slabs, then release the emptied slabs.  Slabs are released whole; free
+blocks in the slabs which are kept remain available to Alloc.  The pool
+can grow again afterwards.
+
+relocate is called as for Pool.Compact, also in increasing order of oldPtr.
+*/
+func (sp *SlabPool) Compact(relocate func(oldPtr, newPtr Ptr)) CompactReport {
+	report := sp.CompactDryRun()
+	keepSlabs := sp.compactSlabs()
+
+	dest := 0
+	for slabIndex := keepSlabs; slabIndex < len(sp.slabs); slabIndex++ {
+		src := sp.slabs[slabIndex]
+		for index := uint64(0); src.NumUsed() > 0; index++ {
+			if !src.allocMask.IsSet(index) {
+				continue
+			}
+			local := src.encodePtr(index)
+
+			for sp.slabs[dest].NumFree() == 0 {
+				dest++
+			}
+			newLocal := sp.slabs[dest].Alloc()
+			copy(sp.slabs[dest].Get(newLocal), src.Get(local))
+			src.Free(local)
+			relocate(sp.encode(slabIndex, local), sp.encode(dest, newLocal))
+		}
+	}
+
+	for i := keepSlabs; i < len(sp.slabs); i++ {
+		sp.slabs[i] = nil
+	}
+	sp.slabs = sp.slabs[:keepSlabs]
+	sp.allocSlab = 0
+
+	return report
+}
+
+/*
+The moves made by a Compact, for owners which cannot find the holder of a Ptr
+from the Ptr alone (eg a hash table whose pool blocks do not point back at
+their bucket).  Pass Record as the relocate callback, then walk every stored
+Ptr once and replace it with Lookup(ptr).  Costs 8 bytes per move.
+*/
+type Relocations struct {
+	oldPtrs []Ptr
+	newPtrs []Ptr
+}
+
+//Remember one move.  Moves must be recorded in increasing order of oldPtr, as Compact makes them.
+func (r *Relocations) Record(oldPtr, newPtr Ptr) {
+	if n := len(r.oldPtrs); n > 0 && oldPtr <= r.oldPtrs[n-1] {
+		panic("fixedpool.Relocations.Record: moves out of order")
+	}
+	r.oldPtrs = append(r.oldPtrs, oldPtr)
+	r.newPtrs = append(r.newPtrs, newPtr)
+}
+
+//Number of moves recorded
+func (r *Relocations) Len() int {
+	return len(r.oldPtrs)
+}
+
+//Where the block at ptr went, or ptr itself if it did not move
+func (r *Relocations) Lookup(ptr Ptr) Ptr {
+	i := sort.Search(len(r.oldPtrs), func(i int) bool { return r.oldPtrs[i] >= ptr })
+	if i == len(r.oldPtrs) || r.oldPtrs[i] != ptr {
+		return ptr
+	}
+	return r.newPtrs[i]
+}
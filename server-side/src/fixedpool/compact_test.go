@@ -0,0 +1,196 @@
+package fixedpool
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+)
+
+/*
+Allocate n blocks, each filled with its own id, free a random half and
+return the owners' view: Ptr -> id.
+*/
+func scatter(alloc func() Ptr, get func(Ptr) []byte, free func(Ptr), n int) map[Ptr]byte {
+	rng := rand.New(rand.NewSource(1))
+	owned := make(map[Ptr]byte)
+	for i := 0; i < n; i++ {
+		ptr := alloc()
+		id := byte(i)
+		for j := range get(ptr) {
+			get(ptr)[j] = id
+		}
+		owned[ptr] = id
+	}
+	for ptr := range owned {
+		if rng.Intn(2) == 0 {
+			free(ptr)
+			delete(owned, ptr)
+		}
+	}
+	return owned
+}
+
+func checkOwned(req *require.Assertions, get func(Ptr) []byte, owned map[Ptr]byte) {
+	for ptr, id := range owned {
+		for _, b := range get(ptr) {
+			req.Equal(id, b)
+		}
+	}
+}
+
+func TestPoolCompact(t *testing.T) {
+	req := require.New(t)
+
+	const nBlocks = 200
+	pool := NewPool(5, nBlocks)
+	owned := scatter(pool.Alloc, pool.Get, pool.Free, nBlocks)
+	nLive := len(owned)
+
+	dry := pool.CompactDryRun(0)
+	req.Equal(nLive, dry.LiveBlocks)
+	req.Equal(nBlocks - nLive, dry.BlocksReclaimed)
+	req.Equal(int64(5 * (nBlocks - nLive)), dry.BytesReclaimed)
+	req.True(dry.Moves > 0)
+	//dry run changes nothing
+	req.Equal(nBlocks, pool.NumBlocks())
+
+	moves := 0
+	report := pool.Compact(0, func(oldPtr, newPtr Ptr) {
+		req.True(int(oldPtr) > nLive)
+		req.True(int(newPtr) <= nLive)
+		id, ok := owned[oldPtr]
+		req.True(ok)
+		delete(owned, oldPtr)
+		owned[newPtr] = id
+		moves++
+	})
+	req.Equal(dry, report)
+	req.Equal(dry.Moves, moves)
+
+	req.Equal(nLive, pool.NumBlocks())
+	req.Equal(nLive, pool.NumUsed())
+	req.Equal(0, pool.NumFree())
+	req.Equal(Zero, pool.Alloc())
+	checkOwned(req, pool.Get, owned)
+
+	//still usable
+	for ptr := range owned {
+		pool.Free(ptr)
+	}
+	req.Equal(nLive, pool.NumFree())
+	req.NotEqual(Zero, pool.Alloc())
+}
+
+//With headroom the pool can keep allocating after compaction
+func TestPoolCompactHeadroom(t *testing.T) {
+	req := require.New(t)
+
+	pool := NewPool(5, 200)
+	owned := scatter(pool.Alloc, pool.Get, pool.Free, 200)
+	nLive := len(owned)
+	keep := nLive + 20
+
+	dry := pool.CompactDryRun(keep)
+	req.Equal(200 - keep, dry.BlocksReclaimed)
+	var relocs Relocations
+	report := pool.Compact(keep, relocs.Record)
+	req.Equal(dry, report)
+	req.Equal(report.Moves, relocs.Len())
+	moved := make(map[Ptr]byte)
+	for ptr, id := range owned {
+		newPtr := relocs.Lookup(ptr)
+		req.LessOrEqual(int(newPtr), keep)
+		moved[newPtr] = id
+	}
+	checkOwned(req, pool.Get, moved)
+
+	req.Equal(keep, pool.NumBlocks())
+	req.Equal(20, pool.NumFree())
+	for i := 0; i < 20; i++ {
+		ptr := pool.Alloc()
+		req.NotEqual(Zero, ptr)
+		_, taken := moved[ptr]
+		req.False(taken)
+		for _, b := range pool.Get(ptr) {
+			req.Equal(byte(0), b)
+		}
+	}
+	req.Equal(Zero, pool.Alloc())
+
+	//the size never grows and never drops below the blocks in use
+	req.Equal(0, pool.CompactDryRun(1000).BlocksReclaimed)
+	req.Equal(0, pool.CompactDryRun(0).BlocksReclaimed)
+}
+
+func TestRelocations(t *testing.T) {
+	req := require.New(t)
+
+	var relocs Relocations
+	relocs.Record(5, 1)
+	relocs.Record(9, 2)
+	req.Equal(Ptr(1), relocs.Lookup(5))
+	req.Equal(Ptr(2), relocs.Lookup(9))
+	req.Equal(Ptr(7), relocs.Lookup(7))
+	req.Equal(Ptr(10), relocs.Lookup(10))
+	req.Panics(func() { relocs.Record(9, 3) })
+}
+
+func TestPoolCompactEmpty(t *testing.T) {
+	req := require.New(t)
+
+	pool := NewPool(8, 100)
+	pool.Free(pool.Alloc())
+	report := pool.Compact(0, func(oldPtr, newPtr Ptr) {
+		t.Fatal("nothing to move")
+	})
+	req.Equal(99, report.BlocksReclaimed)
+	req.Equal(1, pool.NumBlocks())
+	req.Equal(Ptr(1), pool.Alloc())
+	req.Equal(Zero, pool.Alloc())
+}
+
+func TestPoolCompactDebug(t *testing.T) {
+	req := require.New(t)
+
+	pool := NewDebugPool(4, 50, DebugOptions{Poison: true, Generations: true})
+	owned := scatter(pool.Alloc, pool.Get, pool.Free, 50)
+	pool.Compact(0, func(oldPtr, newPtr Ptr) {
+		owned[newPtr] = owned[oldPtr]
+		delete(owned, oldPtr)
+	})
+	checkOwned(req, pool.Get, owned)
+	for ptr := range owned {
+		req.True(pool.IsAllocated(ptr))
+	}
+}
+
+func TestSlabPoolCompact(t *testing.T) {
+	req := require.New(t)
+
+	sp := NewSlabPool(6, 16, 0)
+	owned := scatter(sp.Alloc, sp.Get, sp.Free, 100)
+	nLive := len(owned)
+	req.Equal(7, sp.NumSlabs())
+
+	keepSlabs := (nLive + 15) / 16
+	dry := sp.CompactDryRun()
+	req.Equal(nLive, dry.LiveBlocks)
+	req.Equal((7 - keepSlabs) * 16, dry.BlocksReclaimed)
+
+	report := sp.Compact(func(oldPtr, newPtr Ptr) {
+		req.True(int(oldPtr) > keepSlabs * 16)
+		req.True(int(newPtr) <= keepSlabs * 16)
+		owned[newPtr] = owned[oldPtr]
+		delete(owned, oldPtr)
+	})
+	req.Equal(dry, report)
+	req.Equal(keepSlabs, sp.NumSlabs())
+	req.Equal(nLive, sp.NumUsed())
+	checkOwned(req, sp.Get, owned)
+
+	//grows again
+	for sp.NumUsed() < 100 {
+		req.NotEqual(Zero, sp.Alloc())
+	}
+	req.Equal(7, sp.NumSlabs())
+}
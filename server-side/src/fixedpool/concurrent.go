@@ -0,0 +1,250 @@
+package fixedpool
+
+import (
+	"fixedpool/bitarray"
+	"runtime"
+	"sync/atomic"
+)
+
+/*
+A fixed size block allocator which is safe for use by many goroutines.
+Blocks and Ptrs are the same as Pool.
+
+The allocation mask is divided into ranges.  Each goroutine allocates through
+its own PoolWorker which is assigned a home range, so goroutines usually claim
+bits in different words and rarely contend.  A bit is claimed with a
+compare-and-swap on its 64bit word.  When the home range is full the worker
+steals from the other ranges.  A freed block returns to the range which owns
+it, where its home worker (or any other) will find it again.
+
+Get is lock free and, like Pool.Get, only safe as long as each Ptr is
+accessed by one goroutine at a time.
+*/
+type ConcurrentPool struct {
+	blockSize int
+	numBlocks int
+	data []byte
+	//1 bit per block
+	allocMask bitarray.AtomicBitArray
+	//words of allocMask per range
+	rangeWords int
+	ranges []poolRange
+	//round robin assignment of home ranges to workers
+	nextHome atomic.Uint32
+}
+
+type poolRange struct {
+	//blocks in use in this range
+	nUsed atomic.Int64
+	//keep each counter in its own cache line
+	_ [56]byte
+}
+
+/*
+Allocates from a ConcurrentPool on behalf of one goroutine.  A PoolWorker
+must not be shared between goroutines.
+*/
+type PoolWorker struct {
+	pool *ConcurrentPool
+	home int
+	//word index to resume scanning from
+	cursor int
+}
+
+/*
+Create a pool of numBlocks blocks.  numRanges is the number of allocation
+ranges; pass 0 to use 4 per CPU.
+*/
+func NewConcurrentPool(blockSize, numBlocks, numRanges int) *ConcurrentPool {
+	if numBlocks <= 0 || blockSize <= 0 {
+		panic("NewConcurrentPool illegal arg")
+	}
+
+	allocMask := bitarray.NewAtomicBitArray(uint64(numBlocks))
+	//BitArray rounds up to a multiple of 64.  Mark these all allocated.
+	allocMask.SetLastN(allocMask.NumBits() - uint64(numBlocks))
+
+	nWords := len(allocMask)
+	if numRanges <= 0 {
+		numRanges = runtime.GOMAXPROCS(0) * 4
+	}
+	if numRanges > nWords {
+		numRanges = nWords
+	}
+	rangeWords := (nWords + numRanges - 1) / numRanges
+	numRanges = (nWords + rangeWords - 1) / rangeWords
+
+	return &ConcurrentPool{
+		blockSize: blockSize,
+		numBlocks: numBlocks,
+		data: make([]byte, numBlocks * blockSize),
+		allocMask: allocMask,
+		rangeWords: rangeWords,
+		ranges: make([]poolRange, numRanges),
+	}
+}
+
+func (cp *ConcurrentPool) NumBlocks() int {
+	return cp.numBlocks
+}
+
+func (cp *ConcurrentPool) BlockSize() int {
+	return cp.blockSize
+}
+
+func (cp *ConcurrentPool) NumRanges() int {
+	return len(cp.ranges)
+}
+
+/*
+Number of blocks in use.  Exact when no Alloc or Free is in progress.
+*/
+func (cp *ConcurrentPool) NumUsed() int {
+	var n int64
+	for i := range cp.ranges {
+		n += cp.ranges[i].nUsed.Load()
+	}
+	return int(n)
+}
+
+func (cp *ConcurrentPool) NumFree() int {
+	return cp.numBlocks - cp.NumUsed()
+}
+
+/*
+Create a worker for the calling goroutine.  Home ranges are handed out
+round robin.
+*/
+func (cp *ConcurrentPool) Worker() *PoolWorker {
+	home := int(cp.nextHome.Add(1) - 1) % len(cp.ranges)
+	return &PoolWorker{
+		pool: cp,
+		home: home,
+		cursor: home * cp.rangeWords,
+	}
+}
+
+/*
+Access the block at the given Ptr.  See Pool.Get.
+*/
+func (cp *ConcurrentPool) Get(ptr Ptr) []byte {
+	if ptr == Zero {
+		panic("fixedpool.ConcurrentPool.Get: zero ptr")
+	}
+	bs := uint32(cp.blockSize)
+	offset := (uint32(ptr) - 1) * bs
+	return cp.data[offset:offset+bs]
+}
+
+//True if the given Ptr is currently allocated
+func (cp *ConcurrentPool) IsAllocated(ptr Ptr) bool {
+	if ptr == Zero || int(ptr) > cp.numBlocks {
+		return false
+	}
+	return cp.allocMask.IsSet(uint64(ptr) - 1)
+}
+
+//Word range [start, end) of the given range
+func (cp *ConcurrentPool) rangeBounds(r int) (start, end int) {
+	start = r * cp.rangeWords
+	end = start + cp.rangeWords
+	if end > len(cp.allocMask) {
+		end = len(cp.allocMask)
+	}
+	return
+}
+
+/*
+Scan words [from, end) of range r for a free block.
+*/
+func (w *PoolWorker) scan(r, from, end int) Ptr {
+	cp := w.pool
+	if bit := cp.allocMask.FindZeroAndSetIn(from, end); bit != bitarray.NotFound {
+		cp.ranges[r].nUsed.Add(1)
+		return Ptr(bit + 1)
+	}
+	return Zero
+}
+
+/*
+Allocate one zeroed block.  Returns Zero if no free blocks.
+*/
+func (w *PoolWorker) Alloc() Ptr {
+	cp := w.pool
+	nRanges := len(cp.ranges)
+
+	//Home range first, then steal from the others.  Skip any which look full.
+	for i := 0; i < nRanges; i++ {
+		r := w.home + i
+		if r >= nRanges {
+			r -= nRanges
+		}
+		if cp.ranges[r].nUsed.Load() >= cp.rangeCapacity(r) {
+			continue
+		}
+
+		start, end := cp.rangeBounds(r)
+		if r != w.home {
+			if ptr := w.scan(r, start, end); ptr != Zero {
+				return ptr
+			}
+			continue
+		}
+
+		//Resume from the cursor then wrap to the start of the range
+		cursor := w.cursor
+		if cursor < start || cursor >= end {
+			cursor = start
+		}
+		if ptr := w.scan(r, cursor, end); ptr != Zero {
+			w.cursor = int((uint32(ptr) - 1) / 64)
+			return ptr
+		}
+		if ptr := w.scan(r, start, cursor); ptr != Zero {
+			w.cursor = int((uint32(ptr) - 1) / 64)
+			return ptr
+		}
+	}
+
+	return Zero
+}
+
+//Number of real blocks in range r (the last range excludes the padding bits)
+func (cp *ConcurrentPool) rangeCapacity(r int) int64 {
+	start, end := cp.rangeBounds(r)
+	n := (end - start) * 64
+	if end == len(cp.allocMask) {
+		n -= len(cp.allocMask) * 64 - cp.numBlocks
+	}
+	return int64(n)
+}
+
+/*
+Return a block to the pool.  Harmless to pass zero.  Safe to call from any
+goroutine.  Passing an already freed Ptr will panic.
+*/
+func (cp *ConcurrentPool) Free(ptr Ptr) {
+	if ptr == Zero {
+		return
+	}
+
+	index := uint64(ptr) - 1
+	if !cp.allocMask.IsSet(index) {
+		//checked before zeroing so a double free does not wipe another goroutine's block
+		panic("fixedpool.ConcurrentPool.Free: already freed")
+	}
+
+	//Clear it to zero so that it's ready for reallocation.
+	//Must happen before the bit is cleared, after which another goroutine may claim it.
+	fillZero(cp.Get(ptr))
+
+	//The counter is decremented before the bit is cleared (and incremented after
+	// a bit is claimed) so it never overstates usage.  Alloc relies on that to skip full ranges.
+	counter := &cp.ranges[int(index / 64) / cp.rangeWords].nUsed
+	counter.Add(-1)
+
+	if !cp.allocMask.ClearIfSet(index) {
+		counter.Add(1)
+		panic("fixedpool.ConcurrentPool.Free: already freed")
+	}
+}
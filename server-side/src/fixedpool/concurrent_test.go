@@ -0,0 +1,155 @@
+package fixedpool
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"util"
+	"sync"
+	"strconv"
+)
+
+func TestConcurrentBasic(t * testing.T) {
+	req := require.New(t)
+
+	const blockSize = 7
+	const nBlocks = 190
+	cp := NewConcurrentPool(blockSize, nBlocks, 3)
+	req.Equal(3, cp.NumRanges())
+	req.Equal(nBlocks, cp.NumFree())
+
+	//the last range excludes padding bits
+	req.Equal(int64(64), cp.rangeCapacity(0))
+	req.Equal(int64(nBlocks - 128), cp.rangeCapacity(2))
+
+	//A single worker can allocate every block (stealing from other ranges)
+	w := cp.Worker()
+	seen := make(map[Ptr]bool)
+	for i := 0; i < nBlocks; i++ {
+		ptr := w.Alloc()
+		req.True(ptr != Zero)
+		req.False(seen[ptr])
+		seen[ptr] = true
+		req.True(cp.IsAllocated(ptr))
+		req.True(isAllZero(cp.Get(ptr)))
+		util.FillConst(cp.Get(ptr), 0xEE)
+	}
+	req.True(w.Alloc() == Zero)
+	req.True(cp.Worker().Alloc() == Zero)
+	req.Equal(nBlocks, cp.NumUsed())
+
+	//Free from "another goroutine" and reallocate zeroed
+	for ptr := range seen {
+		cp.Free(ptr)
+		req.False(cp.IsAllocated(ptr))
+		req.Panics(func() { cp.Free(ptr) })
+		ptr2 := w.Alloc()
+		req.Equal(ptr, ptr2)
+		req.True(isAllZero(cp.Get(ptr2)))
+	}
+	req.Equal(nBlocks, cp.NumUsed())
+
+	cp.Free(Zero)
+	req.False(cp.IsAllocated(Zero))
+	req.False(cp.IsAllocated(Ptr(nBlocks + 1)))
+}
+
+/*
+Many goroutines allocate, write a signature, verify and free.  A block handed
+to two goroutines at once shows up as a corrupted signature (or a -race report).
+*/
+func TestConcurrentStress(t * testing.T) {
+	const nGoroutines = 16
+	const nBlocks = 2000
+	const rounds = 300
+
+	cp := NewConcurrentPool(8, nBlocks, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan string, nGoroutines)
+
+	for g := 0; g < nGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			w := cp.Worker()
+			var held []Ptr
+
+			for round := 0; round < rounds; round++ {
+				//Alloc a varying number.  Pool is over-subscribed so Alloc sometimes fails.
+				n := (round * 7 + g) % 40
+				for i := 0; i < n; i++ {
+					ptr := w.Alloc()
+					if ptr == Zero {
+						break
+					}
+					block := cp.Get(ptr)
+					if !isAllZero(block) {
+						errs <- "block not zero"
+						return
+					}
+					util.Uint32ToBytes(uint32(g), block)
+					util.Uint32ToBytes(uint32(ptr), block[4:])
+					held = append(held, ptr)
+				}
+
+				//Verify and free most of them.  Some are freed by this goroutine in a different order.
+				keep := len(held) / 4
+				for _, ptr := range held[keep:] {
+					block := cp.Get(ptr)
+					if util.Uint32FromBytes(block) != uint32(g) || util.Uint32FromBytes(block[4:]) != uint32(ptr) {
+						errs <- "block shared between goroutines"
+						return
+					}
+					cp.Free(ptr)
+				}
+				held = held[:keep]
+			}
+
+			for _, ptr := range held {
+				cp.Free(ptr)
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	//everything was returned
+	require.Equal(t, 0, cp.NumUsed())
+	for i := 0; i < len(cp.allocMask) - 1; i++ {
+		require.Equal(t, uint64(0), cp.allocMask.Word(i))
+	}
+}
+
+func Benchmark_concurrentAlloc(b *testing.B) {
+	const nBlocks = 1 << 20
+	const perGoroutine = 1 << 14
+
+	for _, nGoroutines := range []int{1, 2, 4, 8, 16, 32} {
+		cp := NewConcurrentPool(16, nBlocks, 0)
+
+		b.Run(strconv.Itoa(nGoroutines), func(b *testing.B) {
+			for j := 0; j < b.N; j++ {
+				var wg sync.WaitGroup
+				for g := 0; g < nGoroutines; g++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						w := cp.Worker()
+						held := make([]Ptr, 0, perGoroutine)
+						for i := 0; i < perGoroutine; i++ {
+							held = append(held, w.Alloc())
+						}
+						for _, ptr := range held {
+							cp.Free(ptr)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package fixedpool
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+/*
+Debug mode catches use-after-free and stale pointers at the cost of speed.
+Enable it per pool with NewDebugPool or for every Pool and SlabPool in the
+program by building with the "fixedpooldebug" tag:
+
+	go test -tags fixedpooldebug map326
+
+In debug mode:
+	- every Get and Free checks that the Ptr is currently allocated
+	- freed blocks are filled with PoisonByte instead of zeros and Alloc
+	  panics if the poison was overwritten (a write after free)
+	- optionally (Generations) each block has a generation counter which is
+	  incremented on Free and encoded in the high bits of the Ptr, so a Ptr
+	  kept past Free is detected even after the block is reallocated
+
+Panics name the offending Ptr.
+*/
+type DebugOptions struct {
+	//Fill freed blocks with PoisonByte and verify the poison on Alloc
+	Poison bool
+	/*
+	Encode a per-block generation in the unused high bits of each Ptr.  The
+	number of generation bits is 32 minus the bits needed for numBlocks, up
+	to 8.  Not supported by SlabPool since it uses the high bits for the slab.
+	*/
+	Generations bool
+}
+
+//Freed blocks are filled with this in debug mode
+const PoisonByte = 0xDB
+
+//Options used for every pool when built with the fixedpooldebug tag
+var DefaultDebugOptions = DebugOptions{Poison: true}
+
+type poolDebug struct {
+	opts DebugOptions
+	//Ptr bits used for the block index (+1).  The rest hold the generation.
+	indexBits uint
+	indexMask uint32
+	genMask uint32
+	//one generation counter per block (nil unless opts.Generations)
+	gens []uint8
+}
+
+/*
+Create a pool in debug mode.  See DebugOptions.
+*/
+func NewDebugPool(blockSize, numBlocks int, opts DebugOptions) *Pool {
+	pool := NewPool(blockSize, numBlocks)
+	pool.setDebug(opts)
+	return pool
+}
+
+func (pool *Pool) setDebug(opts DebugOptions) {
+	numBlocks := pool.NumBlocks()
+	dbg := &poolDebug{
+		opts: opts,
+		indexBits: 32,
+		indexMask: 0xFFFFFFFF,
+	}
+
+	if opts.Generations {
+		dbg.indexBits = uint(bits.Len32(uint32(numBlocks)))
+		genBits := 32 - dbg.indexBits
+		if genBits > 8 {
+			genBits = 8
+		}
+		if genBits == 0 {
+			panic("NewDebugPool: numBlocks too large to encode generations")
+		}
+		dbg.indexMask = (uint32(1) << dbg.indexBits) - 1
+		dbg.genMask = (uint32(1) << genBits) - 1
+		dbg.gens = make([]uint8, numBlocks)
+	}
+
+	pool.debug = dbg
+
+	//Start out as if every block had been freed
+	if opts.Poison {
+		pool.fillFree(pool.data)
+	}
+}
+
+//True if this pool is in debug mode
+func (pool *Pool) IsDebug() bool {
+	return pool.debug != nil
+}
+
+//Fill freed memory with zeros, or poison in debug mode
+func (pool *Pool) fillFree(dest []byte) {
+	if pool.debug != nil && pool.debug.opts.Poison {
+		fillByte(dest, PoisonByte)
+	} else {
+		fillZero(dest)
+	}
+}
+
+func fillByte(dest []byte, b byte) {
+	for i := range dest {
+		dest[i] = b
+	}
+}
+
+//Build the Ptr for a block index (including the generation in debug mode)
+func (pool *Pool) encodePtr(index uint64) Ptr {
+	ptr := uint32(index) + 1 //+1 ensures never zero
+	if dbg := pool.debug; dbg != nil && dbg.gens != nil {
+		ptr |= uint32(dbg.gens[index]) << dbg.indexBits
+	}
+	return Ptr(ptr)
+}
+
+/*
+Debug mode only: validate ptr and return its block index.  Panics if the Ptr
+is out of range, has a stale generation or (if mustBeAllocated) is not allocated.
+*/
+func (pool *Pool) debugIndex(ptr Ptr, op string, mustBeAllocated bool) uint64 {
+	dbg := pool.debug
+	raw := uint32(ptr) & dbg.indexMask
+	if raw == 0 || int(raw) > pool.NumBlocks() {
+		panic(fmt.Sprintf("fixedpool.%s: invalid Ptr 0x%08x", op, uint32(ptr)))
+	}
+
+	index := uint64(raw - 1)
+	if dbg.gens != nil {
+		gen := (uint32(ptr) >> dbg.indexBits) & dbg.genMask
+		if gen != uint32(dbg.gens[index]) {
+			panic(fmt.Sprintf("fixedpool.%s: stale Ptr 0x%08x (block %d generation %d, current generation %d)",
+				op, uint32(ptr), index, gen, dbg.gens[index]))
+		}
+	}
+
+	if mustBeAllocated && !pool.allocMask.IsSet(index) {
+		panic(fmt.Sprintf("fixedpool.%s: Ptr 0x%08x (block %d) is not allocated", op, uint32(ptr), index))
+	}
+
+	return index
+}
+
+//Debug mode only: IsAllocated, checking the generation like debugIndex
+func (pool *Pool) debugIsAllocated(ptr Ptr) bool {
+	dbg := pool.debug
+	raw := uint32(ptr) & dbg.indexMask
+	if raw == 0 || int(raw) > pool.NumBlocks() {
+		return false
+	}
+	index := uint64(raw - 1)
+	if dbg.gens != nil && (uint32(ptr) >> dbg.indexBits) & dbg.genMask != uint32(dbg.gens[index]) {
+		return false
+	}
+	return pool.allocMask.IsSet(index)
+}
+
+/*
+Debug mode only: verify a block which is about to be allocated still holds
+the poison written when it was freed.
+*/
+func (pool *Pool) checkPoison(index uint64) {
+	if !pool.debug.opts.Poison {
+		return
+	}
+
+	for i, b := range pool.block(index) {
+		if b != PoisonByte {
+			panic(fmt.Sprintf("fixedpool.Alloc: block %d (Ptr 0x%08x) was written after Free (byte %d is 0x%02x)",
+				index, uint32(pool.encodePtr(index)), i, b))
+		}
+	}
+}
+
+//Debug mode only: bump the generation of a freed block
+func (pool *Pool) nextGeneration(index uint64) {
+	if dbg := pool.debug; dbg.gens != nil {
+		dbg.gens[index] = uint8((uint32(dbg.gens[index]) + 1) & dbg.genMask)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !fixedpooldebug
+
+package fixedpool
+
+//See debug_on.go
+const debugByDefault = false
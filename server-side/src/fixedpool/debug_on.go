@@ -0,0 +1,6 @@
+//go:build fixedpooldebug
+
+package fixedpool
+
+//Built with the fixedpooldebug tag: every Pool and SlabPool starts in debug mode
+const debugByDefault = true
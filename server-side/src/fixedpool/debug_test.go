@@ -0,0 +1,129 @@
+package fixedpool
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugUseAfterFree(t *testing.T) {
+	req := require.New(t)
+
+	pool := NewDebugPool(8, 10, DebugOptions{Poison: true})
+	req.True(pool.IsDebug())
+
+	p := pool.Alloc()
+	req.True(isAllZero(pool.Get(p)))
+	pool.Get(p)[0] = 1
+	pool.Free(p)
+
+	//freed block is poisoned
+	raw := pool.data[0:8]
+	for _, b := range raw {
+		req.Equal(byte(PoisonByte), b)
+	}
+
+	req.PanicsWithValue("fixedpool.Get: Ptr 0x00000001 (block 0) is not allocated", func() {
+		pool.Get(p)
+	})
+	req.PanicsWithValue("fixedpool.Free: Ptr 0x00000001 (block 0) is not allocated", func() {
+		pool.Free(p)
+	})
+	req.PanicsWithValue("fixedpool.Get: invalid Ptr 0x0000000b", func() {
+		pool.Get(Ptr(11))
+	})
+
+	//write after free is caught by the next Alloc of that block
+	raw[3] = 7
+	req.Panics(func() {
+		pool.Alloc()
+	})
+}
+
+func TestDebugGenerations(t *testing.T) {
+	req := require.New(t)
+
+	//10 blocks need 4 bits, leaving 8 for the generation
+	pool := NewDebugPool(8, 10, DebugOptions{Poison: true, Generations: true})
+
+	p1 := pool.Alloc()
+	req.Equal(Ptr(1), p1)
+	req.True(pool.IsAllocated(p1))
+	pool.Free(p1)
+	req.False(pool.IsAllocated(p1))
+
+	//same block, new generation
+	p2 := pool.Alloc()
+	req.Equal(Ptr(1 | 1 << 4), p2)
+	req.True(isAllZero(pool.Get(p2)))
+	req.True(pool.IsAllocated(p2))
+	req.False(pool.IsAllocated(p1))
+
+	req.PanicsWithValue("fixedpool.Get: stale Ptr 0x00000001 (block 0 generation 0, current generation 1)", func() {
+		pool.Get(p1)
+	})
+	req.Panics(func() {
+		pool.Free(p1)
+	})
+
+	//generation wraps within its bits
+	for i := 0; i < 300; i++ {
+		pool.Free(p2)
+		p2 = pool.Alloc()
+		req.Equal(uint32(1), uint32(p2) & 0xF)
+		req.True(uint32(p2) >> 12 == 0)
+	}
+
+	//FreeAll makes every outstanding Ptr stale
+	p3 := pool.Alloc()
+	pool.FreeAll()
+	req.Equal(0, pool.NumUsed())
+	req.Panics(func() {
+		pool.Get(p3)
+	})
+	req.Panics(func() {
+		pool.Get(p2)
+	})
+
+	//all blocks still allocatable and poisoned
+	for i := 0; i < 10; i++ {
+		req.NotEqual(Zero, pool.Alloc())
+	}
+	req.Equal(Zero, pool.Alloc())
+}
+
+func TestDebugTooManyBlocksForGenerations(t *testing.T) {
+	req := require.New(t)
+	pool := NewPool(1, 1)
+	//fake a pool whose block count leaves no bits for the generation
+	pool.data = make([]byte, 0x80000000)
+	req.PanicsWithValue("NewDebugPool: numBlocks too large to encode generations", func() {
+		pool.setDebug(DebugOptions{Generations: true})
+	})
+}
+
+func TestDebugSlabPool(t *testing.T) {
+	req := require.New(t)
+
+	req.Panics(func() {
+		NewDebugSlabPool(8, 4, 0, DebugOptions{Generations: true})
+	})
+
+	sp := NewDebugSlabPool(8, 4, 0, DebugOptions{Poison: true})
+	req.True(sp.IsDebug())
+
+	var ptrs []Ptr
+	for i := 0; i < 6; i++ {
+		ptrs = append(ptrs, sp.Alloc())
+	}
+	req.Equal(2, sp.NumSlabs())
+	req.True(sp.slabs[1].IsDebug())
+
+	sp.Free(ptrs[5])
+	req.PanicsWithValue("fixedpool.SlabPool.Get: Ptr 0x00000006 is not allocated", func() {
+		sp.Get(ptrs[5])
+	})
+	req.PanicsWithValue("fixedpool.SlabPool.Free: Ptr 0x00000006 is not allocated", func() {
+		sp.Free(ptrs[5])
+	})
+	req.Equal(byte(PoisonByte), sp.slabs[1].data[8])
+}
@@ -22,9 +22,14 @@ type Pool struct {
 	blockSize int
 	nUsed int
 	data []byte
-	//1 bit per block to track which have been allocated
-	allocMask bitarray.BitArray
+	//1 bit per block to track which have been allocated.
+	//Indexed so that Alloc stays fast when a huge pool is nearly full.
+	allocMask bitarray.IndexedBitArray
 	nextAllocIndex uint64
+	//how far Alloc searches (see Stats)
+	scan scanStats
+	//nil unless in debug mode (see debug.go)
+	debug *poolDebug
 }
 
 func NewPool(blockSize, numBlocks int) *Pool {
@@ -35,12 +40,16 @@ func NewPool(blockSize, numBlocks int) *Pool {
 	pool := &Pool {
 		blockSize: blockSize,
 		data: make([]byte, numBlocks * blockSize),
-		allocMask: bitarray.NewBitArray(uint64(numBlocks)),
+		allocMask: bitarray.NewIndexedBitArray(uint64(numBlocks)),
 	}
 
 	//BitArray rounds up to a multiple of 64.  Mark these all allocated.
 	pool.allocMask.SetLastN(pool.allocMask.NumBits() - uint64(numBlocks))
 
+	if debugByDefault {
+		pool.setDebug(DefaultDebugOptions)
+	}
+
 	return pool
 }
 
@@ -65,32 +74,69 @@ func (pool *Pool) NumFree() int {
 Access the block at the given Ptr.  This function thread-safe as long
 as each Ptr is only accessed by one thread.
 
-This function DOES NOT check if the given Ptr has already been freed.
+This function DOES NOT check if the given Ptr has already been freed
+(unless the pool is in debug mode).
 */
 func (pool *Pool) Get(ptr Ptr) []byte {
 	if ptr == Zero {
 		panic("fixedpool.Fetch: zero ptr")
 	}
+	if pool.debug != nil {
+		ptr = Ptr(pool.debugIndex(ptr, "Get", true) + 1)
+	}
 	bs := uint32(pool.blockSize)
 	offset := (uint32(ptr) - 1) * bs
 	return pool.data[offset:offset+bs]
 }
 
+/*
+True if the given Ptr refers to a block which is currently allocated.
+Returns false for Zero and for pointers beyond the end of the pool, and in
+debug mode with Generations for a stale Ptr to a block since reallocated.
+*/
+func (pool *Pool) IsAllocated(ptr Ptr) bool {
+	if pool.debug != nil {
+		return pool.debugIsAllocated(ptr)
+	}
+	if ptr == Zero || int(ptr) > pool.NumBlocks() {
+		return false
+	}
+	return pool.allocMask.IsSet(uint64(ptr) - 1)
+}
+
 /*
 Allocate one block.  Returns 0 if no free blocks.
 */
 func (pool *Pool) Alloc() Ptr {
-	freeIndex := pool.allocMask.FindZero(pool.nextAllocIndex)
+	hint := pool.nextAllocIndex
+	freeIndex := pool.allocMask.FindZero(hint)
 	if freeIndex == bitarray.NotFound {
 		return Zero
 	} else {
+		if freeIndex >= hint {
+			pool.scan.record(freeIndex - hint)
+		} else {
+			//wrapped around
+			pool.scan.record(freeIndex + pool.allocMask.NumBits() - hint)
+		}
+
+		if pool.debug != nil {
+			pool.checkPoison(freeIndex)
+			fillZero(pool.block(freeIndex))
+		}
 		pool.allocMask.Set(freeIndex)
 		pool.nextAllocIndex = freeIndex + 1
 		pool.nUsed++
-		return Ptr(uint32(freeIndex) + 1)  //+1 ensures never zero
+		return pool.encodePtr(freeIndex)
 	}
 }
 
+//The block at the given index (Ptr - 1)
+func (pool *Pool) block(index uint64) []byte {
+	bs := uint64(pool.blockSize)
+	return pool.data[index*bs:(index+1)*bs]
+}
+
 //fill given slice with zeros
 func fillZero(dest []byte) {
 	var _zeros [128]byte
@@ -109,10 +155,15 @@ Passing an already freed Ptr will panic.
 */
 func (pool *Pool) Free(ptr Ptr) {
 	if ptr != Zero {
-		//Clear it to zero so that it's ready for reallocation.
-		fillZero(pool.Get(ptr))
-
 		index := uint64(ptr) - 1
+		if pool.debug != nil {
+			index = pool.debugIndex(ptr, "Free", true)
+			pool.nextGeneration(index)
+		}
+
+		//Clear it to zero so that it's ready for reallocation (or poison in debug mode).
+		pool.fillFree(pool.block(index))
+
 		if !pool.allocMask.ClearIfSet(index) {
 			panic("fixedpool.Free: already freed")
 		}
@@ -127,7 +178,15 @@ Reset the pool.
 */
 func (pool *Pool) FreeAll() {
 	pool.allocMask.ClearAll()
-	fillZero(pool.data)
+	//restore the padding bits (see NewPool)
+	pool.allocMask.SetLastN(pool.allocMask.NumBits() - uint64(pool.NumBlocks()))
+	pool.fillFree(pool.data)
+	if pool.debug != nil {
+		//every outstanding Ptr is now stale
+		for i := range pool.debug.gens {
+			pool.nextGeneration(uint64(i))
+		}
+	}
 	pool.nUsed = 0
 	pool.nextAllocIndex = 0
 }
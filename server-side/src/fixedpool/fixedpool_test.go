@@ -15,6 +15,19 @@ func isAllZero(dat []byte) bool {
 	return true
 }
 
+//All zero, or all PoisonByte if the pool is in debug mode
+func isAllFree(pool *Pool, dat []byte) bool {
+	if !pool.IsDebug() || !pool.debug.opts.Poison {
+		return isAllZero(dat)
+	}
+	for _, b := range dat {
+		if b != PoisonByte {
+			return false
+		}
+	}
+	return true
+}
+
 func Test_fillZero(t * testing.T) {
 	dat := make([]byte, 99999)
 	for i := range dat {
@@ -125,14 +138,28 @@ func Test_FreeAll(t *testing.T) {
 
 		pool.FreeAll()
 
-		//verify all blocks were reset to zero
+		//verify all blocks were reset to zero (poison in debug mode)
 		for _, block := range blocks {
-			req.True(isAllZero(block))
+			req.True(isAllFree(pool, block))
 		}
 	}
 
 }
 
+//FreeAll must not make the padding bits of the last word allocatable
+func Test_FreeAllPadding(t *testing.T) {
+	req := require.New(t)
+
+	pool := NewPool(4, 70)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 70; i++ {
+			req.NotEqual(Zero, pool.Alloc())
+		}
+		req.Equal(Zero, pool.Alloc())
+		pool.FreeAll()
+	}
+}
+
 func benchSequentialAlloc(pool *Pool) bool {
 	nBlocks := pool.NumBlocks()
 	pool.FreeAll()
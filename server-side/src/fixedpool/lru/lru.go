@@ -0,0 +1,363 @@
+/*
+A least recently used cache of chunks keyed by 32 byte digest, built on a
+fixedpool.Pool so that cached entries cost no Go heap objects.
+
+Everything lives in the pool's blocks: the doubly linked LRU list and the hash
+chains are 32bit Ptrs stored in each entry's first block, and values longer
+than one block continue in a chain of further blocks.  The only other memory
+is the hash table of Ptrs, which holds no Go pointers for the GC to scan.
+
+First block of an entry:
+	LRU prev (4 bytes)
+	LRU next (4 bytes)
+	hash chain next (4 bytes)
+	continuation block (4 bytes)
+	value length (4 bytes)
+	key (32 bytes)
+	value data...
+Continuation block:
+	next continuation block (4 bytes)
+	value data...
+
+All methods are safe for concurrent use.
+*/
+package lru
+
+import (
+	"encoding/binary"
+	"fixedpool"
+	"sync"
+)
+
+//Size of keys (a SHA256 digest)
+const KeySize = 32
+
+//Default block size for New
+const DefaultBlockSize = 4096
+
+const (
+	offPrev = 0
+	offNext = 4
+	offHashNext = 8
+	offCont = 12
+	offLen = 16
+	offKey = 20
+	headerSize = offKey + KeySize
+	contHeaderSize = 4
+)
+
+type Cache struct {
+	mu sync.Mutex
+	pool *fixedpool.Pool
+	//heads of the hash chains.  Length is a power of 2.
+	table []fixedpool.Ptr
+	//most and least recently used entries
+	head, tail fixedpool.Ptr
+	nEntries int
+	//bytes of values held
+	valueBytes int64
+
+	hits, misses, evictions int64
+
+	/*
+	Called (with the cache locked) for each entry evicted to make room.  Not
+	called for entries removed by Delete or replaced by Put.  Set before use.
+	*/
+	OnEvict func(key []byte, valueLen int)
+}
+
+/*
+Create a cache which uses at most budgetBytes of memory for entries, divided
+into blocks of blockSize bytes (use DefaultBlockSize).  Each entry has a 52
+byte header in its first block and 4 bytes in each further block.
+*/
+func New(budgetBytes int64, blockSize int) *Cache {
+	if blockSize <= headerSize {
+		panic("lru.New: blockSize too small")
+	}
+	numBlocks := budgetBytes / int64(blockSize)
+	if numBlocks <= 0 || numBlocks > 0xFFFFFFFE {
+		panic("lru.New: illegal budget")
+	}
+
+	nBuckets := 1
+	for int64(nBuckets) < numBlocks {
+		nBuckets <<= 1
+	}
+
+	return &Cache{
+		pool: fixedpool.NewPool(blockSize, int(numBlocks)),
+		table: make([]fixedpool.Ptr, nBuckets),
+	}
+}
+
+func getPtr(block []byte, offset int) fixedpool.Ptr {
+	return fixedpool.Ptr(binary.LittleEndian.Uint32(block[offset:]))
+}
+
+func setPtr(block []byte, offset int, ptr fixedpool.Ptr) {
+	binary.LittleEndian.PutUint32(block[offset:], uint32(ptr))
+}
+
+func (c *Cache) bucket(key []byte) *fixedpool.Ptr {
+	//keys are digests so any bits will do
+	return &c.table[binary.LittleEndian.Uint64(key) & uint64(len(c.table) - 1)]
+}
+
+func checkKey(key []byte) {
+	if len(key) != KeySize {
+		panic("lru: wrong key size")
+	}
+}
+
+//Number of blocks needed for a value of n bytes
+func (c *Cache) blocksFor(n int) int {
+	bs := c.pool.BlockSize()
+	first := bs - headerSize
+	if n <= first {
+		return 1
+	}
+	per := bs - contHeaderSize
+	return 1 + (n - first + per - 1) / per
+}
+
+//Find the entry for key.  Returns Zero if absent.
+func (c *Cache) find(key []byte) fixedpool.Ptr {
+	for ptr := *c.bucket(key); ptr != fixedpool.Zero; {
+		block := c.pool.Get(ptr)
+		if string(block[offKey:offKey+KeySize]) == string(key) {
+			return ptr
+		}
+		ptr = getPtr(block, offHashNext)
+	}
+	return fixedpool.Zero
+}
+
+/*
+Append the value for key to dst and return it.  The entry becomes the most
+recently used.  Returns dst unchanged and false if absent.
+*/
+func (c *Cache) Get(key []byte, dst []byte) ([]byte, bool) {
+	checkKey(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ptr := c.find(key)
+	if ptr == fixedpool.Zero {
+		c.misses++
+		return dst, false
+	}
+	c.hits++
+	c.unlink(ptr)
+	c.pushFront(ptr)
+
+	block := c.pool.Get(ptr)
+	n := int(binary.LittleEndian.Uint32(block[offLen:]))
+	data := block[headerSize:]
+	if len(data) > n {
+		data = data[:n]
+	}
+	dst = append(dst, data...)
+	n -= len(data)
+
+	for cont := getPtr(block, offCont); n > 0; {
+		block = c.pool.Get(cont)
+		data = block[contHeaderSize:]
+		if len(data) > n {
+			data = data[:n]
+		}
+		dst = append(dst, data...)
+		n -= len(data)
+		cont = getPtr(block, 0)
+	}
+	return dst, true
+}
+
+//True if key is cached.  Does not affect the LRU order or the counters.
+func (c *Cache) Contains(key []byte) bool {
+	checkKey(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.find(key) != fixedpool.Zero
+}
+
+/*
+Add or replace the value for key, evicting least recently used entries to
+make room.  Returns false if the value is larger than the whole budget, in
+which case nothing is cached (and any previous value for key is removed).
+*/
+func (c *Cache) Put(key []byte, value []byte) bool {
+	checkKey(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old := c.find(key); old != fixedpool.Zero {
+		c.remove(old)
+	}
+
+	need := c.blocksFor(len(value))
+	if need > c.pool.NumBlocks() {
+		return false
+	}
+	for c.pool.NumFree() < need {
+		c.evict()
+	}
+
+	valueLen := len(value)
+
+	//Continuation blocks are written last to first so each can link to the next
+	var cont fixedpool.Ptr
+	bs := c.pool.BlockSize()
+	first := bs - headerSize
+	if len(value) > first {
+		per := bs - contHeaderSize
+		rest := value[first:]
+		for i := (len(rest) - 1) / per; i >= 0; i-- {
+			ptr := c.pool.Alloc()
+			block := c.pool.Get(ptr)
+			setPtr(block, 0, cont)
+			end := (i + 1) * per
+			if end > len(rest) {
+				end = len(rest)
+			}
+			copy(block[contHeaderSize:], rest[i*per:end])
+			cont = ptr
+		}
+		value = value[:first]
+	}
+
+	ptr := c.pool.Alloc()
+	block := c.pool.Get(ptr)
+	setPtr(block, offCont, cont)
+	binary.LittleEndian.PutUint32(block[offLen:], uint32(valueLen))
+	copy(block[offKey:], key)
+	copy(block[headerSize:], value)
+
+	bucket := c.bucket(key)
+	setPtr(block, offHashNext, *bucket)
+	*bucket = ptr
+	c.pushFront(ptr)
+	c.nEntries++
+	c.valueBytes += int64(valueLen)
+	return true
+}
+
+//Remove key.  Returns false if it was not cached.
+func (c *Cache) Delete(key []byte) bool {
+	checkKey(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ptr := c.find(key)
+	if ptr == fixedpool.Zero {
+		return false
+	}
+	c.remove(ptr)
+	return true
+}
+
+//Evict the least recently used entry
+func (c *Cache) evict() {
+	ptr := c.tail
+	if c.OnEvict != nil {
+		block := c.pool.Get(ptr)
+		c.OnEvict(block[offKey:offKey+KeySize], int(binary.LittleEndian.Uint32(block[offLen:])))
+	}
+	c.remove(ptr)
+	c.evictions++
+}
+
+//Unlink an entry from the list and its hash chain and free its blocks
+func (c *Cache) remove(ptr fixedpool.Ptr) {
+	block := c.pool.Get(ptr)
+	c.unlink(ptr)
+
+	//hash chain
+	next := getPtr(block, offHashNext)
+	bucket := c.bucket(block[offKey:offKey+KeySize])
+	if *bucket == ptr {
+		*bucket = next
+	} else {
+		prev := c.pool.Get(*bucket)
+		for getPtr(prev, offHashNext) != ptr {
+			prev = c.pool.Get(getPtr(prev, offHashNext))
+		}
+		setPtr(prev, offHashNext, next)
+	}
+
+	c.valueBytes -= int64(binary.LittleEndian.Uint32(block[offLen:]))
+	for cont := getPtr(block, offCont); cont != fixedpool.Zero; {
+		next := getPtr(c.pool.Get(cont), 0)
+		c.pool.Free(cont)
+		cont = next
+	}
+	c.pool.Free(ptr)
+	c.nEntries--
+}
+
+//Remove an entry from the LRU list
+func (c *Cache) unlink(ptr fixedpool.Ptr) {
+	block := c.pool.Get(ptr)
+	prev := getPtr(block, offPrev)
+	next := getPtr(block, offNext)
+
+	if prev == fixedpool.Zero {
+		c.head = next
+	} else {
+		setPtr(c.pool.Get(prev), offNext, next)
+	}
+	if next == fixedpool.Zero {
+		c.tail = prev
+	} else {
+		setPtr(c.pool.Get(next), offPrev, prev)
+	}
+}
+
+//Make an (unlinked) entry the most recently used
+func (c *Cache) pushFront(ptr fixedpool.Ptr) {
+	block := c.pool.Get(ptr)
+	setPtr(block, offPrev, fixedpool.Zero)
+	setPtr(block, offNext, c.head)
+	if c.head != fixedpool.Zero {
+		setPtr(c.pool.Get(c.head), offPrev, ptr)
+	} else {
+		c.tail = ptr
+	}
+	c.head = ptr
+}
+
+type Stats struct {
+	Hits int64
+	Misses int64
+	Evictions int64
+	Entries int
+	//bytes of cached values
+	ValueBytes int64
+	//bytes of blocks in use (values plus headers and rounding)
+	BytesUsed int64
+	//the memory budget
+	BytesBudget int64
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bs := int64(c.pool.BlockSize())
+	return Stats{
+		Hits: c.hits,
+		Misses: c.misses,
+		Evictions: c.evictions,
+		Entries: c.nEntries,
+		ValueBytes: c.valueBytes,
+		BytesUsed: int64(c.pool.NumUsed()) * bs,
+		BytesBudget: int64(c.pool.NumBlocks()) * bs,
+	}
+}
+
+//Number of cached entries
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nEntries
+}
@@ -0,0 +1,178 @@
+package lru
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"strconv"
+)
+
+func key(i int) []byte {
+	sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+	return sum[:]
+}
+
+func value(i, n int) []byte {
+	v := make([]byte, n)
+	for j := range v {
+		v[j] = byte(i + j)
+	}
+	return v
+}
+
+func TestBasic(t *testing.T) {
+	req := require.New(t)
+
+	//4 blocks of 100 bytes: 48 bytes of value in the first block, 96 in each further block
+	c := New(400, 100)
+
+	_, ok := c.Get(key(1), nil)
+	req.False(ok)
+
+	req.True(c.Put(key(1), value(1, 10)))
+	got, ok := c.Get(key(1), nil)
+	req.True(ok)
+	req.Equal(value(1, 10), got)
+
+	//spans 3 blocks
+	req.Equal(3, c.blocksFor(48 + 96 + 1))
+	req.True(c.Put(key(2), value(2, 48 + 96 + 1)))
+	got, ok = c.Get(key(2), []byte("prefix"))
+	req.True(ok)
+	req.Equal(append([]byte("prefix"), value(2, 48 + 96 + 1)...), got)
+
+	stats := c.Stats()
+	req.Equal(int64(2), stats.Hits)
+	req.Equal(int64(1), stats.Misses)
+	req.Equal(2, stats.Entries)
+	req.Equal(int64(10 + 145), stats.ValueBytes)
+	req.Equal(int64(400), stats.BytesUsed)
+	req.Equal(int64(400), stats.BytesBudget)
+
+	//replace
+	req.True(c.Put(key(1), value(9, 3)))
+	got, _ = c.Get(key(1), nil)
+	req.Equal(value(9, 3), got)
+	req.Equal(2, c.Len())
+
+	req.True(c.Delete(key(2)))
+	req.False(c.Delete(key(2)))
+	req.False(c.Contains(key(2)))
+	req.True(c.Contains(key(1)))
+	req.Equal(int64(3), c.Stats().ValueBytes)
+
+	//too large for the whole budget
+	req.False(c.Put(key(3), value(3, 1000)))
+	req.False(c.Contains(key(3)))
+
+	req.Panics(func() {
+		c.Put([]byte("short"), nil)
+	})
+}
+
+func TestEvictionOrder(t *testing.T) {
+	req := require.New(t)
+
+	c := New(3 * 100, 100)
+	var evicted []string
+	c.OnEvict = func(k []byte, valueLen int) {
+		evicted = append(evicted, string(k))
+		req.Equal(5, valueLen)
+	}
+
+	c.Put(key(1), value(1, 5))
+	c.Put(key(2), value(2, 5))
+	c.Put(key(3), value(3, 5))
+
+	//touch 1 so that 2 is the least recently used
+	c.Get(key(1), nil)
+	c.Put(key(4), value(4, 5))
+	req.Equal([]string{string(key(2))}, evicted)
+	req.False(c.Contains(key(2)))
+
+	//Contains does not change the order
+	c.Contains(key(3))
+	c.Put(key(5), value(5, 5))
+	req.Equal(string(key(3)), evicted[1])
+
+	req.Equal(int64(2), c.Stats().Evictions)
+	req.Equal(3, c.Len())
+}
+
+//Large values evict as many entries as needed
+func TestEvictForLarge(t *testing.T) {
+	req := require.New(t)
+
+	c := New(5 * 100, 100)
+	for i := 0; i < 5; i++ {
+		c.Put(key(i), value(i, 1))
+	}
+	req.True(c.Put(key(9), value(9, 48 + 96 * 2)))
+	req.Equal(3, c.Len())
+	req.Equal(int64(3), c.Stats().Evictions)
+	for i := 0; i < 3; i++ {
+		req.False(c.Contains(key(i)))
+	}
+	got, ok := c.Get(key(9), nil)
+	req.True(ok)
+	req.Equal(value(9, 48 + 96 * 2), got)
+}
+
+//Compare against a simple model
+func TestRandom(t *testing.T) {
+	req := require.New(t)
+
+	const budget = 64 * 256
+	c := New(budget, 256)
+	rng := rand.New(rand.NewSource(5))
+
+	//model: keys in LRU order, most recent last
+	type entry struct {
+		k int
+		v []byte
+	}
+	var model []entry
+	modelFind := func(k int) int {
+		for i, e := range model {
+			if e.k == k {
+				return i
+			}
+		}
+		return -1
+	}
+	modelBlocks := func() int {
+		n := 0
+		for _, e := range model {
+			n += c.blocksFor(len(e.v))
+		}
+		return n
+	}
+
+	for i := 0; i < 5000; i++ {
+		k := rng.Intn(100)
+		if rng.Intn(2) == 0 {
+			v := value(i, rng.Intn(1000))
+			req.True(c.Put(key(k), v))
+			if j := modelFind(k); j >= 0 {
+				model = append(model[:j], model[j+1:]...)
+			}
+			model = append(model, entry{k, v})
+			for modelBlocks() > 64 {
+				model = model[1:]
+			}
+		} else {
+			got, ok := c.Get(key(k), nil)
+			j := modelFind(k)
+			req.Equal(j >= 0, ok)
+			if ok {
+				req.True(bytes.Equal(model[j].v, got))
+				e := model[j]
+				model = append(model[:j], model[j+1:]...)
+				model = append(model, e)
+			}
+		}
+		req.Equal(len(model), c.Len())
+	}
+}
@@ -0,0 +1,308 @@
+package fixedpool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fixedpool/bitarray"
+	"fmt"
+	"io"
+	"math/bits"
+	"util"
+)
+
+/*
+Call fn for each allocated block in Ptr order until it returns false.
+Free regions are skipped a 64bit word at a time.  fn must not Alloc or Free.
+*/
+func (pool *Pool) ForEachAllocated(fn func(ptr Ptr, block []byte) bool) {
+	numBlocks := uint64(pool.NumBlocks())
+	for wordIndex, word := range pool.allocMask.Bits() {
+		for word != 0 {
+			bit := uint64(bits.TrailingZeros64(word))
+			word &= word - 1
+
+			index := uint64(wordIndex) * 64 + bit
+			if index >= numBlocks {
+				//padding bits
+				return
+			}
+			if !fn(pool.encodePtr(index), pool.block(index)) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Call fn for each allocated block, slab by slab in Ptr order, until it returns false.
+*/
+func (sp *SlabPool) ForEachAllocated(fn func(ptr Ptr, block []byte) bool) {
+	for slabIndex, slab := range sp.slabs {
+		keepGoing := true
+		slab.ForEachAllocated(func(local Ptr, block []byte) bool {
+			keepGoing = fn(sp.encode(slabIndex, local), block)
+			return keepGoing
+		})
+		if !keepGoing {
+			return
+		}
+	}
+}
+
+/*
+File format (all integers little endian):
+
+	Header:
+		magic "FXPL" (4 bytes)
+		version (4 bytes)
+		blockSize (4 bytes)
+		numBlocks (8 bytes)
+		nUsed (8 bytes)
+	The allocation mask: numBlocks bits rounded up to whole 64bit words (8 bytes each)
+	Each allocated block in Ptr order (blockSize bytes each)
+
+Free blocks are not written so a sparse pool stays small on disk.  Ptrs are
+preserved: a Ptr saved by the owner refers to the same block after ReadFrom.
+*/
+
+const fileMagic = "FXPL"
+const fileVersion = 1
+const fileHeaderSize = 28
+
+/*
+Write the pool to w.  Implements io.WriterTo.
+*/
+func (pool *Pool) WriteTo(w io.Writer) (int64, error) {
+	cw := &util.CountingWriter{W: w}
+	bw := bufio.NewWriter(cw)
+
+	var hdr [fileHeaderSize]byte
+	copy(hdr[0:4], fileMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], fileVersion)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(pool.blockSize))
+	binary.LittleEndian.PutUint64(hdr[12:], uint64(pool.NumBlocks()))
+	binary.LittleEndian.PutUint64(hdr[20:], uint64(pool.nUsed))
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return cw.N, err
+	}
+
+	var rec [8]byte
+	for _, word := range pool.allocMask.Bits() {
+		binary.LittleEndian.PutUint64(rec[:], word)
+		if _, err := bw.Write(rec[:]); err != nil {
+			return cw.N, err
+		}
+	}
+
+	var err error
+	pool.ForEachAllocated(func(ptr Ptr, block []byte) bool {
+		_, err = bw.Write(block)
+		return err == nil
+	})
+	if err != nil {
+		return cw.N, err
+	}
+
+	err = bw.Flush()
+	return cw.N, err
+}
+
+/*
+Replace the contents of the pool with data previously written by WriteTo.
+Implements io.ReaderFrom.  The file must have the same blockSize and
+numBlocks as the pool.  On error the pool is left unchanged.
+
+Nothing beyond the end of the pool is consumed from r, so r should be
+buffered by the caller (eg bufio.Reader) when reading from a file.
+
+In debug mode every block starts again at generation zero.
+*/
+func (pool *Pool) ReadFrom(r io.Reader) (int64, error) {
+	//not buffered so that nothing past the end of the pool is consumed
+	cr := &util.CountingReader{R: r}
+
+	var hdr [fileHeaderSize]byte
+	if err := cr.ReadFull(hdr[:]); err != nil {
+		return cr.N, err
+	}
+
+	if string(hdr[0:4]) != fileMagic {
+		return cr.N, errors.New("fixedpool: not a fixedpool file")
+	}
+	if version := binary.LittleEndian.Uint32(hdr[4:]); version != fileVersion {
+		return cr.N, fmt.Errorf("fixedpool: unsupported file version %d", version)
+	}
+
+	blockSize := binary.LittleEndian.Uint32(hdr[8:])
+	numBlocks := binary.LittleEndian.Uint64(hdr[12:])
+	nUsed := binary.LittleEndian.Uint64(hdr[20:])
+	if int(blockSize) != pool.blockSize {
+		return cr.N, fmt.Errorf("fixedpool: file has blockSize %d but pool has %d", blockSize, pool.blockSize)
+	}
+	if numBlocks != uint64(pool.NumBlocks()) {
+		return cr.N, fmt.Errorf("fixedpool: file has %d blocks but pool has %d", numBlocks, pool.NumBlocks())
+	}
+	if nUsed > numBlocks {
+		return cr.N, errors.New("fixedpool: corrupt header")
+	}
+
+	allocMask := bitarray.NewBitArray(numBlocks)
+	buf := make([]byte, 8 * len(allocMask))
+	if err := cr.ReadFull(buf); err != nil {
+		return cr.N, err
+	}
+	var count uint64
+	for i := range allocMask {
+		allocMask[i] = binary.LittleEndian.Uint64(buf[i*8:])
+		count += uint64(bits.OnesCount64(allocMask[i]))
+	}
+
+	//padding bits must be set (see NewPool) and the rest must agree with nUsed
+	nPadding := allocMask.NumBits() - numBlocks
+	for i := numBlocks; i < allocMask.NumBits(); i++ {
+		if !allocMask.IsSet(i) {
+			return cr.N, errors.New("fixedpool: corrupt allocation mask")
+		}
+	}
+	if count - nPadding != nUsed {
+		return cr.N, errors.New("fixedpool: allocation mask does not match header")
+	}
+
+	//Read the blocks into a copy so the pool is unchanged on error
+	loaded := &Pool{
+		blockSize: pool.blockSize,
+		nUsed: int(nUsed),
+		data: make([]byte, len(pool.data)),
+		allocMask: bitarray.NewIndexedFrom(allocMask),
+		debug: pool.debug,
+	}
+	loaded.fillFree(loaded.data)
+
+	var err error
+	loaded.ForEachAllocated(func(ptr Ptr, block []byte) bool {
+		err = cr.ReadFull(block)
+		return err == nil
+	})
+	if err != nil {
+		return cr.N, err
+	}
+
+	if loaded.debug != nil && loaded.debug.gens != nil {
+		for i := range loaded.debug.gens {
+			loaded.debug.gens[i] = 0
+		}
+	}
+
+	*pool = *loaded
+	return cr.N, nil
+}
+
+/*
+SlabPool file format (all integers little endian):
+
+	Header:
+		magic "FXSP" (4 bytes)
+		version (4 bytes)
+		blockSize (4 bytes)
+		blocksPerSlab (4 bytes)
+		maxBlocks (8 bytes)
+		number of slabs (4 bytes)
+	Each slab in order, in the Pool format above
+
+Empty slabs are still written (they cost a header and mask only) so that every
+Ptr keeps its slab.
+*/
+
+const slabFileMagic = "FXSP"
+const slabFileVersion = 1
+const slabFileHeaderSize = 28
+
+/*
+Write the pool to w.  Implements io.WriterTo.
+*/
+func (sp *SlabPool) WriteTo(w io.Writer) (int64, error) {
+	var hdr [slabFileHeaderSize]byte
+	copy(hdr[0:4], slabFileMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], slabFileVersion)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(sp.blockSize))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(sp.BlocksPerSlab()))
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(sp.maxBlocks))
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(len(sp.slabs)))
+	n, err := w.Write(hdr[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for _, slab := range sp.slabs {
+		n, err := slab.WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+/*
+Replace the contents of the pool with data previously written by WriteTo.
+Implements io.ReaderFrom.  The file must have the same blockSize,
+blocksPerSlab and maxBlocks as the pool, so a corrupt file cannot make it
+allocate more than the owner allowed for.  On error the pool is left
+unchanged.  Ptrs are preserved.
+
+As with Pool.ReadFrom, nothing beyond the end of the pool is consumed from r.
+*/
+func (sp *SlabPool) ReadFrom(r io.Reader) (int64, error) {
+	cr := &util.CountingReader{R: r}
+
+	var hdr [slabFileHeaderSize]byte
+	if err := cr.ReadFull(hdr[:]); err != nil {
+		return cr.N, err
+	}
+
+	if string(hdr[0:4]) != slabFileMagic {
+		return cr.N, errors.New("fixedpool: not a fixedpool slab file")
+	}
+	if version := binary.LittleEndian.Uint32(hdr[4:]); version != slabFileVersion {
+		return cr.N, fmt.Errorf("fixedpool: unsupported slab file version %d", version)
+	}
+
+	blockSize := binary.LittleEndian.Uint32(hdr[8:])
+	blocksPerSlab := binary.LittleEndian.Uint32(hdr[12:])
+	maxBlocks := binary.LittleEndian.Uint64(hdr[16:])
+	numSlabs := int(binary.LittleEndian.Uint32(hdr[24:]))
+	if int(blockSize) != sp.blockSize {
+		return cr.N, fmt.Errorf("fixedpool: file has blockSize %d but pool has %d", blockSize, sp.blockSize)
+	}
+	if int(blocksPerSlab) != sp.BlocksPerSlab() {
+		return cr.N, fmt.Errorf("fixedpool: file has %d blocks per slab but pool has %d", blocksPerSlab, sp.BlocksPerSlab())
+	}
+	if maxBlocks != uint64(sp.maxBlocks) {
+		return cr.N, fmt.Errorf("fixedpool: file has maxBlocks %d but pool has %d", maxBlocks, sp.maxBlocks)
+	}
+	if numSlabs > 0 && slabCapacity(numSlabs - 1, sp.slabShift, sp.maxBlocks) <= 0 {
+		return cr.N, fmt.Errorf("fixedpool: file has %d slabs, more than maxBlocks allows", numSlabs)
+	}
+
+	slabs := make([]*Pool, numSlabs)
+	nUsed := 0
+	for i := range slabs {
+		nBlocks := slabCapacity(i, sp.slabShift, sp.maxBlocks)
+		if sp.debug != nil {
+			slabs[i] = NewDebugPool(sp.blockSize, nBlocks, *sp.debug)
+		} else {
+			slabs[i] = NewPool(sp.blockSize, nBlocks)
+		}
+		if _, err := slabs[i].ReadFrom(cr); err != nil {
+			return cr.N, fmt.Errorf("fixedpool: slab %d: %w", i, err)
+		}
+		nUsed += slabs[i].NumUsed()
+	}
+
+	sp.slabs = slabs
+	sp.nUsed = nUsed
+	sp.allocSlab = 0
+	return cr.N, nil
+}
@@ -0,0 +1,241 @@
+package fixedpool
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"bytes"
+	"io"
+)
+
+func TestForEachAllocated(t *testing.T) {
+	req := require.New(t)
+
+	pool := NewPool(3, 200)
+	owned := scatter(pool.Alloc, pool.Get, pool.Free, 200)
+
+	var prev Ptr
+	n := 0
+	pool.ForEachAllocated(func(ptr Ptr, block []byte) bool {
+		req.True(ptr > prev)
+		prev = ptr
+		req.Equal(owned[ptr], block[0])
+		n++
+		return true
+	})
+	req.Equal(len(owned), n)
+
+	//early stop
+	n = 0
+	pool.ForEachAllocated(func(ptr Ptr, block []byte) bool {
+		n++
+		return n < 5
+	})
+	req.Equal(5, n)
+
+	//full pool: padding bits are not visited
+	full := NewPool(1, 70)
+	for full.Alloc() != Zero {
+	}
+	n = 0
+	full.ForEachAllocated(func(ptr Ptr, block []byte) bool {
+		n++
+		return true
+	})
+	req.Equal(70, n)
+
+	//SlabPool
+	sp := NewSlabPool(3, 16, 0)
+	owned = scatter(sp.Alloc, sp.Get, sp.Free, 100)
+	n = 0
+	sp.ForEachAllocated(func(ptr Ptr, block []byte) bool {
+		req.Equal(owned[ptr], block[0])
+		n++
+		return true
+	})
+	req.Equal(len(owned), n)
+}
+
+func TestPoolWriteReadFrom(t *testing.T) {
+	req := require.New(t)
+
+	const nBlocks = 1000
+	pool := NewPool(16, nBlocks)
+	owned := scatter(pool.Alloc, pool.Get, pool.Free, 300)
+
+	var buf bytes.Buffer
+	n, err := pool.WriteTo(&buf)
+	req.NoError(err)
+	req.Equal(int64(buf.Len()), n)
+	//sparse: only allocated blocks are written
+	req.Equal(int64(fileHeaderSize + 16 * 8 + 16 * len(owned)), n)
+
+	//trailing data must not be consumed
+	buf.WriteString("xyz")
+
+	loaded := NewPool(16, nBlocks)
+	loaded.Alloc()
+	n2, err := loaded.ReadFrom(&buf)
+	req.NoError(err)
+	req.Equal(n, n2)
+	req.Equal("xyz", buf.String())
+
+	req.Equal(len(owned), loaded.NumUsed())
+	checkOwned(req, loaded.Get, owned)
+	for i := 1; i <= nBlocks; i++ {
+		_, isOwned := owned[Ptr(i)]
+		req.Equal(isOwned, loaded.IsAllocated(Ptr(i)))
+	}
+
+	//free blocks are zero and allocatable
+	for loaded.NumFree() > 0 {
+		req.True(isAllZero(loaded.Get(loaded.Alloc())))
+	}
+	req.Equal(Zero, loaded.Alloc())
+}
+
+func TestPoolReadFromErrors(t *testing.T) {
+	req := require.New(t)
+
+	pool := NewPool(8, 100)
+	pool.Alloc()
+	var buf bytes.Buffer
+	_, err := pool.WriteTo(&buf)
+	req.NoError(err)
+	file := buf.Bytes()
+
+	target := NewPool(8, 100)
+	ptr := target.Alloc()
+	target.Get(ptr)[0] = 42
+	target.Alloc()
+
+	check := func(dat []byte, pool *Pool, msg string) {
+		_, err := pool.ReadFrom(bytes.NewReader(dat))
+		req.Error(err)
+		if msg != "" {
+			req.Equal(msg, err.Error())
+		}
+	}
+
+	check(file, NewPool(9, 100), "fixedpool: file has blockSize 8 but pool has 9")
+	check(file, NewPool(8, 101), "fixedpool: file has 100 blocks but pool has 101")
+
+	bad := append([]byte{}, file...)
+	bad[0] = 'X'
+	check(bad, target, "fixedpool: not a fixedpool file")
+
+	//clear a padding bit
+	bad = append([]byte{}, file...)
+	bad[fileHeaderSize + 15] = 0x7F
+	check(bad, target, "fixedpool: corrupt allocation mask")
+
+	//an extra allocated bit
+	bad = append([]byte{}, file...)
+	bad[fileHeaderSize] |= 2
+	check(bad, target, "fixedpool: allocation mask does not match header")
+
+	for i := 0; i < len(file); i++ {
+		_, err := target.ReadFrom(bytes.NewReader(file[:i]))
+		req.Equal(io.ErrUnexpectedEOF, err)
+	}
+
+	//unchanged by all of the above
+	req.Equal(2, target.NumUsed())
+	req.Equal(byte(42), target.Get(ptr)[0])
+}
+
+func TestSlabPoolWriteReadFrom(t *testing.T) {
+	req := require.New(t)
+
+	//the last slab is trimmed to maxBlocks
+	sp := NewSlabPool(4, 16, 70)
+	owned := scatter(sp.Alloc, sp.Get, sp.Free, 70)
+	req.Equal(5, sp.NumSlabs())
+
+	var buf bytes.Buffer
+	n, err := sp.WriteTo(&buf)
+	req.NoError(err)
+	req.Equal(int64(buf.Len()), n)
+	buf.WriteString("xyz")
+
+	loaded := NewSlabPool(4, 16, 70)
+	loaded.Alloc()
+	n2, err := loaded.ReadFrom(&buf)
+	req.NoError(err)
+	req.Equal(n, n2)
+	req.Equal("xyz", buf.String())
+
+	//Ptrs are preserved
+	req.Equal(5, loaded.NumSlabs())
+	req.Equal(len(owned), loaded.NumUsed())
+	checkOwned(req, loaded.Get, owned)
+	for i := 1; i <= 70; i++ {
+		_, isOwned := owned[Ptr(i)]
+		req.Equal(isOwned, loaded.IsAllocated(Ptr(i)))
+	}
+	for loaded.NumFree() > 0 {
+		req.True(isAllZero(loaded.Get(loaded.Alloc())))
+	}
+	req.Equal(Zero, loaded.Alloc())
+
+	//an empty pool round trips
+	buf.Reset()
+	_, err = NewSlabPool(4, 16, 70).WriteTo(&buf)
+	req.NoError(err)
+	req.Equal(slabFileHeaderSize, buf.Len())
+	_, err = loaded.ReadFrom(&buf)
+	req.NoError(err)
+	req.Equal(0, loaded.NumSlabs())
+	req.Equal(0, loaded.NumUsed())
+}
+
+func TestSlabPoolReadFromErrors(t *testing.T) {
+	req := require.New(t)
+
+	sp := NewSlabPool(8, 16, 100)
+	for i := 0; i < 20; i++ {
+		sp.Alloc()
+	}
+	var buf bytes.Buffer
+	_, err := sp.WriteTo(&buf)
+	req.NoError(err)
+	file := buf.Bytes()
+
+	target := NewSlabPool(8, 16, 100)
+	ptr := target.Alloc()
+	target.Get(ptr)[0] = 42
+
+	check := func(dat []byte, pool *SlabPool, msg string) {
+		_, err := pool.ReadFrom(bytes.NewReader(dat))
+		req.Error(err)
+		if msg != "" {
+			req.Equal(msg, err.Error())
+		}
+	}
+
+	check(file, NewSlabPool(9, 16, 100), "fixedpool: file has blockSize 8 but pool has 9")
+	check(file, NewSlabPool(8, 32, 100), "fixedpool: file has 16 blocks per slab but pool has 32")
+	check(file, NewSlabPool(8, 16, 200), "fixedpool: file has maxBlocks 100 but pool has 200")
+
+	bad := append([]byte{}, file...)
+	bad[0] = 'X'
+	check(bad, target, "fixedpool: not a fixedpool slab file")
+
+	//more slabs than maxBlocks allows
+	bad = append([]byte{}, file...)
+	bad[24] = 8
+	check(bad, target, "fixedpool: file has 8 slabs, more than maxBlocks allows")
+
+	//a damaged slab
+	bad = append([]byte{}, file...)
+	bad[slabFileHeaderSize] = 'X'
+	check(bad, target, "fixedpool: slab 0: fixedpool: not a fixedpool file")
+
+	for i := 0; i < len(file); i++ {
+		_, err := target.ReadFrom(bytes.NewReader(file[:i]))
+		req.ErrorIs(err, io.ErrUnexpectedEOF)
+	}
+
+	//unchanged by all of the above
+	req.Equal(1, target.NumUsed())
+	req.Equal(byte(42), target.Get(ptr)[0])
+}
@@ -0,0 +1,237 @@
+/*
+An allocator of variable length records built on fixedpool.  Each request is
+rounded up to a size class (16, 32, 64 ... 4096 bytes) and served from that
+class's pool, so millions of small records (file names, small inline files,
+snapshot metadata) cost no Go heap objects and no per-record pointers.
+
+Records are referred to by a 32bit Handle.  The high 4 bits select the class,
+the low 28 bits are the Ptr within that class's pool.
+
+Each block begins with a 2 byte length, so the largest record in a class is
+2 bytes less than the class size.
+*/
+package sizeclass
+
+import (
+	"encoding/binary"
+	"fixedpool"
+)
+
+//Refers to one record.  A valid Handle is never Nil.
+type Handle uint32
+
+const Nil Handle = 0
+
+//Block sizes of each class
+var ClassSizes = []int{16, 32, 64, 128, 256, 512, 1024, 2048, 4096}
+
+//Bytes at the start of each block holding the record length
+const headerSize = 2
+
+//Largest record which can be allocated
+const MaxSize = 4096 - headerSize
+
+const classShift = 28
+const ptrMask = (1 << classShift) - 1
+
+//Each class grows by about this many bytes at a time
+const slabBytes = 1 << 20
+
+type Allocator struct {
+	classes []*fixedpool.SlabPool
+	//sum of the requested lengths per class
+	requested []int64
+}
+
+/*
+Create an allocator.  maxBlocksPerClass limits each class; pass 0 for the
+most a Handle can address (2^28 - 2 blocks).  Memory is only allocated as
+classes fill.
+*/
+func New(maxBlocksPerClass int) *Allocator {
+	if maxBlocksPerClass <= 0 || maxBlocksPerClass > ptrMask - 1 {
+		maxBlocksPerClass = ptrMask - 1
+	}
+
+	a := &Allocator{
+		classes: make([]*fixedpool.SlabPool, len(ClassSizes)),
+		requested: make([]int64, len(ClassSizes)),
+	}
+	for i, size := range ClassSizes {
+		a.classes[i] = fixedpool.NewSlabPool(size, slabBytes / size, maxBlocksPerClass)
+	}
+	return a
+}
+
+//The smallest class which holds n bytes, or -1 if too large
+func classFor(n int) int {
+	for i, size := range ClassSizes {
+		if n <= size - headerSize {
+			return i
+		}
+	}
+	return -1
+}
+
+func makeHandle(class int, ptr fixedpool.Ptr) Handle {
+	return Handle(uint32(class) << classShift | uint32(ptr))
+}
+
+func (h Handle) class() int {
+	return int(uint32(h) >> classShift)
+}
+
+func (h Handle) ptr() fixedpool.Ptr {
+	return fixedpool.Ptr(uint32(h) & ptrMask)
+}
+
+//The block (including the length header) for a Handle
+func (a *Allocator) block(h Handle) []byte {
+	if h == Nil {
+		panic("sizeclass: nil handle")
+	}
+	class := h.class()
+	if class >= len(a.classes) {
+		panic("sizeclass: invalid handle")
+	}
+	return a.classes[class].Get(h.ptr())
+}
+
+/*
+Allocate a zeroed record of n bytes.  Returns Nil if its class is full.
+Panics if n is negative or greater than MaxSize.
+*/
+func (a *Allocator) Alloc(n int) Handle {
+	if n < 0 || n > MaxSize {
+		panic("sizeclass.Alloc: illegal size")
+	}
+
+	class := classFor(n)
+	ptr := a.classes[class].Alloc()
+	if ptr == fixedpool.Zero {
+		return Nil
+	}
+
+	//blocks are zeroed by the pool
+	binary.LittleEndian.PutUint16(a.classes[class].Get(ptr), uint16(n))
+	a.requested[class] += int64(n)
+	return makeHandle(class, ptr)
+}
+
+/*
+The record for the given Handle.  The slice is only valid until the record
+is freed or reallocated.  Same thread-safety rules as fixedpool.Pool.Get.
+*/
+func (a *Allocator) Get(h Handle) []byte {
+	block := a.block(h)
+	n := int(binary.LittleEndian.Uint16(block))
+	return block[headerSize:headerSize+n]
+}
+
+//Length of the record
+func (a *Allocator) Len(h Handle) int {
+	return int(binary.LittleEndian.Uint16(a.block(h)))
+}
+
+/*
+Release a record.  Harmless to pass Nil.
+*/
+func (a *Allocator) Free(h Handle) {
+	if h == Nil {
+		return
+	}
+	class := h.class()
+	a.requested[class] -= int64(a.Len(h))
+	a.classes[class].Free(h.ptr())
+}
+
+/*
+Change the length of a record, preserving its contents up to the smaller of
+the old and new lengths.  Any added bytes are zero.  Resizing within the same
+class is done in place and returns the same Handle; otherwise the record moves
+and the old Handle is freed.  Returns Nil (and h remains valid) if the new
+class is full.  Panics if n is negative or greater than MaxSize.
+*/
+func (a *Allocator) Realloc(h Handle, n int) Handle {
+	if h == Nil {
+		return a.Alloc(n)
+	}
+	if n < 0 || n > MaxSize {
+		panic("sizeclass.Realloc: illegal size")
+	}
+
+	block := a.block(h)
+	oldLen := int(binary.LittleEndian.Uint16(block))
+	class := h.class()
+
+	if classFor(n) == class {
+		if n > oldLen {
+			clear(block[headerSize+oldLen:headerSize+n])
+		}
+		binary.LittleEndian.PutUint16(block, uint16(n))
+		a.requested[class] += int64(n - oldLen)
+		return h
+	}
+
+	newH := a.Alloc(n)
+	if newH == Nil {
+		return Nil
+	}
+	copy(a.Get(newH), block[headerSize:headerSize+oldLen])
+	a.Free(h)
+	return newH
+}
+
+/*
+Usage of one size class.
+*/
+type ClassStats struct {
+	//block size
+	Size int
+	//records allocated
+	Records int
+	//bytes of blocks holding records (Records * Size)
+	BytesUsed int64
+	//bytes the records actually hold
+	BytesRequested int64
+	//bytes of slabs allocated so far
+	BytesReserved int64
+}
+
+/*
+Fraction of BytesUsed not holding record data (length headers and rounding up).
+*/
+func (cs ClassStats) Fragmentation() float64 {
+	if cs.BytesUsed == 0 {
+		return 0
+	}
+	return float64(cs.BytesUsed - cs.BytesRequested) / float64(cs.BytesUsed)
+}
+
+//Usage of each class, smallest first
+func (a *Allocator) Stats() []ClassStats {
+	stats := make([]ClassStats, len(a.classes))
+	for i, pool := range a.classes {
+		size := ClassSizes[i]
+		stats[i] = ClassStats{
+			Size: size,
+			Records: pool.NumUsed(),
+			BytesUsed: int64(pool.NumUsed()) * int64(size),
+			BytesRequested: a.requested[i],
+			BytesReserved: int64(pool.NumBlocks()) * int64(size),
+		}
+	}
+	return stats
+}
+
+//The sum over all classes
+func (a *Allocator) TotalStats() ClassStats {
+	var total ClassStats
+	for _, cs := range a.Stats() {
+		total.Records += cs.Records
+		total.BytesUsed += cs.BytesUsed
+		total.BytesRequested += cs.BytesRequested
+		total.BytesReserved += cs.BytesReserved
+	}
+	return total
+}
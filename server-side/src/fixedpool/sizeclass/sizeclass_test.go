@@ -0,0 +1,172 @@
+package sizeclass
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"bytes"
+	"math/rand"
+)
+
+func TestClassFor(t *testing.T) {
+	req := require.New(t)
+
+	req.Equal(0, classFor(0))
+	req.Equal(0, classFor(14))
+	req.Equal(1, classFor(15))
+	req.Equal(1, classFor(30))
+	req.Equal(8, classFor(MaxSize))
+	req.Equal(-1, classFor(MaxSize + 1))
+}
+
+func TestAllocGetFree(t *testing.T) {
+	req := require.New(t)
+
+	a := New(0)
+	h := a.Alloc(5)
+	req.NotEqual(Nil, h)
+	req.Equal(0, h.class())
+	req.Equal([]byte{0, 0, 0, 0, 0}, a.Get(h))
+	copy(a.Get(h), "hello")
+
+	big := a.Alloc(1000)
+	req.Equal(6, big.class())
+	req.Equal(1000, len(a.Get(big)))
+	req.Equal(1000, a.Len(big))
+
+	req.Equal("hello", string(a.Get(h)))
+
+	empty := a.Alloc(0)
+	req.Equal(0, len(a.Get(empty)))
+
+	stats := a.Stats()
+	req.Equal(2, stats[0].Records)
+	req.Equal(int64(32), stats[0].BytesUsed)
+	req.Equal(int64(5), stats[0].BytesRequested)
+	req.InDelta(27.0 / 32.0, stats[0].Fragmentation(), 1e-9)
+	req.Equal(1, stats[6].Records)
+	req.True(stats[6].BytesReserved >= 1024)
+
+	a.Free(h)
+	a.Free(big)
+	a.Free(empty)
+	a.Free(Nil)
+	total := a.TotalStats()
+	req.Equal(0, total.Records)
+	req.Equal(int64(0), total.BytesRequested)
+
+	req.Panics(func() {
+		a.Alloc(MaxSize + 1)
+	})
+	req.Panics(func() {
+		a.Get(Nil)
+	})
+}
+
+func TestRealloc(t *testing.T) {
+	req := require.New(t)
+
+	a := New(0)
+	h := a.Alloc(10)
+	copy(a.Get(h), "0123456789")
+
+	//same class: in place
+	h2 := a.Realloc(h, 4)
+	req.Equal(h, h2)
+	req.Equal("0123", string(a.Get(h2)))
+	h2 = a.Realloc(h2, 12)
+	req.Equal(h, h2)
+	//grown bytes are zero
+	req.Equal("0123\x00\x00\x00\x00\x00\x00\x00\x00", string(a.Get(h2)))
+
+	//move to a larger class
+	h3 := a.Realloc(h2, 100)
+	req.NotEqual(h2, h3)
+	req.Equal(3, h3.class())
+	req.Equal(100, len(a.Get(h3)))
+	req.Equal([]byte("0123"), a.Get(h3)[0:4])
+	req.Equal(0, a.Stats()[0].Records)
+	req.Equal(int64(100), a.TotalStats().BytesRequested)
+
+	//and back down
+	h4 := a.Realloc(h3, 2)
+	req.Equal(0, h4.class())
+	req.Equal("01", string(a.Get(h4)))
+	req.Equal(1, a.TotalStats().Records)
+
+	//Nil handle allocates
+	h5 := a.Realloc(Nil, 3)
+	req.Equal(3, a.Len(h5))
+}
+
+func TestClassFull(t *testing.T) {
+	req := require.New(t)
+
+	a := New(3)
+	var hs []Handle
+	for i := 0; i < 3; i++ {
+		hs = append(hs, a.Alloc(1))
+	}
+	req.Equal(Nil, a.Alloc(1))
+
+	//other classes are independent
+	big := a.Alloc(100)
+	req.NotEqual(Nil, big)
+
+	//failed Realloc leaves the record intact
+	a.Get(big)[0] = 7
+	req.Equal(Nil, a.Realloc(big, 1))
+	req.Equal(byte(7), a.Get(big)[0])
+
+	a.Free(hs[0])
+	req.NotEqual(Nil, a.Realloc(big, 1))
+}
+
+func TestRandom(t *testing.T) {
+	req := require.New(t)
+
+	rng := rand.New(rand.NewSource(3))
+	a := New(0)
+	live := make(map[Handle][]byte)
+
+	for i := 0; i < 20000; i++ {
+		switch rng.Intn(3) {
+		case 0:
+			n := rng.Intn(MaxSize + 1)
+			if rng.Intn(4) != 0 {
+				n = rng.Intn(60)
+			}
+			h := a.Alloc(n)
+			rng.Read(a.Get(h))
+			live[h] = append([]byte{}, a.Get(h)...)
+		case 1:
+			for h := range live {
+				a.Free(h)
+				delete(live, h)
+				break
+			}
+		case 2:
+			for h, want := range live {
+				n := rng.Intn(300)
+				h2 := a.Realloc(h, n)
+				got := a.Get(h2)
+				m := len(want)
+				if n < m {
+					m = n
+				}
+				req.True(bytes.Equal(want[:m], got[:m]))
+				delete(live, h)
+				live[h2] = append([]byte{}, got...)
+				break
+			}
+		}
+	}
+
+	var requested int64
+	for h, want := range live {
+		req.True(bytes.Equal(want, a.Get(h)))
+		requested += int64(len(want))
+	}
+	total := a.TotalStats()
+	req.Equal(len(live), total.Records)
+	req.Equal(requested, total.BytesRequested)
+}
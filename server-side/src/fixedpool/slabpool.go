@@ -0,0 +1,276 @@
+package fixedpool
+
+import (
+	"fmt"
+)
+
+/*
+A pool which grows on demand by adding slabs.  Each slab is a Pool of
+blocksPerSlab blocks (a power of 2) and is only allocated when the slabs before
+it are full, so memory does not have to be reserved up front.
+
+Pointers remain 32bits: the high bits select the slab and the low bits the
+block within it.  Existing Ptrs stay valid as the pool grows because slabs are
+never moved.
+*/
+type SlabPool struct {
+	blockSize int
+	//log2(blocksPerSlab)
+	slabShift uint
+	//blocksPerSlab - 1
+	slabMask uint32
+	slabs []*Pool
+	//upper limit on the total number of blocks
+	maxBlocks int
+	nUsed int
+	//index of the slab to try first in Alloc
+	allocSlab int
+	//nil unless in debug mode.  Applied to each new slab.
+	debug *DebugOptions
+}
+
+/*
+Default slab size for the indexes: 65,536 blocks.  This leaves 16bits of the Ptr
+to select the slab.
+*/
+const DefaultSlabBlocks = 1 << 16
+
+/*
+The largest Ptr value is reserved (map326 uses 0xFFFFFFFF as a marker) so
+at most this many blocks are addressable.  With Zero also excluded,
+a valid Ptr is in [1, 0xFFFFFFFE].
+*/
+const maxAddressableBlocks = 0xFFFFFFFE
+
+/*
+Create a pool of blockSize byte blocks which grows blocksPerSlab blocks at a
+time up to maxBlocks.  blocksPerSlab is rounded up to a power of 2.  If
+maxBlocks is <= 0 the pool grows until the 32bit Ptr space is exhausted.
+
+No memory is allocated until the first Alloc.
+*/
+func NewSlabPool(blockSize, blocksPerSlab, maxBlocks int) *SlabPool {
+	if blockSize <= 0 || blocksPerSlab <= 0 {
+		panic("NewSlabPool illegal arg")
+	}
+
+	var shift uint
+	for (1 << shift) < blocksPerSlab {
+		shift++
+	}
+	if shift > 31 {
+		panic("NewSlabPool: blocksPerSlab too large")
+	}
+
+	if maxBlocks <= 0 || uint64(maxBlocks) > maxAddressableBlocks {
+		maxBlocks = maxAddressableBlocks
+	}
+
+	sp := &SlabPool{
+		blockSize: blockSize,
+		slabShift: shift,
+		slabMask: uint32(1 << shift) - 1,
+		maxBlocks: maxBlocks,
+	}
+
+	if debugByDefault {
+		opts := DefaultDebugOptions
+		opts.Generations = false
+		sp.debug = &opts
+	}
+
+	return sp
+}
+
+/*
+Create a SlabPool in debug mode.  See DebugOptions.  Generations are not
+supported because the high bits of the Ptr select the slab.
+*/
+func NewDebugSlabPool(blockSize, blocksPerSlab, maxBlocks int, opts DebugOptions) *SlabPool {
+	if opts.Generations {
+		panic("NewDebugSlabPool: Generations not supported")
+	}
+	sp := NewSlabPool(blockSize, blocksPerSlab, maxBlocks)
+	sp.debug = &opts
+	return sp
+}
+
+//True if this pool is in debug mode
+func (sp *SlabPool) IsDebug() bool {
+	return sp.debug != nil
+}
+
+func (sp *SlabPool) BlockSize() int {
+	return sp.blockSize
+}
+
+//Number of blocks per slab (a power of 2)
+func (sp *SlabPool) BlocksPerSlab() int {
+	return 1 << sp.slabShift
+}
+
+//Number of slabs allocated so far
+func (sp *SlabPool) NumSlabs() int {
+	return len(sp.slabs)
+}
+
+//The most blocks this pool will ever hold
+func (sp *SlabPool) MaxBlocks() int {
+	return sp.maxBlocks
+}
+
+//Number of blocks currently backed by memory (the sum of all slab sizes)
+func (sp *SlabPool) NumBlocks() int {
+	n := 0
+	for _, slab := range sp.slabs {
+		n += slab.NumBlocks()
+	}
+	return n
+}
+
+func (sp *SlabPool) NumUsed() int {
+	return sp.nUsed
+}
+
+//Number of blocks which can still be allocated, including those in slabs not yet created
+func (sp *SlabPool) NumFree() int {
+	return sp.maxBlocks - sp.nUsed
+}
+
+/*
+Number of blocks in the given slab.  Every slab is full size except possibly
+the last, which is trimmed to maxBlocks and to the addressable Ptr range.
+*/
+func slabCapacity(slabIndex int, slabShift uint, maxBlocks int) int {
+	start := uint64(slabIndex) << slabShift
+	end := start + (uint64(1) << slabShift)
+	if end > uint64(maxBlocks) {
+		end = uint64(maxBlocks)
+	}
+	if end > maxAddressableBlocks {
+		end = maxAddressableBlocks
+	}
+	if end <= start {
+		return 0
+	}
+	return int(end - start)
+}
+
+func (sp *SlabPool) encode(slabIndex int, local Ptr) Ptr {
+	return Ptr((uint32(slabIndex) << sp.slabShift) | (uint32(local) - 1)) + 1
+}
+
+/*
+Access the block at the given Ptr.  Same rules as Pool.Get.
+*/
+func (sp *SlabPool) Get(ptr Ptr) []byte {
+	if ptr == Zero {
+		panic("fixedpool.SlabPool.Get: zero ptr")
+	}
+	if sp.debug != nil && !sp.IsAllocated(ptr) {
+		panic(fmt.Sprintf("fixedpool.SlabPool.Get: Ptr 0x%08x is not allocated", uint32(ptr)))
+	}
+	p := uint32(ptr) - 1
+	data := sp.slabs[p >> sp.slabShift].data
+	bs := uint32(sp.blockSize)
+	offset := (p & sp.slabMask) * bs
+	return data[offset:offset+bs]
+}
+
+//Split a Ptr into its slab and the Ptr within that slab.  Returns nil if out of range.
+func (sp *SlabPool) decode(ptr Ptr) (*Pool, Ptr) {
+	p := uint32(ptr) - 1
+	slabIndex := int(p >> sp.slabShift)
+	if ptr == Zero || slabIndex >= len(sp.slabs) {
+		return nil, Zero
+	}
+	return sp.slabs[slabIndex], Ptr(p & sp.slabMask) + 1
+}
+
+//True if the given Ptr refers to a block which is currently allocated.
+func (sp *SlabPool) IsAllocated(ptr Ptr) bool {
+	slab, local := sp.decode(ptr)
+	return slab != nil && slab.IsAllocated(local)
+}
+
+/*
+Allocate one zeroed block.  A new slab is added when all existing slabs are
+full.  Returns Zero when MaxBlocks are in use.
+*/
+func (sp *SlabPool) Alloc() Ptr {
+	if sp.nUsed >= sp.maxBlocks {
+		return Zero
+	}
+
+	//Try the hinted slab first, then any other with room
+	n := len(sp.slabs)
+	for i := 0; i < n; i++ {
+		slabIndex := sp.allocSlab + i
+		if slabIndex >= n {
+			slabIndex -= n
+		}
+
+		slab := sp.slabs[slabIndex]
+		if slab.NumFree() > 0 {
+			local := slab.Alloc()
+			sp.allocSlab = slabIndex
+			sp.nUsed++
+			return sp.encode(slabIndex, local)
+		}
+	}
+
+	//All full.  Grow.
+	nBlocks := slabCapacity(n, sp.slabShift, sp.maxBlocks)
+	if nBlocks <= 0 {
+		//should not happen because nUsed < maxBlocks
+		return Zero
+	}
+
+	var slab *Pool
+	if sp.debug != nil {
+		slab = NewDebugPool(sp.blockSize, nBlocks, *sp.debug)
+	} else {
+		slab = NewPool(sp.blockSize, nBlocks)
+	}
+	sp.slabs = append(sp.slabs, slab)
+	sp.allocSlab = n
+	sp.nUsed++
+	return sp.encode(n, sp.slabs[n].Alloc())
+}
+
+/*
+Return a block to the pool.  Harmless to pass zero.
+Passing an already freed Ptr will panic.
+
+Slabs are not released when they become empty; they will be reused.
+*/
+func (sp *SlabPool) Free(ptr Ptr) {
+	if ptr != Zero {
+		slab, local := sp.decode(ptr)
+		if slab == nil {
+			panic("fixedpool.SlabPool.Free: Ptr out of range")
+		}
+		if sp.debug != nil && !slab.IsAllocated(local) {
+			panic(fmt.Sprintf("fixedpool.SlabPool.Free: Ptr 0x%08x is not allocated", uint32(ptr)))
+		}
+		slab.Free(local)
+		sp.nUsed--
+
+		//prefer filling lower slabs
+		slabIndex := int((uint32(ptr) - 1) >> sp.slabShift)
+		if slabIndex < sp.allocSlab {
+			sp.allocSlab = slabIndex
+		}
+	}
+}
+
+/*
+Reset the pool.  Slabs are kept (and zeroed) for reuse.
+*/
+func (sp *SlabPool) FreeAll() {
+	for _, slab := range sp.slabs {
+		slab.FreeAll()
+	}
+	sp.nUsed = 0
+	sp.allocSlab = 0
+}
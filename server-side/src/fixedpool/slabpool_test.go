@@ -0,0 +1,129 @@
+package fixedpool
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"util"
+)
+
+func TestSlabPoolBasic(t * testing.T) {
+	req := require.New(t)
+
+	const blockSize = 5
+	//3 rounds up to 4 blocks per slab.  Last slab holds 2.
+	sp := NewSlabPool(blockSize, 3, 14)
+	req.Equal(4, sp.BlocksPerSlab())
+	req.Equal(14, sp.MaxBlocks())
+	req.Equal(14, sp.NumFree())
+	req.Equal(0, sp.NumBlocks())
+	req.Equal(0, sp.NumSlabs())
+
+	var pointers []Ptr
+	for i := 0; i < 14; i++ {
+		ptr := sp.Alloc()
+		req.True(ptr != Zero)
+		req.True(sp.IsAllocated(ptr))
+		pointers = append(pointers, ptr)
+
+		//fresh blocks are zero
+		req.True(isAllZero(sp.Get(ptr)))
+		util.FillConst(sp.Get(ptr), byte(i + 1))
+
+		//grows one slab at a time
+		req.Equal((i / 4) + 1, sp.NumSlabs())
+	}
+	req.Equal(14, sp.NumBlocks())
+	req.Equal(14, sp.NumUsed())
+	req.Equal(0, sp.NumFree())
+	req.True(sp.Alloc() == Zero)
+
+	//slab number is in the high bits
+	req.Equal(Ptr(1), pointers[0])
+	req.Equal(Ptr(4), pointers[3])
+	req.Equal(Ptr(5), pointers[4])
+	req.Equal(Ptr(14), pointers[13])
+
+	//existing blocks survived the growth
+	for i, ptr := range pointers {
+		dat := sp.Get(ptr)
+		req.Equal(blockSize, len(dat))
+		req.Equal(byte(i + 1), dat[0])
+		req.Equal(byte(i + 1), dat[blockSize - 1])
+	}
+
+	//Free one from the first and last slab.  They are reused, lowest slab first.
+	sp.Free(pointers[13])
+	sp.Free(pointers[1])
+	req.False(sp.IsAllocated(pointers[1]))
+	req.Equal(12, sp.NumUsed())
+	req.Equal(pointers[1], sp.Alloc())
+	req.Equal(pointers[13], sp.Alloc())
+	req.True(isAllZero(sp.Get(pointers[1])))
+	req.True(sp.Alloc() == Zero)
+
+	req.Panics(func() { sp.Free(pointers[1]); sp.Free(pointers[1]) })
+
+	sp.FreeAll()
+	req.Equal(0, sp.NumUsed())
+	req.Equal(4, sp.NumSlabs())
+	req.Equal(Ptr(1), sp.Alloc())
+	req.True(isAllZero(sp.Get(Ptr(1))))
+
+	//out of range
+	req.False(sp.IsAllocated(Zero))
+	req.False(sp.IsAllocated(Ptr(999)))
+	req.Panics(func() { sp.Free(Ptr(999)) })
+	req.Panics(func() { sp.Get(Zero) })
+}
+
+func TestSlabPoolUnlimited(t * testing.T) {
+	req := require.New(t)
+
+	sp := NewSlabPool(8, 1024, 0)
+	req.Equal(maxAddressableBlocks, sp.MaxBlocks())
+
+	var pointers []Ptr
+	for i := 0; i < 10000; i++ {
+		ptr := sp.Alloc()
+		req.True(ptr != Zero)
+		util.Uint32ToBytes(uint32(i), sp.Get(ptr))
+		pointers = append(pointers, ptr)
+	}
+	req.Equal(10, sp.NumSlabs())
+	req.Equal(10240, sp.NumBlocks())
+
+	for i, ptr := range pointers {
+		req.Equal(uint32(i), util.Uint32FromBytes(sp.Get(ptr)))
+	}
+}
+
+func TestSlabCapacity(t * testing.T) {
+	req := require.New(t)
+
+	req.Equal(4, slabCapacity(0, 2, 14))
+	req.Equal(2, slabCapacity(3, 2, 14))
+	req.Equal(0, slabCapacity(4, 2, 14))
+
+	//The last slab never reaches the reserved Ptr 0xFFFFFFFF
+	req.Equal(1 << 31, slabCapacity(0, 31, maxAddressableBlocks))
+	req.Equal((1 << 31) - 2, slabCapacity(1, 31, maxAddressableBlocks))
+	req.Equal(0, slabCapacity(2, 31, maxAddressableBlocks))
+
+	sp := NewSlabPool(1, 1 << 16, 0)
+	last := sp.encode(0xFFFF, Ptr(slabCapacity(0xFFFF, 16, maxAddressableBlocks)))
+	req.Equal(Ptr(0xFFFFFFFE), last)
+}
+
+func Benchmark_slabSequentialAlloc(b *testing.B) {
+	const nBlocks = 1000000
+	sp := NewSlabPool(3, DefaultSlabBlocks, nBlocks)
+
+	for j := 0; j < b.N; j++ {
+		sp.FreeAll()
+		for i := 0; i < nBlocks; i++ {
+			if sp.Alloc() == Zero {
+				panic("alloc fail")
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fixedpool
+
+import (
+	"math/bits"
+)
+
+/*
+Occupancy and fragmentation of a pool.  Useful to tune allocators and to spot
+leaks (NumUsed growing while the owner's entry count does not).
+*/
+type PoolStats struct {
+	NumBlocks int
+	NumUsed int
+	NumFree int
+	/*
+	Histogram of maximal runs of consecutive free blocks.  FreeRuns[i] counts
+	the runs whose length is in [2^i, 2^(i+1)).
+	*/
+	FreeRuns [32]int
+	LongestFreeRun int
+	//64 block words of the allocation mask which are entirely free or entirely used
+	FreeWords int
+	FullWords int
+	//where the next Alloc starts searching
+	NextAllocIndex uint64
+	/*
+	Average number of blocks FindZero skipped per Alloc over roughly the last
+	scanWindow to 2*scanWindow allocations.  0 is ideal (sequential allocation).
+	*/
+	AvgScanDistance float64
+}
+
+const allOnes = 0xFFFFFFFFFFFFFFFF
+
+//Allocations per scan distance window (see scanStats.record)
+const scanWindow = 1024
+
+//Scan distance counters for the current and previous window
+type scanStats struct {
+	sum, count uint64
+	prevSum, prevCount uint64
+}
+
+/*
+Record how far FindZero moved from its hint.  The sums are kept for the
+current and previous windows only, so the average reflects recent allocations.
+*/
+func (ss *scanStats) record(distance uint64) {
+	ss.sum += distance
+	ss.count++
+	if ss.count == scanWindow {
+		ss.prevSum, ss.prevCount = ss.sum, ss.count
+		ss.sum, ss.count = 0, 0
+	}
+}
+
+func (ss *scanStats) avg() float64 {
+	n := ss.count + ss.prevCount
+	if n == 0 {
+		return 0
+	}
+	return float64(ss.sum + ss.prevSum) / float64(n)
+}
+
+/*
+Gather statistics.  This scans the whole allocation mask so it is O(NumBlocks / 64).
+*/
+func (pool *Pool) Stats() PoolStats {
+	stats := PoolStats{
+		NumBlocks: pool.NumBlocks(),
+		NumUsed: pool.nUsed,
+		NumFree: pool.NumFree(),
+		NextAllocIndex: pool.nextAllocIndex,
+		AvgScanDistance: pool.scan.avg(),
+	}
+
+	run := 0
+	endRun := func() {
+		if run > 0 {
+			stats.FreeRuns[bits.Len(uint(run)) - 1]++
+			if run > stats.LongestFreeRun {
+				stats.LongestFreeRun = run
+			}
+			run = 0
+		}
+	}
+
+	//padding bits are set so they end the last run
+	for _, word := range pool.allocMask.Bits() {
+		switch word {
+		case 0:
+			stats.FreeWords++
+			run += 64
+		case allOnes:
+			stats.FullWords++
+			endRun()
+		default:
+			for bit := 0; bit < 64; bit++ {
+				if word & (uint64(1) << uint(bit)) == 0 {
+					run++
+				} else {
+					endRun()
+				}
+			}
+		}
+	}
+	endRun()
+
+	return stats
+}
+
+/*
+Statistics for the blocks backed by slabs so far (NumFree excludes slabs not
+yet created).  Free runs and words are counted per slab; a run never spans
+slabs.  NextAllocIndex is the pool-wide index where the next Alloc starts and
+AvgScanDistance is averaged over all slabs' recent allocations.
+*/
+func (sp *SlabPool) Stats() PoolStats {
+	stats := PoolStats{
+		NumUsed: sp.nUsed,
+	}
+
+	var scanSum, scanCount uint64
+	for slabIndex, slab := range sp.slabs {
+		s := slab.Stats()
+		stats.NumBlocks += s.NumBlocks
+		for i, n := range s.FreeRuns {
+			stats.FreeRuns[i] += n
+		}
+		if s.LongestFreeRun > stats.LongestFreeRun {
+			stats.LongestFreeRun = s.LongestFreeRun
+		}
+		stats.FreeWords += s.FreeWords
+		stats.FullWords += s.FullWords
+		if slabIndex == sp.allocSlab {
+			stats.NextAllocIndex = uint64(slabIndex) << sp.slabShift + s.NextAllocIndex
+		}
+		scanSum += slab.scan.sum + slab.scan.prevSum
+		scanCount += slab.scan.count + slab.scan.prevCount
+	}
+
+	stats.NumFree = stats.NumBlocks - stats.NumUsed
+	if scanCount > 0 {
+		stats.AvgScanDistance = float64(scanSum) / float64(scanCount)
+	}
+	return stats
+}
@@ -0,0 +1,95 @@
+package fixedpool
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolStats(t *testing.T) {
+	req := require.New(t)
+
+	//3 words, the last has 56 padding bits
+	pool := NewPool(1, 136)
+	stats := pool.Stats()
+	req.Equal(136, stats.NumFree)
+	req.Equal(2, stats.FreeWords)
+	req.Equal(0, stats.FullWords)
+	req.Equal(136, stats.LongestFreeRun)
+	req.Equal(1, stats.FreeRuns[7])
+	req.Equal(0.0, stats.AvgScanDistance)
+
+	var ptrs []Ptr
+	for i := 0; i < 136; i++ {
+		ptrs = append(ptrs, pool.Alloc())
+	}
+	stats = pool.Stats()
+	req.Equal(136, stats.NumUsed)
+	req.Equal(3, stats.FullWords)
+	req.Equal(0, stats.LongestFreeRun)
+	req.Equal([32]int{}, stats.FreeRuns)
+	req.Equal(uint64(136), stats.NextAllocIndex)
+	//sequential
+	req.Equal(0.0, stats.AvgScanDistance)
+
+	//free runs of 1, 3 and 64 (all of word 1)
+	pool.Free(ptrs[5])
+	for i := 10; i < 13; i++ {
+		pool.Free(ptrs[i])
+	}
+	for i := 64; i < 128; i++ {
+		pool.Free(ptrs[i])
+	}
+	stats = pool.Stats()
+	req.Equal(1, stats.FreeRuns[0])
+	req.Equal(1, stats.FreeRuns[1])
+	req.Equal(1, stats.FreeRuns[6])
+	req.Equal(64, stats.LongestFreeRun)
+	req.Equal(1, stats.FreeWords)
+	req.Equal(1, stats.FullWords)
+	//Free moves the hint to the block just freed
+	req.Equal(uint64(127), stats.NextAllocIndex)
+
+	//allocating everything back has to wrap around to find the low holes
+	for pool.Alloc() != Zero {
+	}
+	stats = pool.Stats()
+	req.True(stats.AvgScanDistance > 0)
+}
+
+func TestScanWindow(t *testing.T) {
+	req := require.New(t)
+
+	var ss scanStats
+	for i := 0; i < scanWindow; i++ {
+		ss.record(10)
+	}
+	req.Equal(10.0, ss.avg())
+	for i := 0; i < scanWindow; i++ {
+		ss.record(0)
+	}
+	//only the last two windows count
+	req.Equal(0.0, ss.avg())
+	ss.record(3)
+	req.InDelta(3.0 / float64(scanWindow + 1), ss.avg(), 1e-12)
+}
+
+func TestSlabPoolStats(t *testing.T) {
+	req := require.New(t)
+
+	sp := NewSlabPool(1, 64, 0)
+	var ptrs []Ptr
+	for i := 0; i < 64 * 3; i++ {
+		ptrs = append(ptrs, sp.Alloc())
+	}
+	sp.Free(ptrs[70])
+	sp.Free(ptrs[71])
+
+	stats := sp.Stats()
+	req.Equal(64 * 3, stats.NumBlocks)
+	req.Equal(64 * 3 - 2, stats.NumUsed)
+	req.Equal(2, stats.NumFree)
+	req.Equal(1, stats.FreeRuns[1])
+	req.Equal(2, stats.FullWords)
+	//allocation resumes in slab 1 at the last freed block
+	req.Equal(uint64(64 + 7), stats.NextAllocIndex)
+}
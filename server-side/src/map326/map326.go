@@ -29,6 +29,9 @@ const entrySize = 40
 //65,536 (16bits)
 const nRegions = 0x10000
 
+//Regions for ForEachInRegion: one per value of a key's first two bytes
+const NumRegions = nRegions
+
 //a fake Ptr value which marks the head bucket at used.
 const ptrSolo = fixedpool.Ptr(0xFFFFFFFF)
 
@@ -50,8 +53,9 @@ type Map struct {
 	epr int
 	//the current number of key/value entries which are used.
 	numEntries int
-	//buckets with more than one occupant are allocated from here
-	pool *fixedpool.Pool
+	//buckets with more than one occupant are allocated from here.
+	//Slabs are added as chains grow so the pool memory is not reserved up front.
+	pool *fixedpool.SlabPool
 }
 
 /*
@@ -144,10 +148,60 @@ func New(maxNumEntries int) (*Map, error) {
 	return &Map{
 		data: make([]byte, int(nBytes)),
 		epr: epr,
-		pool: fixedpool.NewPool(entrySize, poolSize),
+		pool: fixedpool.NewSlabPool(entrySize, fixedpool.DefaultSlabBlocks, poolSize),
 	}, nil
 }
 
+//Number of key/value entries in the map
+func (m *Map) Len() int {
+	return m.numEntries
+}
+
+/*
+Total number of entries the map has room for: every head bucket plus every
+pool block.  In practice Put fails somewhat before this because some head
+buckets remain empty while the pool is exhausted by longer chains.
+*/
+func (m *Map) Capacity() int {
+	return len(m.data) / entrySize + m.pool.MaxBlocks()
+}
+
+//Approximate RAM used by the map, in bytes (head buckets plus the pool slabs allocated so far)
+func (m *Map) MemSize() int64 {
+	return int64(len(m.data)) + int64(m.pool.NumBlocks()) * int64(m.pool.BlockSize())
+}
+
+//Occupancy and fragmentation of the pool holding the chained entries
+func (m *Map) PoolStats() fixedpool.PoolStats {
+	return m.pool.Stats()
+}
+
+/*
+Move chained entries out of the highest pool slabs into free blocks of the
+lower slabs, release the emptied slabs and rewrite the chain pointers.
+Lookups are unaffected and chains keep their order.  Costs one pass over the
+head buckets and the pool plus 8 bytes per moved entry.
+*/
+func (m *Map) Compact() fixedpool.CompactReport {
+	var relocs fixedpool.Relocations
+	report := m.pool.Compact(relocs.Record)
+	if relocs.Len() == 0 {
+		return report
+	}
+
+	//head buckets (ptrSolo never moves), then the next pointers within chains
+	for offs := 0; offs < len(m.data); offs += entrySize {
+		bucket := _Entry(m.data[offs:offs+entrySize])
+		bucket.setPtr(relocs.Lookup(bucket.getPtr()))
+	}
+	m.pool.ForEachAllocated(func(ptr fixedpool.Ptr, block []byte) bool {
+		bucket := _Entry(block)
+		bucket.setPtr(relocs.Lookup(bucket.getPtr()))
+		return true
+	})
+	return report
+}
+
 //16bit integer big-endian from bytes
 func uint16FromBytes(v []byte) int {
 	return (int(v[0]) << 8) | int(v[1])
@@ -191,6 +245,7 @@ func (m *Map) Put(key []byte, value Value) int {
 		//headBucket is empty.  Use it.
 		headBucket.setPtr(ptrSolo)
 		headBucket.setKeyValue(keySuffix, value)
+		m.numEntries++
 		return putKeyWasNew
 	} else if headBucket.cmpKeySuffix(keySuffix) == 0 {
 		//key already present.  Just update the value
@@ -234,6 +289,7 @@ func (m *Map) Put(key []byte, value Value) int {
 	newBucket.setPtr(next)
 	newBucket.setKeyValue(keySuffix, value)
 	prevBucket.setPtr(ptr)
+	m.numEntries++
 	return putKeyWasNew
 }
 
@@ -320,6 +376,50 @@ func (m *Map) Get(key []byte) (value Value, found bool) {
 	return*/
 }
 
+/*
+Call fn for every entry, in no particular order, until it returns false.  key
+is only valid during the call.  The map must not be modified during ForEach.
+*/
+func (m *Map) ForEach(fn func(key []byte, value Value) bool) {
+	for region := 0; region < NumRegions; region++ {
+		if !m.ForEachInRegion(region, fn) {
+			return
+		}
+	}
+}
+
+/*
+Like ForEach but only for the keys whose first two bytes (big-endian) are
+region.  Returns false if fn did.  A key's region does not depend on the map's
+capacity or contents, so a walk by region can be resumed on a map which has
+changed since, or on another map.
+*/
+func (m *Map) ForEachInRegion(region int, fn func(key []byte, value Value) bool) bool {
+	var key [KeySize]byte
+	key[0] = byte(region >> 8)
+	key[1] = byte(region)
+	reg := m.getRegionForKey(key[:])
+	for i := 0; i < reg.epr; i++ {
+		bucket := reg.getBucket(i)
+		next := bucket.getPtr()
+		if next == fixedpool.Zero {
+			continue
+		}
+		for {
+			copy(key[2:], bucket[4:34])
+			if !fn(key[:], bucket.getValue()) {
+				return false
+			}
+			if next == ptrSolo || next == fixedpool.Zero {
+				break
+			}
+			bucket = m.getPoolBucket(next)
+			next = bucket.getPtr()
+		}
+	}
+	return true
+}
+
 func (reg _Region) getBucket(index int) _Entry {
 	offset := index * entrySize
 	return _Entry(reg.data[offset:offset+entrySize])
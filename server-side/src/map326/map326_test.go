@@ -6,6 +6,7 @@ import (
 	"util"
 	"math/rand"
 	"fixedpool"
+	"bytes"
 )
 
 func uint16ToBytes(val int, dest []byte) {
@@ -82,6 +83,14 @@ func Test_Basic(t * testing.T) {
 		req.True(found)
 		req.Equal(val, val2)
 	}
+	req.Equal(5, dm.Len())
+
+	//updates do not change Len
+	for k := range keys {
+		req.Equal(2, dm.Put(k[:], ValueFromInt(7)))
+	}
+	req.Equal(5, dm.Len())
+	req.Equal(nRegions + 10, dm.Capacity())
 }
 
 func randKeyValue() (key [KeySize]byte, value Value) {
@@ -120,6 +129,12 @@ func Test_randFill(t * testing.T) {
 	percent := float32(nAdded) / float32(approxNumKeys) * 100.0
 	req.True(percent > 99.0, percent)
 
+	//chains never shrink so the pool fills sequentially
+	ps := dm.PoolStats()
+	req.True(ps.NumUsed > 0)
+	req.Equal(dm.pool.NumUsed(), ps.NumUsed)
+	req.Equal(0.0, ps.AvgScanDistance)
+
 	//
 	// Verify all
 
@@ -326,3 +341,210 @@ func Benchmark_GoMap(b *testing.B) {
 	}
 }
 */
+
+func Test_ForEach(t * testing.T) {
+	req := require.New(t)
+
+	dm, err := New(200000)
+	req.Nil(err)
+
+	//random keys plus a chain of keys sharing a region and bucket
+	rng := rand.New(rand.NewSource(5))
+	want := make(map[[KeySize]byte]Value)
+	var k [KeySize]byte
+	for i := 0; i < 10000; i++ {
+		rng.Read(k[:])
+		if i < 5 {
+			util.FillSeq(k[:KeySize-1], 1)
+			k[KeySize-1] = byte(i)
+		}
+		want[k] = ValueFromInt(i)
+		req.Equal(1, dm.Put(k[:], want[k]))
+	}
+
+	got := make(map[[KeySize]byte]Value)
+	dm.ForEach(func(key []byte, value Value) bool {
+		var kk [KeySize]byte
+		copy(kk[:], key)
+		_, dup := got[kk]
+		req.False(dup)
+		got[kk] = value
+		return true
+	})
+	req.Equal(want, got)
+
+	//stops early
+	n := 0
+	dm.ForEach(func(key []byte, value Value) bool {
+		n++
+		return n < 10
+	})
+	req.Equal(10, n)
+
+	//by region, each key in the region of its first two bytes
+	got = make(map[[KeySize]byte]Value)
+	for region := 0; region < NumRegions; region++ {
+		req.True(dm.ForEachInRegion(region, func(key []byte, value Value) bool {
+			req.Equal(region, uint16FromBytes(key))
+			var kk [KeySize]byte
+			copy(kk[:], key)
+			got[kk] = value
+			return true
+		}))
+	}
+	req.Equal(want, got)
+	var chained [KeySize]byte
+	util.FillSeq(chained[:], 1)
+	n = 0
+	req.False(dm.ForEachInRegion(uint16FromBytes(chained[:]), func(key []byte, value Value) bool {
+		n++
+		return n < 3
+	}))
+	req.Equal(3, n)
+}
+
+func Test_Compact(t * testing.T) {
+	req := require.New(t)
+
+	//one bucket per region so most entries are chained, with small slabs
+	dm, err := New(nRegions)
+	req.Nil(err)
+	dm.pool = fixedpool.NewSlabPool(entrySize, 64, 0)
+	var junk []fixedpool.Ptr
+	for i := 0; i < 1000; i++ {
+		junk = append(junk, dm.pool.Alloc())
+	}
+
+	rng := rand.New(rand.NewSource(9))
+	want := make(map[[KeySize]byte]Value)
+	var k [KeySize]byte
+	for i := 0; i < 5000; i++ {
+		rng.Read(k[:])
+		//few regions so that chains are long
+		k[0], k[1] = 0, byte(i % 8)
+		want[k] = ValueFromInt(i)
+		req.Equal(1, dm.Put(k[:], want[k]))
+	}
+	for _, ptr := range junk {
+		dm.pool.Free(ptr)
+	}
+	chained := dm.pool.NumUsed()
+	slabs := dm.pool.NumSlabs()
+
+	report := dm.Compact()
+	req.True(report.Moves > 0)
+	req.Equal(chained, report.LiveBlocks)
+	req.Equal((chained + 63) / 64, dm.pool.NumSlabs())
+	req.Less(dm.pool.NumSlabs(), slabs)
+
+	for key, value := range want {
+		got, found := dm.Get(key[:])
+		req.True(found)
+		req.Equal(value, got)
+	}
+	n := 0
+	dm.ForEach(func(key []byte, value Value) bool {
+		n++
+		return true
+	})
+	req.Equal(len(want), n)
+
+	//still usable
+	rng.Read(k[:])
+	k[0], k[1] = 0, 0
+	req.Equal(1, dm.Put(k[:], ValueFromInt(1)))
+}
+
+func Test_WriteReadFrom(t * testing.T) {
+	req := require.New(t)
+
+	dm, err := New(nRegions * 8)
+	req.Nil(err)
+	rng := rand.New(rand.NewSource(3))
+	want := make(map[[KeySize]byte]Value)
+	var k [KeySize]byte
+	for i := 0; i < 300000; i++ {
+		rng.Read(k[:])
+		want[k] = ValueFromInt(i)
+		req.Equal(1, dm.Put(k[:], want[k]))
+	}
+	req.True(dm.pool.NumUsed() > 0)
+
+	var buf bytes.Buffer
+	nWritten, err := dm.WriteTo(&buf)
+	req.Nil(err)
+	req.Equal(int64(buf.Len()), nWritten)
+	file := append([]byte{}, buf.Bytes()...)
+
+	//trailing bytes must not be consumed
+	buf.WriteString("trailer")
+
+	var loaded Map
+	nRead, err := loaded.ReadFrom(&buf)
+	req.Nil(err)
+	req.Equal(nWritten, nRead)
+	req.Equal("trailer", buf.String())
+	req.Equal(dm.Len(), loaded.Len())
+	req.Equal(dm.Capacity(), loaded.Capacity())
+	for key, value := range want {
+		got, found := loaded.Get(key[:])
+		req.True(found)
+		req.Equal(value, got)
+	}
+
+	//still usable
+	rng.Read(k[:])
+	req.Equal(1, loaded.Put(k[:], ValueFromInt(7)))
+
+	check := func(dat []byte, msg string) {
+		var m Map
+		_, err := m.ReadFrom(bytes.NewReader(dat))
+		req.Error(err)
+		req.Contains(err.Error(), msg)
+		req.Nil(m.data)
+	}
+	check(file[:len(file) - 1], "unexpected EOF")
+	check(file[:fileHeaderSize + 100], "unexpected EOF")
+
+	bad := append([]byte{}, file...)
+	bad[0] = 'X'
+	check(bad, "not a map326 file")
+
+	//a huge head table is refused or runs out of input, without allocating it all
+	bad = append([]byte{}, file[:fileHeaderSize]...)
+	bad[14] = 1
+	check(bad, "corrupt header")
+	bad[14] = 0
+	bad[10] = 0xFF
+	check(bad, "unexpected EOF")
+
+	//find a head bucket with a chain
+	var head int
+	for head = 0; ; head++ {
+		ptr := _Entry(file[fileHeaderSize + head * entrySize:]).getPtr()
+		if ptr != fixedpool.Zero && ptr != ptrSolo {
+			break
+		}
+	}
+	headOffs := fileHeaderSize + head * entrySize
+
+	//a chain pointing at a free block
+	bad = append([]byte{}, file...)
+	_Entry(bad[headOffs:]).setPtr(fixedpool.Ptr(dm.pool.NumUsed() + 1000))
+	check(bad, "bad pointer")
+
+	//a chain which is cut short leaves blocks unreachable
+	bad = append([]byte{}, file...)
+	_Entry(bad[headOffs:]).setPtr(ptrSolo)
+	check(bad, "are on chains")
+
+	//a key moved to the wrong bucket
+	bad = append([]byte{}, file...)
+	bad[headOffs + 5]++
+	check(bad, "another bucket")
+
+	//entry count
+	bad = append([]byte{}, file...)
+	bad[16]++
+	check(bad, "entries but")
+}
@@ -0,0 +1,182 @@
+package map326
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fixedpool"
+	"fixedpool/bitarray"
+	"fmt"
+	"io"
+	"slices"
+	"util"
+)
+
+/*
+File format (all integers little endian):
+
+	Header:
+		magic "M326" (4 bytes)
+		version (4 bytes)
+		entries per region (8 bytes)
+		number of entries (8 bytes)
+		maxBlocks of the pool (8 bytes)
+	The head buckets of every region as they are in memory (epr * 65,536 * 40 bytes)
+	The pool in the fixedpool.SlabPool format
+
+Chain pointers are stored as they are, so the pool is saved with its Ptrs
+intact rather than re-chained.  Everything is checked on load: every chain
+must be in order and end properly, every pool block must be on exactly one
+chain and the entry count must match.
+*/
+
+const fileMagic = "M326"
+const fileVersion = 1
+const fileHeaderSize = 32
+
+//Head buckets are read this much at a time so a corrupt header cannot force a huge allocation
+const readPiece = 64 << 20
+
+/*
+Write the entire map to w.  Implements io.WriterTo.
+*/
+func (m *Map) WriteTo(w io.Writer) (int64, error) {
+	cw := &util.CountingWriter{W: w}
+	bw := bufio.NewWriter(cw)
+
+	var hdr [fileHeaderSize]byte
+	copy(hdr[0:4], fileMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], fileVersion)
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(m.epr))
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(m.numEntries))
+	binary.LittleEndian.PutUint64(hdr[24:], uint64(m.pool.MaxBlocks()))
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return cw.N, err
+	}
+	if _, err := bw.Write(m.data); err != nil {
+		return cw.N, err
+	}
+	if _, err := m.pool.WriteTo(bw); err != nil {
+		return cw.N, err
+	}
+
+	err := bw.Flush()
+	return cw.N, err
+}
+
+/*
+Replace the contents of the map with data previously written by WriteTo.
+Implements io.ReaderFrom.  The receiver may be a zero Map.  On error the
+map is left unchanged.
+
+Nothing beyond the end of the map is consumed from r, so r should be
+buffered by the caller (eg bufio.Reader) when reading from a file.
+*/
+func (m *Map) ReadFrom(r io.Reader) (int64, error) {
+	//not buffered so that nothing past the end of the map is consumed
+	cr := &util.CountingReader{R: r}
+
+	var hdr [fileHeaderSize]byte
+	if err := cr.ReadFull(hdr[:]); err != nil {
+		return cr.N, err
+	}
+
+	if string(hdr[0:4]) != fileMagic {
+		return cr.N, errors.New("map326: not a map326 file")
+	}
+	if version := binary.LittleEndian.Uint32(hdr[4:]); version != fileVersion {
+		return cr.N, fmt.Errorf("map326: unsupported file version %d", version)
+	}
+
+	epr := binary.LittleEndian.Uint64(hdr[8:])
+	numEntries := binary.LittleEndian.Uint64(hdr[16:])
+	poolBlocks := binary.LittleEndian.Uint64(hdr[24:])
+
+	//sanity (also guards against int overflow below)
+	const maxEpr = 1 << 24
+	if epr == 0 || epr > maxEpr || poolBlocks == 0 || poolBlocks > 0xFFFFFFFE ||
+		numEntries > epr * nRegions + poolBlocks {
+		return cr.N, errors.New("map326: corrupt header")
+	}
+
+	nBytes := int(epr) * nRegions * entrySize
+	data := make([]byte, 0, min(nBytes, readPiece))
+	for len(data) < nBytes {
+		n := min(nBytes - len(data), readPiece)
+		data = slices.Grow(data, n)[:len(data) + n]
+		if err := cr.ReadFull(data[len(data) - n:]); err != nil {
+			return cr.N, err
+		}
+	}
+
+	loaded := &Map{
+		data: data,
+		epr: int(epr),
+		numEntries: int(numEntries),
+		pool: fixedpool.NewSlabPool(entrySize, fixedpool.DefaultSlabBlocks, int(poolBlocks)),
+	}
+	if _, err := loaded.pool.ReadFrom(cr); err != nil {
+		return cr.N, err
+	}
+	if err := loaded.check(); err != nil {
+		return cr.N, err
+	}
+
+	*m = *loaded
+	return cr.N, nil
+}
+
+/*
+Check that the chains are intact so that Get, Put and ForEach cannot panic or
+loop on a damaged file.  See the file format comment.
+*/
+func (m *Map) check() error {
+	onChain := bitarray.NewBitArray(uint64(m.pool.NumBlocks()))
+	nEntries := 0
+	nChained := 0
+
+	inBucket := func(e _Entry, bucketIndex int) bool {
+		return uint16FromBytes(e[4:]) % m.epr == bucketIndex
+	}
+
+	for headIndex := 0; headIndex < len(m.data) / entrySize; headIndex++ {
+		bucketIndex := headIndex % m.epr
+		head := _Entry(m.data[headIndex*entrySize:(headIndex+1)*entrySize])
+		next := head.getPtr()
+		if next == fixedpool.Zero {
+			continue
+		}
+		if !inBucket(head, bucketIndex) {
+			return fmt.Errorf("map326: corrupt: head bucket %d holds a key for another bucket", headIndex)
+		}
+		nEntries++
+		if next == ptrSolo {
+			continue
+		}
+
+		//the chain after the head is in increasing key order (see Put)
+		var prev _Entry
+		for next != fixedpool.Zero {
+			if !m.pool.IsAllocated(next) || onChain.IsSet(uint64(next) - 1) {
+				return fmt.Errorf("map326: corrupt: chain from head bucket %d has bad pointer 0x%08x", headIndex, uint32(next))
+			}
+			onChain.Set(uint64(next) - 1)
+			bucket := m.getPoolBucket(next)
+			if !inBucket(bucket, bucketIndex) || (prev != nil && prev.cmpKeySuffix(bucket[4:34]) >= 0) {
+				return fmt.Errorf("map326: corrupt: chain from head bucket %d is out of order", headIndex)
+			}
+			nEntries++
+			nChained++
+			prev = bucket
+			next = bucket.getPtr()
+		}
+	}
+
+	if nChained != m.pool.NumUsed() {
+		return fmt.Errorf("map326: corrupt: %d pool blocks are in use but %d are on chains", m.pool.NumUsed(), nChained)
+	}
+	if nEntries != m.numEntries {
+		return fmt.Errorf("map326: corrupt: header has %d entries but %d were found", m.numEntries, nEntries)
+	}
+	return nil
+}
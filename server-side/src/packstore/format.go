@@ -0,0 +1,301 @@
+package packstore
+
+import (
+	"chunker"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"map326"
+	"util"
+)
+
+/*
+Pack file format (all integers little endian):
+
+	Header:
+		magic "DDPK" (4 bytes)
+		version (2 bytes)
+	Records, one per chunk:
+		digest (32 bytes)
+		length of payload (4 bytes)
+		flags (1 byte)
+		CRC32C of the above (4 bytes)
+		payload (length bytes)
+	Footer, written when the pack is sealed:
+		One index entry per record, in file order:
+			digest (32 bytes)
+			offset of the record (4 bytes)
+			length of payload (4 bytes)
+			flags (1 byte)
+		offset of the first index entry (4 bytes)
+		number of index entries (4 bytes)
+		CRC32C of the index entries and the two fields above (4 bytes)
+		magic "DDPF" (4 bytes)
+
+The header CRC detects a torn or garbage record header; the payload is checked
+against the digest.  The footer lets the records of a pack be listed without
+reading the payloads.  A pack without a valid footer (the one being written
+when the process died) is recovered by scanning its records.
+*/
+
+const packMagic = "DDPK"
+const packVersion = 1
+const packHeaderSize = 6
+
+const recordHeaderSize = 41
+const indexEntrySize = 41
+const footerMagic = "DDPF"
+const trailerSize = 16
+
+//Packs are addressed by 32bit offsets
+const maxPackSize = 1 << 32 - 1
+
+var ErrCorrupt = errors.New("packstore: corrupt pack")
+
+func corruptf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+/*
+Where a record is stored: a 16bit pack number and the 32bit offset of the
+record within the pack.  Fits in 48 bits (a map326.Value).  A valid Location
+is never 0 because records start after the pack header.
+*/
+type Location uint64
+
+func MakeLocation(pack uint16, offset uint32) Location {
+	return Location(pack) << 32 | Location(offset)
+}
+
+func (loc Location) Pack() uint16 {
+	return uint16(loc >> 32)
+}
+
+func (loc Location) Offset() uint32 {
+	return uint32(loc)
+}
+
+func (loc Location) String() string {
+	return fmt.Sprintf("%d:%d", loc.Pack(), loc.Offset())
+}
+
+//Implements encoding.TextMarshaler ("pack:offset", as String)
+func (loc Location) MarshalText() ([]byte, error) {
+	return []byte(loc.String()), nil
+}
+
+func (loc *Location) UnmarshalText(text []byte) error {
+	var pack uint16
+	var offset uint32
+	_, err := fmt.Sscanf(string(text), "%d:%d", &pack, &offset)
+	parsed := MakeLocation(pack, offset)
+	if err != nil || parsed.String() != string(text) {
+		return fmt.Errorf("packstore: bad location %q", text)
+	}
+	*loc = parsed
+	return nil
+}
+
+//Encode as a map326.Value (big-endian, like map326.ValueFromInt)
+func (loc Location) Value() (v map326.Value) {
+	for i := range v {
+		v[i] = byte(loc >> (8 * (5 - i)))
+	}
+	return
+}
+
+func LocationFromValue(v map326.Value) Location {
+	var loc Location
+	for _, b := range v {
+		loc = loc << 8 | Location(b)
+	}
+	return loc
+}
+
+//A record as listed by ForEach
+type IndexEntry struct {
+	Loc Location
+	Digest chunker.Digest
+	Length uint32
+	Flags uint8
+}
+
+func encodeRecordHeader(enc *util.Encoder, digest *chunker.Digest, length uint32, flags uint8) {
+	start := enc.Len()
+	enc.PutBytes(digest[:])
+	enc.PutUint32(length)
+	enc.PutUint8(flags)
+	enc.PutCRC32C(start)
+}
+
+//Decode and check a record header.  Returns an error wrapping ErrCorrupt if invalid.
+func decodeRecordHeader(hdr []byte) (digest chunker.Digest, length uint32, flags uint8, err error) {
+	dec := util.NewDecoder(hdr)
+	copy(digest[:], dec.Bytes(len(digest)))
+	length = dec.Uint32()
+	flags = dec.Uint8()
+	dec.CheckCRC32C(0)
+	if err = dec.Finish(); err != nil {
+		err = corruptf("record header: %v", err)
+	}
+	return
+}
+
+//The footer for entries, which start at offset indexOffset
+func encodeFooter(entries []IndexEntry, indexOffset uint32) []byte {
+	enc := util.NewEncoder(make([]byte, 0, len(entries) * indexEntrySize + trailerSize))
+	for i := range entries {
+		e := &entries[i]
+		enc.PutBytes(e.Digest[:])
+		enc.PutUint32(e.Loc.Offset())
+		enc.PutUint32(e.Length)
+		enc.PutUint8(e.Flags)
+	}
+	enc.PutUint32(indexOffset)
+	enc.PutUint32(uint32(len(entries)))
+	enc.PutCRC32C(0)
+	enc.PutBytes([]byte(footerMagic))
+	return enc.Bytes()
+}
+
+/*
+Where the footer of a pack of size bytes starts according to its trailer, or
+-1 if there is no trailer.  Unlike readFooter this does not check the footer
+itself, so a scan can stop short of a damaged one.
+*/
+func footerOffset(f io.ReaderAt, size int64) int64 {
+	var trailer [trailerSize]byte
+	if size < packHeaderSize + trailerSize {
+		return -1
+	}
+	if _, err := f.ReadAt(trailer[:], size - trailerSize); err != nil || string(trailer[12:]) != footerMagic {
+		return -1
+	}
+	at := int64(util.Uint32FromBytes(trailer[:]))
+	if at < packHeaderSize || at > size - trailerSize {
+		return -1
+	}
+	return at
+}
+
+/*
+Read the footer of a pack of size bytes.  ok is false if there is no valid
+footer.  The entries are checked to lie within the record area.
+*/
+func readFooter(f io.ReaderAt, pack uint16, size int64) (entries []IndexEntry, indexOffset int64, ok bool) {
+	if size < packHeaderSize + trailerSize {
+		return nil, 0, false
+	}
+	var trailer [trailerSize]byte
+	if _, err := f.ReadAt(trailer[:], size - trailerSize); err != nil {
+		return nil, 0, false
+	}
+	if string(trailer[12:]) != footerMagic {
+		return nil, 0, false
+	}
+	dec := util.NewDecoder(trailer[:])
+	indexOffset = int64(dec.Uint32())
+	count := int64(dec.Uint32())
+	if indexOffset < packHeaderSize || indexOffset + count * indexEntrySize != size - trailerSize {
+		return nil, 0, false
+	}
+
+	footer := make([]byte, size - indexOffset - 4)
+	if _, err := f.ReadAt(footer, indexOffset); err != nil {
+		return nil, 0, false
+	}
+	dec = util.NewDecoder(footer)
+	end := uint32(packHeaderSize)
+	for i := int64(0); i < count; i++ {
+		var e IndexEntry
+		copy(e.Digest[:], dec.Bytes(len(e.Digest)))
+		offset := dec.Uint32()
+		e.Length = dec.Uint32()
+		e.Flags = dec.Uint8()
+		//records are contiguous, in order, and end where the index starts
+		if offset != end || int64(offset) + recordHeaderSize + int64(e.Length) > indexOffset {
+			return nil, 0, false
+		}
+		end = offset + recordHeaderSize + e.Length
+		e.Loc = MakeLocation(pack, offset)
+		entries = append(entries, e)
+	}
+	dec.Uint32()
+	dec.Uint32()
+	dec.CheckCRC32C(0)
+	if dec.Finish() != nil || int64(end) != indexOffset {
+		return nil, 0, false
+	}
+	return entries, indexOffset, true
+}
+
+/*
+Scan the records of a pack from its header, stopping at the first which is
+torn (a short or corrupt header, or a payload running past stopAt).  Returns
+the records and the offset just past the last of them.
+
+Payloads are verified against their digests.  A record whose header is intact
+but whose payload is not is bitrot: it is returned in entries (so the records
+stay contiguous, as a footer lists them) and its location in bad, and the scan
+carries on after it.  Bad records at the very end are treated as torn instead,
+since their payloads may never have been synced.
+*/
+func scanRecords(f io.ReaderAt, pack uint16, stopAt int64) (entries []IndexEntry, bad []Location, validEnd int64) {
+	validEnd = packHeaderSize
+	var hdr [recordHeaderSize]byte
+	var payload []byte
+	for validEnd + recordHeaderSize <= stopAt {
+		if _, err := f.ReadAt(hdr[:], validEnd); err != nil {
+			break
+		}
+		digest, length, flags, err := decodeRecordHeader(hdr[:])
+		if err != nil || validEnd + recordHeaderSize + int64(length) > stopAt {
+			break
+		}
+		if cap(payload) < int(length) {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := f.ReadAt(payload, validEnd + recordHeaderSize); err != nil {
+			break
+		}
+		loc := MakeLocation(pack, uint32(validEnd))
+		if sha256.Sum256(payload) != digest {
+			bad = append(bad, loc)
+		}
+		entries = append(entries, IndexEntry{
+			Loc: loc,
+			Digest: digest,
+			Length: length,
+			Flags: flags,
+		})
+		validEnd += recordHeaderSize + int64(length)
+	}
+
+	//drop bad records with nothing intact after them
+	for len(bad) > 0 && len(entries) > 0 && bad[len(bad) - 1] == entries[len(entries) - 1].Loc {
+		validEnd = int64(bad[len(bad) - 1].Offset())
+		bad = bad[:len(bad) - 1]
+		entries = entries[:len(entries) - 1]
+	}
+	return entries, bad, validEnd
+}
+
+//Check a pack header
+func checkPackHeader(f io.ReaderAt) error {
+	var hdr [packHeaderSize]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		return corruptf("pack header: %v", err)
+	}
+	return decodePackHeader(hdr[:])
+}
+
+func decodePackHeader(hdr []byte) error {
+	dec := util.NewDecoder(hdr)
+	dec.Header(packMagic, packVersion)
+	if err := dec.Finish(); err != nil {
+		return corruptf("pack header: %v", err)
+	}
+	return nil
+}
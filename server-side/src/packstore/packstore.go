@@ -0,0 +1,513 @@
+/*
+An append-only store of chunks in pack files.
+
+Chunks are appended to the current pack until it reaches Options.MaxPackSize,
+then the pack is sealed with a footer listing its records and a new pack is
+started.  Put returns a Location which fits in a map326.Value so the digest
+index can map each digest to where its chunk is stored.
+
+Writes are not synced individually.  The current pack is fsynced once
+Options.SyncBytes have been written since the last sync, and by Sync and
+Close.  After a crash, Open truncates the unsynced tail of the last pack back
+to its last complete record, so chunks stored since the last Sync may be lost
+and must be re-stored (their digests must not be trusted to be in the store
+until Sync returns).
+*/
+package packstore
+
+import (
+	"chunker"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"util"
+)
+
+type Options struct {
+	//seal the current pack and start a new one beyond this size.  At most 4GB - 1.
+	MaxPackSize int64
+	//fsync after this many bytes have been written
+	SyncBytes int64
+}
+
+var DefaultOptions = Options{
+	MaxPackSize: 256 * 1024 * 1024,
+	SyncBytes: 16 * 1024 * 1024,
+}
+
+var ErrClosed = errors.New("packstore: store is closed")
+
+//Put on a store opened by OpenReadOnly
+var ErrReadOnly = errors.New("packstore: store is read-only")
+
+//Every pack number has been used
+var ErrFull = errors.New("packstore: no more pack numbers")
+
+//What Open found in the last pack
+type Recovery struct {
+	//the last pack had no valid footer and was scanned
+	Scanned bool
+	Pack uint16
+	//complete records kept
+	Records int
+	//torn bytes cut from the end
+	TruncatedBytes int64
+	//records kept (and counted in Records) whose payload does not match its digest
+	Corrupt []Location
+}
+
+//A chunk read back by Get
+type Record struct {
+	Digest chunker.Digest
+	Flags uint8
+	Data []byte
+}
+
+type Store struct {
+	dir string
+	opts Options
+
+	//Put, Sync and Close take the write lock; Get and ForEach the read lock
+	mu sync.RWMutex
+	closed bool
+	//every pack, including the active one, open for reading
+	packs map[uint16]*os.File
+	//opened by OpenReadOnly: no pack is active and nothing is written
+	readOnly bool
+
+	//nil until the first Put after Open or a roll
+	active *os.File
+	activeNum uint16
+	activeSize int64
+	activeIndex []IndexEntry
+	//number for the next new pack
+	nextPack int
+	unsynced int64
+
+	recovery Recovery
+	//reused to encode records
+	buf []byte
+}
+
+func packName(num uint16) string {
+	return fmt.Sprintf("pack-%05d.pack", num)
+}
+
+//Pack numbers present in dir, sorted
+func listPacks(dir string) ([]uint16, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "pack-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint16
+	for _, name := range names {
+		var num uint16
+		if _, err := fmt.Sscanf(filepath.Base(name), "pack-%05d.pack", &num); err == nil &&
+			filepath.Base(name) == packName(num) {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+/*
+Open the store in dir, creating dir if necessary.  If the last pack was not
+sealed (the process died while writing it) its torn tail is truncated; see
+Recovery.  Records before the tail are kept even if their payloads are
+corrupt.  A pack with a corrupt header fails Open, unless it is the last and
+no longer than a header (torn while the header was written).
+*/
+func Open(dir string, opts Options) (*Store, error) {
+	if opts.MaxPackSize <= packHeaderSize || opts.MaxPackSize > maxPackSize || opts.SyncBytes <= 0 {
+		return nil, fmt.Errorf("packstore: invalid options %+v", opts)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	nums, err := listPacks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir: dir,
+		opts: opts,
+		packs: make(map[uint16]*os.File),
+	}
+	for i, num := range nums {
+		last := i == len(nums) - 1
+		flag := os.O_RDONLY
+		if last {
+			flag = os.O_RDWR
+		}
+		f, err := os.OpenFile(filepath.Join(dir, packName(num)), flag, 0)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.packs[num] = f
+		if last {
+			if err := s.reopenLast(num, f); err != nil {
+				s.closeFiles()
+				return nil, err
+			}
+		} else if err := checkPackHeader(f); err != nil {
+			s.closeFiles()
+			return nil, fmt.Errorf("%s: %w", packName(num), err)
+		}
+		s.nextPack = int(num) + 1
+	}
+	return s, nil
+}
+
+/*
+Open the packs in dir for reading only, eg to scrub them alongside a server
+which has the store open.  Nothing is ever written, truncated or sealed: a
+torn or unsealed last pack is left as it is, and packs with bad headers are
+opened anyway so that they can be reported.  Put returns ErrReadOnly.
+
+Packs created after OpenReadOnly are not seen.
+*/
+func OpenReadOnly(dir string) (*Store, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	nums, err := listPacks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir: dir,
+		packs: make(map[uint16]*os.File),
+		readOnly: true,
+	}
+	for _, num := range nums {
+		f, err := os.Open(filepath.Join(dir, packName(num)))
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.packs[num] = f
+		s.nextPack = int(num) + 1
+	}
+	return s, nil
+}
+
+/*
+Make the last pack the active one again: strip its footer, or recover it if it
+has none.  If it is already full it stays sealed.
+*/
+func (s *Store) reopenLast(num uint16, f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	if err := checkPackHeader(f); err != nil {
+		//the header is synced before any record is written, so only a pack no longer than it can be torn
+		if size > packHeaderSize {
+			return fmt.Errorf("%s: %w", packName(num), err)
+		}
+		s.recovery = Recovery{Scanned: true, Pack: num, TruncatedBytes: size}
+		return s.startPack(num, f)
+	}
+
+	entries, indexOffset, ok := readFooter(f, num, size)
+	if ok && size >= s.opts.MaxPackSize {
+		return nil
+	}
+	if !ok {
+		var bad []Location
+		entries, bad, indexOffset = scanRecords(f, num, size)
+		s.recovery = Recovery{
+			Scanned: true,
+			Pack: num,
+			Records: len(entries),
+			TruncatedBytes: size - indexOffset,
+			Corrupt: bad,
+		}
+	}
+
+	//drop the footer (or torn tail); it is rewritten when the pack is sealed
+	if err := f.Truncate(indexOffset); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.active = f
+	s.activeNum = num
+	s.activeSize = indexOffset
+	s.activeIndex = entries
+	return nil
+}
+
+//Write a new pack header to f and make it the active pack
+func (s *Store) startPack(num uint16, f *os.File) error {
+	enc := util.NewEncoder(nil)
+	enc.PutHeader(packMagic, packVersion)
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(enc.Bytes(), 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.active = f
+	s.activeNum = num
+	s.activeSize = packHeaderSize
+	s.activeIndex = nil
+	return nil
+}
+
+//Create the next pack
+func (s *Store) newPack() error {
+	if s.nextPack > 0xFFFF {
+		return ErrFull
+	}
+	num := uint16(s.nextPack)
+	f, err := os.OpenFile(filepath.Join(s.dir, packName(num)), os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := s.startPack(num, f); err != nil {
+		f.Close()
+		return err
+	}
+	//make the new file's directory entry durable
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		return err
+	}
+	s.packs[num] = f
+	s.nextPack++
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//Write the footer of the active pack, sync it and stop writing to it
+func (s *Store) seal() error {
+	footer := encodeFooter(s.activeIndex, uint32(s.activeSize))
+	if _, err := s.active.WriteAt(footer, s.activeSize); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	s.active = nil
+	s.activeIndex = nil
+	s.unsynced = 0
+	return nil
+}
+
+//What Open found in the last pack.  Zero if it was sealed or there were no packs.
+func (s *Store) Recovery() Recovery {
+	return s.recovery
+}
+
+/*
+Append a chunk and return its location.  digest must be the SHA256 of data;
+it is stored, not recomputed, and Get will report ErrCorrupt if they differ.
+flags are stored for the caller and not interpreted.
+
+The chunk can be read back immediately but is only durable after a sync (see
+the package comment).
+*/
+func (s *Store) Put(digest chunker.Digest, flags uint8, data []byte) (Location, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	recSize := int64(recordHeaderSize + len(data))
+	if recSize > maxPackSize - packHeaderSize - indexEntrySize - trailerSize {
+		return 0, fmt.Errorf("packstore: chunk of %d bytes is too large", len(data))
+	}
+	//seal when full, but always accept one record into an empty pack
+	if s.active != nil && len(s.activeIndex) > 0 &&
+		s.activeSize + recSize + int64(len(s.activeIndex) + 1) * indexEntrySize + trailerSize > s.opts.MaxPackSize {
+		if err := s.seal(); err != nil {
+			return 0, err
+		}
+	}
+	if s.active == nil {
+		if err := s.newPack(); err != nil {
+			return 0, err
+		}
+	}
+
+	enc := util.NewEncoder(s.buf[:0])
+	encodeRecordHeader(enc, &digest, uint32(len(data)), flags)
+	enc.PutBytes(data)
+	s.buf = enc.Bytes()
+	if _, err := s.active.WriteAt(s.buf, s.activeSize); err != nil {
+		return 0, err
+	}
+
+	loc := MakeLocation(s.activeNum, uint32(s.activeSize))
+	s.activeIndex = append(s.activeIndex, IndexEntry{
+		Loc: loc,
+		Digest: digest,
+		Length: uint32(len(data)),
+		Flags: flags,
+	})
+	s.activeSize += recSize
+	s.unsynced += recSize
+	if s.unsynced >= s.opts.SyncBytes {
+		if err := s.syncLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return loc, nil
+}
+
+func (s *Store) syncLocked() error {
+	if s.active == nil || s.unsynced == 0 {
+		return nil
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	s.unsynced = 0
+	return nil
+}
+
+//Make every chunk Put so far durable
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.syncLocked()
+}
+
+/*
+Read the chunk at loc, appending its data to dst[:0] (which may be nil).
+The data is verified against the stored digest; a mismatch or an invalid
+location is reported as an error wrapping ErrCorrupt.
+*/
+func (s *Store) Get(loc Location, dst []byte) (Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return Record{}, ErrClosed
+	}
+
+	f := s.packs[loc.Pack()]
+	if f == nil || loc.Offset() < packHeaderSize {
+		return Record{}, corruptf("no record at %v", loc)
+	}
+	var hdr [recordHeaderSize]byte
+	if _, err := f.ReadAt(hdr[:], int64(loc.Offset())); err != nil {
+		return Record{}, corruptf("record at %v: %v", loc, err)
+	}
+	digest, length, flags, err := decodeRecordHeader(hdr[:])
+	if err != nil {
+		return Record{}, fmt.Errorf("record at %v: %w", loc, err)
+	}
+
+	if cap(dst) < int(length) {
+		dst = make([]byte, length)
+	}
+	data := dst[:length]
+	if _, err := f.ReadAt(data, int64(loc.Offset()) + recordHeaderSize); err != nil {
+		return Record{}, corruptf("record at %v: %v", loc, err)
+	}
+	if sha256.Sum256(data) != digest {
+		return Record{}, corruptf("record at %v: digest mismatch", loc)
+	}
+	return Record{Digest: digest, Flags: flags, Data: data}, nil
+}
+
+/*
+Call fn for every record, in pack and offset order.  Sealed packs are listed
+from their footers without reading the payloads; a pack whose footer is damaged
+is scanned instead.  Stops at the first error from fn and returns it.
+*/
+func (s *Store) ForEach(fn func(e IndexEntry) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	nums := make([]int, 0, len(s.packs))
+	for num := range s.packs {
+		nums = append(nums, int(num))
+	}
+	sort.Ints(nums)
+
+	for _, n := range nums {
+		num := uint16(n)
+		var entries []IndexEntry
+		if s.active != nil && num == s.activeNum {
+			entries = s.activeIndex
+		} else {
+			f := s.packs[num]
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			var ok bool
+			entries, _, ok = readFooter(f, num, info.Size())
+			if !ok {
+				entries, _, _ = scanRecords(f, num, info.Size())
+			}
+		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) closeFiles() {
+	for _, f := range s.packs {
+		f.Close()
+	}
+	s.packs = nil
+}
+
+/*
+Seal the active pack (it is reopened for appending by the next Open) and close
+all files.
+*/
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+
+	var err error
+	if s.active != nil {
+		err = s.seal()
+	}
+	s.closeFiles()
+	return err
+}
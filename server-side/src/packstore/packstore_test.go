@@ -0,0 +1,396 @@
+package packstore
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"bytes"
+	"chunker"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"util"
+)
+
+func makeChunk(seed uint64, size int) (chunker.Digest, []byte) {
+	data := make([]byte, size)
+	util.NewRandStream64(seed).Read(data)
+	return sha256.Sum256(data), data
+}
+
+//Abandon a store without sealing, as if the process died
+func crash(s *Store) {
+	s.closeFiles()
+	s.closed = true
+}
+
+func TestLocation(t *testing.T) {
+	req := require.New(t)
+
+	loc := MakeLocation(0xBEEF, 0xDEADBEEF)
+	req.Equal(uint16(0xBEEF), loc.Pack())
+	req.Equal(uint32(0xDEADBEEF), loc.Offset())
+	req.Equal(loc, LocationFromValue(loc.Value()))
+	req.Equal([6]byte{0xBE, 0xEF, 0xDE, 0xAD, 0xBE, 0xEF}, [6]byte(loc.Value()))
+	req.Equal("48879:3735928559", loc.String())
+}
+
+func TestPutGet(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+
+	var locs []Location
+	for i := 0; i < 100; i++ {
+		digest, data := makeChunk(uint64(i), i * 100)
+		loc, err := s.Put(digest, uint8(i), data)
+		req.NoError(err)
+		req.NotEqual(Location(0), loc)
+		locs = append(locs, loc)
+	}
+
+	var buf []byte
+	for i, loc := range locs {
+		digest, data := makeChunk(uint64(i), i * 100)
+		rec, err := s.Get(loc, buf)
+		req.NoError(err)
+		req.Equal(digest, rec.Digest)
+		req.Equal(uint8(i), rec.Flags)
+		req.True(bytes.Equal(data, rec.Data))
+		buf = rec.Data
+	}
+	req.NoError(s.Close())
+
+	//readable after reopening, and new chunks go into the same pack
+	s, err = Open(dir, DefaultOptions)
+	req.NoError(err)
+	req.Equal(Recovery{}, s.Recovery())
+	digest, data := makeChunk(1000, 500)
+	loc, err := s.Put(digest, 0, data)
+	req.NoError(err)
+	req.Equal(uint16(0), loc.Pack())
+	rec, err := s.Get(locs[50], nil)
+	req.NoError(err)
+	req.Len(rec.Data, 5000)
+
+	n := 0
+	req.NoError(s.ForEach(func(e IndexEntry) error {
+		if n < len(locs) {
+			req.Equal(locs[n], e.Loc)
+		}
+		n++
+		return nil
+	}))
+	req.Equal(101, n)
+	req.NoError(s.Close())
+
+	_, err = s.Put(digest, 0, data)
+	req.Equal(ErrClosed, err)
+}
+
+func TestRollPacks(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	opts := Options{MaxPackSize: 20000, SyncBytes: 5000}
+
+	s, err := Open(dir, opts)
+	req.NoError(err)
+	var locs []Location
+	for i := 0; i < 50; i++ {
+		digest, data := makeChunk(uint64(i), 3000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		locs = append(locs, loc)
+		req.Less(s.unsynced, opts.SyncBytes)
+	}
+	//6 chunks per pack
+	req.Equal(uint16(8), locs[49].Pack())
+	req.Equal(uint32(packHeaderSize), locs[6].Offset())
+
+	//sealed packs have valid footers and are no bigger than MaxPackSize
+	for num := uint16(0); num < 8; num++ {
+		f := s.packs[num]
+		info, err := f.Stat()
+		req.NoError(err)
+		req.LessOrEqual(info.Size(), opts.MaxPackSize)
+		entries, _, ok := readFooter(f, num, info.Size())
+		req.True(ok)
+		req.Len(entries, 6)
+		req.Equal(locs[num * 6 + 2], entries[2].Loc)
+	}
+
+	//a chunk bigger than MaxPackSize gets a pack of its own
+	digest, data := makeChunk(99, 30000)
+	loc, err := s.Put(digest, 0, data)
+	req.NoError(err)
+	req.Equal(uint16(9), loc.Pack())
+	req.NoError(s.Close())
+
+	//a full last pack stays sealed
+	s, err = Open(dir, opts)
+	req.NoError(err)
+	digest, data = makeChunk(100, 100)
+	loc, err = s.Put(digest, 0, data)
+	req.NoError(err)
+	req.Equal(uint16(10), loc.Pack())
+
+	var seen []Location
+	req.NoError(s.ForEach(func(e IndexEntry) error {
+		seen = append(seen, e.Loc)
+		return nil
+	}))
+	req.Equal(52, len(seen))
+	req.Equal(locs, seen[:50])
+
+	stop := errors.New("stop")
+	req.Equal(stop, s.ForEach(func(e IndexEntry) error { return stop }))
+	req.NoError(s.Close())
+}
+
+func TestRecoverTornPack(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	var locs []Location
+	for i := 0; i < 10; i++ {
+		digest, data := makeChunk(uint64(i), 1000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		locs = append(locs, loc)
+	}
+	req.NoError(s.Sync())
+	crash(s)
+
+	//the last record was only partly written
+	path := filepath.Join(dir, packName(0))
+	info, err := os.Stat(path)
+	req.NoError(err)
+	req.NoError(os.Truncate(path, info.Size() - 300))
+
+	s, err = Open(dir, DefaultOptions)
+	req.NoError(err)
+	req.Equal(Recovery{Scanned: true, Pack: 0, Records: 9, TruncatedBytes: recordHeaderSize + 1000 - 300}, s.Recovery())
+	for _, loc := range locs[:9] {
+		_, err := s.Get(loc, nil)
+		req.NoError(err)
+	}
+	_, err = s.Get(locs[9], nil)
+	req.True(errors.Is(err, ErrCorrupt))
+
+	//appending continues where the valid records end
+	digest, data := makeChunk(9, 1000)
+	loc, err := s.Put(digest, 0, data)
+	req.NoError(err)
+	req.Equal(locs[9], loc)
+	crash(s)
+
+	//garbage after the last record (eg a reused disk block) is also cut
+	f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0)
+	req.NoError(err)
+	f.Write(make([]byte, 100))
+	f.Close()
+	s, err = Open(dir, DefaultOptions)
+	req.NoError(err)
+	req.Equal(10, s.Recovery().Records)
+	req.Equal(int64(100), s.Recovery().TruncatedBytes)
+	req.NoError(s.Close())
+}
+
+func TestRecoverTornHeader(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, Options{MaxPackSize: 5000, SyncBytes: 1000})
+	req.NoError(err)
+	digest, data := makeChunk(1, 4000)
+	_, err = s.Put(digest, 0, data)
+	req.NoError(err)
+	req.NoError(s.Close())
+
+	//the process died just after creating pack 1
+	req.NoError(os.WriteFile(filepath.Join(dir, packName(1)), []byte("DD"), 0644))
+
+	s, err = Open(dir, Options{MaxPackSize: 5000, SyncBytes: 1000})
+	req.NoError(err)
+	req.Equal(Recovery{Scanned: true, Pack: 1, TruncatedBytes: 2}, s.Recovery())
+	loc, err := s.Put(digest, 0, data)
+	req.NoError(err)
+	req.Equal(MakeLocation(1, packHeaderSize), loc)
+	req.NoError(s.Close())
+}
+
+//Bitrot in a synced record of the last pack is not mistaken for a torn tail
+func TestRecoverBitrot(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	var locs []Location
+	for i := 0; i < 20; i++ {
+		digest, data := makeChunk(uint64(i), 1000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		locs = append(locs, loc)
+	}
+	req.NoError(s.Sync())
+	crash(s)
+
+	path := filepath.Join(dir, packName(0))
+	raw, err := os.ReadFile(path)
+	req.NoError(err)
+	raw[int(locs[2].Offset()) + recordHeaderSize + 10] ^= 1
+	raw[int(locs[19].Offset()) + recordHeaderSize + 10] ^= 1
+	req.NoError(os.WriteFile(path, raw, 0644))
+
+	//the last record may never have been synced, so it is cut; the one before is kept
+	s, err = Open(dir, DefaultOptions)
+	req.NoError(err)
+	req.Equal(Recovery{
+		Scanned: true,
+		Records: 19,
+		TruncatedBytes: recordHeaderSize + 1000,
+		Corrupt: []Location{locs[2]},
+	}, s.Recovery())
+	_, err = s.Get(locs[2], nil)
+	req.True(errors.Is(err, ErrCorrupt))
+	for _, loc := range locs[3:19] {
+		_, err := s.Get(loc, nil)
+		req.NoError(err)
+	}
+	digest, data := makeChunk(19, 1000)
+	loc, err := s.Put(digest, 0, data)
+	req.NoError(err)
+	req.Equal(locs[19], loc)
+	req.NoError(s.Close())
+
+	//the footer lists the corrupt record, so the pack is sealed normally
+	s, err = Open(dir, DefaultOptions)
+	req.NoError(err)
+	req.Equal(Recovery{}, s.Recovery())
+	n := 0
+	req.NoError(s.ForEach(func(e IndexEntry) error {
+		n++
+		return nil
+	}))
+	req.Equal(20, n)
+	req.NoError(s.Close())
+}
+
+//A corrupt header on a last pack longer than a header fails Open and leaves the pack alone
+func TestCorruptLastHeader(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	for i := 0; i < 20; i++ {
+		digest, data := makeChunk(uint64(i), 1000)
+		_, err := s.Put(digest, 0, data)
+		req.NoError(err)
+	}
+	req.NoError(s.Close())
+
+	path := filepath.Join(dir, packName(0))
+	raw, err := os.ReadFile(path)
+	req.NoError(err)
+	raw[1] ^= 1
+	req.NoError(os.WriteFile(path, raw, 0644))
+
+	_, err = Open(dir, DefaultOptions)
+	req.True(errors.Is(err, ErrCorrupt))
+	after, err := os.ReadFile(path)
+	req.NoError(err)
+	req.Equal(raw, after)
+}
+
+//OpenReadOnly leaves a torn last pack as it is
+func TestOpenReadOnly(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	var locs []Location
+	for i := 0; i < 5; i++ {
+		digest, data := makeChunk(uint64(i), 1000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		locs = append(locs, loc)
+	}
+	req.NoError(s.Sync())
+	crash(s)
+	path := filepath.Join(dir, packName(0))
+	info, err := os.Stat(path)
+	req.NoError(err)
+	req.NoError(os.Truncate(path, info.Size() - 300))
+	before, err := os.ReadFile(path)
+	req.NoError(err)
+
+	s, err = OpenReadOnly(dir)
+	req.NoError(err)
+	req.Equal(Recovery{}, s.Recovery())
+	for i, loc := range locs[:4] {
+		rec, err := s.Get(loc, nil)
+		req.NoError(err)
+		digest, _ := makeChunk(uint64(i), 1000)
+		req.Equal(digest, rec.Digest)
+	}
+	digest, data := makeChunk(5, 1000)
+	_, err = s.Put(digest, 0, data)
+	req.ErrorIs(err, ErrReadOnly)
+	req.NoError(s.Sync())
+	req.NoError(s.Close())
+
+	after, err := os.ReadFile(path)
+	req.NoError(err)
+	req.Equal(before, after)
+
+	_, err = OpenReadOnly(filepath.Join(dir, "missing"))
+	req.Error(err)
+}
+
+func TestCorruption(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	digest, data := makeChunk(1, 1000)
+	loc, err := s.Put(digest, 0, data)
+	req.NoError(err)
+	req.NoError(s.Close())
+
+	//flip a payload byte
+	path := filepath.Join(dir, packName(0))
+	raw, err := os.ReadFile(path)
+	req.NoError(err)
+	raw[int(loc.Offset()) + recordHeaderSize + 10] ^= 1
+	req.NoError(os.WriteFile(path, raw, 0644))
+
+	s, err = Open(dir, DefaultOptions)
+	req.NoError(err)
+	_, err = s.Get(loc, nil)
+	req.True(errors.Is(err, ErrCorrupt))
+	req.Contains(err.Error(), "digest mismatch")
+
+	for _, bad := range []Location{0, MakeLocation(0, 3), MakeLocation(7, packHeaderSize), loc + 1} {
+		_, err = s.Get(bad, nil)
+		req.True(errors.Is(err, ErrCorrupt), "%v", bad)
+	}
+	req.NoError(s.Close())
+
+	//a corrupt header on a pack other than the last fails Open
+	req.NoError(os.WriteFile(filepath.Join(dir, packName(1)), nil, 0644))
+	raw[0] = 'X'
+	req.NoError(os.WriteFile(path, raw, 0644))
+	_, err = Open(dir, DefaultOptions)
+	req.True(errors.Is(err, ErrCorrupt))
+
+	_, err = Open(dir, Options{MaxPackSize: 1 << 40, SyncBytes: 1})
+	req.Error(err)
+}
@@ -0,0 +1,269 @@
+package packstore
+
+import (
+	"bufio"
+	"chunker"
+	"errors"
+	"fmt"
+	"map326"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+/*
+Rebuilding the digest index from the packs alone, for when the index is lost
+or damaged.  Pack footers are read in parallel; a pack whose footer is damaged
+(or missing, like the last pack after a crash) is scanned record by record,
+which reads and verifies every payload so is much slower.  The scan carries on
+past a corrupt payload but not past a damaged record header; both are listed
+in the RebuildReport, as their chunks are missing from the index.
+*/
+
+type RebuildOptions struct {
+	//packs read at once.  Default runtime.NumCPU().
+	Parallelism int
+	//capacity of the new index.  Default: a quarter more than the number of records found.
+	Capacity int
+	//called after each pack has been read, from the goroutine which called Rebuild
+	Progress func(p RebuildProgress)
+}
+
+type RebuildProgress struct {
+	PacksDone int
+	PacksTotal int
+	//records read so far
+	Records int64
+}
+
+//A digest stored at more than one location.  The index keeps the first.
+type Duplicate struct {
+	Digest chunker.Digest
+	Kept Location
+	Dropped Location
+}
+
+const maxDuplicateSamples = 100
+
+/*
+The end of a scanned pack which could not be read as records: a torn tail, or
+everything after a damaged record header.  Chunks stored there are not indexed.
+*/
+type Unindexed struct {
+	Pack uint16
+	Offset int64
+	Bytes int64
+}
+
+type RebuildReport struct {
+	Packs int
+	//records added to the index (not counting duplicates)
+	Records int64
+	//packs with a missing or damaged footer which were scanned
+	Scanned []uint16
+	//packs which could not be read at all (bad header or I/O error)
+	Unreadable []uint16
+	//records of scanned packs whose payload does not match its digest.  They are not indexed.
+	Corrupt []Location
+	//the ends of scanned packs which could not be read
+	Unindexed []Unindexed
+	//number of records whose digest was already in the index
+	Duplicates int64
+	//the first few of them
+	DuplicateSamples []Duplicate
+}
+
+//Records of one pack, read by a worker
+type packEntries struct {
+	entries []IndexEntry
+	scanned bool
+	//found by scanning
+	corrupt []Location
+	unindexed Unindexed
+	err error
+}
+
+//List the records of a pack file without modifying it
+func readPackEntries(path string, num uint16) packEntries {
+	f, err := os.Open(path)
+	if err != nil {
+		return packEntries{err: err}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return packEntries{err: err}
+	}
+	if err := checkPackHeader(f); err != nil {
+		return packEntries{err: err}
+	}
+	if entries, _, ok := readFooter(f, num, info.Size()); ok {
+		return packEntries{entries: entries}
+	}
+	//stop where a damaged footer starts, if its trailer still says
+	stopAt := info.Size()
+	if at := footerOffset(f, info.Size()); at >= 0 {
+		stopAt = at
+	}
+	entries, bad, validEnd := scanRecords(f, num, stopAt)
+	res := packEntries{
+		scanned: true,
+		corrupt: bad,
+		unindexed: Unindexed{Pack: num, Offset: validEnd, Bytes: stopAt - validEnd},
+	}
+	isBad := make(map[Location]bool, len(bad))
+	for _, loc := range bad {
+		isBad[loc] = true
+	}
+	for _, e := range entries {
+		if !isBad[e.Loc] {
+			res.entries = append(res.entries, e)
+		}
+	}
+	return res
+}
+
+/*
+Build a new map326.Map from the packs in dir, mapping each digest to its
+Location (see Location.Value).  dir is only read, so this is safe while no
+Store has it open for writing.
+
+Records are added in pack and offset order so that when a digest is stored
+more than once (eg re-stored after a crash lost the index) the oldest copy
+is kept.  Every record is held in memory until all packs are read, about 60
+bytes each.
+*/
+func Rebuild(dir string, opts RebuildOptions) (*map326.Map, RebuildReport, error) {
+	var report RebuildReport
+	nums, err := listPacks(dir)
+	if err != nil {
+		return nil, report, err
+	}
+	report.Packs = len(nums)
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	results := make([]packEntries, len(nums))
+	done := make(chan int)
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(parallelism, len(nums)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = readPackEntries(filepath.Join(dir, packName(nums[i])), nums[i])
+				done <- i
+			}
+		}()
+	}
+	go func() {
+		for i := range nums {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+		close(done)
+	}()
+
+	var progress RebuildProgress
+	progress.PacksTotal = len(nums)
+	for i := range done {
+		progress.PacksDone++
+		progress.Records += int64(len(results[i].entries))
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+
+	for i, res := range results {
+		switch {
+		case res.err != nil:
+			report.Unreadable = append(report.Unreadable, nums[i])
+		case res.scanned:
+			report.Scanned = append(report.Scanned, nums[i])
+			report.Corrupt = append(report.Corrupt, res.corrupt...)
+			if res.unindexed.Bytes > 0 {
+				report.Unindexed = append(report.Unindexed, res.unindexed)
+			}
+		}
+	}
+
+	capacity := opts.Capacity
+	if capacity <= 0 {
+		capacity = max(int(progress.Records + progress.Records / 4), 1024)
+	}
+	m, err := map326.New(capacity)
+	if err != nil {
+		return nil, report, err
+	}
+
+	for _, res := range results {
+		for _, e := range res.entries {
+			if kept, found := m.Get(e.Digest[:]); found {
+				report.Duplicates++
+				if len(report.DuplicateSamples) < maxDuplicateSamples {
+					report.DuplicateSamples = append(report.DuplicateSamples, Duplicate{
+						Digest: e.Digest,
+						Kept: LocationFromValue(kept),
+						Dropped: e.Loc,
+					})
+				}
+				continue
+			}
+			if m.Put(e.Digest[:], e.Loc.Value()) == 0 {
+				return nil, report, errors.New("packstore: index full while rebuilding; increase Capacity")
+			}
+			report.Records++
+		}
+	}
+	return m, report, nil
+}
+
+/*
+Save an index to path (see map326.Map.WriteTo), replacing any existing file
+only once the new one is complete and synced, so a crash leaves either the old
+index or the new one.
+*/
+func WriteIndex(path string, m *map326.Map) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := m.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+//Load an index saved by WriteIndex
+func ReadIndex(path string) (*map326.Map, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &map326.Map{}
+	if _, err := m.ReadFrom(bufio.NewReader(f)); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,167 @@
+package packstore
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"chunker"
+	"map326"
+	"os"
+	"path/filepath"
+)
+
+func TestRebuild(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, Options{MaxPackSize: 20000, SyncBytes: 5000})
+	req.NoError(err)
+	want := make(map[chunker.Digest]Location)
+	for i := 0; i < 60; i++ {
+		digest, data := makeChunk(uint64(i), 1500)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		want[digest] = loc
+	}
+	//chunks 0 to 4 stored again in later packs
+	for i := 0; i < 5; i++ {
+		digest, data := makeChunk(uint64(i), 1500)
+		_, err := s.Put(digest, 0, data)
+		req.NoError(err)
+	}
+	req.NoError(s.Sync())
+	//the last pack (5) is left without a footer
+	crash(s)
+
+	//damage the footer of pack 2
+	path := filepath.Join(dir, packName(2))
+	raw, err := os.ReadFile(path)
+	req.NoError(err)
+	raw[len(raw) - trailerSize - 10] ^= 1
+	req.NoError(os.WriteFile(path, raw, 0644))
+
+	var progress []RebuildProgress
+	m, report, err := Rebuild(dir, RebuildOptions{
+		Parallelism: 3,
+		Progress: func(p RebuildProgress) {
+			progress = append(progress, p)
+		},
+	})
+	req.NoError(err)
+	req.Equal(6, report.Packs)
+	req.Equal(int64(60), report.Records)
+	req.Equal([]uint16{2, 5}, report.Scanned)
+	req.Empty(report.Unreadable)
+	req.Empty(report.Corrupt)
+	req.Empty(report.Unindexed)
+	req.Equal(int64(5), report.Duplicates)
+	req.Len(report.DuplicateSamples, 5)
+	for _, dup := range report.DuplicateSamples {
+		req.Equal(want[dup.Digest], dup.Kept)
+		req.Equal(uint16(5), dup.Dropped.Pack())
+	}
+
+	req.Len(progress, 6)
+	req.Equal(RebuildProgress{PacksDone: 6, PacksTotal: 6, Records: 65}, progress[5])
+
+	req.Equal(60, m.Len())
+	for digest, loc := range want {
+		v, found := m.Get(digest[:])
+		req.True(found)
+		req.Equal(loc, LocationFromValue(v))
+	}
+
+	//the packs were not modified: the last one still has no footer
+	info, err := os.Stat(filepath.Join(dir, packName(5)))
+	req.NoError(err)
+	f, err := os.Open(filepath.Join(dir, packName(5)))
+	req.NoError(err)
+	_, _, ok := readFooter(f, 5, info.Size())
+	f.Close()
+	req.False(ok)
+
+	//an unreadable pack is reported and the rest still indexed
+	req.NoError(os.WriteFile(filepath.Join(dir, packName(3)), []byte("junk"), 0644))
+	m, report, err = Rebuild(dir, RebuildOptions{})
+	req.NoError(err)
+	req.Equal([]uint16{3}, report.Unreadable)
+	req.Less(m.Len(), 60)
+
+	//no packs at all
+	m, report, err = Rebuild(t.TempDir(), RebuildOptions{})
+	req.NoError(err)
+	req.Equal(0, m.Len())
+	req.Equal(0, report.Packs)
+}
+
+//A scanned pack is indexed past a corrupt payload; what cannot be read is reported
+func TestRebuildScanDamage(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	var locs []Location
+	for i := 0; i < 10; i++ {
+		digest, data := makeChunk(uint64(i), 1000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		locs = append(locs, loc)
+	}
+	req.NoError(s.Close())
+
+	//damage the footer, a payload in record 2 and the header of record 7
+	path := filepath.Join(dir, packName(0))
+	raw, err := os.ReadFile(path)
+	req.NoError(err)
+	raw[len(raw) - trailerSize - 10] ^= 1
+	raw[int(locs[2].Offset()) + recordHeaderSize + 10] ^= 1
+	raw[locs[7].Offset()] ^= 1
+	req.NoError(os.WriteFile(path, raw, 0644))
+
+	m, report, err := Rebuild(dir, RebuildOptions{})
+	req.NoError(err)
+	req.Equal([]uint16{0}, report.Scanned)
+	req.Equal([]Location{locs[2]}, report.Corrupt)
+	req.Equal([]Unindexed{{Pack: 0, Offset: int64(locs[7].Offset()), Bytes: 3 * (recordHeaderSize + 1000)}},
+		report.Unindexed)
+	req.Equal(int64(6), report.Records)
+	for i, loc := range locs {
+		digest, _ := makeChunk(uint64(i), 1000)
+		v, found := m.Get(digest[:])
+		req.Equal(i != 2 && i < 7, found, "record %d", i)
+		if found {
+			req.Equal(loc, LocationFromValue(v))
+		}
+	}
+}
+
+func TestWriteReadIndex(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "index")
+
+	m, err := map326.New(200000)
+	req.NoError(err)
+	var digests []chunker.Digest
+	for i := 0; i < 5000; i++ {
+		digest, _ := makeChunk(uint64(i), 10)
+		req.Equal(1, m.Put(digest[:], MakeLocation(uint16(i % 7), uint32(i)).Value()))
+		digests = append(digests, digest)
+	}
+	req.NoError(WriteIndex(path, m))
+
+	loaded, err := ReadIndex(path)
+	req.NoError(err)
+	req.Equal(m.Len(), loaded.Len())
+	for i, digest := range digests {
+		v, found := loaded.Get(digest[:])
+		req.True(found)
+		req.Equal(MakeLocation(uint16(i % 7), uint32(i)), LocationFromValue(v))
+	}
+	_, err = os.Stat(path + ".tmp")
+	req.True(os.IsNotExist(err))
+
+	//a damaged file names itself
+	req.NoError(os.WriteFile(path, []byte("junk"), 0644))
+	_, err = ReadIndex(path)
+	req.ErrorContains(err, path)
+}
@@ -0,0 +1,595 @@
+package packstore
+
+import (
+	"chunker"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"map326"
+	"os"
+	"sort"
+	"time"
+	"util"
+)
+
+/*
+Scrubbing: re-reading every stored chunk to find bitrot before a restore needs
+the data.  It runs in two phases:
+
+	1. Every record of every pack is read and its payload hashed.  The result is
+	   compared with the record header, the pack footer and the index.  Records
+	   the index does not point at are orphans (eg chunks re-stored after a
+	   crash); they waste space but lose nothing.
+	2. Every index entry is checked to point at a record with its digest.  A
+	   record phase 1 did not reach (after damage it could not read past, or in
+	   a pack created since) is hashed here; the rest were verified by phase 1.
+
+Progress is kept in the ScrubReport so a scrub interrupted by cancelling its
+context (or by a crash, if the report was saved by Checkpoint) can be resumed.
+
+A store opened by OpenReadOnly can be scrubbed while a server writes to the
+same directory; see UnsealedPack.
+*/
+
+type ScrubOptions struct {
+	//bytes read per second, so a scrub can run alongside backups.  0 for no limit.
+	RateLimit int64
+	//how often Checkpoint is called.  Default 10 seconds.
+	CheckpointInterval time.Duration
+	/*
+	Called periodically, when the scrub stops and when it ends with the report so
+	far, eg to save it as JSON for resuming.  An error stops the scrub.
+	*/
+	Checkpoint func(report *ScrubReport) error
+}
+
+const defaultCheckpointInterval = 10 * time.Second
+
+//A record which failed verification
+type BadChunk struct {
+	Loc Location `json:"location"`
+	//from the record header, if it could be read
+	Digest string `json:"digest,omitempty"`
+	Reason string `json:"reason"`
+}
+
+//An intact record which the index does not point at
+type Orphan struct {
+	Loc Location `json:"location"`
+	Digest string `json:"digest"`
+	Length uint32 `json:"length"`
+	//where the index points for this digest instead, if anywhere
+	IndexedAt *Location `json:"indexed_at,omitempty"`
+}
+
+//An index entry which does not lead to its chunk
+type BadIndexEntry struct {
+	Digest string `json:"digest"`
+	Loc Location `json:"location"`
+	Reason string `json:"reason"`
+}
+
+/*
+The last pack of a store opened by OpenReadOnly, when it has no footer.  Either
+a server has it open, or one died while writing it and the next Open will cut
+TornBytes from its end (chunks there were never synced; see Store), along with
+any corrupt records reported just before them.  If a server is writing the
+pack while it is scrubbed, the tail may be caught mid-write and show as torn.
+*/
+type UnsealedPack struct {
+	Pack uint16 `json:"pack"`
+	//complete records
+	Records int64 `json:"records"`
+	//bytes after the last complete record
+	TornBytes int64 `json:"torn_bytes"`
+}
+
+/*
+Results and progress of a scrub.  Pass a zero report to Scrub to start, or a
+previous unfinished one (eg decoded from JSON) to resume.
+*/
+type ScrubReport struct {
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	//phase 1 resumes at this record
+	NextPack int `json:"next_pack"`
+	NextOffset uint32 `json:"next_offset"`
+	RecordsDone bool `json:"records_done"`
+	//per pack, the end of the records phase 1 verified; phase 2 hashes index entries beyond it
+	CheckedEnd map[uint16]uint32 `json:"checked_end,omitempty"`
+	//phase 2 resumes at this map326 region (see map326.Map.ForEachInRegion)
+	NextRegion int `json:"next_region"`
+	IndexEntriesChecked int64 `json:"index_entries_checked"`
+	Done bool `json:"done"`
+
+	RecordsChecked int64 `json:"records_checked"`
+	BytesChecked int64 `json:"bytes_checked"`
+	BadChunks []BadChunk `json:"bad_chunks"`
+	Orphans []Orphan `json:"orphans"`
+	BadIndexEntries []BadIndexEntry `json:"bad_index_entries"`
+	//not an error in itself; see UnsealedPack
+	Unsealed *UnsealedPack `json:"unsealed,omitempty"`
+}
+
+//True if nothing wrong has been found (orphans are not errors)
+func (r *ScrubReport) OK() bool {
+	return len(r.BadChunks) == 0 && len(r.BadIndexEntries) == 0
+}
+
+//Sleeps to keep the read rate under a limit
+type rateLimiter struct {
+	rate int64
+	start time.Time
+	n int64
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int64) {
+	if l.rate <= 0 {
+		return
+	}
+	l.n += n
+	due := l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+type scrubber struct {
+	s *Store
+	idx *map326.Map
+	opts ScrubOptions
+	report *ScrubReport
+	limiter rateLimiter
+	lastCheckpoint time.Time
+	//locations of bad records, for phase 2
+	bad map[Location]bool
+	//reused to read payloads
+	payload []byte
+}
+
+/*
+Scrub the store, checking it against idx (which may be nil to check only the
+records).  Progress and results accumulate in report; see ScrubReport.
+
+Returns nil once the scrub is complete (report.Done), ctx.Err() if it was
+cancelled, or the first error from Checkpoint or I/O outside the records
+themselves (bad records are reported, not returned).  Chunks may be Put
+meanwhile but idx must not be modified while Scrub runs.  A report which is
+already Done starts a new scrub.
+
+A scrub may be resumed with a different idx, eg one saved or rebuilt since:
+phase 2 resumes by key, so entries in the part of the key space already
+checked are skipped and the rest are all checked.
+*/
+func (s *Store) Scrub(ctx context.Context, idx *map326.Map, opts ScrubOptions, report *ScrubReport) error {
+	if report.Done {
+		*report = ScrubReport{}
+	}
+	now := time.Now()
+	if report.Started.IsZero() {
+		report.Started = now
+	}
+	if report.CheckedEnd == nil {
+		report.CheckedEnd = make(map[uint16]uint32)
+	}
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = defaultCheckpointInterval
+	}
+	sc := &scrubber{
+		s: s,
+		idx: idx,
+		opts: opts,
+		report: report,
+		limiter: rateLimiter{rate: opts.RateLimit, start: now},
+		lastCheckpoint: now,
+		bad: make(map[Location]bool),
+	}
+	for _, b := range report.BadChunks {
+		sc.bad[b.Loc] = true
+	}
+
+	err := sc.run(ctx)
+	if err == nil {
+		report.Done = true
+	}
+	if cpErr := sc.checkpoint(true); err == nil {
+		err = cpErr
+	}
+	return err
+}
+
+func (sc *scrubber) run(ctx context.Context) error {
+	report := sc.report
+	if !report.RecordsDone {
+		nums, err := sc.s.packNums()
+		if err != nil {
+			return err
+		}
+		for i, num := range nums {
+			if int(num) < report.NextPack {
+				continue
+			}
+			if int(num) > report.NextPack {
+				report.NextPack, report.NextOffset = int(num), 0
+			}
+			if err := sc.scrubPack(ctx, num, i == len(nums) - 1); err != nil {
+				return err
+			}
+			report.NextPack, report.NextOffset = int(num) + 1, 0
+		}
+		report.RecordsDone = true
+		if err := sc.checkpoint(true); err != nil {
+			return err
+		}
+	}
+	if sc.idx != nil {
+		return sc.scrubIndex(ctx)
+	}
+	return nil
+}
+
+func (sc *scrubber) checkpoint(force bool) error {
+	now := time.Now()
+	if sc.opts.Checkpoint == nil || (!force && now.Sub(sc.lastCheckpoint) < sc.opts.CheckpointInterval) {
+		return nil
+	}
+	sc.lastCheckpoint = now
+	sc.report.Updated = now
+	return sc.opts.Checkpoint(sc.report)
+}
+
+//Called after each record, and each region of the index
+func (sc *scrubber) step(ctx context.Context, nBytes int64) error {
+	sc.limiter.wait(ctx, nBytes)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sc.checkpoint(false)
+}
+
+//Pack numbers, sorted
+func (s *Store) packNums() ([]uint16, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	nums := make([]uint16, 0, len(s.packs))
+	for num := range s.packs {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+/*
+The records of a pack as listed by its footer (or the in-memory index of the
+active pack).  hasList is false if the pack has no valid footer; end is then
+the file size.
+*/
+func (s *Store) packListing(num uint16) (entries []IndexEntry, hasList bool, end int64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, false, 0, ErrClosed
+	}
+	if s.active != nil && num == s.activeNum {
+		return append([]IndexEntry(nil), s.activeIndex...), true, s.activeSize, nil
+	}
+	f := s.packs[num]
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if entries, indexOffset, ok := readFooter(f, num, info.Size()); ok {
+		return entries, true, indexOffset, nil
+	}
+	return nil, false, info.Size(), nil
+}
+
+//ReadAt on a pack, safe against a concurrent Close
+func (s *Store) readAt(num uint16, buf []byte, off int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	f := s.packs[num]
+	if f == nil {
+		return os.ErrNotExist
+	}
+	_, err := f.ReadAt(buf, off)
+	return err
+}
+
+//digest is "" if unknown
+func (sc *scrubber) addBad(loc Location, digest string, reason string) {
+	sc.report.BadChunks = append(sc.report.BadChunks, BadChunk{Loc: loc, Digest: digest, Reason: reason})
+	sc.bad[loc] = true
+}
+
+func hexDigest(digest []byte) string {
+	return fmt.Sprintf("%x", digest)
+}
+
+func (sc *scrubber) scrubPack(ctx context.Context, num uint16, last bool) error {
+	entries, hasList, end, err := sc.s.packListing(num)
+	if err != nil {
+		return err
+	}
+	resumeAt := int64(sc.report.NextOffset)
+
+	if hasList {
+		for i := range entries {
+			e := &entries[i]
+			if int64(e.Loc.Offset()) < resumeAt {
+				continue
+			}
+			length, _, err := sc.checkRecord(num, int64(e.Loc.Offset()), e)
+			if err != nil {
+				return err
+			}
+			sc.report.NextOffset = e.Loc.Offset() + recordHeaderSize + length
+			sc.report.CheckedEnd[num] = sc.report.NextOffset
+			if err := sc.step(ctx, recordHeaderSize + int64(length)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	//no footer: follow the record headers, stopping at a damaged footer if its trailer still says where it starts
+	footerAt := int64(-1)
+	var trailer [trailerSize]byte
+	if end >= packHeaderSize + trailerSize && sc.s.readAt(num, trailer[:], end - trailerSize) == nil &&
+		string(trailer[12:]) == footerMagic {
+		footerAt = int64(util.Uint32FromBytes(trailer[:]))
+	}
+	//the last pack of a read-only store is expected to have no footer; see UnsealedPack
+	unsealed := last && sc.s.readOnly && footerAt < 0
+	if unsealed && sc.report.Unsealed == nil {
+		sc.report.Unsealed = &UnsealedPack{Pack: num}
+	}
+
+	if resumeAt == 0 {
+		if !unsealed {
+			sc.addBad(MakeLocation(num, 0), "", "pack footer missing or damaged")
+		}
+		var hdr [packHeaderSize]byte
+		if err := sc.s.readAt(num, hdr[:], 0); err != nil || decodePackHeader(hdr[:]) != nil {
+			if unsealed {
+				//torn while the header was being written
+				sc.report.Unsealed.TornBytes = end
+			} else {
+				sc.addBad(MakeLocation(num, 0), "", "bad pack header; pack not checked")
+			}
+			return nil
+		}
+		resumeAt = packHeaderSize
+	}
+	for off := resumeAt; off < end && off != footerAt; {
+		if unsealed && !sc.recordFits(num, off, end) {
+			sc.report.Unsealed.TornBytes = end - off
+			break
+		}
+		if off + recordHeaderSize > end {
+			break
+		}
+		length, known, err := sc.checkRecord(num, off, nil)
+		if err != nil {
+			return err
+		}
+		if !known {
+			sc.addBad(MakeLocation(num, uint32(off)), "", "rest of pack not checked")
+			break
+		}
+		if unsealed {
+			sc.report.Unsealed.Records++
+		}
+		off += recordHeaderSize + int64(length)
+		sc.report.NextOffset = uint32(off)
+		sc.report.CheckedEnd[num] = sc.report.NextOffset
+		if err := sc.step(ctx, recordHeaderSize + int64(length)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//True if a complete record (header and payload) starts at off, before end
+func (sc *scrubber) recordFits(num uint16, off, end int64) bool {
+	var hdr [recordHeaderSize]byte
+	if off + recordHeaderSize > end || sc.s.readAt(num, hdr[:], off) != nil {
+		return false
+	}
+	_, length, _, err := decodeRecordHeader(hdr[:])
+	return err == nil && off + recordHeaderSize + int64(length) <= end
+}
+
+/*
+Verify the record at off in pack num against expected (from the footer, may be
+nil) and the index.  Returns the payload length; known is false if it could
+not be determined (so the next record cannot be found).  Only a closed store
+is returned as an error; everything else is reported.
+*/
+func (sc *scrubber) checkRecord(num uint16, off int64, expected *IndexEntry) (length uint32, known bool, err error) {
+	loc := MakeLocation(num, uint32(off))
+	var hdr [recordHeaderSize]byte
+	if err := sc.s.readAt(num, hdr[:], off); err != nil {
+		if err == ErrClosed {
+			return 0, false, err
+		}
+		sc.addBad(loc, "", fmt.Sprintf("read error: %v", err))
+		if expected != nil {
+			return expected.Length, true, nil
+		}
+		return 0, false, nil
+	}
+	digest, length, flags, hdrErr := decodeRecordHeader(hdr[:])
+	if hdrErr != nil {
+		sc.addBad(loc, "", "bad record header")
+		if expected != nil {
+			return expected.Length, true, nil
+		}
+		return 0, false, nil
+	}
+	if expected != nil && (digest != expected.Digest || length != expected.Length || flags != expected.Flags) {
+		sc.addBad(loc, hexDigest(digest[:]), "record header does not match pack footer")
+		return expected.Length, true, nil
+	}
+
+	payload, err := sc.readPayload(num, off, length)
+	if err != nil {
+		if err == ErrClosed {
+			return 0, false, err
+		}
+		sc.addBad(loc, hexDigest(digest[:]), fmt.Sprintf("read error: %v", err))
+		return length, true, nil
+	}
+	sc.report.RecordsChecked++
+	sc.report.BytesChecked += recordHeaderSize + int64(length)
+	if sha256.Sum256(payload) != digest {
+		sc.addBad(loc, hexDigest(digest[:]), "payload does not match digest")
+		return length, true, nil
+	}
+
+	if sc.idx != nil {
+		v, found := sc.idx.Get(digest[:])
+		if !found || LocationFromValue(v) != loc {
+			orphan := Orphan{Loc: loc, Digest: hexDigest(digest[:]), Length: length}
+			if found {
+				indexedAt := LocationFromValue(v)
+				orphan.IndexedAt = &indexedAt
+			}
+			sc.report.Orphans = append(sc.report.Orphans, orphan)
+		}
+	}
+	return length, true, nil
+}
+
+//The payload of the record at off, in a buffer reused by the next call
+func (sc *scrubber) readPayload(num uint16, off int64, length uint32) ([]byte, error) {
+	if cap(sc.payload) < int(length) {
+		sc.payload = make([]byte, length)
+	}
+	payload := sc.payload[:length]
+	return payload, sc.s.readAt(num, payload, off + recordHeaderSize)
+}
+
+//Where a region of phase 2 started, to undo it if the scrub stops part way
+type scrubMark struct {
+	badChunks, badIndexEntries int
+	recordsChecked, bytesChecked, indexEntriesChecked int64
+}
+
+func (sc *scrubber) mark() scrubMark {
+	r := sc.report
+	return scrubMark{len(r.BadChunks), len(r.BadIndexEntries), r.RecordsChecked, r.BytesChecked, r.IndexEntriesChecked}
+}
+
+func (sc *scrubber) rollback(m scrubMark) {
+	r := sc.report
+	for _, b := range r.BadChunks[m.badChunks:] {
+		delete(sc.bad, b.Loc)
+	}
+	r.BadChunks = r.BadChunks[:m.badChunks]
+	r.BadIndexEntries = r.BadIndexEntries[:m.badIndexEntries]
+	r.RecordsChecked, r.BytesChecked, r.IndexEntriesChecked = m.recordsChecked, m.bytesChecked, m.indexEntriesChecked
+}
+
+/*
+Phase 2, one map326 region at a time.  A region's results only reach the
+report (and a checkpoint) once it is complete, so a resumed scrub redoes the
+region it stopped in and carries on from there even if the index has changed.
+*/
+func (sc *scrubber) scrubIndex(ctx context.Context) error {
+	for sc.report.NextRegion < map326.NumRegions {
+		m := sc.mark()
+		var stopErr error
+		sc.idx.ForEachInRegion(sc.report.NextRegion, func(key []byte, value map326.Value) bool {
+			nBytes, err := sc.checkIndexEntry(key, value)
+			if err == nil {
+				sc.limiter.wait(ctx, nBytes)
+				err = ctx.Err()
+			}
+			stopErr = err
+			return err == nil
+		})
+		if stopErr != nil {
+			sc.rollback(m)
+			return stopErr
+		}
+		sc.report.NextRegion++
+		if err := sc.step(ctx, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Check that an index entry points at a record with its digest.  Returns the
+bytes read; only a closed store is returned as an error.
+*/
+func (sc *scrubber) checkIndexEntry(key []byte, value map326.Value) (int64, error) {
+	loc := LocationFromValue(value)
+	reason := ""
+	nBytes := int64(recordHeaderSize)
+	var hdr [recordHeaderSize]byte
+	if sc.bad[loc] {
+		reason = "record is corrupt"
+	} else if err := sc.s.readAt(loc.Pack(), hdr[:], int64(loc.Offset())); err != nil {
+		if err == ErrClosed {
+			return 0, err
+		}
+		reason = "no record at location"
+	} else if digest, length, _, err := decodeRecordHeader(hdr[:]); err != nil {
+		reason = "no record at location"
+	} else if string(digest[:]) != string(key) {
+		reason = "record at location has a different digest"
+	} else if loc.Offset() >= sc.report.CheckedEnd[loc.Pack()] {
+		//phase 1 did not reach this record
+		nBytes += int64(length)
+		var err error
+		if reason, err = sc.checkPayload(loc, digest, length); err != nil {
+			return 0, err
+		}
+	}
+	if reason != "" {
+		sc.report.BadIndexEntries = append(sc.report.BadIndexEntries, BadIndexEntry{
+			Digest: hexDigest(key),
+			Loc: loc,
+			Reason: reason,
+		})
+	}
+	sc.report.IndexEntriesChecked++
+	return nBytes, nil
+}
+
+/*
+Hash the payload of an indexed record which phase 1 did not reach.  Returns
+why the index entry is bad, or "".  Only a closed store is returned as an error.
+*/
+func (sc *scrubber) checkPayload(loc Location, digest chunker.Digest, length uint32) (string, error) {
+	payload, err := sc.readPayload(loc.Pack(), int64(loc.Offset()), length)
+	if err == ErrClosed {
+		return "", err
+	}
+	if err != nil {
+		sc.addBad(loc, hexDigest(digest[:]), fmt.Sprintf("read error: %v", err))
+		return "record is corrupt", nil
+	}
+	sc.report.RecordsChecked++
+	sc.report.BytesChecked += recordHeaderSize + int64(length)
+	if sha256.Sum256(payload) != digest {
+		sc.addBad(loc, hexDigest(digest[:]), "payload does not match digest")
+		return "record is corrupt", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,408 @@
+package packstore
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"context"
+	"encoding/json"
+	"map326"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+A store of 3 packs with an index, then damaged:
+	- a payload byte flipped in pack 0 (bitrot)
+	- pack 1's footer damaged
+	- an orphan record (stored twice, index points at the first copy)
+	- an index entry pointing nowhere and one pointing at the wrong record
+*/
+func damagedStore(t *testing.T) (dir string, idx *map326.Map, locs []Location) {
+	req := require.New(t)
+	dir = t.TempDir()
+	opts := Options{MaxPackSize: 20000, SyncBytes: 5000}
+
+	s, err := Open(dir, opts)
+	req.NoError(err)
+	idx, err = map326.New(100000)
+	req.NoError(err)
+	for i := 0; i < 15; i++ {
+		digest, data := makeChunk(uint64(i), 3000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		idx.Put(digest[:], loc.Value())
+		locs = append(locs, loc)
+	}
+	digest, data := makeChunk(3, 3000)
+	_, err = s.Put(digest, 0, data)
+	req.NoError(err)
+	req.NoError(s.Close())
+
+	nowhere, _ := makeChunk(100, 10)
+	idx.Put(nowhere[:], MakeLocation(7, 1000).Value())
+	wrong, _ := makeChunk(101, 10)
+	idx.Put(wrong[:], locs[8].Value())
+
+	flip := func(pack uint16, offset int) {
+		path := filepath.Join(dir, packName(pack))
+		raw, err := os.ReadFile(path)
+		req.NoError(err)
+		if offset < 0 {
+			offset += len(raw)
+		}
+		raw[offset] ^= 1
+		req.NoError(os.WriteFile(path, raw, 0644))
+	}
+	flip(0, int(locs[2].Offset()) + recordHeaderSize + 100)
+	flip(1, -trailerSize - 5)
+	return dir, idx, locs
+}
+
+func checkDamageReport(req *require.Assertions, report *ScrubReport, locs []Location) {
+	req.True(report.Done)
+	req.False(report.OK())
+	req.Equal(int64(16), report.RecordsChecked)
+
+	var reasons []string
+	for _, b := range report.BadChunks {
+		reasons = append(reasons, b.Loc.String() + " " + b.Reason)
+	}
+	req.Equal([]string{
+		locs[2].String() + " payload does not match digest",
+		"1:0 pack footer missing or damaged",
+	}, reasons)
+
+	req.Len(report.Orphans, 1)
+	req.Equal(uint16(2), report.Orphans[0].Loc.Pack())
+	req.Equal(locs[3], *report.Orphans[0].IndexedAt)
+
+	reasons = nil
+	for _, b := range report.BadIndexEntries {
+		reasons = append(reasons, b.Loc.String() + " " + b.Reason)
+	}
+	req.ElementsMatch([]string{
+		locs[2].String() + " record is corrupt",
+		"7:1000 no record at location",
+		locs[8].String() + " record at location has a different digest",
+	}, reasons)
+	req.Equal(int64(17), report.IndexEntriesChecked)
+}
+
+func TestScrub(t *testing.T) {
+	req := require.New(t)
+	dir, idx, locs := damagedStore(t)
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	var report ScrubReport
+	req.NoError(s.Scrub(context.Background(), idx, ScrubOptions{}, &report))
+	checkDamageReport(req, &report, locs)
+
+	//the report survives JSON
+	data, err := json.Marshal(&report)
+	req.NoError(err)
+	var decoded ScrubReport
+	req.NoError(json.Unmarshal(data, &decoded))
+	req.Equal(report.BadChunks, decoded.BadChunks)
+	req.Equal(report.Orphans, decoded.Orphans)
+	req.Contains(string(data), `"location":"0:`)
+
+	//without an index only the records are checked
+	var recordsOnly ScrubReport
+	req.NoError(s.Scrub(context.Background(), nil, ScrubOptions{}, &recordsOnly))
+	req.Len(recordsOnly.BadChunks, 2)
+	req.Empty(recordsOnly.Orphans)
+	req.Empty(recordsOnly.BadIndexEntries)
+	req.NoError(s.Close())
+}
+
+func TestScrubClean(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	idx, err := map326.New(1000)
+	req.NoError(err)
+	for i := 0; i < 10; i++ {
+		digest, data := makeChunk(uint64(i), 1000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		idx.Put(digest[:], loc.Value())
+	}
+	//the active pack is checked from its in-memory index
+	var report ScrubReport
+	req.NoError(s.Scrub(context.Background(), idx, ScrubOptions{}, &report))
+	req.True(report.OK())
+	req.Equal(int64(10), report.RecordsChecked)
+	req.Equal(int64(10 * (recordHeaderSize + 1000)), report.BytesChecked)
+
+	//a Done report starts again
+	started := report.Started
+	time.Sleep(time.Millisecond)
+	req.NoError(s.Scrub(context.Background(), idx, ScrubOptions{}, &report))
+	req.True(report.Started.After(started))
+	req.Equal(int64(10), report.RecordsChecked)
+	req.NoError(s.Close())
+}
+
+//Interrupted after every few steps and resumed from the saved JSON, the result is the same
+func TestScrubResume(t *testing.T) {
+	req := require.New(t)
+	dir, idx, locs := damagedStore(t)
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	defer s.Close()
+
+	var saved []byte
+	report := &ScrubReport{}
+	for runs := 0; ; runs++ {
+		req.Less(runs, 100)
+		ctx, cancel := context.WithCancel(context.Background())
+		steps := 0
+		opts := ScrubOptions{
+			//checkpoint after every step
+			CheckpointInterval: time.Nanosecond,
+			Checkpoint: func(r *ScrubReport) error {
+				var err error
+				saved, err = json.Marshal(r)
+				req.NoError(err)
+				//phase 2 checkpoints after each of the 65536 index regions
+				steps++
+				if (!r.RecordsDone && steps == 3) || steps == 20000 {
+					cancel()
+				}
+				return nil
+			},
+		}
+		err := s.Scrub(ctx, idx, opts, report)
+		cancel()
+		if err == nil {
+			break
+		}
+		req.Equal(context.Canceled, err)
+
+		//resume from what was saved, as a new process would
+		report = &ScrubReport{}
+		req.NoError(json.Unmarshal(saved, report))
+	}
+	checkDamageReport(req, report, locs)
+}
+
+//Phase 2 resumes correctly with an index whose entries are in a different order
+func TestScrubResumeOtherIndex(t *testing.T) {
+	req := require.New(t)
+	dir, idx, locs := damagedStore(t)
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var report ScrubReport
+	opts := ScrubOptions{
+		CheckpointInterval: time.Nanosecond,
+		Checkpoint: func(r *ScrubReport) error {
+			if r.NextRegion >= map326.NumRegions / 2 {
+				cancel()
+			}
+			return nil
+		},
+	}
+	req.Equal(context.Canceled, s.Scrub(ctx, idx, opts, &report))
+	req.Less(report.IndexEntriesChecked, int64(idx.Len()))
+
+	//the same entries in a map of another capacity, so ForEach visits them in another order
+	other, err := map326.New(1 << 20)
+	req.NoError(err)
+	idx.ForEach(func(key []byte, value map326.Value) bool {
+		req.Equal(1, other.Put(key, value))
+		return true
+	})
+	req.NoError(s.Scrub(context.Background(), other, ScrubOptions{}, &report))
+	checkDamageReport(req, &report, locs)
+}
+
+func TestScrubRateLimit(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, DefaultOptions)
+	req.NoError(err)
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		digest, data := makeChunk(uint64(i), 10000)
+		_, err := s.Put(digest, 0, data)
+		req.NoError(err)
+	}
+
+	//100KB at 500KB/s
+	start := time.Now()
+	var report ScrubReport
+	req.NoError(s.Scrub(context.Background(), nil, ScrubOptions{RateLimit: 500 * 1000}, &report))
+	req.GreaterOrEqual(time.Since(start), 150 * time.Millisecond)
+
+	//cancelling interrupts the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	report = ScrubReport{}
+	req.Equal(context.DeadlineExceeded, s.Scrub(ctx, nil, ScrubOptions{RateLimit: 1000}, &report))
+	req.Less(time.Since(start), time.Second)
+	req.False(report.Done)
+}
+
+func TestLocationText(t *testing.T) {
+	req := require.New(t)
+
+	var loc Location
+	req.NoError(loc.UnmarshalText([]byte("3:4096")))
+	req.Equal(MakeLocation(3, 4096), loc)
+	for _, bad := range []string{"", "3", "3:x", "70000:1", "3:4096junk"} {
+		req.Error(loc.UnmarshalText([]byte(bad)), bad)
+	}
+}
+
+//Chunks can be stored while a scrub runs (run with -race)
+func TestScrubConcurrentPut(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, Options{MaxPackSize: 20000, SyncBytes: 5000})
+	req.NoError(err)
+	defer s.Close()
+	for i := 0; i < 20; i++ {
+		digest, data := makeChunk(uint64(i), 1000)
+		_, err := s.Put(digest, 0, data)
+		req.NoError(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 20; i < 100; i++ {
+			digest, data := makeChunk(uint64(i), 1000)
+			if _, err := s.Put(digest, 0, data); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	var report ScrubReport
+	req.NoError(s.Scrub(context.Background(), nil, ScrubOptions{}, &report))
+	req.NoError(<-done)
+	req.True(report.OK())
+	req.GreaterOrEqual(report.RecordsChecked, int64(20))
+}
+
+//A read-only scrub reports the last pack's torn tail and changes nothing
+func TestScrubReadOnly(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := Open(dir, Options{MaxPackSize: 20000, SyncBytes: 5000})
+	req.NoError(err)
+	for i := 0; i < 10; i++ {
+		digest, data := makeChunk(uint64(i), 3000)
+		_, err := s.Put(digest, 0, data)
+		req.NoError(err)
+	}
+	req.NoError(s.Sync())
+	last := s.activeNum
+	crash(s)
+	path := filepath.Join(dir, packName(last))
+	info, err := os.Stat(path)
+	req.NoError(err)
+	req.NoError(os.Truncate(path, info.Size() - 300))
+	before, err := os.ReadFile(path)
+	req.NoError(err)
+
+	s, err = OpenReadOnly(dir)
+	req.NoError(err)
+	var report ScrubReport
+	req.NoError(s.Scrub(context.Background(), nil, ScrubOptions{}, &report))
+	req.NoError(s.Close())
+	req.True(report.OK())
+	req.Equal(int64(9), report.RecordsChecked)
+	req.NotNil(report.Unsealed)
+	req.Equal(UnsealedPack{Pack: last, Records: report.Unsealed.Records, TornBytes: recordHeaderSize + 3000 - 300},
+		*report.Unsealed)
+	req.Positive(report.Unsealed.Records)
+
+	after, err := os.ReadFile(path)
+	req.NoError(err)
+	req.Equal(before, after)
+
+	//Open would cut the same bytes
+	s, err = Open(dir, Options{MaxPackSize: 20000, SyncBytes: 5000})
+	req.NoError(err)
+	req.Equal(report.Unsealed.TornBytes, s.Recovery().TruncatedBytes)
+	req.Equal(int(report.Unsealed.Records), s.Recovery().Records)
+	req.NoError(s.Close())
+}
+
+//Index entries phase 1 could not reach are hashed by phase 2
+func TestScrubIndexUnchecked(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	opts := Options{MaxPackSize: 20000, SyncBytes: 5000}
+
+	s, err := Open(dir, opts)
+	req.NoError(err)
+	idx, err := map326.New(100000)
+	req.NoError(err)
+	var locs []Location
+	for i := 0; i < 10; i++ {
+		digest, data := makeChunk(uint64(i), 3000)
+		loc, err := s.Put(digest, 0, data)
+		req.NoError(err)
+		idx.Put(digest[:], loc.Value())
+		locs = append(locs, loc)
+	}
+	req.NoError(s.Close())
+	req.Equal(uint16(0), locs[4].Pack())
+
+	//pack 0 loses its footer, the header of its second record and a payload byte of its fourth
+	path := filepath.Join(dir, packName(0))
+	raw, err := os.ReadFile(path)
+	req.NoError(err)
+	last := 0
+	for locs[last + 1].Pack() == 0 {
+		last++
+	}
+	raw = raw[:int(locs[last].Offset()) + recordHeaderSize + 3000]
+	raw[locs[1].Offset()] ^= 1
+	raw[int(locs[3].Offset()) + recordHeaderSize + 10] ^= 1
+	req.NoError(os.WriteFile(path, raw, 0644))
+
+	s, err = Open(dir, opts)
+	req.NoError(err)
+	defer s.Close()
+	var report ScrubReport
+	req.NoError(s.Scrub(context.Background(), idx, ScrubOptions{}, &report))
+
+	var reasons []string
+	for _, b := range report.BadChunks {
+		reasons = append(reasons, b.Loc.String() + " " + b.Reason)
+	}
+	req.Equal([]string{
+		"0:0 pack footer missing or damaged",
+		locs[1].String() + " bad record header",
+		locs[1].String() + " rest of pack not checked",
+		locs[3].String() + " payload does not match digest",
+	}, reasons)
+	reasons = nil
+	for _, b := range report.BadIndexEntries {
+		reasons = append(reasons, b.Loc.String() + " " + b.Reason)
+	}
+	req.ElementsMatch([]string{
+		locs[1].String() + " record is corrupt",
+		locs[3].String() + " record is corrupt",
+	}, reasons)
+	//every intact record was hashed once, in one phase or the other
+	req.Equal(int64(9), report.RecordsChecked)
+	req.Equal(locs[1].Offset(), report.CheckedEnd[0])
+}
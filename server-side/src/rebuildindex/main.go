@@ -0,0 +1,96 @@
+/*
+rebuildindex rebuilds the digest index from the pack files of a packstore, for
+when the index has been lost or damaged.  It reports progress on stderr and a
+summary on stdout: records indexed, packs whose footers were damaged and had to
+be scanned, unreadable packs, and digests stored more than once.
+
+Example:
+
+	rebuildindex -packs /var/lib/dedupd/packs -out /var/lib/dedupd/index -parallel 8
+
+The index is written to -out (see packstore.WriteIndex), replacing the file only
+once the new index is complete.  Without -out the rebuild is a dry run: the
+index is built, summarised and discarded.
+
+The packs are only read.  Do not run it while the server is writing to them.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"packstore"
+	"time"
+)
+
+func main() {
+	packsDir := flag.String("packs", "", "directory holding the pack files")
+	parallel := flag.Int("parallel", 0, "packs to read at once (default: number of CPUs)")
+	capacity := flag.Int("capacity", 0, "index capacity (default: from the number of records)")
+	outPath := flag.String("out", "", "file to write the index to (default: dry run, nothing written)")
+	quiet := flag.Bool("q", false, "no progress output")
+	flag.Parse()
+
+	if *packsDir == "" {
+		log.Fatal("-packs is required")
+	}
+	if _, err := os.Stat(*packsDir); err != nil {
+		log.Fatal(err)
+	}
+
+	var progress io.Writer = os.Stderr
+	if *quiet {
+		progress = io.Discard
+	}
+	opts := packstore.RebuildOptions{Parallelism: *parallel, Capacity: *capacity}
+	if err := run(*packsDir, *outPath, opts, os.Stdout, progress); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//Rebuild, write the index to outPath unless it is empty, and print the summary to out and progress to progress
+func run(dir, outPath string, opts packstore.RebuildOptions, out, progress io.Writer) error {
+	start := time.Now()
+	lastReport := start
+	opts.Progress = func(p packstore.RebuildProgress) {
+		//at most once a second, and always at the end
+		if now := time.Now(); now.Sub(lastReport) >= time.Second || p.PacksDone == p.PacksTotal {
+			fmt.Fprintf(progress, "%d/%d packs, %d records\n", p.PacksDone, p.PacksTotal, p.Records)
+			lastReport = now
+		}
+	}
+
+	m, report, err := packstore.Rebuild(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "packs: %d\n", report.Packs)
+	fmt.Fprintf(out, "records indexed: %d\n", report.Records)
+	fmt.Fprintf(out, "index: %d entries, %d bytes\n", m.Len(), m.MemSize())
+	fmt.Fprintf(out, "packs scanned (damaged or missing footer): %v\n", report.Scanned)
+	fmt.Fprintf(out, "packs unreadable: %v\n", report.Unreadable)
+	fmt.Fprintf(out, "corrupt records (not indexed): %v\n", report.Corrupt)
+	fmt.Fprintf(out, "unreadable pack tails (not indexed): %d\n", len(report.Unindexed))
+	for _, u := range report.Unindexed {
+		fmt.Fprintf(out, "  pack %d: %d bytes from offset %d could not be read\n", u.Pack, u.Bytes, u.Offset)
+	}
+	fmt.Fprintf(out, "duplicate records: %d\n", report.Duplicates)
+	for _, dup := range report.DuplicateSamples {
+		fmt.Fprintf(out, "  %x at %v, kept %v\n", dup.Digest, dup.Dropped, dup.Kept)
+	}
+
+	if outPath == "" {
+		fmt.Fprintf(out, "dry run: index not written (use -out)\n")
+	} else {
+		if err := packstore.WriteIndex(outPath, m); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "index written to %s\n", outPath)
+	}
+	fmt.Fprintf(out, "elapsed: %v\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"packstore"
+	"path/filepath"
+	"testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	s, err := packstore.Open(dir, packstore.Options{MaxPackSize: 5000, SyncBytes: 5000})
+	req.NoError(err)
+	for i := 0; i < 20; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1000)
+		_, err := s.Put(sha256.Sum256(data), 0, data)
+		req.NoError(err)
+	}
+	data := bytes.Repeat([]byte{3}, 1000)
+	digest := sha256.Sum256(data)
+	_, err = s.Put(digest, 0, data)
+	req.NoError(err)
+	req.NoError(s.Close())
+
+	var out, progress bytes.Buffer
+	req.NoError(run(dir, "", packstore.RebuildOptions{}, &out, &progress))
+	req.Contains(out.String(), "packs: 6\n")
+	req.Contains(out.String(), "records indexed: 20\n")
+	req.Contains(out.String(), "duplicate records: 1\n")
+	req.Contains(out.String(), "dry run")
+	req.Contains(progress.String(), "6/6 packs, 21 records\n")
+
+	//the index is written and can be loaded
+	indexPath := filepath.Join(t.TempDir(), "index")
+	out.Reset()
+	req.NoError(run(dir, indexPath, packstore.RebuildOptions{}, &out, &progress))
+	req.Contains(out.String(), "index written to " + indexPath)
+	m, err := packstore.ReadIndex(indexPath)
+	req.NoError(err)
+	req.Equal(20, m.Len())
+	_, found := m.Get(digest[:])
+	req.True(found)
+}
@@ -1,5 +1,7 @@
 /*
-Playground to experiment with robin hood hashing.
+A generic Robin Hood hash map.  It started as a playground to experiment with
+robin hood hashing (uint32 keys where key == hashcode) and is now usable for
+any comparable key with a user supplied hash function.
 
 https://www.sebastiansylvan.com/post/robin-hood-hashing-should-be-your-default-hash-table-implementation/
 
@@ -12,40 +14,62 @@ import (
 )
 
 
-type Bucket struct {
-	Key uint32
-	Value int
+type Bucket[K comparable, V any] struct {
+	Key K
+	Value V
+	//cached hash of Key so probing never calls the hash function
+	hash uint64
 	used bool
 }
 
-type Map struct {
-	buckets []Bucket
+type RobinMap[K comparable, V any] struct {
+	buckets []Bucket[K, V]
 	nUsed int
 	//90% of len(buckets)
 	maxAllowed int
+	hash func(K) uint64
 }
 
-func NewMap(maxCapacity int) *Map {
+//The original playground map: uint32 keys which are their own hashcode.
+type Map = RobinMap[uint32, int]
+
+/*
+Create a map which holds up to maxCapacity entries.  hash must be a good
+quality hash of the key; the map takes it modulo the number of buckets.
+*/
+func New[K comparable, V any](maxCapacity int, hash func(K) uint64) *RobinMap[K, V] {
+	if hash == nil {
+		panic("robin1.New: nil hash")
+	}
 	if maxCapacity < 1 {
 		maxCapacity = 1
 	}
 
-	//10% extra
-	nBuckets := int(float32(maxCapacity) * 1.10) + 1
-
-	return &Map{
-		buckets: make([]Bucket, nBuckets),
+	return &RobinMap[K, V]{
+		buckets: make([]Bucket[K, V], numBucketsFor(maxCapacity)),
 		maxAllowed: maxCapacity,
+		hash: hash,
 	}
 }
 
-func (m *Map) index(key uint32) int {
+//10% extra
+func numBucketsFor(maxCapacity int) int {
+	return int(float32(maxCapacity) * 1.10) + 1
+}
+
+func NewMap(maxCapacity int) *Map {
 	//for now we assume key == hashcode
-	return int(key % uint32(len(m.buckets)))
+	return New[uint32, int](maxCapacity, func(key uint32) uint64 {
+		return uint64(key)
+	})
 }
 
-func (m *Map) probeDist(b Bucket, currentIndex int) int {
-	desiredIndex := m.index(b.Key)
+func (m *RobinMap[K, V]) index(hash uint64) int {
+	return int(hash % uint64(len(m.buckets)))
+}
+
+func (m *RobinMap[K, V]) probeDist(b Bucket[K, V], currentIndex int) int {
+	desiredIndex := m.index(b.hash)
 	if currentIndex < desiredIndex {
 		//wrapped due to modulo
 		return len(m.buckets) - desiredIndex + currentIndex
@@ -54,6 +78,16 @@ func (m *Map) probeDist(b Bucket, currentIndex int) int {
 	}
 }
 
+//Number of entries in the map
+func (m *RobinMap[K, V]) Len() int {
+	return m.nUsed
+}
+
+//Maximum number of entries before Put fails
+func (m *RobinMap[K, V]) MaxCapacity() int {
+	return m.maxAllowed
+}
+
 type Stats struct {
 	NumBuckets int
 	NumUsed int
@@ -91,7 +125,7 @@ func (stats Stats) PrintCollisionsPerBucket() {
 	}
 }
 
-func (m *Map) CalcStats() Stats {
+func (m *RobinMap[K, V]) CalcStats() Stats {
 	var sum int64
 	var stats Stats
 
@@ -106,7 +140,7 @@ func (m *Map) CalcStats() Stats {
 				stats.MaxProbeDist = dist
 			}
 
-			collisionCounts[m.index(bucket.Key)]++
+			collisionCounts[m.index(bucket.hash)]++
 		} else {
 			stats.NumEmpty++
 		}
@@ -116,7 +150,9 @@ func (m *Map) CalcStats() Stats {
 		panic("nUsed mismatch")
 	}
 
-	stats.AvgProbeDist = float32(float64(sum) / float64(stats.NumUsed))
+	if stats.NumUsed > 0 {
+		stats.AvgProbeDist = float32(float64(sum) / float64(stats.NumUsed))
+	}
 
 	stats.MaxAllowed = m.maxAllowed
 	stats.NumBuckets = len(m.buckets)
@@ -128,7 +164,9 @@ func (m *Map) CalcStats() Stats {
 			totalCollisions += count
 		}
 	}
-	stats.CollisionPercent = float32(totalCollisions) / float32(stats.NumUsed)
+	if stats.NumUsed > 0 {
+		stats.CollisionPercent = float32(totalCollisions) / float32(stats.NumUsed)
+	}
 
 	stats.CollisionsPerBucket = make([]int, stats.NumBuckets)
 	for i := range stats.CollisionsPerBucket {
@@ -138,7 +176,7 @@ func (m *Map) CalcStats() Stats {
 	return stats
 }
 
-func (m *Map) PrintProbeDistances() {
+func (m *RobinMap[K, V]) PrintProbeDistances() {
 	fmt.Println("Bucket: Occupant distance from optimal")
 	for idx, bucket := range m.buckets {
 		if bucket.used {
@@ -150,20 +188,34 @@ func (m *Map) PrintProbeDistances() {
 	}
 }
 
-func (m *Map) Put(key uint32, value int) bool {
+/*
+Add or update an entry.  Returns false if the key is new and the map already
+holds MaxCapacity entries.  Existing keys can always be updated.
+*/
+func (m *RobinMap[K, V]) Put(key K, value V) bool {
+	hash := m.hash(key)
+
 	if m.nUsed >= m.maxAllowed {
-		//we are 90% full.
-		//TODO: this disallows updating of existing entries when full
-		return false
+		//we are 90% full.  Only an update is possible.
+		idx, found := m.find(key, hash)
+		if found {
+			m.buckets[idx].Value = value
+		}
+		return found
 	}
 
-	incoming := Bucket{
+	m.insert(Bucket[K, V]{
 		Key: key,
 		Value: value,
+		hash: hash,
 		used: true,
-	}
+	})
+	return true
+}
 
-	idx := m.index(key)
+//Add or update an entry.  The caller ensures there is room.
+func (m *RobinMap[K, V]) insert(incoming Bucket[K, V]) {
+	idx := m.index(incoming.hash)
 	dist := 0
 	wrapCount := 0
 
@@ -174,11 +226,11 @@ func (m *Map) Put(key uint32, value int) bool {
 			//Use empty bucket
 			m.nUsed++
 			m.buckets[idx] = incoming
-			return true
-		} else if other.Key == incoming.Key {
+			return
+		} else if other.hash == incoming.hash && other.Key == incoming.Key {
 			//Update existing
 			m.buckets[idx].Value = incoming.Value
-			return true
+			return
 		}
 
 		otherDist := m.probeDist(other, idx)
@@ -190,9 +242,6 @@ func (m *Map) Put(key uint32, value int) bool {
 		}
 
 		dist++
-		//if dist > m.maxProbeDist {
-		//	m.maxProbeDist = dist
-		//}
 
 		idx++
 		if idx >= len(m.buckets) {
@@ -207,8 +256,11 @@ func (m *Map) Put(key uint32, value int) bool {
 	}
 }
 
-func (m *Map) Get(key uint32) (value int, found bool) {
-	idx := m.index(key)
+/*
+Locate the bucket holding key.  Returns false if not present.
+*/
+func (m *RobinMap[K, V]) find(key K, hash uint64) (int, bool) {
+	idx := m.index(hash)
 	dist := 0
 	wrapped := false
 
@@ -217,18 +269,16 @@ func (m *Map) Get(key uint32) (value int, found bool) {
 
 		if !other.used {
 			//not found
-			break
-		} else if other.Key == key {
+			return 0, false
+		} else if other.hash == hash && other.Key == key {
 			//Found!
-			found = true
-			value = other.Value
-			break
+			return idx, true
 		}
 
 		otherDist := m.probeDist(other, idx)
 		if otherDist < dist {
 			//not found
-			break
+			return 0, false
 		}
 
 		dist++
@@ -236,12 +286,94 @@ func (m *Map) Get(key uint32) (value int, found bool) {
 		if idx >= len(m.buckets) {
 			if wrapped {
 				//not found
-				break
+				return 0, false
 			}
 			idx = 0
 			wrapped = true
 		}
 	}
+}
 
+func (m *RobinMap[K, V]) Get(key K) (value V, found bool) {
+	var idx int
+	idx, found = m.find(key, m.hash(key))
+	if found {
+		value = m.buckets[idx].Value
+	}
 	return
 }
+
+/*
+Remove an entry.  Returns false if the key was not present.
+
+Uses backward shift deletion: following entries which are not in their
+preferred bucket are moved back one place, so no tombstones are needed and
+probe distances stay as short as if the key had never been added.
+*/
+func (m *RobinMap[K, V]) Delete(key K) bool {
+	idx, found := m.find(key, m.hash(key))
+	if !found {
+		return false
+	}
+
+	n := len(m.buckets)
+	for {
+		next := idx + 1
+		if next >= n {
+			next = 0
+		}
+
+		b := m.buckets[next]
+		if !b.used || m.probeDist(b, next) == 0 {
+			break
+		}
+
+		m.buckets[idx] = b
+		idx = next
+	}
+
+	m.buckets[idx] = Bucket[K, V]{}
+	m.nUsed--
+	return true
+}
+
+/*
+Call fn for each entry, in bucket order.  Stops when fn returns false.
+The map must not be modified during iteration.
+*/
+func (m *RobinMap[K, V]) Range(fn func(key K, value V) bool) {
+	for _, b := range m.buckets {
+		if b.used {
+			if !fn(b.Key, b.Value) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Change the maximum capacity, rehashing every entry into a new bucket array.
+Returns false (and leaves the map unchanged) if maxCapacity is less than Len().
+*/
+func (m *RobinMap[K, V]) Resize(maxCapacity int) bool {
+	if maxCapacity < 1 {
+		maxCapacity = 1
+	}
+	if maxCapacity < m.nUsed {
+		return false
+	}
+
+	old := m.buckets
+	m.buckets = make([]Bucket[K, V], numBucketsFor(maxCapacity))
+	m.maxAllowed = maxCapacity
+	m.nUsed = 0
+
+	//cached hashes are reused
+	for _, b := range old {
+		if b.used {
+			m.insert(b)
+		}
+	}
+
+	return true
+}
@@ -4,6 +4,8 @@ import (
 	"testing"
 	"github.com/stretchr/testify/require"
 	"math/rand"
+	"hash/fnv"
+	"fmt"
 )
 
 func randKeyValue() (key uint32, value int) {
@@ -174,3 +176,229 @@ func Test211(t * testing.T) {
 
 	*/
 }
+
+/*
+Check the Robin Hood invariant and that the map matches expect exactly.
+*/
+func checkMap(m *Map, expect map[uint32]int) string {
+	n := len(m.buckets)
+	nUsed := 0
+	for idx, b := range m.buckets {
+		if !b.used {
+			continue
+		}
+		nUsed++
+
+		prev := idx - 1
+		if prev < 0 {
+			prev = n - 1
+		}
+		prevDist := -1
+		if m.buckets[prev].used {
+			prevDist = m.probeDist(m.buckets[prev], prev)
+		}
+		if m.probeDist(b, idx) > prevDist + 1 {
+			return "robin hood invariant broken"
+		}
+	}
+
+	if nUsed != m.Len() || nUsed != len(expect) {
+		return "wrong count"
+	}
+
+	for k, v := range expect {
+		v2, found := m.Get(k)
+		if !found {
+			return "key not found"
+		} else if v != v2 {
+			return "wrong value"
+		}
+	}
+
+	return ""
+}
+
+func TestDeleteExhaustive(t * testing.T) {
+	const maxCapacity = 150
+
+	rand.Seed(2)
+	var keys [maxCapacity]KV
+	for i := 0; i < maxCapacity; i++ {
+		keys[i].Key, keys[i].Value = randKeyValue()
+	}
+
+	for capacity := 1; capacity <= maxCapacity; capacity++ {
+		m := NewMap(capacity)
+		expect := make(map[uint32]int)
+
+		//Fill to capacity
+		for i := 0; i < capacity; i++ {
+			kv := keys[i]
+			if !m.Put(kv.Key, kv.Value) {
+				t.Fatal("put failed")
+			}
+			expect[kv.Key] = kv.Value
+		}
+
+		//Updates are allowed when full
+		if !m.Put(keys[0].Key, keys[0].Value + 1) {
+			t.Fatal("update when full failed")
+		}
+		expect[keys[0].Key] = keys[0].Value + 1
+
+		//Delete every other key, checking after each
+		for i := 0; i < capacity; i += 2 {
+			if !m.Delete(keys[i].Key) {
+				t.Fatal("delete failed")
+			}
+			if m.Delete(keys[i].Key) {
+				t.Fatal("deleted twice")
+			}
+			delete(expect, keys[i].Key)
+
+			if msg := checkMap(m, expect); msg != "" {
+				t.Fatalf("capacity %d: %s", capacity, msg)
+			}
+		}
+
+		//Deleted keys are gone
+		for i := 0; i < capacity; i += 2 {
+			if _, found := m.Get(keys[i].Key); found {
+				t.Fatal("deleted key found")
+			}
+		}
+
+		//Refill to capacity
+		for i := 0; i < capacity; i += 2 {
+			if !m.Put(keys[i].Key, keys[i].Value) {
+				t.Fatal("put after delete failed")
+			}
+			expect[keys[i].Key] = keys[i].Value
+		}
+		if msg := checkMap(m, expect); msg != "" {
+			t.Fatalf("capacity %d: %s", capacity, msg)
+		}
+
+		//Delete everything
+		for i := 0; i < capacity; i++ {
+			m.Delete(keys[i].Key)
+		}
+		if m.Len() != 0 {
+			t.Fatal("not empty")
+		}
+	}
+}
+
+func TestRangeAndResize(t * testing.T) {
+	req := require.New(t)
+
+	m := NewMap(50)
+	expect := make(map[uint32]int)
+	rand.Seed(3)
+	for i := 0; i < 50; i++ {
+		k, v := randKeyValue()
+		req.True(m.Put(k, v))
+		expect[k] = v
+	}
+	req.False(m.Put(1234, 5678))
+
+	//Range visits everything once
+	seen := make(map[uint32]int)
+	m.Range(func(k uint32, v int) bool {
+		_, dup := seen[k]
+		req.False(dup)
+		seen[k] = v
+		return true
+	})
+	req.Equal(expect, seen)
+
+	//Grow
+	req.True(m.Resize(500))
+	req.Equal(500, m.MaxCapacity())
+	req.Equal(551, len(m.buckets))
+	req.Equal("", checkMap(m, expect))
+
+	for i := 0; i < 450; i++ {
+		k, v := randKeyValue()
+		req.True(m.Put(k, v))
+		expect[k] = v
+	}
+	req.Equal("", checkMap(m, expect))
+
+	//Cannot shrink below Len
+	req.False(m.Resize(499))
+	req.Equal(500, m.MaxCapacity())
+
+	//Delete most then shrink
+	n := 0
+	for k := range expect {
+		if n >= 480 {
+			break
+		}
+		req.True(m.Delete(k))
+		delete(expect, k)
+		n++
+	}
+	req.True(m.Resize(20))
+	req.Equal("", checkMap(m, expect))
+
+	stats := m.CalcStats()
+	req.Equal(20, stats.NumUsed)
+	req.Equal(20, stats.MaxAllowed)
+}
+
+func fnv64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func TestGenericKeys(t * testing.T) {
+	req := require.New(t)
+
+	type snapshot struct {
+		Id int
+		Name string
+	}
+
+	m := New[string, snapshot](100, fnv64)
+
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("/home/user/file%d.txt", i)
+		req.True(m.Put(path, snapshot{i, path}))
+	}
+	req.False(m.Put("/one/too/many", snapshot{}))
+	req.Equal(100, m.Len())
+
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("/home/user/file%d.txt", i)
+		snap, found := m.Get(path)
+		req.True(found)
+		req.Equal(i, snap.Id)
+		req.Equal(path, snap.Name)
+	}
+
+	_, found := m.Get("/not/there")
+	req.False(found)
+
+	req.True(m.Delete("/home/user/file7.txt"))
+	_, found = m.Get("/home/user/file7.txt")
+	req.False(found)
+	req.True(m.Put("/one/too/many", snapshot{}))
+
+	//A constant hash puts everything in one probe sequence
+	bad := New[int, int](40, func(int) uint64 { return 7 })
+	for i := 0; i < 40; i++ {
+		req.True(bad.Put(i, i * 10))
+	}
+	for i := 0; i < 40; i += 3 {
+		req.True(bad.Delete(i))
+	}
+	for i := 0; i < 40; i++ {
+		v, found := bad.Get(i)
+		req.Equal(i % 3 != 0, found, i)
+		if found {
+			req.Equal(i * 10, v)
+		}
+	}
+}
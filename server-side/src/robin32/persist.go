@@ -0,0 +1,344 @@
+package robin32
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fixedpool"
+	"fmt"
+	"io"
+	"util"
+)
+
+/*
+File format (all integers little endian):
+
+	Header:
+		magic "RB32" (4 bytes)
+		version (4 bytes)
+		valueSize (4 bytes)
+		number of buckets (8 bytes)
+		maxOccupied (8 bytes)
+		nOccupied (8 bytes)
+	One record per bucket (8 bytes each):
+		KeyPrefix (4 bytes)
+		1 if occupied, otherwise 0 (4 bytes)
+	One record per occupied bucket, in bucket order:
+		key suffix (28 bytes)
+		value (valueSize bytes)
+
+Pool pointers are not written.  Blocks are re-allocated when loading so the pool
+layout after ReadFrom is compact regardless of how fragmented it was when saved.
+*/
+
+const fileMagic = "RB32"
+const fileVersion = 1
+const fileHeaderSize = 36
+
+/*
+Write the entire map to w.  Implements io.WriterTo.
+*/
+func (m *Map) WriteTo(w io.Writer) (int64, error) {
+	cw := &util.CountingWriter{W: w}
+	bw := bufio.NewWriter(cw)
+
+	var hdr [fileHeaderSize]byte
+	copy(hdr[0:4], fileMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], fileVersion)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(m.valueSize))
+	binary.LittleEndian.PutUint64(hdr[12:], uint64(len(m.buckets)))
+	binary.LittleEndian.PutUint64(hdr[20:], uint64(m.maxOccupied))
+	binary.LittleEndian.PutUint64(hdr[28:], uint64(m.nOccupied))
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return cw.N, err
+	}
+
+	var rec [8]byte
+	for _, b := range m.buckets {
+		binary.LittleEndian.PutUint32(rec[0:], b.KeyPrefix)
+		if b.isEmpty() {
+			binary.LittleEndian.PutUint32(rec[4:], 0)
+		} else {
+			binary.LittleEndian.PutUint32(rec[4:], 1)
+		}
+		if _, err := bw.Write(rec[:]); err != nil {
+			return cw.N, err
+		}
+	}
+
+	for _, b := range m.buckets {
+		if !b.isEmpty() {
+			if _, err := bw.Write(m.pool.Get(b.More)); err != nil {
+				return cw.N, err
+			}
+		}
+	}
+
+	err := bw.Flush()
+	return cw.N, err
+}
+
+/*
+Replace the contents of the map with data previously written by WriteTo.
+Implements io.ReaderFrom.  The receiver may be a zero Map.  The loaded map is
+checked with Verify.  On error the map is left unchanged.
+
+Nothing beyond the end of the map is consumed from r, so r should be
+buffered by the caller (eg bufio.Reader) when reading from a file.
+*/
+func (m *Map) ReadFrom(r io.Reader) (int64, error) {
+	//not buffered so that nothing past the end of the map is consumed
+	cr := &util.CountingReader{R: r}
+
+	var hdr [fileHeaderSize]byte
+	if err := cr.ReadFull(hdr[:]); err != nil {
+		return cr.N, err
+	}
+
+	if string(hdr[0:4]) != fileMagic {
+		return cr.N, errors.New("robin32: not a robin32 map file")
+	}
+	if version := binary.LittleEndian.Uint32(hdr[4:]); version != fileVersion {
+		return cr.N, fmt.Errorf("robin32: unsupported file version %d", version)
+	}
+
+	valueSize := int(binary.LittleEndian.Uint32(hdr[8:]))
+	nBuckets := binary.LittleEndian.Uint64(hdr[12:])
+	maxOccupied := binary.LittleEndian.Uint64(hdr[20:])
+	nOccupied := binary.LittleEndian.Uint64(hdr[28:])
+
+	//sanity (also guards against int overflow below)
+	const maxInt32 = 0x7FFFFFFF
+	if valueSize <= 0 || nBuckets == 0 || nBuckets > maxInt32 || maxOccupied == 0 ||
+		maxOccupied > nBuckets || nOccupied > maxOccupied {
+		return cr.N, errors.New("robin32: corrupt header")
+	}
+
+	loaded := &Map{
+		buckets: make([]_Bucket, int(nBuckets)),
+		maxOccupied: int(maxOccupied),
+		valueSize: valueSize,
+		pool: fixedpool.NewSlabPool(keySuffixLen + valueSize, fixedpool.DefaultSlabBlocks, int(maxOccupied)),
+	}
+
+	//bucket records are read in batches
+	batch := make([]byte, 8 * 4096)
+	occupied := make([]bool, len(loaded.buckets))
+	for start := 0; start < len(loaded.buckets); start += len(batch) / 8 {
+		n := len(loaded.buckets) - start
+		if n > len(batch) / 8 {
+			n = len(batch) / 8
+		}
+		if err := cr.ReadFull(batch[0:n*8]); err != nil {
+			return cr.N, err
+		}
+
+		for j := 0; j < n; j++ {
+			i := start + j
+			rec := batch[j*8:]
+			loaded.buckets[i].KeyPrefix = binary.LittleEndian.Uint32(rec[0:])
+			switch binary.LittleEndian.Uint32(rec[4:]) {
+			case 0:
+			case 1:
+				occupied[i] = true
+				loaded.nOccupied++
+			default:
+				return cr.N, fmt.Errorf("robin32: corrupt bucket %d", i)
+			}
+		}
+	}
+
+	if loaded.nOccupied != int(nOccupied) {
+		return cr.N, errors.New("robin32: occupied bucket count does not match header")
+	}
+
+	for i, isOccupied := range occupied {
+		if !isOccupied {
+			continue
+		}
+
+		ptr := loaded.pool.Alloc()
+		if ptr == fixedpool.Zero {
+			//should not happen because nOccupied <= maxOccupied
+			return cr.N, errors.New("robin32: pool exhausted while loading")
+		}
+		if err := cr.ReadFull(loaded.pool.Get(ptr)); err != nil {
+			return cr.N, err
+		}
+		loaded.buckets[i].More = ptr
+	}
+
+	//a plausible but corrupt file would otherwise load and then miss keys
+	if err := loaded.Verify(); err != nil {
+		return cr.N, err
+	}
+	*m = *loaded
+	return cr.N, nil
+}
+
+/*
+TagMap file format (all integers little endian):
+
+	Header:
+		magic "RBTG" (4 bytes)
+		version (4 bytes)
+		valueSize (4 bytes)
+		number of buckets (8 bytes)
+		maxOccupied (8 bytes)
+		nOccupied (8 bytes)
+	One record per bucket (9 bytes each):
+		KeyPrefix (4 bytes)
+		More pointer, Zero if empty (4 bytes)
+		tag (1 byte)
+	The pool in the fixedpool.SlabPool format
+
+Unlike Map the pool is saved with its Ptrs intact, so loading does not
+re-allocate every entry.  The buckets are checked against the pool on load.
+*/
+
+const tagFileMagic = "RBTG"
+const tagFileVersion = 1
+
+/*
+Write the entire map to w.  Implements io.WriterTo.
+*/
+func (m *TagMap) WriteTo(w io.Writer) (int64, error) {
+	cw := &util.CountingWriter{W: w}
+	bw := bufio.NewWriter(cw)
+
+	var hdr [fileHeaderSize]byte
+	copy(hdr[0:4], tagFileMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], tagFileVersion)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(m.valueSize))
+	binary.LittleEndian.PutUint64(hdr[12:], uint64(len(m.buckets)))
+	binary.LittleEndian.PutUint64(hdr[20:], uint64(m.maxOccupied))
+	binary.LittleEndian.PutUint64(hdr[28:], uint64(m.nOccupied))
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return cw.N, err
+	}
+
+	var rec [9]byte
+	for i, b := range m.buckets {
+		binary.LittleEndian.PutUint32(rec[0:], b.KeyPrefix)
+		binary.LittleEndian.PutUint32(rec[4:], uint32(b.More))
+		rec[8] = m.ctrl[i]
+		if _, err := bw.Write(rec[:]); err != nil {
+			return cw.N, err
+		}
+	}
+
+	if _, err := m.pool.WriteTo(bw); err != nil {
+		return cw.N, err
+	}
+	err := bw.Flush()
+	return cw.N, err
+}
+
+/*
+Replace the contents of the map with data previously written by WriteTo.
+Implements io.ReaderFrom.  The receiver may be a zero TagMap.  On error the
+map is left unchanged.
+
+Nothing beyond the end of the map is consumed from r, so r should be
+buffered by the caller (eg bufio.Reader) when reading from a file.
+*/
+func (m *TagMap) ReadFrom(r io.Reader) (int64, error) {
+	//not buffered so that nothing past the end of the map is consumed
+	cr := &util.CountingReader{R: r}
+
+	var hdr [fileHeaderSize]byte
+	if err := cr.ReadFull(hdr[:]); err != nil {
+		return cr.N, err
+	}
+
+	if string(hdr[0:4]) != tagFileMagic {
+		return cr.N, errors.New("robin32: not a robin32 tag map file")
+	}
+	if version := binary.LittleEndian.Uint32(hdr[4:]); version != tagFileVersion {
+		return cr.N, fmt.Errorf("robin32: unsupported file version %d", version)
+	}
+
+	valueSize := int(binary.LittleEndian.Uint32(hdr[8:]))
+	nBuckets := binary.LittleEndian.Uint64(hdr[12:])
+	maxOccupied := binary.LittleEndian.Uint64(hdr[20:])
+	nOccupied := binary.LittleEndian.Uint64(hdr[28:])
+
+	//sanity (also guards against int overflow below).  There must be an empty bucket to end probing.
+	const maxInt32 = 0x7FFFFFFF
+	if valueSize <= 0 || valueSize > maxInt32 || nBuckets == 0 || nBuckets > maxInt32 ||
+		maxOccupied == 0 || maxOccupied >= nBuckets || nOccupied > maxOccupied {
+		return cr.N, errors.New("robin32: corrupt header")
+	}
+
+	loaded := newTagMap(int(nBuckets), int(maxOccupied), valueSize)
+
+	//bucket records are read in batches
+	batch := make([]byte, 9 * 4096)
+	for start := 0; start < len(loaded.buckets); start += len(batch) / 9 {
+		n := min(len(loaded.buckets) - start, len(batch) / 9)
+		if err := cr.ReadFull(batch[0:n*9]); err != nil {
+			return cr.N, err
+		}
+		for j := 0; j < n; j++ {
+			rec := batch[j*9:]
+			loaded.buckets[start + j] = _Bucket{
+				KeyPrefix: binary.LittleEndian.Uint32(rec[0:]),
+				More: fixedpool.Ptr(binary.LittleEndian.Uint32(rec[4:])),
+			}
+			loaded.setTag(start + j, rec[8])
+		}
+	}
+
+	if _, err := loaded.pool.ReadFrom(cr); err != nil {
+		return cr.N, err
+	}
+	if err := loaded.check(int(nOccupied)); err != nil {
+		return cr.N, err
+	}
+	loaded.nOccupied = int(nOccupied)
+
+	*m = *loaded
+	return cr.N, nil
+}
+
+/*
+Check loaded buckets against the pool so that a damaged file cannot make Get
+or Put panic: every occupied bucket has a tag matching its key and its own
+allocated block, and is reachable by probing from its home bucket.
+*/
+func (m *TagMap) check(nOccupied int) error {
+	n := len(m.buckets)
+	owners := make(map[fixedpool.Ptr]bool, nOccupied)
+	count := 0
+	for i, b := range m.buckets {
+		tag := m.ctrl[i]
+		if b.More == fixedpool.Zero {
+			if tag != tagEmpty {
+				return fmt.Errorf("robin32: corrupt: empty bucket %d has tag 0x%02x", i, tag)
+			}
+			continue
+		}
+
+		if !m.pool.IsAllocated(b.More) || owners[b.More] {
+			return fmt.Errorf("robin32: corrupt: bucket %d has bad pointer 0x%08x", i, uint32(b.More))
+		}
+		owners[b.More] = true
+		if tag != m.pool.Get(b.More)[0] & 0x7F {
+			return fmt.Errorf("robin32: corrupt: bucket %d has the wrong tag", i)
+		}
+		for idx := m.index(b.KeyPrefix); idx != i; idx = (idx + 1) % n {
+			if m.buckets[idx].More == fixedpool.Zero {
+				return fmt.Errorf("robin32: corrupt: bucket %d is not reachable from its home bucket", i)
+			}
+		}
+		count++
+	}
+
+	if count != nOccupied {
+		return fmt.Errorf("robin32: corrupt: header has %d entries but %d buckets are occupied", nOccupied, count)
+	}
+	if m.pool.NumUsed() != count {
+		return fmt.Errorf("robin32: corrupt: pool has %d blocks in use but %d buckets are occupied", m.pool.NumUsed(), count)
+	}
+	return nil
+}
@@ -20,6 +20,8 @@ import (
 	"math"
 	"encoding/binary"
 	"bytes"
+	"errors"
+	"fmt"
 )
 
 
@@ -63,8 +65,8 @@ type _Bucket struct {
 type Map struct {
 	buckets []_Bucket
 
-	//holds the key suffix and value for each entry
-	pool *fixedpool.Pool
+	//holds the key suffix and value for each entry.  Grows as entries are added.
+	pool *fixedpool.SlabPool
 
 	//Current number of occupied buckets
 	nOccupied int
@@ -89,11 +91,16 @@ func NewMap(maxCapacity int, valueSize int) *Map {
 	// probe distance reasonable until about 85-90% capacity
 	nBuckets := int(math.Ceil(float64(maxCapacity) * 1.15))
 
+	return newMap(nBuckets, maxCapacity, valueSize)
+}
+
+//Create a map with an explicit bucket count (used by benchmarks to control load factor)
+func newMap(nBuckets, maxOccupied, valueSize int) *Map {
 	return &Map{
 		buckets: make([]_Bucket, nBuckets),
-		maxOccupied: maxCapacity,
+		maxOccupied: maxOccupied,
 		valueSize: valueSize,
-		pool: fixedpool.NewPool(keySuffixLen + valueSize, maxCapacity),
+		pool: fixedpool.NewSlabPool(keySuffixLen + valueSize, fixedpool.DefaultSlabBlocks, maxOccupied),
 	}
 }
 
@@ -185,12 +192,17 @@ func (m *Map) Put(key []byte, value []byte) PutResult {
 	}
 
 	if m.nOccupied >= m.maxOccupied {
+		//Full.  Only an update of an existing key is possible.
+		if idx, found := m.find(key); found {
+			copy(m.getValueRef(m.buckets[idx]), value)
+			return PRValueUpdated
+		}
 		return PRFull
 	}
 
 	incoming, ok := m.allocBucket(key, value)
 	if !ok {
-		//should not happen because pool was allocated to hold maxOccupied
+		//should not happen because the pool can hold maxOccupied
 		return PRAssertFail
 	}
 
@@ -244,6 +256,15 @@ func (m *Map) Get(key []byte, resultValue []byte) bool {
 		panic("resultValue wrong size")
 	}
 
+	idx, found := m.find(key)
+	if found {
+		copy(resultValue, m.getValueRef(m.buckets[idx]))
+	}
+	return found
+}
+
+//Locate the bucket holding key.  Returns false if not present.
+func (m *Map) find(key []byte) (int, bool) {
 	keyPrefix := keyPrefixAsUint32(key)
 	keySuffix := key[4:]
 	idx := m.index(keyPrefix)
@@ -255,17 +276,16 @@ func (m *Map) Get(key []byte, resultValue []byte) bool {
 
 		if other.isEmpty() {
 			//not found
-			return false
+			return 0, false
 		} else if m.isKeyEqual2(other, keyPrefix, keySuffix) {
 			//Found!
-			copy(resultValue, m.getValueRef(other))
-			return true
+			return idx, true
 		}
 
 		otherDist := m.probeDist(other, idx)
 		if otherDist < dist {
 			//not found
-			return false
+			return 0, false
 		}
 
 		dist++
@@ -273,10 +293,139 @@ func (m *Map) Get(key []byte, resultValue []byte) bool {
 		if idx >= len(m.buckets) {
 			if wrapped {
 				//not found
-				return false
+				return 0, false
 			}
 			idx = 0
 			wrapped = true
 		}
 	}
 }
+
+//Number of entries in the map
+func (m *Map) Len() int {
+	return m.nOccupied
+}
+
+//Maximum number of entries.  Put returns PRFull beyond this.
+func (m *Map) Capacity() int {
+	return m.maxOccupied
+}
+
+//Approximate RAM used by the map, in bytes (buckets plus the pool slabs allocated so far)
+func (m *Map) MemSize() int64 {
+	const bucketSize = 8
+	return int64(len(m.buckets)) * bucketSize +
+		int64(m.pool.NumBlocks()) * int64(m.pool.BlockSize())
+}
+
+//Occupancy and fragmentation of the pool holding the key suffixes and values
+func (m *Map) PoolStats() fixedpool.PoolStats {
+	return m.pool.Stats()
+}
+
+/*
+Move entries out of the highest pool slabs into free blocks of the lower
+slabs, release the emptied slabs and rewrite the bucket pointers.  Lookups
+are unaffected.  Costs one pass over the buckets plus 8 bytes per moved entry.
+*/
+func (m *Map) Compact() fixedpool.CompactReport {
+	var relocs fixedpool.Relocations
+	report := m.pool.Compact(relocs.Record)
+	if relocs.Len() > 0 {
+		for i := range m.buckets {
+			if !m.buckets[i].isEmpty() {
+				m.buckets[i].More = relocs.Lookup(m.buckets[i].More)
+			}
+		}
+	}
+	return report
+}
+
+/*
+Call fn for every entry in the map.  The key is rebuilt from the bucket
+KeyPrefix plus the key suffix held in the pool.  Both slices are only valid
+until fn returns; the value slice refers directly to the pool so writing to it
+updates the map.  Iteration stops when fn returns false.
+
+The map must not be modified during iteration.
+*/
+func (m *Map) Range(fn func(key []byte, value []byte) bool) {
+	var key [KeySize]byte
+
+	for _, b := range m.buckets {
+		if b.isEmpty() {
+			continue
+		}
+
+		more := m.pool.Get(b.More)
+		binary.LittleEndian.PutUint32(key[:], b.KeyPrefix)
+		copy(key[4:], more[0:keySuffixLen])
+
+		if !fn(key[:], more[keySuffixLen:]) {
+			return
+		}
+	}
+}
+
+/*
+Check the internal invariants of the map.  Returns nil if the map is consistent,
+otherwise an error describing the first problem found.  This visits every bucket
+so it is intended for tests and offline audits.
+
+The following are checked:
+	- probe distance never increases by more than one between neighboring buckets
+	  (and an entry following an empty bucket is in its preferred bucket)
+	- every More pointer is allocated in the pool and no two buckets share one
+	- nOccupied matches the number of occupied buckets and the pool usage
+*/
+func (m *Map) Verify() error {
+	n := len(m.buckets)
+	if n == 0 {
+		return errors.New("robin32: map has no buckets")
+	}
+
+	seen := make(map[fixedpool.Ptr]bool, m.nOccupied)
+	nOccupied := 0
+
+	for idx, b := range m.buckets {
+		if b.isEmpty() {
+			continue
+		}
+		nOccupied++
+
+		if !m.pool.IsAllocated(b.More) {
+			return fmt.Errorf("robin32: bucket %d points to unallocated block %d", idx, b.More)
+		}
+		if seen[b.More] {
+			return fmt.Errorf("robin32: bucket %d shares block %d with another bucket", idx, b.More)
+		}
+		seen[b.More] = true
+
+		//The previous bucket (with wrap around) must be no more than one closer
+		// to its preferred bucket.  An empty predecessor acts as distance -1.
+		dist := m.probeDist(b, idx)
+		prevIdx := idx - 1
+		if prevIdx < 0 {
+			prevIdx = n - 1
+		}
+		prevDist := -1
+		if prev := m.buckets[prevIdx]; !prev.isEmpty() {
+			prevDist = m.probeDist(prev, prevIdx)
+		}
+		if dist > prevDist + 1 {
+			return fmt.Errorf("robin32: bucket %d has probe distance %d after distance %d", idx, dist, prevDist)
+		}
+	}
+
+	if nOccupied != m.nOccupied {
+		return fmt.Errorf("robin32: nOccupied is %d but %d buckets are occupied", m.nOccupied, nOccupied)
+	}
+	if nOccupied > m.maxOccupied {
+		return fmt.Errorf("robin32: %d occupied buckets exceeds maxOccupied %d", nOccupied, m.maxOccupied)
+	}
+	if m.pool.NumUsed() != nOccupied {
+		return fmt.Errorf("robin32: pool has %d blocks in use but %d buckets are occupied", m.pool.NumUsed(), nOccupied)
+	}
+
+	return nil
+}
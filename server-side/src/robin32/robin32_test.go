@@ -5,7 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"util"
 	"math/rand"
-	//"fixedpool"
+	"fixedpool"
 	"encoding/binary"
 	"bytes"
 )
@@ -155,12 +155,17 @@ func TestTiny(t * testing.T) {
 	//Value which does not exist
 	req.False(m.Get(int2key(99), vbuf))
 
-	//TODO: Update every value.
-	//Must remove one first because map becomes readonly when completely full.
-	//for _, ki := range keyInts {
-	//	res := m.Put(int2key(ki), util.MakeSeq(13, byte(ki + 7)))
-	//	req.Equal(PRValueUpdated, res)
-	//}
+	//Update every value.  Allowed even when completely full.
+	for _, ki := range keyInts {
+		res := m.Put(int2key(ki), util.MakeSeq(13, byte(ki + 7)))
+		req.Equal(PRValueUpdated, res)
+	}
+	for _, ki := range keyInts {
+		req.True(m.Get(int2key(ki), vbuf))
+		req.Equal(util.MakeSeq(13, byte(ki + 7)), vbuf)
+	}
+	req.Equal(0, m.pool.NumFree())
+	req.Equal(10, m.Len())
 }
 
 func TestRand(t * testing.T) {
@@ -192,6 +197,9 @@ func TestRand(t * testing.T) {
 
 	//entire pool was used (except 1)
 	req.Equal(1, m.pool.NumFree())
+	ps := m.PoolStats()
+	req.Equal(N, ps.NumUsed)
+	req.Equal(1, ps.LongestFreeRun)
 
 	//Update all
 	for i := 0; i < N; i++ {
@@ -238,3 +246,203 @@ func TestWorstCase(t *testing.T) {
 	}
 }
 
+
+func fillRand(m *Map, n int, seed int64) (keys, vals [][]byte) {
+	rand.Seed(seed)
+	for i := 0; i < n; i++ {
+		k := randKey()
+		v := randValue(m.valueSize)
+		if m.Put(k, v) != PRKeyWasNew {
+			panic("fillRand: put failed")
+		}
+		keys = append(keys, k)
+		vals = append(vals, v)
+	}
+	return
+}
+
+func TestRange(t *testing.T) {
+	req := require.New(t)
+
+	m := NewMap(200, 7)
+	keys, vals := fillRand(m, 150, 3)
+
+	expect := make(map[string]string)
+	for i := range keys {
+		expect[string(keys[i])] = string(vals[i])
+	}
+
+	//every entry is visited exactly once with the full key
+	visited := make(map[string]bool)
+	m.Range(func(key []byte, value []byte) bool {
+		req.Equal(KeySize, len(key))
+		req.Equal(7, len(value))
+		v, ok := expect[string(key)]
+		req.True(ok)
+		req.Equal(v, string(value))
+		req.False(visited[string(key)])
+		visited[string(key)] = true
+		return true
+	})
+	req.Equal(len(keys), len(visited))
+
+	//early stop
+	n := 0
+	m.Range(func(key []byte, value []byte) bool {
+		n++
+		return n < 10
+	})
+	req.Equal(10, n)
+
+	//value slice is writable
+	m.Range(func(key []byte, value []byte) bool {
+		util.FillConst(value, 0x55)
+		return true
+	})
+	vbuf := make([]byte, 7)
+	req.True(m.Get(keys[0], vbuf))
+	req.Equal(bytes.Repeat([]byte{0x55}, 7), vbuf)
+}
+
+func TestVerify(t *testing.T) {
+	req := require.New(t)
+
+	m := NewMap(300, 4)
+	req.Nil(m.Verify())
+
+	fillRand(m, 299, 5)
+	req.Nil(m.Verify())
+
+	//find an entry which is displaced from its preferred bucket
+	displaced := -1
+	for idx, b := range m.buckets {
+		if !b.isEmpty() && m.probeDist(b, idx) > 0 {
+			displaced = idx
+			break
+		}
+	}
+	req.True(displaced >= 0)
+
+	//Emptying the bucket before it breaks the robin hood invariant
+	prev := displaced - 1
+	if prev < 0 {
+		prev = len(m.buckets) - 1
+	}
+	saved := m.buckets[prev]
+	m.buckets[prev].More = fixedpool.Zero
+	req.NotNil(m.Verify())
+	m.buckets[prev] = saved
+	req.Nil(m.Verify())
+
+	//pointer to an unallocated block
+	saved = m.buckets[displaced]
+	m.pool.Free(saved.More)
+	req.NotNil(m.Verify())
+	m.buckets[displaced].More = m.pool.Alloc()
+	req.Nil(m.Verify())
+
+	//nOccupied mismatch
+	m.nOccupied--
+	req.NotNil(m.Verify())
+	m.nOccupied++
+	req.Nil(m.Verify())
+}
+
+func TestCompact(t *testing.T) {
+	req := require.New(t)
+
+	//small slabs, and entries allocated after blocks which are then freed
+	m := NewMap(300, 4)
+	m.pool = fixedpool.NewSlabPool(keySuffixLen + 4, 16, 300)
+	var junk []fixedpool.Ptr
+	for i := 0; i < 100; i++ {
+		junk = append(junk, m.pool.Alloc())
+	}
+	keys, vals := fillRand(m, 150, 11)
+	for _, ptr := range junk {
+		m.pool.Free(ptr)
+	}
+	req.Equal(16, m.pool.NumSlabs())
+
+	report := m.Compact()
+	req.Equal(150, report.LiveBlocks)
+	req.Equal(10, m.pool.NumSlabs())
+	req.Nil(m.Verify())
+	vbuf := make([]byte, 4)
+	for i := range keys {
+		req.True(m.Get(keys[i], vbuf))
+		req.Equal(vals[i], vbuf)
+	}
+
+	//nothing left to move
+	req.Equal(0, m.Compact().Moves)
+	req.Equal(PRKeyWasNew, m.Put(randKey(), randValue(4)))
+	req.Nil(m.Verify())
+}
+
+func TestWriteReadFrom(t *testing.T) {
+	req := require.New(t)
+
+	m := NewMap(500, 9)
+	keys, vals := fillRand(m, 480, 7)
+
+	var buf bytes.Buffer
+	nWritten, err := m.WriteTo(&buf)
+	req.Nil(err)
+	req.Equal(int64(buf.Len()), nWritten)
+	req.Equal(int64(fileHeaderSize + 8 * len(m.buckets) + 480 * (keySuffixLen + 9)), nWritten)
+
+	//trailing bytes must not be consumed
+	buf.WriteString("trailer")
+
+	var m2 Map
+	nRead, err := m2.ReadFrom(&buf)
+	req.Nil(err)
+	req.Equal(nWritten, nRead)
+	req.Equal("trailer", buf.String())
+	req.Nil(m2.Verify())
+
+	req.Equal(m.nOccupied, m2.nOccupied)
+	req.Equal(m.maxOccupied, m2.maxOccupied)
+	req.Equal(len(m.buckets), len(m2.buckets))
+
+	vbuf := make([]byte, 9)
+	for i := range keys {
+		req.True(m2.Get(keys[i], vbuf))
+		req.Equal(vals[i], vbuf)
+	}
+
+	//loaded map is still usable
+	req.Equal(PRKeyWasNew, m2.Put(randKey(), randValue(9)))
+	req.Nil(m2.Verify())
+
+	//truncated input fails and leaves the map untouched
+	buf.Reset()
+	m.WriteTo(&buf)
+	truncated := buf.Bytes()[0:buf.Len() - 1]
+	_, err = m2.ReadFrom(bytes.NewReader(truncated))
+	req.NotNil(err)
+	req.Equal(m.nOccupied + 1, m2.nOccupied)
+
+	//bad magic
+	bad := append([]byte{}, buf.Bytes()...)
+	bad[0] = 'X'
+	_, err = m2.ReadFrom(bytes.NewReader(bad))
+	req.NotNil(err)
+
+	//an entry moved away from its home bucket fails Verify
+	n := len(m.buckets)
+	i := 1
+	for !(m.buckets[i - 1].isEmpty() && !m.buckets[i].isEmpty()) {
+		i++
+	}
+	prefix := uint32(0)
+	for m.index(prefix) != (i + 1) % n {
+		prefix++
+	}
+	bad = append([]byte{}, buf.Bytes()...)
+	binary.LittleEndian.PutUint32(bad[fileHeaderSize + 8 * i:], prefix)
+	_, err = m2.ReadFrom(bytes.NewReader(bad))
+	req.ErrorContains(err, "probe distance")
+	req.Equal(m.nOccupied + 1, m2.nOccupied)
+}
@@ -0,0 +1,236 @@
+package robin32
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fixedpool"
+	"math"
+	"math/bits"
+)
+
+/*
+TagMap is an experimental variant of Map which keeps a parallel array of 1 byte
+control tags (in the style of Google's "Swiss table").  Each tag holds 7 bits of
+the key (taken from outside the KeyPrefix which selects the bucket) or tagEmpty.
+Probing compares 8 tags at a time using 64bit word tricks so that most
+non-matching buckets are skipped without reading the 8 byte bucket or
+dereferencing its pool block.
+
+Keys, values and the pool layout are the same as Map.  Since the map never
+deletes, probing is plain linear probing which stops at the first empty tag;
+no Robin Hood displacement is needed.
+
+Memory cost is one extra byte per bucket (plus 8 bytes to mirror the first
+group so that a group read never needs to wrap).
+*/
+type TagMap struct {
+	buckets []_Bucket
+
+	//One tag per bucket, followed by a copy of the first groupSize tags
+	ctrl []byte
+
+	//holds the key suffix and value for each entry.  Grows as entries are added.
+	pool *fixedpool.SlabPool
+
+	//Current number of occupied buckets
+	nOccupied int
+
+	//Max number of occupied buckets.
+	maxOccupied int
+
+	//The size of each value, in bytes
+	valueSize int
+}
+
+//number of tags compared at once
+const groupSize = 8
+
+//high bit set means empty.  Occupied tags are 0-127.
+const tagEmpty = 0x80
+
+const lsbEachByte = 0x0101010101010101
+const msbEachByte = 0x8080808080808080
+const allOnes = 0xFFFFFFFFFFFFFFFF
+
+func NewTagMap(maxCapacity int, valueSize int) *TagMap {
+	if maxCapacity < 10 {
+		maxCapacity = 10
+	}
+
+	//Same 15% headroom as Map so the two can be compared fairly
+	nBuckets := int(math.Ceil(float64(maxCapacity) * 1.15))
+	return newTagMap(nBuckets, maxCapacity, valueSize)
+}
+
+func newTagMap(nBuckets, maxOccupied, valueSize int) *TagMap {
+	if valueSize <= 0 {
+		panic("illegal valueSize")
+	}
+	if maxOccupied >= nBuckets {
+		//at least one empty bucket is required to terminate probing
+		panic("maxOccupied must be less than nBuckets")
+	}
+
+	ctrl := make([]byte, nBuckets + groupSize)
+	for i := range ctrl {
+		ctrl[i] = tagEmpty
+	}
+
+	return &TagMap{
+		buckets: make([]_Bucket, nBuckets),
+		ctrl: ctrl,
+		maxOccupied: maxOccupied,
+		valueSize: valueSize,
+		pool: fixedpool.NewSlabPool(keySuffixLen + valueSize, fixedpool.DefaultSlabBlocks, maxOccupied),
+	}
+}
+
+//Number of entries in the map
+func (m *TagMap) Len() int {
+	return m.nOccupied
+}
+
+//Hash the first 32bits of the key to an index
+func (m *TagMap) index(keyPrefix uint32) int {
+	return int(keyPrefix % uint32(len(m.buckets)))
+}
+
+/*
+7 bits of the key for the tag.  The KeyPrefix already decides the bucket so
+the tag uses the first suffix byte which is independent of it.
+*/
+func keyTag(key []byte) byte {
+	return key[4] & 0x7F
+}
+
+//Read the group of tags starting at idx.  Byte i of the result is ctrl[idx+i].
+func (m *TagMap) group(idx int) uint64 {
+	return binary.LittleEndian.Uint64(m.ctrl[idx:])
+}
+
+/*
+Returns a mask with the high bit set in each byte of group which equals tag.
+May have false positives in a byte directly following a true match (the classic
+"has zero byte" trick) but those are filtered by the full key compare.
+*/
+func matchTag(group uint64, tag byte) uint64 {
+	x := group ^ (lsbEachByte * uint64(tag))
+	return (x - lsbEachByte) &^ x & msbEachByte
+}
+
+//High bit set in each byte of group which is empty
+func matchEmpty(group uint64) uint64 {
+	return group & msbEachByte
+}
+
+func (m *TagMap) setTag(idx int, tag byte) {
+	m.ctrl[idx] = tag
+	//mirror the first group after the end
+	if idx < groupSize {
+		m.ctrl[len(m.buckets) + idx] = tag
+	}
+}
+
+/*
+Probe for the key.  Returns the bucket index holding the key and true, or
+the index of the first empty bucket in the probe sequence and false.
+*/
+func (m *TagMap) find(keyPrefix uint32, keySuffix []byte, tag byte) (int, bool) {
+	n := len(m.buckets)
+	idx := m.index(keyPrefix)
+
+	//there is always an empty bucket so this terminates
+	for {
+		g := m.group(idx)
+
+		//only look at tags before the first empty one
+		empty := matchEmpty(g)
+		limit := uint64(allOnes)
+		if empty != 0 {
+			limit = (empty & -empty) - 1
+		}
+
+		match := matchTag(g, tag) & limit
+		for match != 0 {
+			i := idx + bits.TrailingZeros64(match) / 8
+			if i >= n {
+				i -= n
+			}
+
+			b := m.buckets[i]
+			if b.KeyPrefix == keyPrefix &&
+				bytes.Equal(m.pool.Get(b.More)[0:keySuffixLen], keySuffix) {
+				return i, true
+			}
+
+			match &= match - 1
+		}
+
+		if empty != 0 {
+			i := idx + bits.TrailingZeros64(empty) / 8
+			if i >= n {
+				i -= n
+			}
+			return i, false
+		}
+
+		idx += groupSize
+		if idx >= n {
+			idx -= n
+		}
+	}
+}
+
+func (m *TagMap) Put(key []byte, value []byte) PutResult {
+	if len(key) != KeySize {
+		return PRIllegalArg
+	}
+	if len(value) != m.valueSize {
+		return PRIllegalArg
+	}
+
+	keyPrefix := keyPrefixAsUint32(key)
+	tag := keyTag(key)
+	idx, found := m.find(keyPrefix, key[4:], tag)
+	if found {
+		copy(m.pool.Get(m.buckets[idx].More)[keySuffixLen:], value)
+		return PRValueUpdated
+	}
+
+	if m.nOccupied >= m.maxOccupied {
+		return PRFull
+	}
+
+	ptr := m.pool.Alloc()
+	if ptr == fixedpool.Zero {
+		//should not happen because the pool can hold maxOccupied
+		return PRAssertFail
+	}
+
+	dat := m.pool.Get(ptr)
+	copy(dat, key[4:])
+	copy(dat[keySuffixLen:], value)
+
+	m.buckets[idx] = _Bucket{
+		KeyPrefix: keyPrefix,
+		More: ptr,
+	}
+	m.setTag(idx, tag)
+	m.nOccupied++
+	return PRKeyWasNew
+}
+
+func (m *TagMap) Get(key []byte, resultValue []byte) bool {
+	//sanity
+	if len(key) != KeySize {
+		return false
+	} else if len(resultValue) != m.valueSize {
+		panic("resultValue wrong size")
+	}
+
+	idx, found := m.find(keyPrefixAsUint32(key), key[4:], keyTag(key))
+	if found {
+		copy(resultValue, m.pool.Get(m.buckets[idx].More)[keySuffixLen:])
+	}
+	return found
+}
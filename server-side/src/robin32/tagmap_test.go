@@ -0,0 +1,284 @@
+package robin32
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"util"
+	"math/rand"
+	"map326"
+	"encoding/binary"
+	"strconv"
+	"bytes"
+)
+
+func TestMatchTag(t *testing.T) {
+	req := require.New(t)
+
+	//tags 0..7 in bytes 0..7
+	var g uint64
+	for i := 7; i >= 0; i-- {
+		g = (g << 8) | uint64(i)
+	}
+
+	for tag := 0; tag < 8; tag++ {
+		m := matchTag(g, byte(tag))
+		//the true match is always reported
+		req.True(m & (0x80 << (uint(tag) * 8)) != 0, tag)
+		//nothing below it
+		req.Equal(uint64(0), m & ((uint64(1) << (uint(tag) * 8)) - 1), tag)
+	}
+
+	req.Equal(uint64(0), matchEmpty(g))
+	g |= tagEmpty << 24
+	req.Equal(uint64(0x80 << 24), matchEmpty(g))
+}
+
+func TestTagMapTiny(t *testing.T) {
+	req := require.New(t)
+
+	m := NewTagMap(10, 13)
+	req.Equal(12, len(m.buckets))
+	req.Equal(12 + groupSize, len(m.ctrl))
+
+	vbuf := make([]byte, 13)
+	req.False(m.Get(int2key(99), vbuf))
+
+	//Fill
+	keyInts := []int{67, 38, 41, 75, 77, 27, 50, 3, 19, 91}
+	for _, ki := range keyInts {
+		res := m.Put(int2key(ki), util.MakeSeq(13, byte(ki + 3)))
+		req.Equal(PRKeyWasNew, res)
+	}
+	req.Equal(10, m.Len())
+
+	//cannot put another
+	req.Equal(PRFull, m.Put(int2key(99), make([]byte, 13)))
+
+	//but updates are still allowed when full
+	for _, ki := range keyInts {
+		res := m.Put(int2key(ki), util.MakeSeq(13, byte(ki + 7)))
+		req.Equal(PRValueUpdated, res)
+	}
+
+	for _, ki := range keyInts {
+		req.True(m.Get(int2key(ki), vbuf))
+		req.Equal(util.MakeSeq(13, byte(ki + 7)), vbuf)
+	}
+
+	//mirrored tags match the first group
+	n := len(m.buckets)
+	req.Equal(m.ctrl[0:groupSize], m.ctrl[n:n+groupSize])
+
+	req.Equal(0, m.pool.NumFree())
+	req.False(m.Get(int2key(99), vbuf))
+
+	//illegal args
+	req.Equal(PRIllegalArg, m.Put(make([]byte, 3), vbuf))
+	req.Equal(PRIllegalArg, m.Put(int2key(1), make([]byte, 3)))
+}
+
+/*
+Compare against a Go map with random keys, many of which share a bucket
+and tag, so that probing wraps around the end of the table.
+*/
+func TestTagMapRand(t *testing.T) {
+	req := require.New(t)
+
+	for _, capacity := range []int{10, 17, 100, 1000} {
+		m := NewTagMap(capacity, 5)
+		expect := make(map[string][]byte)
+
+		rand.Seed(int64(capacity))
+		for i := 0; i < capacity; i++ {
+			k := randKey()
+			//crowd keys into the last few buckets
+			binary.LittleEndian.PutUint32(k, uint32(len(m.buckets) - 1 - rand.Intn(3)))
+			//few distinct tags
+			k[4] = byte(rand.Intn(2))
+			v := randValue(5)
+
+			req.Equal(PRKeyWasNew, m.Put(k, v))
+			expect[string(k)] = v
+		}
+
+		vbuf := make([]byte, 5)
+		for k, v := range expect {
+			req.True(m.Get([]byte(k), vbuf))
+			req.Equal(v, vbuf)
+		}
+
+		//misses with the same prefix and tag
+		for i := 0; i < 50; i++ {
+			k := randKey()
+			binary.LittleEndian.PutUint32(k, uint32(len(m.buckets) - 1))
+			k[4] = 0
+			req.False(m.Get(k, vbuf))
+		}
+	}
+}
+
+func TestTagMapWriteReadFrom(t *testing.T) {
+	req := require.New(t)
+
+	m := NewTagMap(500, 9)
+	rand.Seed(8)
+	expect := make(map[string][]byte)
+	for i := 0; i < 480; i++ {
+		k, v := randKey(), randValue(9)
+		req.Equal(PRKeyWasNew, m.Put(k, v))
+		expect[string(k)] = v
+	}
+
+	var buf bytes.Buffer
+	nWritten, err := m.WriteTo(&buf)
+	req.Nil(err)
+	req.Equal(int64(buf.Len()), nWritten)
+	file := append([]byte{}, buf.Bytes()...)
+	buf.WriteString("trailer")
+
+	var m2 TagMap
+	nRead, err := m2.ReadFrom(&buf)
+	req.Nil(err)
+	req.Equal(nWritten, nRead)
+	req.Equal("trailer", buf.String())
+	req.Equal(480, m2.Len())
+	req.Equal(m.ctrl, m2.ctrl)
+	vbuf := make([]byte, 9)
+	for k, v := range expect {
+		req.True(m2.Get([]byte(k), vbuf))
+		req.Equal(v, vbuf)
+	}
+	req.Equal(PRKeyWasNew, m2.Put(randKey(), randValue(9)))
+
+	check := func(dat []byte, msg string) {
+		var m3 TagMap
+		_, err := m3.ReadFrom(bytes.NewReader(dat))
+		req.Error(err)
+		req.Contains(err.Error(), msg)
+		req.Nil(m3.buckets)
+	}
+	check(file[:len(file) - 1], "unexpected EOF")
+	bad := append([]byte{}, file...)
+	bad[0] = 'X'
+	check(bad, "not a robin32 tag map file")
+
+	//maxOccupied must leave an empty bucket
+	bad = append([]byte{}, file...)
+	copy(bad[20:], bad[12:20])
+	check(bad, "corrupt header")
+
+	occupied := 0
+	for m.buckets[occupied].More == 0 {
+		occupied++
+	}
+	rec := fileHeaderSize + 9 * occupied
+
+	bad = append([]byte{}, file...)
+	bad[rec + 8] ^= 1
+	check(bad, "wrong tag")
+
+	bad = append([]byte{}, file...)
+	bad[rec + 7] = 0xF0
+	check(bad, "bad pointer")
+
+	//an entry directly after an empty bucket is at home; make that empty bucket its home
+	atHome := 1
+	for m.buckets[atHome - 1].More != 0 || m.buckets[atHome].More == 0 {
+		atHome++
+	}
+	rec = fileHeaderSize + 9 * atHome
+	bad = append([]byte{}, file...)
+	binary.LittleEndian.PutUint32(bad[rec:], m.buckets[atHome].KeyPrefix - 1)
+	check(bad, "not reachable")
+
+	bad = append([]byte{}, file...)
+	bad[28]--
+	check(bad, "entries but")
+}
+
+//Keys for a benchmark plus as many misses
+func benchKeys(n int, valueSize int) (hits, misses [][]byte, vals [][]byte) {
+	rand.Seed(42)
+	for i := 0; i < n; i++ {
+		hits = append(hits, randKey())
+		misses = append(misses, randKey())
+		vals = append(vals, randValue(valueSize))
+	}
+	return
+}
+
+type benchIndex interface {
+	put(k, v []byte) bool
+	get(k, v []byte) bool
+}
+
+type benchImpl struct {
+	name string
+	idx benchIndex
+}
+
+type benchRobin struct{ m *Map }
+func (b benchRobin) put(k, v []byte) bool { return b.m.Put(k, v).OK() }
+func (b benchRobin) get(k, v []byte) bool { return b.m.Get(k, v) }
+
+type benchTag struct{ m *TagMap }
+func (b benchTag) put(k, v []byte) bool { return b.m.Put(k, v).OK() }
+func (b benchTag) get(k, v []byte) bool { return b.m.Get(k, v) }
+
+type benchMap326 struct{ m *map326.Map }
+func (b benchMap326) put(k, v []byte) bool {
+	var val map326.Value
+	copy(val[:], v)
+	return b.m.Put(k, val) != 0
+}
+func (b benchMap326) get(k, v []byte) bool {
+	val, found := b.m.Get(k)
+	copy(v, val[:])
+	return found
+}
+
+/*
+Compare Map, TagMap and map326 at 50%, 85% and 95% load.  For the robin32 maps
+load is occupied/buckets.  map326 has no bucket count (it chains into a pool) so
+it is created with a capacity of nBuckets and holds the same n entries.
+*/
+func Benchmark_load(b *testing.B) {
+	const nBuckets = 1 << 20
+	const valueSize = 6
+
+	for _, load := range []int{50, 85, 95} {
+		n := nBuckets * load / 100
+		hits, misses, vals := benchKeys(n, valueSize)
+
+		m326, _ := map326.New(nBuckets)
+		impls := []benchImpl{
+			{"robin32", benchRobin{newMap(nBuckets, n, valueSize)}},
+			{"tagmap", benchTag{newTagMap(nBuckets, n, valueSize)}},
+			{"map326", benchMap326{m326}},
+		}
+
+		for _, impl := range impls {
+			for i := range hits {
+				if !impl.idx.put(hits[i], vals[i]) {
+					b.Fatalf("%s: put failed at %d%% load", impl.name, load)
+				}
+			}
+
+			vbuf := make([]byte, valueSize)
+			b.Run(impl.name + "/hit/" + strconv.Itoa(load), func(b *testing.B) {
+				for j := 0; j < b.N; j++ {
+					if !impl.idx.get(hits[j % n], vbuf) {
+						b.Fatal("not found")
+					}
+				}
+			})
+			b.Run(impl.name + "/miss/" + strconv.Itoa(load), func(b *testing.B) {
+				for j := 0; j < b.N; j++ {
+					if impl.idx.get(misses[j % n], vbuf) {
+						b.Fatal("found")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+scrub re-reads every chunk in a packstore and verifies it against its SHA256
+digest, the pack footers and the digest index, to find bitrot before a restore
+needs the data.  The report is written as JSON.
+
+Example:
+
+	scrub -packs /var/lib/dedupd/packs -rate 20 -report scrub.json
+
+-rate limits reads (in MB per second) so it can run during the day.  The report
+file doubles as the saved progress: it is rewritten every few seconds and on
+interrupt (Ctrl-C), and a later run with the same -report resumes an unfinished
+scrub.  Use -restart to start over.  The index may differ between runs (it is
+rebuilt each time without -index): checking resumes by key, not by position.
+
+-index checks an index saved by the server or by rebuildindex -out; without
+it the index is rebuilt from the pack footers, which still finds footer and
+record damage.
+
+The packs are opened read-only, so scrub can run next to a live server.  The
+pack it is writing has no footer yet and is reported as unsealed; bytes after
+its last complete record are reported as torn (a crashed server, or a record
+caught mid-write).
+
+Exits with status 1 if any bad chunks or index entries were found.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"map326"
+	"os"
+	"os/signal"
+	"packstore"
+	"time"
+)
+
+func main() {
+	packsDir := flag.String("packs", "", "directory holding the pack files")
+	indexPath := flag.String("index", "", "saved index to check (default: rebuild from the packs)")
+	rate := flag.Float64("rate", 0, "read rate limit in MB per second (0 for no limit)")
+	reportPath := flag.String("report", "scrub.json", "JSON report, also used to resume")
+	restart := flag.Bool("restart", false, "ignore an unfinished report and start over")
+	flag.Parse()
+
+	if *packsDir == "" {
+		log.Fatal("-packs is required")
+	}
+	if _, err := os.Stat(*packsDir); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts := packstore.ScrubOptions{RateLimit: int64(*rate * 1e6)}
+	report, err := run(ctx, *packsDir, *indexPath, *reportPath, *restart, opts, os.Stdout)
+	if errors.Is(err, context.Canceled) {
+		fmt.Printf("interrupted; run again to resume from %s\n", *reportPath)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+//Load a previous report to resume, if there is an unfinished one
+func loadReport(path string) (*packstore.ScrubReport, error) {
+	report := &packstore.ScrubReport{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return report, nil
+}
+
+//Write the report atomically so an interrupted write never loses progress
+func saveReport(path string, report *packstore.ScrubReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//The saved index at path, or one rebuilt from the packs if path is empty
+func loadIndex(dir, path string, out io.Writer) (*map326.Map, error) {
+	if path != "" {
+		idx, err := packstore.ReadIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "index: %d entries from %s\n", idx.Len(), path)
+		return idx, nil
+	}
+	idx, rebuilt, err := packstore.Rebuild(dir, packstore.RebuildOptions{})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "index: %d entries from %d packs\n", idx.Len(), rebuilt.Packs)
+	return idx, nil
+}
+
+func run(ctx context.Context, dir, indexPath, reportPath string, restart bool, opts packstore.ScrubOptions,
+	out io.Writer) (*packstore.ScrubReport, error) {
+
+	report := &packstore.ScrubReport{}
+	if !restart {
+		var err error
+		if report, err = loadReport(reportPath); err != nil {
+			return nil, err
+		}
+		if !report.Done && !report.Started.IsZero() {
+			fmt.Fprintf(out, "resuming scrub started %v\n", report.Started.Format(time.RFC3339))
+		}
+	}
+
+	s, err := packstore.OpenReadOnly(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	idx, err := loadIndex(dir, indexPath, out)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Checkpoint = func(r *packstore.ScrubReport) error {
+		fmt.Fprintf(out, "%d records, %d MB checked\n", r.RecordsChecked, r.BytesChecked / 1e6)
+		return saveReport(reportPath, r)
+	}
+	if err := s.Scrub(ctx, idx, opts, report); err != nil {
+		return report, err
+	}
+
+	fmt.Fprintf(out, "records checked: %d (%d bytes)\n", report.RecordsChecked, report.BytesChecked)
+	fmt.Fprintf(out, "bad chunks: %d\n", len(report.BadChunks))
+	fmt.Fprintf(out, "bad index entries: %d\n", len(report.BadIndexEntries))
+	fmt.Fprintf(out, "orphans: %d\n", len(report.Orphans))
+	if u := report.Unsealed; u != nil {
+		fmt.Fprintf(out, "unsealed pack %d: %d records, %d torn bytes\n", u.Pack, u.Records, u.TornBytes)
+	}
+	fmt.Fprintf(out, "report: %s\n", reportPath)
+	return report, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"packstore"
+	"path/filepath"
+	"testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	reportPath := filepath.Join(t.TempDir(), "scrub.json")
+
+	s, err := packstore.Open(dir, packstore.Options{MaxPackSize: 5000, SyncBytes: 5000})
+	req.NoError(err)
+	var locs []packstore.Location
+	for i := 0; i < 10; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1000)
+		loc, err := s.Put(sha256.Sum256(data), 0, data)
+		req.NoError(err)
+		locs = append(locs, loc)
+	}
+	req.NoError(s.Close())
+
+	var out bytes.Buffer
+	report, err := run(context.Background(), dir, "", reportPath, false, packstore.ScrubOptions{}, &out)
+	req.NoError(err)
+	req.True(report.OK())
+	req.Contains(out.String(), "records checked: 10 ")
+
+	//bitrot in one chunk
+	path := filepath.Join(dir, fmt.Sprintf("pack-%05d.pack", locs[3].Pack()))
+	raw, err := os.ReadFile(path)
+	req.NoError(err)
+	raw[int(locs[3].Offset()) + 100] ^= 1
+	req.NoError(os.WriteFile(path, raw, 0644))
+
+	//the finished report is not resumed
+	out.Reset()
+	report, err = run(context.Background(), dir, "", reportPath, false, packstore.ScrubOptions{}, &out)
+	req.NoError(err)
+	req.False(report.OK())
+	req.Contains(out.String(), "bad chunks: 1\n")
+	req.NotContains(out.String(), "resuming")
+
+	var saved packstore.ScrubReport
+	data, err := os.ReadFile(reportPath)
+	req.NoError(err)
+	req.NoError(json.Unmarshal(data, &saved))
+	req.True(saved.Done)
+	req.Len(saved.BadChunks, 1)
+	req.Equal(locs[3], saved.BadChunks[0].Loc)
+
+	//an unfinished report is resumed unless -restart
+	saved.Done = false
+	saved.RecordsDone = true
+	data, err = json.Marshal(&saved)
+	req.NoError(err)
+	req.NoError(os.WriteFile(reportPath, data, 0644))
+	out.Reset()
+	_, err = run(context.Background(), dir, "", reportPath, false, packstore.ScrubOptions{}, &out)
+	req.NoError(err)
+	req.Contains(out.String(), "resuming")
+	out.Reset()
+	_, err = run(context.Background(), dir, "", reportPath, true, packstore.ScrubOptions{}, &out)
+	req.NoError(err)
+	req.NotContains(out.String(), "resuming")
+}
+
+//Scrubbing next to a live server leaves its pack alone; a saved index can be checked
+func TestRunLiveStore(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	reportPath := filepath.Join(t.TempDir(), "scrub.json")
+
+	s, err := packstore.Open(dir, packstore.Options{MaxPackSize: 1 << 20, SyncBytes: 1 << 20})
+	req.NoError(err)
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1000)
+		_, err := s.Put(sha256.Sum256(data), 0, data)
+		req.NoError(err)
+	}
+	req.NoError(s.Sync())
+
+	idx, _, err := packstore.Rebuild(dir, packstore.RebuildOptions{})
+	req.NoError(err)
+	indexPath := filepath.Join(t.TempDir(), "index")
+	req.NoError(packstore.WriteIndex(indexPath, idx))
+
+	var out bytes.Buffer
+	report, err := run(context.Background(), dir, indexPath, reportPath, true, packstore.ScrubOptions{}, &out)
+	req.NoError(err)
+	req.True(report.OK(), out.String())
+	req.Contains(out.String(), "index: 10 entries from " + indexPath)
+	req.Contains(out.String(), "unsealed pack 0: 10 records, 0 torn bytes\n")
+
+	//the server carries on appending to the same pack
+	data := bytes.Repeat([]byte{99}, 1000)
+	loc, err := s.Put(sha256.Sum256(data), 0, data)
+	req.NoError(err)
+	req.Equal(uint16(0), loc.Pack())
+	_, err = s.Get(loc, nil)
+	req.NoError(err)
+
+	_, err = run(context.Background(), dir, filepath.Join(dir, "missing"), reportPath, true,
+		packstore.ScrubOptions{}, &out)
+	req.Error(err)
+}
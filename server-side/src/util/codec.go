@@ -0,0 +1,385 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+/*
+Encoder and Decoder for the binary records of on-disk formats and wire frames.
+All fixed-width integers are little-endian like the helpers in util.go.
+
+The Decoder never panics on short or corrupt input.  Its first error is sticky:
+later reads return zero values and Err reports that first error, so a record
+can be decoded field by field with one check at the end:
+
+	dec := NewDecoder(data)
+	version := dec.Header("PACK", 1)
+	n := dec.Uvarint()
+	name := dec.Record()
+	dec.CheckCRC32C(0)
+	if err := dec.Finish(); err != nil {
+		...
+	}
+*/
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//CRC32C (Castagnoli) of data
+func CRC32C(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+/*
+The input ended before a field: Need bytes were required at Offset but only
+Have remained.
+*/
+type ShortBufferError struct {
+	Offset int
+	Need int
+	Have int
+}
+
+func (e *ShortBufferError) Error() string {
+	return fmt.Sprintf("util.Decoder: need %d bytes at offset %d, have %d", e.Need, e.Offset, e.Have)
+}
+
+//A CRC32C footer did not match the data it covers
+type ChecksumError struct {
+	Offset int
+	Stored uint32
+	Computed uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("util.Decoder: checksum mismatch at offset %d: stored 0x%08x, computed 0x%08x",
+		e.Offset, e.Stored, e.Computed)
+}
+
+//The input is long enough but not valid (bad magic, unknown version, varint overflow...)
+type FormatError struct {
+	Offset int
+	Msg string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("util.Decoder: %s at offset %d", e.Msg, e.Offset)
+}
+
+/*
+Appends fields to a byte slice.  Encoding cannot fail.
+*/
+type Encoder struct {
+	buf []byte
+}
+
+//Append to buf (which may be nil)
+func NewEncoder(buf []byte) *Encoder {
+	return &Encoder{buf: buf}
+}
+
+//The encoded bytes so far
+func (enc *Encoder) Bytes() []byte {
+	return enc.buf
+}
+
+func (enc *Encoder) Len() int {
+	return len(enc.buf)
+}
+
+func (enc *Encoder) PutUint8(v uint8) {
+	enc.buf = append(enc.buf, v)
+}
+
+func (enc *Encoder) PutUint16(v uint16) {
+	enc.buf = binary.LittleEndian.AppendUint16(enc.buf, v)
+}
+
+//Low 24 bits of v
+func (enc *Encoder) PutUint24(v uint32) {
+	enc.buf = append(enc.buf, byte(v), byte(v >> 8), byte(v >> 16))
+}
+
+func (enc *Encoder) PutUint32(v uint32) {
+	enc.buf = binary.LittleEndian.AppendUint32(enc.buf, v)
+}
+
+func (enc *Encoder) PutUint64(v uint64) {
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, v)
+}
+
+func (enc *Encoder) PutUvarint(v uint64) {
+	enc.buf = binary.AppendUvarint(enc.buf, v)
+}
+
+func (enc *Encoder) PutVarint(v int64) {
+	enc.buf = binary.AppendVarint(enc.buf, v)
+}
+
+//Raw bytes with no length; the reader must know how many
+func (enc *Encoder) PutBytes(b []byte) {
+	enc.buf = append(enc.buf, b...)
+}
+
+//A length-prefixed (uvarint) record
+func (enc *Encoder) PutRecord(b []byte) {
+	enc.PutUvarint(uint64(len(b)))
+	enc.PutBytes(b)
+}
+
+func (enc *Encoder) PutString(s string) {
+	enc.PutUvarint(uint64(len(s)))
+	enc.buf = append(enc.buf, s...)
+}
+
+//A versioned header: magic then a 16bit version
+func (enc *Encoder) PutHeader(magic string, version uint16) {
+	enc.buf = append(enc.buf, magic...)
+	enc.PutUint16(version)
+}
+
+/*
+Append the CRC32C of everything encoded from offset from onwards, e.g. 0 for
+the whole buffer or the Len() noted at the start of a record.
+*/
+func (enc *Encoder) PutCRC32C(from int) {
+	enc.PutUint32(CRC32C(enc.buf[from:]))
+}
+
+/*
+Reads fields from a byte slice with bounds checks.  See the package comment
+above for the sticky error convention.
+*/
+type Decoder struct {
+	buf []byte
+	off int
+	err error
+}
+
+func NewDecoder(buf []byte) *Decoder {
+	return &Decoder{buf: buf}
+}
+
+//The first error, or nil
+func (dec *Decoder) Err() error {
+	return dec.err
+}
+
+//Bytes consumed so far
+func (dec *Decoder) Offset() int {
+	return dec.off
+}
+
+func (dec *Decoder) Remaining() int {
+	return len(dec.buf) - dec.off
+}
+
+/*
+The first error, or a FormatError if there are unread bytes.  Call after the
+last field of a buffer which should hold exactly one record.
+*/
+func (dec *Decoder) Finish() error {
+	if dec.err == nil && dec.Remaining() != 0 {
+		dec.fail(&FormatError{Offset: dec.off, Msg: fmt.Sprintf("%d trailing bytes", dec.Remaining())})
+	}
+	return dec.err
+}
+
+func (dec *Decoder) fail(err error) {
+	if dec.err == nil {
+		dec.err = err
+	}
+}
+
+//Consume n bytes, or nil after an error
+func (dec *Decoder) take(n int) []byte {
+	if dec.err != nil {
+		return nil
+	}
+	if n < 0 || n > dec.Remaining() {
+		dec.fail(&ShortBufferError{Offset: dec.off, Need: n, Have: dec.Remaining()})
+		return nil
+	}
+	b := dec.buf[dec.off:dec.off+n]
+	dec.off += n
+	return b
+}
+
+func (dec *Decoder) Uint8() uint8 {
+	if b := dec.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (dec *Decoder) Uint16() uint16 {
+	if b := dec.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (dec *Decoder) Uint24() uint32 {
+	if b := dec.take(3); b != nil {
+		return Uint24FromBytes(b)
+	}
+	return 0
+}
+
+func (dec *Decoder) Uint32() uint32 {
+	if b := dec.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (dec *Decoder) Uint64() uint64 {
+	if b := dec.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (dec *Decoder) Uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(dec.buf[dec.off:])
+	return dec.varintResult(v, n)
+}
+
+func (dec *Decoder) Varint() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(dec.buf[dec.off:])
+	return int64(dec.varintResult(uint64(v), n))
+}
+
+func (dec *Decoder) varintResult(v uint64, n int) uint64 {
+	switch {
+	case n == 0:
+		dec.fail(&ShortBufferError{Offset: dec.off, Need: dec.Remaining() + 1, Have: dec.Remaining()})
+		return 0
+	case n < 0:
+		dec.fail(&FormatError{Offset: dec.off, Msg: "varint overflows 64 bits"})
+		return 0
+	}
+	dec.off += n
+	return v
+}
+
+/*
+The next n raw bytes.  The result aliases the Decoder's buffer; copy it if the
+buffer will be reused.
+*/
+func (dec *Decoder) Bytes(n int) []byte {
+	return dec.take(n)
+}
+
+//A record written by PutRecord.  Aliases the buffer like Bytes.
+func (dec *Decoder) Record() []byte {
+	start := dec.off
+	n := dec.Uvarint()
+	if dec.err != nil {
+		return nil
+	}
+	if n > uint64(dec.Remaining()) {
+		dec.fail(&ShortBufferError{Offset: start, Need: int(min(n, uint64(maxInt))), Have: dec.Remaining()})
+		return nil
+	}
+	return dec.take(int(n))
+}
+
+func (dec *Decoder) String() string {
+	return string(dec.Record())
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+/*
+Check a header written by PutHeader and return its version.  A FormatError
+results if the magic differs or the version is 0 or above maxVersion.
+*/
+func (dec *Decoder) Header(magic string, maxVersion uint16) uint16 {
+	start := dec.off
+	m := dec.take(len(magic))
+	version := dec.Uint16()
+	if dec.err != nil {
+		return 0
+	}
+	if string(m) != magic {
+		dec.fail(&FormatError{Offset: start, Msg: fmt.Sprintf("bad magic %q, want %q", m, magic)})
+		return 0
+	}
+	if version == 0 || version > maxVersion {
+		dec.fail(&FormatError{Offset: start, Msg: fmt.Sprintf("unsupported version %d", version)})
+		return 0
+	}
+	return version
+}
+
+/*
+Read a CRC32C footer written by PutCRC32C(from) and check it against the
+bytes from offset from up to the footer.  Returns false (with a ChecksumError)
+on a mismatch.
+*/
+func (dec *Decoder) CheckCRC32C(from int) bool {
+	end := dec.off
+	stored := dec.Uint32()
+	if dec.err != nil {
+		return false
+	}
+	if from < 0 || from > end {
+		dec.fail(&FormatError{Offset: end, Msg: "checksum range starts after footer"})
+		return false
+	}
+	computed := CRC32C(dec.buf[from:end])
+	if stored != computed {
+		dec.fail(&ChecksumError{Offset: end, Stored: stored, Computed: computed})
+		return false
+	}
+	return true
+}
+
+/*
+Counts the bytes written to W, so that an io.WriterTo can report them.
+*/
+type CountingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (cw *CountingWriter) Write(p []byte) (int, error) {
+	n, err := cw.W.Write(p)
+	cw.N += int64(n)
+	return n, err
+}
+
+/*
+Counts the bytes read from R, so that an io.ReaderFrom can report them.
+
+R is read directly (no buffering) so nothing past the end of a saved structure
+is consumed; the caller should pass a bufio.Reader when reading from a file.
+*/
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (cr *CountingReader) Read(p []byte) (int, error) {
+	n, err := cr.R.Read(p)
+	cr.N += int64(n)
+	return n, err
+}
+
+//Fill buf, returning io.ErrUnexpectedEOF if R ends first (even before the first byte)
+func (cr *CountingReader) ReadFull(buf []byte) error {
+	_, err := io.ReadFull(cr, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
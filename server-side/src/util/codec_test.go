@@ -0,0 +1,187 @@
+package util
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"bytes"
+	"errors"
+	"io"
+)
+
+func encodeSample(name string, payload []byte) []byte {
+	enc := NewEncoder(nil)
+	enc.PutHeader("TEST", 2)
+	enc.PutUint8(0xAB)
+	enc.PutUint16(0xBEEF)
+	enc.PutUint24(0x123456)
+	enc.PutUint32(0xDEADBEEF)
+	enc.PutUint64(1 << 60)
+	enc.PutUvarint(300)
+	enc.PutVarint(-5)
+	enc.PutString(name)
+	enc.PutRecord(payload)
+	enc.PutBytes([]byte{1, 2})
+	enc.PutCRC32C(0)
+	return enc.Bytes()
+}
+
+type sample struct {
+	version uint16
+	u8 uint8
+	u16 uint16
+	u24, u32 uint32
+	u64, uv uint64
+	v int64
+	name string
+	payload, raw []byte
+}
+
+func decodeSample(data []byte) (s sample, err error) {
+	dec := NewDecoder(data)
+	s.version = dec.Header("TEST", 2)
+	s.u8 = dec.Uint8()
+	s.u16 = dec.Uint16()
+	s.u24 = dec.Uint24()
+	s.u32 = dec.Uint32()
+	s.u64 = dec.Uint64()
+	s.uv = dec.Uvarint()
+	s.v = dec.Varint()
+	s.name = dec.String()
+	s.payload = dec.Record()
+	s.raw = dec.Bytes(2)
+	dec.CheckCRC32C(0)
+	return s, dec.Finish()
+}
+
+func Test_codecRoundTrip(t *testing.T) {
+	req := require.New(t)
+
+	data := encodeSample("chunk", []byte("hello"))
+	s, err := decodeSample(data)
+	req.NoError(err)
+	req.Equal(sample{
+		version: 2, u8: 0xAB, u16: 0xBEEF, u24: 0x123456, u32: 0xDEADBEEF,
+		u64: 1 << 60, uv: 300, v: -5, name: "chunk",
+		payload: []byte("hello"), raw: []byte{1, 2},
+	}, s)
+
+	//appending to an existing buffer
+	enc := NewEncoder([]byte{9})
+	enc.PutUint24(0x010203)
+	req.Equal([]byte{9, 3, 2, 1}, enc.Bytes())
+	req.Equal(4, enc.Len())
+}
+
+func Test_codecErrors(t *testing.T) {
+	req := require.New(t)
+
+	data := encodeSample("chunk", []byte("hello"))
+
+	//every truncation is a ShortBufferError (or a bad header while it is cut off)
+	for n := 0; n < len(data); n++ {
+		_, err := decodeSample(data[:n])
+		var short *ShortBufferError
+		req.True(errors.As(err, &short), "length %d: %v", n, err)
+	}
+
+	//every single bit flip is caught
+	for i := range data {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 0x10
+		_, err := decodeSample(bad)
+		req.Error(err, "byte %d", i)
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[len(bad) - 5] ^= 1
+	_, err := decodeSample(bad)
+	var sum *ChecksumError
+	req.True(errors.As(err, &sum))
+
+	var format *FormatError
+	_, err = decodeSample(append(data, 0))
+	req.True(errors.As(err, &format))
+
+	enc := NewEncoder(nil)
+	enc.PutHeader("TEST", 3)
+	_, err = decodeSample(enc.Bytes())
+	req.True(errors.As(err, &format))
+	req.Contains(err.Error(), "version 3")
+
+	//a huge record length is short, not an allocation
+	enc = NewEncoder(nil)
+	enc.PutUvarint(1 << 62)
+	dec := NewDecoder(enc.Bytes())
+	req.Nil(dec.Record())
+	var short *ShortBufferError
+	req.True(errors.As(dec.Err(), &short))
+
+	//varint overflow
+	dec = NewDecoder([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	req.Equal(uint64(0), dec.Uvarint())
+	req.True(errors.As(dec.Err(), &format))
+
+	//errors are sticky: later reads return zero and the first error is kept
+	dec = NewDecoder([]byte{1})
+	dec.Uint32()
+	first := dec.Err()
+	req.Equal(uint8(0), dec.Uint8())
+	req.Same(first, dec.Err())
+}
+
+func Test_counting(t *testing.T) {
+	req := require.New(t)
+
+	var buf bytes.Buffer
+	cw := &CountingWriter{W: &buf}
+	cw.Write([]byte("hello"))
+	cw.Write([]byte(" world"))
+	req.Equal(int64(11), cw.N)
+
+	cr := &CountingReader{R: &buf}
+	b := make([]byte, 5)
+	req.NoError(cr.ReadFull(b))
+	req.Equal("hello", string(b))
+	req.Equal(int64(5), cr.N)
+
+	//short and empty input are both unexpected
+	req.Equal(io.ErrUnexpectedEOF, cr.ReadFull(make([]byte, 10)))
+	req.Equal(int64(11), cr.N)
+	req.Equal(io.ErrUnexpectedEOF, cr.ReadFull(b))
+}
+
+func FuzzDecoder(f *testing.F) {
+	f.Add(encodeSample("chunk", []byte("hello")))
+	f.Add([]byte{})
+	f.Add([]byte("TEST\x02\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		//must never panic; valid results must re-encode to the same bytes
+		s, err := decodeSample(data)
+		if err == nil {
+			require.Equal(t, data, encodeSample(s.name, s.payload))
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add(uint64(0), int64(0), "", []byte(nil))
+	f.Add(uint64(1 << 63), int64(-1 << 63), "name", []byte{0, 1, 2})
+	f.Fuzz(func(t *testing.T, u uint64, v int64, s string, b []byte) {
+		enc := NewEncoder(nil)
+		enc.PutUvarint(u)
+		enc.PutVarint(v)
+		enc.PutString(s)
+		enc.PutRecord(b)
+		enc.PutUint64(u)
+		enc.PutCRC32C(0)
+
+		dec := NewDecoder(enc.Bytes())
+		require.Equal(t, u, dec.Uvarint())
+		require.Equal(t, v, dec.Varint())
+		require.Equal(t, s, dec.String())
+		require.True(t, bytes.Equal(b, dec.Record()))
+		require.Equal(t, u, dec.Uint64())
+		require.True(t, dec.CheckCRC32C(0))
+		require.NoError(t, dec.Finish())
+	})
+}
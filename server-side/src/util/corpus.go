@@ -0,0 +1,251 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+Deterministic synthetic data for chunking and dedup tests.  The same options
+(including Seed) always produce the same bytes.
+*/
+
+/*
+Place Data at Offset of a generated stream, overwriting what was there.
+Placing the same Data at several offsets makes blocks which dedup must find,
+e.g. at offsets aligned to a chunk size or deliberately misaligned.
+*/
+type Repeat struct {
+	Offset int
+	Data []byte
+}
+
+type StreamOptions struct {
+	Seed uint64
+	//total bytes to produce
+	Size int
+	/*
+	Fraction (0 to 1) of the bytes which are copies of earlier content of the
+	stream.  Copies are taken from random offsets so are rarely aligned.
+	*/
+	DupRatio float64
+	//mean length of each fresh or copied piece.  Default 8KB.
+	PieceSize int
+	//applied last, in order
+	Repeats []Repeat
+}
+
+const defaultPieceSize = 8 * 1024
+
+/*
+Generate a byte stream of opts.Size bytes.  Returns the stream and the number
+of its bytes which were copied from earlier in it (before Repeats are applied).
+That is within one piece of DupRatio * Size.
+*/
+func GenStream(opts StreamOptions) (data []byte, dupBytes int) {
+	rs := NewRandStream64(opts.Seed)
+	pieceSize := opts.PieceSize
+	if pieceSize <= 0 {
+		pieceSize = defaultPieceSize
+	}
+
+	data = make([]byte, opts.Size)
+	for pos := 0; pos < len(data); {
+		//between half and one and a half times the mean
+		n := pieceSize / 2 + rs.Intn(pieceSize + 1)
+		if n > len(data) - pos {
+			n = len(data) - pos
+		}
+		//copy whenever we are behind the target ratio and there is something to copy
+		if pos >= n && float64(dupBytes + n) <= opts.DupRatio * float64(pos + n) {
+			from := rs.Intn(pos - n + 1)
+			copy(data[pos:pos+n], data[from:from+n])
+			dupBytes += n
+		} else {
+			rs.FillRand(data[pos:pos+n])
+		}
+		pos += n
+	}
+
+	for _, r := range opts.Repeats {
+		if r.Offset < 0 || r.Offset + len(r.Data) > len(data) {
+			panic(fmt.Sprintf("util.GenStream: repeat at %d of %d bytes exceeds Size", r.Offset, len(r.Data)))
+		}
+		copy(data[r.Offset:], r.Data)
+	}
+	return data, dupBytes
+}
+
+type EditKind int
+
+const (
+	//insert new bytes, shifting everything after them
+	EditInsert EditKind = iota
+	//remove bytes, shifting everything after them
+	EditDelete
+	//replace bytes in place, shifting nothing
+	EditOverwrite
+)
+
+type EditOptions struct {
+	Seed uint64
+	Kind EditKind
+	//number of edits
+	Count int
+	//each edit is 1 to MaxLen bytes.  Default 64.
+	MaxLen int
+}
+
+/*
+Return a copy of data with opts.Count random edits, like a user editing a file.
+Inserts and deletes shift the rest of the data, which fixed-size chunking cannot
+handle but content-defined chunking should.  data is unchanged.
+*/
+func Edit(data []byte, opts EditOptions) []byte {
+	rs := NewRandStream64(opts.Seed)
+	maxLen := opts.MaxLen
+	if maxLen <= 0 {
+		maxLen = 64
+	}
+
+	out := append([]byte(nil), data...)
+	for i := 0; i < opts.Count; i++ {
+		n := 1 + rs.Intn(maxLen)
+		switch opts.Kind {
+		case EditInsert:
+			at := rs.Intn(len(out) + 1)
+			ins := make([]byte, n)
+			rs.FillRand(ins)
+			out = append(out[:at], append(ins, out[at:]...)...)
+		case EditDelete:
+			if len(out) == 0 {
+				return out
+			}
+			n = min(n, len(out))
+			at := rs.Intn(len(out) - n + 1)
+			out = append(out[:at], out[at+n:]...)
+		case EditOverwrite:
+			if len(out) == 0 {
+				return out
+			}
+			n = min(n, len(out))
+			at := rs.Intn(len(out) - n + 1)
+			rs.FillRand(out[at:at+n])
+		default:
+			panic("util.Edit: unknown EditKind")
+		}
+	}
+	return out
+}
+
+type TreeOptions struct {
+	Seed uint64
+	NumFiles int
+	//file sizes are uniform in [0, 2 * MeanFileSize]
+	MeanFileSize int
+	/*
+	Fraction (0 to 1) of all bytes which duplicate other content in the tree,
+	including the edited copies below.
+	*/
+	DupRatio float64
+	/*
+	Fraction (0 to 1) of the files which are edited copies of an earlier file
+	(see Edit), like successive versions of a document.  Each copy counts
+	against DupRatio, so fewer copies are made if they alone would exceed it.
+	*/
+	EditedCopies float64
+	//files are placed up to this many directories deep
+	MaxDepth int
+}
+
+/*
+Write a tree of files under dir (which must exist) and return their paths
+relative to dir, sorted.  The content comes from one GenStream split into files,
+so duplicates cross file boundaries, plus the edited copies.
+*/
+func GenTree(dir string, opts TreeOptions) ([]string, error) {
+	rs := NewRandStream64(opts.Seed)
+
+	//the file each file is an edited copy of, or -1
+	sizes := make([]int, opts.NumFiles)
+	copyOf := make([]int, opts.NumFiles)
+	for i := range sizes {
+		sizes[i] = rs.Intn(2 * opts.MeanFileSize + 1)
+		copyOf[i] = -1
+		if i > 0 && rs.Float64() < opts.EditedCopies {
+			copyOf[i] = rs.Intn(i)
+		}
+	}
+
+	/*
+	A copy is (nearly) all duplicate bytes, the same size as its original.  Drop
+	copies from the end until they fit the budget, then the stream supplies the
+	rest of the duplicates.
+	*/
+	var total, copied int
+	effective := make([]int, opts.NumFiles)
+	for {
+		total, copied = 0, 0
+		last := -1
+		for i := range sizes {
+			effective[i] = sizes[i]
+			if copyOf[i] >= 0 {
+				effective[i] = effective[copyOf[i]]
+				copied += effective[i]
+				last = i
+			}
+			total += effective[i]
+		}
+		if last < 0 || float64(copied) <= opts.DupRatio * float64(total) {
+			break
+		}
+		copyOf[last] = -1
+	}
+	streamDup := 0.0
+	if total > copied {
+		streamDup = min(max((opts.DupRatio * float64(total) - float64(copied)) / float64(total - copied), 0), 1)
+	}
+	stream, _ := GenStream(StreamOptions{
+		Seed: rs.Rand64bit(),
+		Size: total - copied,
+		DupRatio: streamDup,
+	})
+
+	var paths []string
+	contents := make([][]byte, opts.NumFiles)
+	for i, size := range sizes {
+		if copyOf[i] >= 0 {
+			contents[i] = Edit(contents[copyOf[i]], EditOptions{
+				Seed: rs.Rand64bit(),
+				Kind: EditKind(rs.Intn(3)),
+				Count: 1 + rs.Intn(4),
+			})
+		} else {
+			contents[i] = stream[:size]
+			stream = stream[size:]
+		}
+
+		rel := fmt.Sprintf("f%04d.bin", i)
+		depth := 0
+		if opts.MaxDepth > 0 {
+			depth = rs.Intn(opts.MaxDepth + 1)
+		}
+		for d := depth; d > 0; d-- {
+			rel = filepath.Join(fmt.Sprintf("d%d", rs.Intn(4)), rel)
+		}
+
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, contents[i], 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, rel)
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
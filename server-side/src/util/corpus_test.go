@@ -0,0 +1,134 @@
+package util
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+func Test_GenStream(t *testing.T) {
+	req := require.New(t)
+
+	opts := StreamOptions{Seed: 3, Size: 1 << 20, DupRatio: 0.4, PieceSize: 4096}
+	a, dup := GenStream(opts)
+	b, _ := GenStream(opts)
+	req.Len(a, 1 << 20)
+	req.Equal(a, b)
+	req.InDelta(0.4 * float64(len(a)), float64(dup), 6 * 1024)
+
+	opts.Seed = 4
+	c, _ := GenStream(opts)
+	req.NotEqual(a, c)
+
+	//no duplication at all
+	_, dup = GenStream(StreamOptions{Seed: 3, Size: 100000})
+	req.Equal(0, dup)
+
+	//repeated blocks land where asked
+	block := MakeSeq(512, 9)
+	d, _ := GenStream(StreamOptions{Seed: 5, Size: 1 << 16, Repeats: []Repeat{
+		{Offset: 0, Data: block},
+		{Offset: 4096, Data: block},
+		{Offset: 10001, Data: block},
+	}})
+	req.Equal(block, d[0:512])
+	req.Equal(block, d[4096:4096+512])
+	req.Equal(block, d[10001:10001+512])
+
+	req.Panics(func() {
+		GenStream(StreamOptions{Size: 100, Repeats: []Repeat{{Offset: 90, Data: block}}})
+	})
+}
+
+func Test_Edit(t *testing.T) {
+	req := require.New(t)
+
+	orig, _ := GenStream(StreamOptions{Seed: 1, Size: 10000})
+	saved := append([]byte(nil), orig...)
+
+	ins := Edit(orig, EditOptions{Seed: 2, Kind: EditInsert, Count: 3, MaxLen: 10})
+	req.True(len(ins) > len(orig) && len(ins) <= len(orig) + 30)
+	del := Edit(orig, EditOptions{Seed: 2, Kind: EditDelete, Count: 3, MaxLen: 10})
+	req.True(len(del) < len(orig) && len(del) >= len(orig) - 30)
+	over := Edit(orig, EditOptions{Seed: 2, Kind: EditOverwrite, Count: 3, MaxLen: 10})
+	req.Len(over, len(orig))
+	req.NotEqual(orig, over)
+
+	//deterministic and the input is untouched
+	req.Equal(ins, Edit(orig, EditOptions{Seed: 2, Kind: EditInsert, Count: 3, MaxLen: 10}))
+	req.Equal(saved, orig)
+
+	//an insert shifts the tail: it still appears, unaligned
+	one := Edit(orig, EditOptions{Seed: 6, Kind: EditInsert, Count: 1, MaxLen: 5})
+	req.True(bytes.HasSuffix(one, orig[len(orig)-100:]))
+}
+
+func Test_GenTree(t *testing.T) {
+	req := require.New(t)
+
+	opts := TreeOptions{Seed: 8, NumFiles: 30, MeanFileSize: 2000, DupRatio: 0.3,
+		EditedCopies: 0.3, MaxDepth: 3}
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	paths, err := GenTree(dir1, opts)
+	req.NoError(err)
+	req.Len(paths, 30)
+	paths2, err := GenTree(dir2, opts)
+	req.NoError(err)
+	req.Equal(paths, paths2)
+
+	nested := false
+	for _, p := range paths {
+		a, err := os.ReadFile(filepath.Join(dir1, p))
+		req.NoError(err)
+		b, err := os.ReadFile(filepath.Join(dir2, p))
+		req.NoError(err)
+		req.Equal(a, b, p)
+		nested = nested || filepath.Dir(p) != "."
+	}
+	req.True(nested)
+}
+
+//Fraction of the bytes of files (in order) covered by a 32 byte window which appeared earlier
+func measureDupRatio(files [][]byte) float64 {
+	const window = 32
+	seen := make(map[[window]byte]bool)
+	var all []byte
+	for _, f := range files {
+		all = append(all, f...)
+	}
+	dupTo := 0
+	dup := 0
+	for i := 0; i + window <= len(all); i++ {
+		w := [window]byte(all[i:i+window])
+		if seen[w] {
+			//count each byte once
+			dup += i + window - max(dupTo, i)
+			dupTo = i + window
+		}
+		seen[w] = true
+	}
+	return float64(dup) / float64(len(all))
+}
+
+func Test_GenTreeDupRatio(t *testing.T) {
+	req := require.New(t)
+
+	for _, editedCopies := range []float64{0, 0.3, 0.9} {
+		opts := TreeOptions{Seed: 3, NumFiles: 40, MeanFileSize: 20000, DupRatio: 0.3,
+			EditedCopies: editedCopies}
+		dir := t.TempDir()
+		paths, err := GenTree(dir, opts)
+		req.NoError(err)
+
+		//f0000.bin... are in generation order
+		var files [][]byte
+		for _, p := range paths {
+			data, err := os.ReadFile(filepath.Join(dir, p))
+			req.NoError(err)
+			files = append(files, data)
+		}
+		req.InDelta(0.3, measureDupRatio(files), 0.05, "EditedCopies %g", editedCopies)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"crypto/cipher"
 	"crypto/aes"
+	"crypto/sha256"
 )
 
 func FillConst(dest []byte, byteVal byte) {
@@ -25,16 +26,47 @@ func MakeSeq(count int, startValue byte) []byte {
 }
 
 
+/*
+A deterministic stream of pseudo random bytes (AES-CTR).  The same seed
+always produces the same stream.  Not safe for concurrent use.
+*/
 type RandStream struct {
 	stream cipher.Stream
 }
 
+/*
+One of 256 streams.  Use NewRandStream64 or NewRandStreamBytes for more.
+*/
 func NewRandStream(seed byte) RandStream {
 	iv := make([]byte, aes.BlockSize)
 	key := make([]byte, aes.BlockSize)
 	FillConst(iv, seed)
 	FillConst(key, 0xA7)
 
+	return newRandStream(key, iv)
+}
+
+func NewRandStream64(seed uint64) RandStream {
+	var b [8]byte
+	Uint64ToBytes(seed, b[:])
+	return NewRandStreamBytes(b[:])
+}
+
+/*
+A stream seeded by any number of bytes.  The key is a hash of the seed
+so every distinct seed gives an unrelated stream.
+*/
+func NewRandStreamBytes(seed []byte) RandStream {
+	h := sha256.New()
+	h.Write([]byte("RandStream"))
+	h.Write(seed)
+	key := h.Sum(nil)[:aes.BlockSize]
+	iv := make([]byte, aes.BlockSize)
+
+	return newRandStream(key, iv)
+}
+
+func newRandStream(key, iv []byte) RandStream {
 	blockCipher, err := aes.NewCipher(key)
 	if err != nil {
 		log.Fatal(err)
@@ -49,6 +81,15 @@ func (rs RandStream) FillRand(dest []byte) {
 	rs.stream.XORKeyStream(dest, dest)
 }
 
+/*
+Implements io.Reader.  Always fills p and never returns an error.
+*/
+func (rs RandStream) Read(p []byte) (n int, err error) {
+	clear(p)
+	rs.stream.XORKeyStream(p, p)
+	return len(p), nil
+}
+
 func (rs RandStream) Rand24bit() uint32 {
 	var temp [3]byte
 	tempSlice := temp[:]
@@ -71,6 +112,35 @@ func (rs RandStream) Rand32bit() uint32 {
 	return Uint32FromBytes(tempSlice)
 }
 
+func (rs RandStream) Rand64bit() uint64 {
+	var temp [8]byte
+	tempSlice := temp[:]
+	rs.stream.XORKeyStream(tempSlice, tempSlice)
+	return Uint64FromBytes(tempSlice)
+}
+
+/*
+A uniform random int in [0, n).  n must be > 0.
+*/
+func (rs RandStream) Intn(n int) int {
+	if n <= 0 {
+		panic("util.RandStream.Intn: n must be > 0")
+	}
+	//reject the top partial range so every value is equally likely
+	limit := ^uint64(0) - ^uint64(0) % uint64(n)
+	for {
+		r := rs.Rand64bit()
+		if r < limit {
+			return int(r % uint64(n))
+		}
+	}
+}
+
+//A random float64 in [0, 1)
+func (rs RandStream) Float64() float64 {
+	return float64(rs.Rand64bit() >> 11) / (1 << 53)
+}
+
 //Read a 24bit little-endian value
 func Uint24FromBytes(src []byte) uint32 {
 	return uint32(src[0]) |
@@ -78,11 +148,11 @@ func Uint24FromBytes(src []byte) uint32 {
 		(uint32(src[2]) << 16)
 }
 
+//Write the low 24 bits of val, little-endian.  Only dest[0:3] is touched.
 func Uint24ToBytes(val uint32, dest []byte) {
 	dest[0] = byte(val & 0xFF)
 	dest[1] = byte((val >> 8) & 0xFF)
 	dest[2] = byte((val >> 16) & 0xFF)
-	dest[3] = byte((val >> 24) & 0xFF)
 }
 
 //Read a 32bit little-endian value
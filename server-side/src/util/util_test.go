@@ -4,6 +4,7 @@ package util
 import (
 	"testing"
 	"github.com/stretchr/testify/require"
+	"io"
 )
 
 
@@ -19,6 +20,11 @@ func Test_utils(t * testing.T) {
 
 	Uint24ToBytes(0xd5c8a9, bb)
 	req.Equal(bb[0], byte(0xa9))
+	//the 4th byte is left alone
+	req.Equal(bb[3], byte(0xe9))
+	req.NotPanics(func() {
+		Uint24ToBytes(0xffffffff, make([]byte, 3))
+	})
 
 	val24 := Uint24FromBytes(bb)
 	req.Equal(uint32(0xd5c8a9), val24)
@@ -48,3 +54,48 @@ func Test_rand(t * testing.T) {
 	req.True(rs1.Rand24bit() != rs2.Rand24bit())
 }
 
+
+func Test_rand64(t * testing.T) {
+	req := require.New(t)
+
+	//same seed, same stream
+	a := make([]byte, 100)
+	b := make([]byte, 100)
+	NewRandStream64(1 << 40).Read(a)
+	NewRandStream64(1 << 40).Read(b)
+	req.Equal(a, b)
+
+	//seeds differing only in the high bytes differ
+	NewRandStream64(2 << 40).Read(b)
+	req.NotEqual(a, b)
+
+	NewRandStreamBytes([]byte("seed")).Read(a)
+	NewRandStreamBytes([]byte("seee")).Read(b)
+	req.NotEqual(a, b)
+
+	//Read ignores the previous content of p
+	rs1 := NewRandStream64(7)
+	rs2 := NewRandStream64(7)
+	FillConst(a, 0x55)
+	FillConst(b, 0xAA)
+	rs1.Read(a)
+	rs2.Read(b)
+	req.Equal(a, b)
+
+	//usable as an io.Reader
+	var r io.Reader = NewRandStream64(7)
+	dat, err := io.ReadAll(io.LimitReader(r, 5000))
+	req.NoError(err)
+	req.Len(dat, 5000)
+
+	rs := NewRandStream64(9)
+	var counts [10]int
+	for i := 0; i < 10000; i++ {
+		counts[rs.Intn(10)]++
+		f := rs.Float64()
+		req.True(f >= 0 && f < 1)
+	}
+	for _, c := range counts {
+		req.InDelta(1000, c, 150)
+	}
+}